@@ -8,6 +8,7 @@ require (
 	github.com/julinox/consolelogrus v0.0.0-20250105143547-99de0a9d2ca5
 	github.com/julinox/statemaquina v0.0.0-20250221193640-262868197863
 	github.com/sirupsen/logrus v1.9.3
+	golang.org/x/crypto v0.36.0
 	golang.org/x/exp v0.0.0-20250106191152-7588d65b2ba8
 )
 
@@ -1,9 +1,167 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	thps "tlesio/server"
+	"tlesio/tlssl/capture"
+	"tlesio/tlssl/dissect"
 )
 
+// Time given to in-progress handshakes on SIGTERM/SIGINT
+const _SHUTDOWN_TIMEOUT_ = 30 * time.Second
+
 func main() {
-	thps.RealServidor()
+
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(replay(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "tlsdump" {
+		os.Exit(tlsdump(os.Args[2:]))
+	}
+
+	server, err := thps.NewServer(":8443")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	drained := make(chan struct{})
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-stop
+		ctx, cancel := context.WithTimeout(context.Background(),
+			_SHUTDOWN_TIMEOUT_)
+		defer cancel()
+		server.Shutdown(ctx)
+		close(drained)
+	}()
+
+	err = server.ListenAndServe()
+	if !errors.Is(err, thps.ErrServerClosed) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	<-drained
+}
+
+// Captures (TLS_CAPTURE_DIR files) through handshakes set up from the
+// environment, the way the captured server's were. Non zero if any diverged
+func replay(paths []string) int {
+
+	var status int
+
+	if len(paths) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: tlesio replay <capture file>...")
+		return 2
+	}
+
+	replayer, err := thps.NewReplayer()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	defer replayer.Close()
+	for _, path := range paths {
+		var report *thps.ReplayReport
+
+		entries, err := capture.ReadFile(path)
+		if err == nil {
+			report, err = replayer.Replay(entries)
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", path, err)
+			status = 1
+			continue
+		}
+
+		fmt.Printf("%v: %v\n", path, report)
+		if report.Diverged >= 0 || report.Err != nil {
+			status = 1
+		}
+	}
+
+	return status
+}
+
+// Dissects hex, raw record files or captures ("-" is stdin). JSON output
+// is one record per line
+func tlsdump(args []string) int {
+
+	var status int
+
+	flags := flag.NewFlagSet("tlsdump", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "one JSON object per record")
+	asHex := flags.Bool("hex", false, "arguments are hex, not files")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: tlesio tlsdump [-json] [-hex] "+
+			"<file|->...")
+		flags.PrintDefaults()
+	}
+
+	if flags.Parse(args) != nil {
+		return 2
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, arg := range flags.Args() {
+		var data []byte
+		var err error
+		var records []*dissect.Record
+
+		switch {
+		case *asHex:
+			data, err = dissect.Hex(arg)
+			if err == nil {
+				records = dissect.Records(data)
+			}
+		case arg == "-":
+			data, err = io.ReadAll(os.Stdin)
+		default:
+			data, err = os.ReadFile(arg)
+		}
+
+		if err == nil && records == nil {
+			records, err = dissect.Dissect(data)
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", arg, err)
+			status = 1
+			continue
+		}
+
+		for _, record := range records {
+			if *asJSON {
+				enc.Encode(record)
+			} else {
+				fmt.Print(record)
+			}
+
+			if record.Error != "" {
+				status = 1
+			}
+		}
+	}
+
+	return status
 }
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"net"
+	"time"
+)
+
+// Deadlines the peer can't push forward. Every Read/Write gets 'timeout'
+// from now, never past 'deadline' (whole handshake). A client trickling
+// one byte at a time still runs out of handshake time. Zero values turn
+// the wrapper into a plain net.Conn
+type xTimedConn struct {
+	net.Conn
+	timeout  time.Duration
+	deadline time.Time
+}
+
+func newTimedConn(conn net.Conn, timeout time.Duration,
+	deadline time.Time) *xTimedConn {
+
+	return &xTimedConn{
+		Conn:     conn,
+		timeout:  timeout,
+		deadline: deadline,
+	}
+}
+
+func (x *xTimedConn) Read(b []byte) (int, error) {
+
+	if x.timeout > 0 || !x.deadline.IsZero() {
+		x.Conn.SetReadDeadline(x.next())
+	}
+
+	return x.Conn.Read(b)
+}
+
+func (x *xTimedConn) Write(b []byte) (int, error) {
+
+	if x.timeout > 0 || !x.deadline.IsZero() {
+		x.Conn.SetWriteDeadline(x.next())
+	}
+
+	return x.Conn.Write(b)
+}
+
+// Handshake is over, whoever reads next sets its own deadlines
+func (x *xTimedConn) release() {
+
+	x.timeout = 0
+	x.deadline = time.Time{}
+	x.Conn.SetDeadline(time.Time{})
+}
+
+func (x *xTimedConn) next() time.Time {
+
+	var next time.Time
+
+	if x.timeout > 0 {
+		next = time.Now().Add(x.timeout)
+	}
+
+	if !x.deadline.IsZero() && (next.IsZero() || x.deadline.Before(next)) {
+		next = x.deadline
+	}
+
+	return next
+}
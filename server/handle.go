@@ -1,10 +1,16 @@
 package server
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"sync/atomic"
+	"time"
 	"tlesio/systema"
 	"tlesio/tlssl"
+	ex "tlesio/tlssl/extensions"
 	"tlesio/tlssl/handshake"
 
 	evilmac "github.com/julinox/statemaquina"
@@ -17,11 +23,22 @@ const _MAX_STATES_COUNT_ = 1 << 4
 
 type xHandle struct {
 	lg        *logrus.Logger
+	conn      net.Conn
+	tCtx      *tlssl.TLSContext
+	metrics   *xMetrics     // nil counts nothing
+	write     time.Duration // Per record once established, zero for none
 	handhsake *handshake.Handshake
 }
 
+// Time spent in each state of the handshake flow
+type xTimedState struct {
+	evilmac.State
+	metrics *xMetrics
+}
+
 // This file is the lowest level for logging stuff
-func Handle(ctx *tlssl.TLSContext, conn net.Conn) (*xHandle, error) {
+func Handle(ctx *tlssl.TLSContext, conn net.Conn,
+	connID uint64) (*xHandle, error) {
 
 	var err error
 	var newHandle xHandle
@@ -36,6 +53,8 @@ func Handle(ctx *tlssl.TLSContext, conn net.Conn) (*xHandle, error) {
 		return nil, systema.ErrNilParams
 	}
 
+	handshakeCtx.SetConnID(connID)
+	handshakeCtx.SetTracer(ctx.Tracer)
 	handshakeCtx.SetTransitionStage(handshake.STAGE_SERVERHELLODONE)
 	newHandle.handhsake, err = handshake.NewHandshake(&handshake.AllContexts{
 		Hctx: handshakeCtx,
@@ -47,10 +66,12 @@ func Handle(ctx *tlssl.TLSContext, conn net.Conn) (*xHandle, error) {
 	}
 
 	newHandle.lg = ctx.Lg
+	newHandle.conn = conn
+	newHandle.tCtx = ctx
 	return &newHandle, nil
 }
 
-func (x *xHandle) LetsTalk(cliHello []byte) {
+func (x *xHandle) LetsTalk(cliHello []byte) error {
 
 	var err error
 
@@ -64,19 +85,251 @@ func (x *xHandle) LetsTalk(cliHello []byte) {
 
 	if err != nil {
 		x.lg.Error("error creating state machine: ", err)
-		return
+		return err
 	}
 
 	if err = x.registryStates(b166er); err != nil {
 		x.lg.Error("error registering state: ", err)
-		return
+		return err
 	}
 
+	start := time.Now()
+	ctx := x.handhsake.Contexto
+	tlssl.TraceRecords(x.tCtx.Tracer, ctx.GetConnID(),
+		tlssl.TraceRecordReceived, cliHello)
 	x.handhsake.Contexto.SetBuffer(handshake.CLIENTHELLO, cliHello)
 	b166er.Post(handshake.CLIENTHELLO)
-	if err = b166er.Start(); err != nil {
+	err = b166er.Start()
+	if hello := ctx.GetMsgHello(); hello != nil {
+		x.metrics.clientHello(hello.JA4())
+	}
+
+	if err != nil {
+		x.metrics.handshakeFailed(err)
+		x.tCtx.Trace(ctx.GetConnID(), &tlssl.TraceEvent{
+			Kind: tlssl.TraceHandshakeDone,
+			Err:  err,
+		})
+
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			x.lg.Warn("Handshake timed out: ", x.conn.RemoteAddr())
+			x.metrics.inc(x.metrics.timeouts, "handshake")
+			return err
+		}
+
 		x.lg.Error("err Handshake flow: ", err)
+		x.sendAlert(err)
+		return err
+	}
+
+	x.tCtx.Trace(ctx.GetConnID(), &tlssl.TraceEvent{
+		Kind:    tlssl.TraceHandshakeDone,
+		Version: ctx.GetVersion(),
+		Suite:   ctx.GetCipherSuite(),
+	})
+
+	x.metrics.handshakeDone(ctx.GetVersion(), ctx.GetCipherSuite(),
+		x.tCtx.Modz.TLSSuite.GetSuite(ctx.GetCipherSuite()), x.sniHost(),
+		time.Since(start))
+	return nil
+}
+
+// First name in the client's server_name extension
+func (x *xHandle) sniHost() string {
+
+	hello := x.handhsake.Contexto.GetMsgHello()
+	if hello == nil {
+		return ""
 	}
+
+	sni := ex.KeySNI.From(hello.Extensions)
+	if sni == nil || len(sni.Names) == 0 {
+		return ""
+	}
+
+	return sni.Names[0].Name
+}
+
+// Established connection. Application data is echoed back to the client
+// until it closes (close_notify), sends nothing for 'idle' or 'closing' is
+// set. The idle deadline is set once per record so it can't be stretched
+// by trickling, each record sent gets 'write' to go out so a client that
+// stops reading can't hold the connection. Whoever sets 'closing' must
+// then move the read deadline to now, 'closing' is checked after the
+// deadline is set
+func (x *xHandle) Established(idle, write time.Duration,
+	closing *atomic.Bool) {
+
+	ctx := x.handhsake.Contexto
+	csClient := ctx.GetCipherScpec(handshake.CIPHERSPECCLIENT)
+	csServer := ctx.GetCipherScpec(handshake.CIPHERSPECSERVER)
+	if csClient == nil || csServer == nil {
+		x.lg.Error("nil cipher spec on established connection")
+		return
+	}
+
+	x.write = write
+
+	for {
+		if idle > 0 {
+			x.conn.SetReadDeadline(time.Now().Add(idle))
+		}
+
+		if closing != nil && closing.Load() {
+			x.lg.Debug("Server closing: ", x.conn.RemoteAddr())
+			x.sendProtected(csServer, tlssl.ContentTypeAlert,
+				tlssl.TLSAlert(tlssl.AlertCloseNotify))
+			return
+		}
+
+		header, fragment, err := tlssl.ReadRecord(x.conn)
+		if err != nil {
+			switch {
+			case errors.Is(err, os.ErrDeadlineExceeded):
+				if closing != nil && closing.Load() {
+					x.lg.Debug("Server closing: ", x.conn.RemoteAddr())
+				} else {
+					x.lg.Info("Idle timeout: ", x.conn.RemoteAddr())
+					x.metrics.inc(x.metrics.timeouts, "idle")
+				}
+
+				x.sendProtected(csServer, tlssl.ContentTypeAlert,
+					tlssl.TLSAlert(tlssl.AlertCloseNotify))
+			case errors.Is(err, io.EOF):
+				x.lg.Debug("Connection closed by client")
+			default:
+				x.lg.Warn("Reading record: ", err)
+				x.sendAlertProtected(csServer, err)
+			}
+
+			return
+		}
+
+		x.tCtx.Trace(ctx.GetConnID(), &tlssl.TraceEvent{
+			Kind:   tlssl.TraceRecordReceived,
+			Record: header,
+		})
+
+		tpt, err := csClient.DecryptRecord(&tlssl.TLSCipherText{
+			Header:   header,
+			Fragment: fragment,
+		})
+
+		if err != nil {
+			x.lg.Warn("Decrypting record: ", err)
+			x.sendAlertProtected(csServer, err)
+			return
+		}
+
+		switch tpt.Header.ContentType {
+		case tlssl.ContentTypeApplicationData:
+			x.lg.Debugf("Application data: %v bytes", len(tpt.Fragment))
+			err = x.sendProtected(csServer, tlssl.ContentTypeApplicationData,
+				tpt.Fragment)
+			if err != nil {
+				x.lg.Error("Echoing application data: ", err)
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					x.metrics.inc(x.metrics.timeouts, "write")
+				}
+
+				return
+			}
+
+		case tlssl.ContentTypeAlert:
+			if len(tpt.Fragment) != tlssl.TLS_ALERT_SIZE {
+				x.sendAlertProtected(csServer, tlssl.NewAlertError(
+					tlssl.AlertDecodeError, "alert len %v", len(tpt.Fragment)))
+				return
+			}
+
+			alert := tlssl.AlertDescriptionType(tpt.Fragment[1])
+			x.traceAlert(alert, false)
+			if alert == tlssl.AlertCloseNotify {
+				x.lg.Debug("Received close_notify")
+				x.sendProtected(csServer, tlssl.ContentTypeAlert,
+					tlssl.TLSAlert(tlssl.AlertCloseNotify))
+			} else {
+				x.lg.Warn("Client alert: ", alert)
+			}
+
+			return
+
+		// Renegotiation is not supported, a ClientHello lands here too
+		default:
+			x.sendAlertProtected(csServer, tlssl.NewAlertError(
+				tlssl.AlertUnexpectedMessage, "%v record on established "+
+					"connection", tpt.Header.ContentType))
+			return
+		}
+	}
+}
+
+func (x *xHandle) sendProtected(cs tlssl.TLSCipherSpec,
+	ct tlssl.ContentTypeType, data []byte) error {
+
+	tpt := &tlssl.TLSPlaintext{
+		Header:   &tlssl.TLSHeader{ContentType: ct},
+		Fragment: data,
+	}
+
+	for _, record := range cs.SplitRecord(tpt) {
+		if x.write > 0 {
+			x.conn.SetWriteDeadline(time.Now().Add(x.write))
+		}
+
+		tct, err := cs.EncryptRecord(record)
+		if err != nil {
+			return err
+		}
+
+		packet, err := tct.Packet(cs.CipherType(), false)
+		if err != nil {
+			return err
+		}
+
+		if err = x.handhsake.Contexto.Send(packet); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Same as 'sendAlert' but once the cipher specs are in use
+func (x *xHandle) sendAlertProtected(cs tlssl.TLSCipherSpec, err error) {
+
+	alert, ok := tlssl.AlertFromError(err)
+	if !ok {
+		return
+	}
+
+	x.lg.Debugf("Sending alert: %v", alert)
+	x.traceAlert(alert, true)
+	x.sendProtected(cs, tlssl.ContentTypeAlert, tlssl.TLSAlert(alert))
+}
+
+// Fatal alert for the error, if there is one to send. Handshake alerts
+// are never protected, the server's ChangeCipherSpec is sent last
+func (x *xHandle) sendAlert(err error) {
+
+	alert, ok := tlssl.AlertFromError(err)
+	if !ok {
+		return
+	}
+
+	x.lg.Debugf("Sending alert: %v", alert)
+	ctx := x.handhsake.Contexto
+	x.traceAlert(alert, true)
+	ctx.Send(tlssl.TLSAlertPacket(alert, ctx.GetVersion()))
+}
+
+func (x *xHandle) traceAlert(alert tlssl.AlertDescriptionType, sent bool) {
+
+	x.tCtx.Trace(x.handhsake.Contexto.GetConnID(), &tlssl.TraceEvent{
+		Kind:  tlssl.TraceAlert,
+		Alert: alert,
+		Sent:  sent,
+	})
 }
 
 func (x *xHandle) registryStates(mac evilmac.StateMac) error {
@@ -101,6 +354,10 @@ func (x *xHandle) registryStates(mac evilmac.StateMac) error {
 	}
 
 	for _, s := range states {
+		if x.metrics != nil {
+			s.state = &xTimedState{State: s.state, metrics: x.metrics}
+		}
+
 		err = mac.Register(s.state, s.id)
 		if err != nil {
 			return fmt.Errorf("'%s'(%w)", s.state.Name(), err)
@@ -109,3 +366,11 @@ func (x *xHandle) registryStates(mac evilmac.StateMac) error {
 
 	return nil
 }
+
+func (x *xTimedState) Next() (int, error) {
+
+	start := time.Now()
+	next, err := x.State.Next()
+	x.metrics.observe(x.metrics.stateTimes, time.Since(start), x.Name())
+	return next, err
+}
@@ -1,11 +1,22 @@
 package server
 
 import (
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
+	"tlesio/tlssl"
 	ex "tlesio/tlssl/extensions"
+	"tlesio/tlssl/handshake"
 	mx "tlesio/tlssl/modulos"
+	"tlesio/tlssl/pcapng"
+	"tlesio/tlssl/remotekey"
 	"tlesio/tlssl/suite"
 	"tlesio/tlssl/suite/ciphersuites"
 
@@ -15,16 +26,65 @@ import (
 
 var (
 	_ENV_LOG_LEVEL_VAR_   = "TLS_LOG_LEVEL"
-	_ENV_CLIENT_AUTH_VAR_ = "TLS_CLIENT_AUTH"
+	_ENV_CLIENT_AUTH_VAR_ = "TLS_CLIENT_AUTH" // "request", "require" ("true")
+	_ENV_CLIENT_CA_VAR_   = "TLS_CLIENT_CA"   // PEM bundle
+	_ENV_CERTS_VAR_       = "TLS_CERTS"       // "cert:key,cert:unix:/key.sock"
+	_ENV_OCSP_VAR_        = "TLS_OCSP"        // "cert=response,cert=response"
+	_ENV_LEGACY_VAR_      = "TLS_LEGACY"
+	_ENV_PSK_FILE_VAR_    = "TLS_PSK_FILE"
+	_ENV_PSK_HINT_VAR_    = "TLS_PSK_HINT"
+
+	_ENV_HANDSHAKE_TIMEOUT_VAR_ = "TLS_HANDSHAKE_TIMEOUT"
+	_ENV_READ_TIMEOUT_VAR_      = "TLS_READ_TIMEOUT"
+	_ENV_IDLE_TIMEOUT_VAR_      = "TLS_IDLE_TIMEOUT"
+	_ENV_MAX_HANDSHAKES_VAR_    = "TLS_MAX_HANDSHAKES"
+	_ENV_METRICS_ADDR_VAR_      = "TLS_METRICS_ADDR"
+
+	// The usual SSLKEYLOGFILE is ignored on purpose, a leftover variable in
+	// the environment must not be enough to leak every session key
+	_ENV_KEYLOG_FILE_VAR_ = "TLS_KEYLOG_FILE"
+	_ENV_TRACE_VAR_       = "TLS_TRACE"       // "json" or "logrus"
+	_ENV_TRACE_FILE_VAR_  = "TLS_TRACE_FILE"  // JSON lines, stdout if empty
+	_ENV_CAPTURE_DIR_VAR_ = "TLS_CAPTURE_DIR" // One file per connection
+	_ENV_PCAP_FILE_VAR_   = "TLS_PCAP_FILE"   // pcapng, key log included
+	_ENV_SSLKEYLOGFILE_   = "SSLKEYLOGFILE"
+)
+
+const (
+	_DEFAULT_HANDSHAKE_TIMEOUT_ = 10 * time.Second
+	_DEFAULT_READ_TIMEOUT_      = 5 * time.Second
+	_DEFAULT_IDLE_TIMEOUT_      = 2 * time.Minute
+	_DEFAULT_MAX_HANDSHAKES_    = 256
+
+	// A remote key operation taking longer fails the handshake, it does
+	// not hold the connection until the handshake timeout
+	_REMOTE_KEY_TIMEOUT_ = 3 * time.Second
+	_REMOTE_KEY_PREFIX_  = "unix:"
 )
 
 func (x *serverOp) initTLSContext() error {
 
+	x.initHandshakeContext()
+	x.initTLSContextKeyLog()
+	x.initTLSContextTracer()
+	x.initCapture()
+	x.initPcap()
+	return nil
+}
+
+// What handshakes need: certificates, suites, extensions, PSK keys and
+// client authentication. Nothing here writes anywhere
+func (x *serverOp) initHandshakeContext() {
+
 	x.initTLSContexLg()
 	x.initTLSContextModz()
 	x.initTLSContextExtensions()
-	x.tlsCtx.OptClientAuth = getTLSClientAuthOpt()
-	return nil
+	x.initTLSContextPSK()
+	x.initTLSContextClientAuth()
+	x.tlsCtx.OptLegacy = getTLSLegacyOpt()
+	if x.tlsCtx.OptLegacy && x.tlsCtx.Lg != nil {
+		x.tlsCtx.Lg.Warn("Legacy mode enabled: TLS 1.0/1.1 will be negotiated")
+	}
 }
 
 func (x *serverOp) initTLSContexLg() {
@@ -69,11 +129,49 @@ func (x *serverOp) initTLSContextModz() {
 	certs := []*mx.CertPaths{
 		{PathCert: "./certs/server.crt", PathKey: "./certs/server.key"},
 		{PathCert: "./certs/server2.crt", PathKey: "./certs/server.key"},
+		{PathCert: "./certs/server-ec.crt", PathKey: "./certs/server-ec.key"},
+	}
+
+	if env := os.Getenv(_ENV_CERTS_VAR_); env != "" {
+		certs = nil
+		for _, pair := range strings.Split(env, ",") {
+			cert, key, ok := strings.Cut(strings.TrimSpace(pair), ":")
+			if !ok || cert == "" || key == "" {
+				x.err = fmt.Errorf("invalid %v: %v", _ENV_CERTS_VAR_, pair)
+				return
+			}
+
+			paths := &mx.CertPaths{PathCert: cert, PathKey: key}
+			if sock, ok := strings.CutPrefix(key, _REMOTE_KEY_PREFIX_); ok {
+				remote, err := remotekey.Dial(sock, _REMOTE_KEY_TIMEOUT_)
+				if err != nil {
+					x.err = err
+					return
+				}
+
+				paths.Signer = remote
+				x.remoteKeys = append(x.remoteKeys, remote)
+				x.tlsCtx.Lg.Info("Remote key: ", sock)
+			}
+
+			certs = append(certs, paths)
+		}
 	}
 
+	x.initOCSP(certs)
 	suites := []suite.Suite{
 		ciphersuites.NewAES_256_CBC_SHA(),
 		ciphersuites.NewAES_256_CBC_SHA256(),
+		ciphersuites.NewECDHE_RSA_CHACHA20_POLY1305_SHA256(),
+		ciphersuites.NewECDHE_ECDSA_CHACHA20_POLY1305_SHA256(),
+		ciphersuites.NewECDHE_ECDSA_AES_128_CCM(),
+		ciphersuites.NewECDHE_ECDSA_AES_128_CCM_8(),
+		ciphersuites.NewECDHE_PSK_CHACHA20_POLY1305_SHA256(),
+		ciphersuites.NewDHE_PSK_CHACHA20_POLY1305_SHA256(),
+		ciphersuites.NewDHE_PSK_AES_128_CCM(),
+		ciphersuites.NewPSK_CHACHA20_POLY1305_SHA256(),
+		ciphersuites.NewPSK_AES_128_CCM(),
+		ciphersuites.NewPSK_AES_128_CCM_8(),
 	}
 
 	if x.err != nil {
@@ -86,6 +184,40 @@ func (x *serverOp) initTLSContextModz() {
 	x.err = x.tlsCtx.Modz.CheckModInit()
 }
 
+// DER OCSP responses to staple, by certificate path. Files are read again
+// when they change, whoever fetches them just rewrites them
+func (x *serverOp) initOCSP(certs []*mx.CertPaths) {
+
+	env := os.Getenv(_ENV_OCSP_VAR_)
+	if x.err != nil || env == "" {
+		return
+	}
+
+	for _, pair := range strings.Split(env, ",") {
+		cert, response, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || cert == "" || response == "" {
+			x.err = fmt.Errorf("invalid %v: %v", _ENV_OCSP_VAR_, pair)
+			return
+		}
+
+		found := false
+		for _, paths := range certs {
+			if paths.PathCert == cert {
+				paths.PathOCSP = response
+				found = true
+			}
+		}
+
+		if !found {
+			x.err = fmt.Errorf("%v: unknown certificate %v", _ENV_OCSP_VAR_,
+				cert)
+			return
+		}
+
+		x.tlsCtx.Lg.Info("OCSP response: ", response)
+	}
+}
+
 func (x *serverOp) initTLSContextExtensions() {
 
 	if x.err != nil {
@@ -93,13 +225,377 @@ func (x *serverOp) initTLSContextExtensions() {
 	}
 
 	x.tlsCtx.Exts = ex.NewExtensions(x.tlsCtx.Lg)
-	x.tlsCtx.Exts.Register(ex.NewExtSignAlgo())
-	x.tlsCtx.Exts.Register(ex.NewExtSessionTicket())
-	x.tlsCtx.Exts.Register(ex.NewExtSNI())
-	//x.tlsCtx.Exts.Register(ex.NewExtEncryptThenMac())
-	x.tlsCtx.Exts.Register(ex.NewExtRenegotiation())
+	ex.Register(x.tlsCtx.Exts, ex.NewExtSignAlgo())
+	ex.Register(x.tlsCtx.Exts, ex.NewExtSessionTicket())
+	ex.Register(x.tlsCtx.Exts, ex.NewExtSNI())
+	ex.Register(x.tlsCtx.Exts, ex.NewExtStatusRequest())
+	ex.Register(x.tlsCtx.Exts, ex.NewExtSupportedGroups())
+	ex.Register(x.tlsCtx.Exts, ex.NewExtECPointFormats())
+	ex.Register(x.tlsCtx.Exts, ex.NewExtEncryptThenMac())
+	ex.Register(x.tlsCtx.Exts, ex.NewExtRenegotiation())
 }
 
-func getTLSClientAuthOpt() bool {
-	return strings.ToLower(os.Getenv(_ENV_CLIENT_AUTH_VAR_)) == "true"
+// PSK suites stay disabled unless there is a keys file
+func (x *serverOp) initTLSContextPSK() {
+
+	if x.err != nil {
+		return
+	}
+
+	path := os.Getenv(_ENV_PSK_FILE_VAR_)
+	if path == "" {
+		return
+	}
+
+	store, err := tlssl.NewPSKStoreFile(path,
+		[]byte(os.Getenv(_ENV_PSK_HINT_VAR_)))
+	if err != nil {
+		x.err = fmt.Errorf("PSK store: %v", err)
+		return
+	}
+
+	x.tlsCtx.PSK = store
+	x.tlsCtx.Lg.Info("PSK store loaded: ", path)
+}
+
+// "request" asks for a certificate, "require" (or "true") also fails the
+// handshake without one. Chains are only verified when there are client
+// CAs, otherwise any certificate whose key signs CertificateVerify is fine
+func (x *serverOp) initTLSContextClientAuth() {
+
+	if x.err != nil {
+		return
+	}
+
+	switch mode := strings.ToLower(os.Getenv(_ENV_CLIENT_AUTH_VAR_)); mode {
+	case "", "false":
+		return
+
+	case "request":
+		x.tlsCtx.OptClientAuth = true
+
+	case "require", "true":
+		x.tlsCtx.OptClientAuth = true
+		x.tlsCtx.OptClientAuthRequired = true
+
+	default:
+		x.err = fmt.Errorf("invalid %v: %v", _ENV_CLIENT_AUTH_VAR_, mode)
+		return
+	}
+
+	path := os.Getenv(_ENV_CLIENT_CA_VAR_)
+	if path == "" {
+		x.tlsCtx.Lg.Warn("Client certificates are not verified, no ",
+			_ENV_CLIENT_CA_VAR_)
+		return
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		x.err = fmt.Errorf("client CAs: %v", err)
+		return
+	}
+
+	for block, rest := pem.Decode(data); block != nil; block, rest =
+		pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			x.err = fmt.Errorf("client CAs: %v", err)
+			return
+		}
+
+		x.tlsCtx.ClientCAs = append(x.tlsCtx.ClientCAs, ca)
+	}
+
+	if len(x.tlsCtx.ClientCAs) == 0 {
+		x.err = fmt.Errorf("client CAs: no certificate in %v", path)
+		return
+	}
+
+	x.tlsCtx.Lg.Infof("Client CAs loaded: %v (%v)", path,
+		len(x.tlsCtx.ClientCAs))
+}
+
+// Legacy mode is meant for isolated listeners only
+func getTLSLegacyOpt() bool {
+	return strings.ToLower(os.Getenv(_ENV_LEGACY_VAR_)) == "true"
+}
+
+// Timeouts are Go durations ("10s", "1m30s"), zero disables one. The
+// in-flight handshakes limit is always on
+func (x *serverOp) initLimits() {
+
+	timeouts := []struct {
+		env   string
+		def   time.Duration
+		value *time.Duration
+	}{
+		{_ENV_HANDSHAKE_TIMEOUT_VAR_, _DEFAULT_HANDSHAKE_TIMEOUT_,
+			&x.limits.handshake},
+		{_ENV_READ_TIMEOUT_VAR_, _DEFAULT_READ_TIMEOUT_, &x.limits.read},
+		{_ENV_IDLE_TIMEOUT_VAR_, _DEFAULT_IDLE_TIMEOUT_, &x.limits.idle},
+	}
+
+	if x.err != nil {
+		return
+	}
+
+	for _, t := range timeouts {
+		*t.value = t.def
+		env := os.Getenv(t.env)
+		if env == "" {
+			continue
+		}
+
+		d, err := time.ParseDuration(env)
+		if err != nil || d < 0 {
+			x.err = fmt.Errorf("invalid %v: %v", t.env, env)
+			return
+		}
+
+		*t.value = d
+	}
+
+	x.limits.maxHandshakes = _DEFAULT_MAX_HANDSHAKES_
+	if env := os.Getenv(_ENV_MAX_HANDSHAKES_VAR_); env != "" {
+		max, err := strconv.Atoi(env)
+		if err != nil || max <= 0 {
+			x.err = fmt.Errorf("invalid %v: %v", _ENV_MAX_HANDSHAKES_VAR_, env)
+			return
+		}
+
+		x.limits.maxHandshakes = max
+	}
+
+	x.lg.Infof("Limits: handshake %v, read %v, idle %v, max handshakes %v",
+		x.limits.handshake, x.limits.read, x.limits.idle,
+		x.limits.maxHandshakes)
+}
+
+// Always counting. The HTTP endpoint is only up when there is an address,
+// meant to be a local one (e.g. 127.0.0.1:9100)
+func (x *serverOp) initMetrics() {
+
+	if x.err != nil {
+		return
+	}
+
+	x.metrics = newMetrics()
+	x.metrics.gauge("tls_handshakes_in_flight", "Handshakes in progress",
+		func() float64 { return float64(len(x.handshakes)) })
+	x.metrics.gauge("tls_handshakes_in_flight_limit",
+		"Max in-flight handshakes",
+		func() float64 { return float64(x.limits.maxHandshakes) })
+	x.metrics.gauge("tls_connections_established",
+		"Connections past the handshake", x.establishedCount)
+
+	addr := os.Getenv(_ENV_METRICS_ADDR_VAR_)
+	if addr == "" {
+		return
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		x.err = fmt.Errorf("invalid %v: %v", _ENV_METRICS_ADDR_VAR_, addr)
+		return
+	}
+
+	if ip := net.ParseIP(host); host != "localhost" &&
+		(ip == nil || !ip.IsLoopback()) {
+		x.lg.Warn("Metrics endpoint is not on a loopback address: ", addr)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", x.metrics)
+	x.metricsSrv = &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: _DEFAULT_READ_TIMEOUT_,
+	}
+}
+
+// Debugging only. Anyone with the file can decrypt the captured traffic,
+// so it must be 0600 and out of reach of everyone else
+func (x *serverOp) initTLSContextKeyLog() {
+
+	if x.err != nil {
+		return
+	}
+
+	if os.Getenv(_ENV_SSLKEYLOGFILE_) != "" {
+		x.tlsCtx.Lg.Warnf("%v is ignored, use %v to log session keys",
+			_ENV_SSLKEYLOGFILE_, _ENV_KEYLOG_FILE_VAR_)
+	}
+
+	path := os.Getenv(_ENV_KEYLOG_FILE_VAR_)
+	if path == "" {
+		return
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		x.err = fmt.Errorf("key log file: %v", err)
+		return
+	}
+
+	if err := checkPrivate(file); err != nil {
+		file.Close()
+		x.err = fmt.Errorf("key log file: %v", err)
+		return
+	}
+
+	x.tlsCtx.KeyLog = file
+	x.warnDebugOutput("KEY LOG", "session secrets", path)
+}
+
+// Owner only file in a directory closed to others, unless no one else can
+// get through a directory above it
+func checkPrivate(file *os.File) error {
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Mode().Perm() != 0600 {
+		return fmt.Errorf("%v has mode %v, expected 0600", file.Name(),
+			info.Mode().Perm())
+	}
+
+	path, err := filepath.Abs(file.Name())
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	for parent := dir; ; parent = filepath.Dir(parent) {
+		info, err := os.Stat(parent)
+		if err != nil {
+			return err
+		}
+
+		if info.Mode().Perm()&0001 == 0 {
+			return nil
+		}
+
+		if parent == filepath.Dir(parent) {
+			break
+		}
+	}
+
+	if info, err = os.Stat(dir); err != nil {
+		return err
+	}
+
+	if info.Mode().Perm()&0006 != 0 {
+		return fmt.Errorf("%v is readable or writable by anyone", dir)
+	}
+
+	return nil
+}
+
+func (x *serverOp) initTLSContextTracer() {
+
+	if x.err != nil {
+		return
+	}
+
+	switch strings.ToLower(os.Getenv(_ENV_TRACE_VAR_)) {
+	case "":
+		return
+
+	case "logrus":
+		x.tlsCtx.Tracer = handshake.NewLogrusTracer(x.tlsCtx.Lg)
+
+	case "json":
+		out := os.Stdout
+		if path := os.Getenv(_ENV_TRACE_FILE_VAR_); path != "" {
+			file, err := os.OpenFile(path,
+				os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+			if err != nil {
+				x.err = fmt.Errorf("trace file: %v", err)
+				return
+			}
+
+			out = file
+		}
+
+		x.tlsCtx.Tracer = handshake.NewJSONTracer(out)
+
+	default:
+		x.err = fmt.Errorf("invalid %v: %v", _ENV_TRACE_VAR_,
+			os.Getenv(_ENV_TRACE_VAR_))
+		return
+	}
+
+	x.tlsCtx.Lg.Info("Tracing handshakes: ", os.Getenv(_ENV_TRACE_VAR_))
+}
+
+// Debugging only. A capture holds the randomness the server used, so
+// anyone with it can decrypt the connection, same as with the key log
+func (x *serverOp) initCapture() {
+
+	if x.err != nil {
+		return
+	}
+
+	dir := os.Getenv(_ENV_CAPTURE_DIR_VAR_)
+	if dir == "" {
+		return
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		x.err = fmt.Errorf("capture dir: %v", err)
+		return
+	}
+
+	x.captureDir = dir
+	x.captureRun = time.Now().UTC().Format("20060102T150405")
+	x.warnDebugOutput("CAPTURE", "records and randomness", dir)
+}
+
+// Debugging only. Every connection's records and session keys go to one
+// pcapng file, a new section per server start
+func (x *serverOp) initPcap() {
+
+	if x.err != nil {
+		return
+	}
+
+	path := os.Getenv(_ENV_PCAP_FILE_VAR_)
+	if path == "" {
+		return
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		x.err = fmt.Errorf("pcap file: %v", err)
+		return
+	}
+
+	x.pcap, err = pcapng.NewWriter(file)
+	if err != nil {
+		file.Close()
+		x.err = fmt.Errorf("pcap file: %v", err)
+		return
+	}
+
+	x.warnDebugOutput("PCAP", "records and session secrets", path)
+}
+
+// Banner for the debugging outputs: 'what' of every connection goes to
+// 'path', enough to decrypt the traffic
+func (x *serverOp) warnDebugOutput(feature, what, path string) {
+
+	x.tlsCtx.Lg.Warn("*************************************************")
+	x.tlsCtx.Lg.Warnf("* %-45v *", feature+" ENABLED: "+what+" of")
+	x.tlsCtx.Lg.Warnf("* %-45v *", "every connection are written to")
+	x.tlsCtx.Lg.Warnf("* %-45v *", path)
+	x.tlsCtx.Lg.Warn("* Anyone with it can decrypt the traffic        *")
+	x.tlsCtx.Lg.Warn("* Never enable it in production                 *")
+	x.tlsCtx.Lg.Warn("*************************************************")
 }
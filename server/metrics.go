@@ -0,0 +1,350 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"tlesio/tlssl"
+	"tlesio/tlssl/suite"
+)
+
+// SNI and fingerprints are whatever the client says, past this many
+// values they are counted as "other"
+const _MAX_SNI_HOSTS_ = 128
+const _MAX_FINGERPRINTS_ = 256
+
+// Seconds
+var _DURATION_BUCKETS_ = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01,
+	0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Counters and histograms in Prometheus text exposition format (0.0.4).
+// Labels are few and known, a series key is its label values joined
+type xMetrics struct {
+	mu         sync.Mutex
+	counters   []*xCounter
+	histograms []*xHistogram
+	gauges     []*xGauge
+
+	started    *xCounter
+	completed  *xCounter
+	failed     *xCounter
+	rejected   *xCounter
+	timeouts   *xCounter
+	versions   *xCounter
+	suites     *xCounter
+	kx         *xCounter
+	sni        *xCounter
+	ja4        *xCounter
+	duration   *xHistogram
+	stateTimes *xHistogram
+}
+
+type xCounter struct {
+	name   string
+	help   string
+	labels []string
+	values map[string]uint64
+}
+
+type xHistogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	series  map[string]*xHistogramSeries
+}
+
+type xHistogramSeries struct {
+	counts []uint64 // Per bucket, cumulative only when written
+	count  uint64
+	sum    float64
+}
+
+// Read at scrape time
+type xGauge struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+func newMetrics() *xMetrics {
+
+	var newX xMetrics
+
+	newX.started = newX.counter("tls_handshakes_started_total",
+		"Handshakes started (ClientHello accepted)")
+	newX.completed = newX.counter("tls_handshakes_completed_total",
+		"Handshakes completed")
+	newX.failed = newX.counter("tls_handshakes_failed_total",
+		"Handshakes failed, by alert sent to the client", "alert")
+	newX.rejected = newX.counter("tls_connections_rejected_total",
+		"Connections dropped because of the in-flight handshakes limit")
+	newX.timeouts = newX.counter("tls_timeouts_total",
+		"Connections closed on a deadline", "phase")
+	newX.versions = newX.counter("tls_negotiated_versions_total",
+		"Completed handshakes by protocol version", "version")
+	newX.suites = newX.counter("tls_negotiated_cipher_suites_total",
+		"Completed handshakes by cipher suite", "suite")
+	newX.kx = newX.counter("tls_negotiated_key_exchanges_total",
+		"Completed handshakes by key exchange", "kx")
+	newX.sni = newX.counter("tls_sni_hosts_total",
+		"Completed handshakes by SNI host", "host")
+	newX.ja4 = newX.counter("tls_client_fingerprints_total",
+		"ClientHellos by JA4 fingerprint, failed handshakes included", "ja4")
+	newX.duration = newX.histogram("tls_handshake_duration_seconds",
+		"Time from ClientHello to the server's Finished")
+	newX.stateTimes = newX.histogram("tls_handshake_state_duration_seconds",
+		"Time spent in each handshake state", "state")
+	return &newX
+}
+
+func (x *xMetrics) counter(name, help string, labels ...string) *xCounter {
+
+	c := &xCounter{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]uint64),
+	}
+
+	x.counters = append(x.counters, c)
+	return c
+}
+
+func (x *xMetrics) histogram(name, help string,
+	labels ...string) *xHistogram {
+
+	h := &xHistogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: _DURATION_BUCKETS_,
+		series:  make(map[string]*xHistogramSeries),
+	}
+
+	x.histograms = append(x.histograms, h)
+	return h
+}
+
+func (x *xMetrics) gauge(name, help string, value func() float64) {
+	x.gauges = append(x.gauges, &xGauge{name: name, help: help, value: value})
+}
+
+func (x *xMetrics) inc(c *xCounter, labels ...string) {
+
+	if x == nil {
+		return
+	}
+
+	x.mu.Lock()
+	c.add(labels...)
+	x.mu.Unlock()
+}
+
+func (c *xCounter) add(labels ...string) {
+	c.values[strings.Join(labels, "\x00")]++
+}
+
+func (x *xMetrics) observe(h *xHistogram, d time.Duration,
+	labels ...string) {
+
+	if x == nil {
+		return
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	key := strings.Join(labels, "\x00")
+	series, ok := h.series[key]
+	if !ok {
+		series = &xHistogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+
+	seconds := d.Seconds()
+	for i, bound := range h.buckets {
+		if seconds <= bound {
+			series.counts[i]++
+			break
+		}
+	}
+
+	series.count++
+	series.sum += seconds
+}
+
+// Negotiated parameters of a completed handshake
+func (x *xMetrics) handshakeDone(version, cipherSuite uint16,
+	st suite.Suite, sniHost string, took time.Duration) {
+
+	if x == nil {
+		return
+	}
+
+	kx := "Unknown"
+	if st != nil {
+		kx = suite.KeyExchangeToString(st.Info().KeyExchange)
+	}
+
+	name, ok := suite.CipherSuiteNames[cipherSuite]
+	if !ok {
+		name = fmt.Sprintf("0x%04X", cipherSuite)
+	}
+
+	x.mu.Lock()
+	if sniHost == "" {
+		sniHost = "none"
+	} else if _, ok := x.sni.values[sniHost]; !ok &&
+		len(x.sni.values) >= _MAX_SNI_HOSTS_ {
+		sniHost = "other"
+	}
+
+	x.completed.add()
+	x.versions.add(tlssl.VersionName(version))
+	x.suites.add(name)
+	x.kx.add(kx)
+	x.sni.add(sniHost)
+	x.mu.Unlock()
+	x.observe(x.duration, took)
+}
+
+func (x *xMetrics) clientHello(ja4 string) {
+
+	if x == nil {
+		return
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if _, ok := x.ja4.values[ja4]; !ok &&
+		len(x.ja4.values) >= _MAX_FINGERPRINTS_ {
+		ja4 = "other"
+	}
+
+	x.ja4.add(ja4)
+}
+
+func (x *xMetrics) handshakeFailed(err error) {
+
+	if x == nil {
+		return
+	}
+
+	alert := "none"
+	if desc, ok := tlssl.AlertFromError(err); ok {
+		alert = desc.String()
+	}
+
+	x.inc(x.failed, alert)
+}
+
+func (x *xMetrics) WriteTo(w io.Writer) (int64, error) {
+
+	var sb strings.Builder
+
+	x.mu.Lock()
+	for _, c := range x.counters {
+		writeHead(&sb, c.name, c.help, "counter")
+		if len(c.labels) == 0 {
+			fmt.Fprintf(&sb, "%v %v\n", c.name, c.values[""])
+			continue
+		}
+
+		for _, key := range sortedKeys(c.values) {
+			fmt.Fprintf(&sb, "%v{%v} %v\n", c.name,
+				labelPairs(c.labels, key), c.values[key])
+		}
+	}
+
+	for _, h := range x.histograms {
+		writeHead(&sb, h.name, h.help, "histogram")
+		for _, key := range sortedKeys(h.series) {
+			var cumulative uint64
+
+			series := h.series[key]
+			pairs := labelPairs(h.labels, key)
+			if pairs != "" {
+				pairs += ","
+			}
+
+			for i, bound := range h.buckets {
+				cumulative += series.counts[i]
+				fmt.Fprintf(&sb, "%v_bucket{%vle=\"%v\"} %v\n", h.name, pairs,
+					bound, cumulative)
+			}
+
+			fmt.Fprintf(&sb, "%v_bucket{%vle=\"+Inf\"} %v\n", h.name, pairs,
+				series.count)
+			pairs = strings.TrimSuffix(pairs, ",")
+			if pairs != "" {
+				pairs = "{" + pairs + "}"
+			}
+
+			fmt.Fprintf(&sb, "%v_sum%v %v\n", h.name, pairs, series.sum)
+			fmt.Fprintf(&sb, "%v_count%v %v\n", h.name, pairs, series.count)
+		}
+	}
+
+	x.mu.Unlock()
+	for _, g := range x.gauges {
+		writeHead(&sb, g.name, g.help, "gauge")
+		fmt.Fprintf(&sb, "%v %v\n", g.name, g.value())
+	}
+
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+func (x *xMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	x.WriteTo(w)
+}
+
+func writeHead(sb *strings.Builder, name, help, kind string) {
+	fmt.Fprintf(sb, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+}
+
+func labelPairs(labels []string, key string) string {
+
+	var pairs []string
+
+	if len(labels) == 0 {
+		return ""
+	}
+
+	values := strings.Split(key, "\x00")
+	for i, label := range labels {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+
+		pairs = append(pairs, fmt.Sprintf("%v=\"%v\"", label,
+			escapeLabel(value)))
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+// Backslash, double quote and line feed (exposition format)
+func escapeLabel(value string) string {
+
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).
+		Replace(value)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"tlesio/systema"
+	"tlesio/tlssl"
+	"tlesio/tlssl/capture"
+	"tlesio/tlssl/remotekey"
+)
+
+// What replaying a capture sent compared to what the server sent back then
+type ReplayReport struct {
+	ConnID   uint64
+	Records  int    // Server records in the capture
+	Replayed int    // Server records the replay sent
+	Diverged int    // First server record that differs, -1 if none does
+	Expected []byte // Captured record at 'Diverged', nil if there is none
+	Got      []byte // Replayed record at 'Diverged', nil if there is none
+	Err      error  // Why the replayed handshake failed, if it did
+}
+
+type Replayer interface {
+	Replay([]*capture.Entry) (*ReplayReport, error)
+	Close() error
+}
+
+type xReplayer struct {
+	tlsCtx     *tlssl.TLSContext
+	remoteKeys []remotekey.Key
+}
+
+// Client side of a capture, one record per read at most, the way the
+// client sent them (the next flight only after the server's). Writes are
+// kept
+type xReplayConn struct {
+	in  [][]byte
+	out bytes.Buffer
+}
+
+// Feeds the client records of a single connection capture through the
+// server state machine, with the captured randomness and the capture's
+// clock. ECDSA signatures can't be replayed, the standard library reads
+// a random extra byte (or not) before the nonce
+func Replay(ctx *tlssl.TLSContext, entries []*capture.Entry) (*ReplayReport,
+	error) {
+
+	var random []byte
+	var report ReplayReport
+	var expected [][]byte
+
+	if ctx == nil {
+		return nil, systema.ErrNilParams
+	}
+
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("empty capture")
+	}
+
+	conn := &xReplayConn{}
+	report.ConnID = entries[0].ConnID
+	for _, entry := range entries {
+		if entry.ConnID != report.ConnID {
+			return nil, fmt.Errorf("capture holds more than one connection"+
+				"(%v, %v)", report.ConnID, entry.ConnID)
+		}
+
+		switch entry.Dir {
+		case capture.DirIn:
+			conn.in = append(conn.in, entry.Data)
+		case capture.DirOut:
+			expected = append(expected, entry.Data)
+		case capture.DirRand:
+			random = append(random, entry.Data...)
+		}
+	}
+
+	header, fragment, err := tlssl.ReadRecord(conn)
+	if err != nil {
+		return nil, fmt.Errorf("no ClientHello in capture: %v", err)
+	}
+
+	// Nothing goes to the key log, the capture already has it all
+	start := entries[0].Time
+	replayCtx := *ctx
+	replayCtx.KeyLog = nil
+	replayCtx.Time = func() time.Time { return start }
+	if len(random) > 0 {
+		replayCtx.Rand = bytes.NewReader(random)
+	}
+
+	handle, err := Handle(&replayCtx, conn, report.ConnID)
+	if err != nil {
+		return nil, err
+	}
+
+	report.Err = handle.LetsTalk(append(tlssl.TLSHeadPacket(header),
+		fragment...))
+	if report.Err == nil {
+		handle.Established(0, 0, nil)
+	}
+
+	report.compare(expected, splitRecords(conn.out.Bytes()))
+	return &report, nil
+}
+
+// Replays through a server set up from the environment, handshakes only:
+// no key log, capture, pcap, metrics or listener. 'Close' lets go of the
+// remote keys
+func NewReplayer() (Replayer, error) {
+
+	var op serverOp
+
+	op.tlsCtx = &tlssl.TLSContext{}
+	op.initHandshakeContext()
+	if op.err != nil {
+		op.closeOutputs()
+		return nil, fmt.Errorf("TLS Init err: %w", op.err)
+	}
+
+	return &xReplayer{tlsCtx: op.tlsCtx, remoteKeys: op.remoteKeys}, nil
+}
+
+func (x *xReplayer) Replay(entries []*capture.Entry) (*ReplayReport,
+	error) {
+	return Replay(x.tlsCtx, entries)
+}
+
+func (x *xReplayer) Close() error {
+
+	for _, key := range x.remoteKeys {
+		key.Close()
+	}
+
+	return nil
+}
+
+// Connections get their own context when captured, it holds their
+// randomness and key log
+func (server *serverOp) startCapture(conn net.Conn,
+	connID uint64) (*tlssl.TLSContext, net.Conn, capture.Capture) {
+
+	var sinks []capture.Sink
+
+	tlsCtx := *server.tlsCtx
+	if server.captureDir != "" {
+		path := filepath.Join(server.captureDir,
+			fmt.Sprintf("%v-%v.jsonl", server.captureRun, connID))
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+			0600)
+		if err != nil {
+			server.lg.Error("capture file: ", err)
+		} else {
+			sinks = append(sinks, capture.NewJSONSink(file))
+		}
+	}
+
+	if server.pcap != nil {
+		pcapConn := server.pcap.Conn(connID, conn.RemoteAddr(),
+			conn.LocalAddr(), tlsCtx.Now())
+		sinks = append(sinks, pcapConn)
+		tlsCtx.KeyLog = pcapConn.KeyLog()
+		if server.tlsCtx.KeyLog != nil {
+			tlsCtx.KeyLog = io.MultiWriter(server.tlsCtx.KeyLog,
+				pcapConn.KeyLog())
+		}
+	}
+
+	if len(sinks) == 0 {
+		return server.tlsCtx, conn, nil
+	}
+
+	cpt := capture.NewCapture(connID, tlsCtx.Now, sinks...)
+	tlsCtx.Rand = cpt.Rand(server.tlsCtx.Random())
+	return &tlsCtx, cpt.Conn(conn), cpt
+}
+
+func (x *ReplayReport) compare(expected, got [][]byte) {
+
+	x.Records = len(expected)
+	x.Replayed = len(got)
+	x.Diverged = -1
+	for i := 0; i < max(len(expected), len(got)); i++ {
+		var exp, rep []byte
+
+		if i < len(expected) {
+			exp = expected[i]
+		}
+
+		if i < len(got) {
+			rep = got[i]
+		}
+
+		if exp == nil || rep == nil || !bytes.Equal(exp, rep) {
+			x.Diverged, x.Expected, x.Got = i, exp, rep
+			return
+		}
+	}
+}
+
+func (x *ReplayReport) String() string {
+
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "conn %v: %v server records captured, %v replayed",
+		x.ConnID, x.Records, x.Replayed)
+	if x.Diverged < 0 {
+		sb.WriteString(", identical")
+	} else {
+		fmt.Fprintf(&sb, ", diverged at record %v: expected %v, got %v",
+			x.Diverged, recordName(x.Expected), recordName(x.Got))
+		if x.Expected != nil && x.Got != nil {
+			fmt.Fprintf(&sb, ", first difference at byte %v",
+				firstDifference(x.Expected, x.Got))
+		}
+	}
+
+	if x.Err != nil {
+		fmt.Fprintf(&sb, ". Handshake failed: %v", x.Err)
+	}
+
+	return sb.String()
+}
+
+func recordName(record []byte) string {
+
+	if len(record) < tlssl.TLS_HEADER_SIZE {
+		return "nothing"
+	}
+
+	return fmt.Sprintf("%v(%v bytes)", tlssl.ContentTypeType(record[0]),
+		len(record))
+}
+
+func firstDifference(a, b []byte) int {
+
+	for i := 0; i < min(len(a), len(b)); i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+
+	return min(len(a), len(b))
+}
+
+// Whole records, header included. A truncated tail is one more record
+func splitRecords(buff []byte) [][]byte {
+
+	var records [][]byte
+
+	for len(buff) > 0 {
+		recLen := len(buff)
+		if len(buff) >= tlssl.TLS_HEADER_SIZE {
+			recLen = min(recLen, tlssl.TLS_HEADER_SIZE+
+				(int(buff[3])<<8|int(buff[4])))
+		}
+
+		records = append(records, buff[:recLen])
+		buff = buff[recLen:]
+	}
+
+	return records
+}
+
+func (x *xReplayConn) Read(b []byte) (int, error) {
+
+	for len(x.in) > 0 && len(x.in[0]) == 0 {
+		x.in = x.in[1:]
+	}
+
+	if len(x.in) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(b, x.in[0])
+	x.in[0] = x.in[0][n:]
+	return n, nil
+}
+
+func (x *xReplayConn) Write(b []byte) (int, error) {
+	return x.out.Write(b)
+}
+
+func (x *xReplayConn) Close() error                       { return nil }
+func (x *xReplayConn) LocalAddr() net.Addr                { return replayAddr }
+func (x *xReplayConn) RemoteAddr() net.Addr               { return replayAddr }
+func (x *xReplayConn) SetDeadline(t time.Time) error      { return nil }
+func (x *xReplayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (x *xReplayConn) SetWriteDeadline(t time.Time) error { return nil }
+
+var replayAddr = &net.UnixAddr{Name: "replay", Net: "unix"}
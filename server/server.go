@@ -1,61 +1,335 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"tlesio/tlssl"
+	"tlesio/tlssl/pcapng"
+	"tlesio/tlssl/remotekey"
 
 	clog "github.com/julinox/consolelogrus"
 	"github.com/sirupsen/logrus"
 )
 
-var port = ":8443"
+var ErrServerClosed = errors.New("server closed")
+
+// 'Shutdown' stops accepting, lets in-progress handshakes finish and
+// sends close_notify to established connections. 'Close' drops everything
+type Server interface {
+	ListenAndServe() error
+	Serve(net.Listener) error
+	Shutdown(context.Context) error
+	Close() error
+}
 
 type serverOp struct {
-	lg     *logrus.Logger
-	tlsCtx *tlssl.TLSContext
-	err    error // For initialization errors
+	lg         *logrus.Logger
+	addr       string
+	tlsCtx     *tlssl.TLSContext
+	limits     serverLimits
+	handshakes chan struct{} // One slot per in-flight handshake
+	metrics    *xMetrics
+	metricsSrv *http.Server  // nil unless there is a metrics address
+	err        error         // For initialization errors
+	captureDir string        // Empty disables capture
+	captureRun string        // Capture file prefix, one per server start
+	pcap       pcapng.Writer // nil disables pcapng export
+	remoteKeys []remotekey.Key
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[*xTimedConn]bool // true once established
+	wg       sync.WaitGroup
+	closing  atomic.Bool
+	connIDs  atomic.Uint64
 }
 
-func RealServidor() {
+type serverLimits struct {
+	handshake     time.Duration // Whole handshake, from accept to Finished
+	read          time.Duration // Each handshake read/write, each write after
+	idle          time.Duration // Established connection with no records
+	maxHandshakes int
+}
+
+func NewServer(addr string) (Server, error) {
 
-	var err error
 	var server serverOp
 
 	server.lg = clog.InitNewLogger(&clog.CustomFormatter{Tag: "SERVER"})
-	listener, err := net.Listen("tcp", port)
-	if err != nil {
-		server.lg.Error(err)
-		return
+	if server.lg == nil {
+		return nil, fmt.Errorf("logger Init err")
 	}
+
 	server.tlsCtx = &tlssl.TLSContext{}
 	server.initTLSContext()
 	if server.err != nil {
-		server.lg.Error("TLS Init err: ", server.err)
-		return
+		return nil, fmt.Errorf("TLS Init err: %w", server.err)
+	}
+
+	server.initLimits()
+	if server.err != nil {
+		return nil, fmt.Errorf("Limits Init err: %w", server.err)
+	}
+
+	server.addr = addr
+	server.conns = make(map[*xTimedConn]bool)
+	server.handshakes = make(chan struct{}, server.limits.maxHandshakes)
+	server.initMetrics()
+	if server.err != nil {
+		return nil, fmt.Errorf("Metrics Init err: %w", server.err)
 	}
 
 	server.lg.Info("TLS Context Initialized")
-	defer listener.Close()
-	server.lg.Info("Listening on PORT ", port)
+	return &server, nil
+}
+
+// Blocks until the server is shut down (ErrServerClosed) or the listener
+// fails
+func (server *serverOp) ListenAndServe() error {
+
+	listener, err := net.Listen("tcp", server.addr)
+	if err != nil {
+		return err
+	}
+
+	return server.Serve(listener)
+}
+
+// Same as ListenAndServe on an already open listener, which the server
+// owns (and closes) from now on
+func (server *serverOp) Serve(listener net.Listener) error {
+
+	server.mu.Lock()
+	if server.closing.Load() {
+		server.mu.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+
+	server.listener = listener
+	server.mu.Unlock()
+	if server.metricsSrv != nil {
+		go func() {
+			err := server.metricsSrv.ListenAndServe()
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				server.lg.Error("metrics endpoint: ", err)
+			}
+		}()
+
+		server.lg.Info("Metrics on ", server.metricsSrv.Addr)
+	}
+
+	server.lg.Info("Listening on ", listener.Addr())
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if server.closing.Load() {
+				return ErrServerClosed
+			}
+
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+
 			server.lg.Error("error accepting connection:", err)
 			continue
 		}
 
+		// Slow or idle clients can't queue up new connections behind them
+		select {
+		case server.handshakes <- struct{}{}:
+		default:
+			server.lg.Warnf("Max in-flight handshakes reached(%v), "+
+				"dropping %v", server.limits.maxHandshakes, conn.RemoteAddr())
+			server.metrics.inc(server.metrics.rejected)
+			conn.Close()
+			continue
+		}
+
+		var deadline time.Time
+		if server.limits.handshake > 0 {
+			deadline = time.Now().Add(server.limits.handshake)
+		}
+
 		server.lg.Info("Connection accepted from ", conn.RemoteAddr())
-		go server.handleConnection(conn)
+		tConn := newTimedConn(conn, server.limits.read, deadline)
+		if !server.track(tConn) {
+			<-server.handshakes
+			conn.Close()
+			continue
+		}
+
+		go server.handleConnection(tConn)
 	}
 }
 
-func (server *serverOp) handleConnection(conn net.Conn) {
+func (server *serverOp) Shutdown(ctx context.Context) error {
+
+	server.lg.Info("Shutting down")
+	server.stopListening()
+
+	// Idle readers wake up and say goodbye. Connections finishing their
+	// handshake see 'closing' before their first read
+	server.mu.Lock()
+	for conn, established := range server.conns {
+		if established {
+			conn.SetReadDeadline(time.Now())
+		}
+	}
+
+	server.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		server.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		server.lg.Info("All connections closed")
+		if server.metricsSrv != nil {
+			server.metricsSrv.Shutdown(ctx)
+		}
+
+		server.closeOutputs()
+		return nil
+
+	case <-ctx.Done():
+		server.lg.Warn("Shutdown deadline, closing remaining connections")
+		server.Close()
+		return ctx.Err()
+	}
+}
 
+func (server *serverOp) Close() error {
+
+	server.stopListening()
+	if server.metricsSrv != nil {
+		server.metricsSrv.Close()
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	for conn := range server.conns {
+		conn.Close()
+	}
+
+	server.closeOutputs()
+	return nil
+}
+
+// What outlives the connections: the pcapng file and the remote keys'
+// sockets
+func (server *serverOp) closeOutputs() {
+
+	if server.pcap != nil {
+		server.pcap.Close()
+	}
+
+	for _, key := range server.remoteKeys {
+		key.Close()
+	}
+}
+
+func (server *serverOp) stopListening() {
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.closing.Store(true)
+	if server.listener != nil {
+		server.listener.Close()
+	}
+}
+
+func (server *serverOp) track(conn *xTimedConn) bool {
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.closing.Load() {
+		return false
+	}
+
+	server.conns[conn] = false
+	server.wg.Add(1)
+	return true
+}
+
+func (server *serverOp) untrack(conn *xTimedConn) {
+
+	server.mu.Lock()
+	delete(server.conns, conn)
+	server.mu.Unlock()
+	server.wg.Done()
+}
+
+func (server *serverOp) setEstablished(conn *xTimedConn) {
+
+	server.mu.Lock()
+	server.conns[conn] = true
+	server.mu.Unlock()
+}
+
+func (server *serverOp) establishedCount() float64 {
+
+	var count int
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	for _, established := range server.conns {
+		if established {
+			count++
+		}
+	}
+
+	return float64(count)
+}
+
+func (server *serverOp) handleConnection(conn *xTimedConn) {
+
+	inFlight := true
+	release := func() {
+		if inFlight {
+			<-server.handshakes
+			inFlight = false
+		}
+	}
+
+	defer server.untrack(conn)
 	defer conn.Close()
+	defer release()
+	// Parsers are bounds checked (and fuzzed). Should one still panic, it
+	// takes down this connection, not the server
+	defer func() {
+		if r := recover(); r != nil {
+			server.lg.Errorf("panic on connection %v: %v\n%s",
+				conn.RemoteAddr(), r, debug.Stack())
+		}
+	}()
+
+	connID := server.connIDs.Add(1)
+	tlsCtx, netConn, cpt := server.startCapture(conn, connID)
+	if cpt != nil {
+		defer cpt.Close()
+	}
+
 	buffer := make([]byte, 4096)
-	n, err := conn.Read(buffer)
+	n, err := netConn.Read(buffer)
 	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			server.lg.Warn("No ClientHello in time: ", conn.RemoteAddr())
+			server.metrics.inc(server.metrics.timeouts, "handshake")
+			return
+		}
+
 		server.lg.Error("error reading data:", err)
 		return
 	}
@@ -93,10 +367,22 @@ func (server *serverOp) handleConnection(conn net.Conn) {
 		return
 	}
 
-	handle, _ := Handle(server.tlsCtx, conn)
+	server.metrics.inc(server.metrics.started)
+	handle, _ := Handle(tlsCtx, netConn, connID)
 	if handle == nil {
+		server.metrics.handshakeFailed(nil)
+		return
+	}
+
+	handle.metrics = server.metrics
+
+	if err = handle.LetsTalk(buffer[:n]); err != nil {
 		return
 	}
 
-	handle.LetsTalk(buffer[:n])
+	release()
+	conn.release()
+	server.setEstablished(conn)
+	handle.Established(server.limits.idle, server.limits.read,
+		&server.closing)
 }
@@ -12,16 +12,16 @@ import (
 // Print a byte array in a 'pretty' format
 func PrettyPrintBytes(buffer []byte) string {
 
-	var pretty string
+	var pretty strings.Builder
 
 	for i, b := range buffer {
-		pretty += fmt.Sprintf("%02x ", b)
+		fmt.Fprintf(&pretty, "%02x ", b)
 		if (i+1)%16 == 0 && i+1 != len(buffer) {
-			pretty += "\n"
+			pretty.WriteByte('\n')
 		}
 	}
 
-	return pretty
+	return pretty.String()
 }
 
 func FileExists(path string) bool {
@@ -0,0 +1,191 @@
+package tester
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"tlesio/tlssl"
+	"tlesio/tlssl/suite"
+	"tlesio/tlssl/suite/ciphersuites"
+)
+
+// NIST SP 800-38C Example 3 (nonce 12 bytes, same as TLS)
+func TestCCMVectors(t *testing.T) {
+
+	key, _ := hex.DecodeString("404142434445464748494a4b4c4d4e4f")
+	nonce, _ := hex.DecodeString("101112131415161718191a1b")
+	aad, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f10111213")
+	plain, _ := hex.DecodeString(
+		"202122232425262728292a2b2c2d2e2f3031323334353637")
+
+	tests := []struct {
+		cs       suite.Suite
+		expected string
+	}{
+		{ciphersuites.NewECDHE_ECDSA_AES_128_CCM_8(),
+			"e3b201a9f5b71a7a9b1ceaeccd97e70b6176aad9a4428aa5" +
+				"484392fbc1b09951"},
+		{ciphersuites.NewECDHE_ECDSA_AES_128_CCM(),
+			"e3b201a9f5b71a7a9b1ceaeccd97e70b6176aad9a4428aa5" +
+				"c87ae488918de93f17dd3e4934347f44"},
+	}
+
+	for _, tt := range tests {
+		ct, err := tt.cs.Cipher(&suite.SuiteContext{
+			Data: plain, Key: key, IV: nonce, AAD: aad})
+		if err != nil {
+			t.Fatalf("%v: %v", tt.cs.Name(), err)
+		}
+
+		if hex.EncodeToString(ct) != tt.expected {
+			t.Fatalf("%v: ciphertext mismatch %x", tt.cs.Name(), ct)
+		}
+
+		pt, err := tt.cs.CipherNot(&suite.SuiteContext{
+			Data: ct, Key: key, IV: nonce, AAD: aad})
+		if err != nil {
+			t.Fatalf("%v: %v", tt.cs.Name(), err)
+		}
+
+		if !bytes.Equal(pt, plain) {
+			t.Errorf("%v: plaintext mismatch %x", tt.cs.Name(), pt)
+		}
+
+		ct[0] ^= 0x01
+		_, err = tt.cs.CipherNot(&suite.SuiteContext{
+			Data: ct, Key: key, IV: nonce, AAD: aad})
+		if err == nil {
+			t.Errorf("%v: tampered record accepted", tt.cs.Name())
+		}
+	}
+}
+
+// RFC 6655: nonce is the 4 bytes salt plus the 8 bytes explicit nonce
+// carried in the record
+func TestAEADRecordCCM(t *testing.T) {
+
+	keys := &tlssl.Keys{
+		Key: bytes.Repeat([]byte{0x42}, 16),
+		IV:  []byte{0x01, 0x02, 0x03, 0x04},
+	}
+
+	cs := ciphersuites.NewECDHE_ECDSA_AES_128_CCM_8()
+	spec := tlssl.NewTLSCipherSpec(cs, keys, tlssl.MODE_MTE,
+		tlssl.TLS_VERSION1_2, nil)
+	if spec == nil {
+		t.Fatal("nil cipher spec")
+	}
+
+	fragment := append([]byte{0x14, 0x00, 0x00, 0x0C}, make([]byte, 12)...)
+	tct, err := spec.EncryptRecord(&tlssl.TLSPlaintext{
+		Header:   &tlssl.TLSHeader{ContentType: tlssl.ContentTypeHandshake},
+		Fragment: fragment,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet, err := tct.Packet(spec.CipherType(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// explicit nonce + ciphertext + 8 bytes tag
+	if len(packet) != tlssl.TLS_HEADER_SIZE+8+len(fragment)+8 {
+		t.Fatalf("unexpected record length %v", len(packet))
+	}
+
+	// One spec per direction, the writer's sequence number is 1 now
+	reader := tlssl.NewTLSCipherSpec(cs, keys, tlssl.MODE_MTE,
+		tlssl.TLS_VERSION1_2, nil)
+	tpt, err := reader.DecryptRecord(&tlssl.TLSCipherText{
+		Header:   tlssl.TLSHead(packet),
+		Fragment: packet[tlssl.TLS_HEADER_SIZE:],
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(tpt.Fragment, fragment) {
+		t.Errorf("plaintext mismatch: %x", tpt.Fragment)
+	}
+}
+
+// Two application data records in a row (sequence numbers 0 and 1) with
+// full and short tags. Expected records from OpenSSL's AES-CCM, the nonce
+// and additional data built as RFC 6655 3 says
+func TestCCMRecordVectors(t *testing.T) {
+
+	keys := &tlssl.Keys{
+		Key: []byte{0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17,
+			0x18, 0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e, 0x1f},
+		IV: []byte{0xa0, 0xa1, 0xa2, 0xa3},
+	}
+
+	plain := []string{"GET / HTTP/1.1\r\n", "ping"}
+	tests := []struct {
+		cs       suite.Suite
+		expected []string
+	}{
+		{ciphersuites.NewECDHE_ECDSA_AES_128_CCM(), []string{
+			"17030300280000000000000000f86605a6c8eaae98edcb36525e6df074" +
+				"a416c99df7b4e27b66e14a8a2f80a268",
+			"170303001c0000000000000001ab7109aa8c3e0be37a8a4c7d7013414a" +
+				"680de7a5",
+		}},
+		{ciphersuites.NewECDHE_ECDSA_AES_128_CCM_8(), []string{
+			"17030300200000000000000000f86605a6c8eaae98edcb36525e6df074" +
+				"d997ed70f3e5d829",
+			"17030300140000000000000001ab7109aa14582171b70b50f4",
+		}},
+	}
+
+	for _, tt := range tests {
+		writer := tlssl.NewTLSCipherSpec(tt.cs, keys, tlssl.MODE_MTE,
+			tlssl.TLS_VERSION1_2, nil)
+		reader := tlssl.NewTLSCipherSpec(tt.cs, keys, tlssl.MODE_MTE,
+			tlssl.TLS_VERSION1_2, nil)
+		if writer == nil || reader == nil {
+			t.Fatalf("%v: nil cipher spec", tt.cs.Name())
+		}
+
+		for i, expected := range tt.expected {
+			tct, err := writer.EncryptRecord(&tlssl.TLSPlaintext{
+				Header: &tlssl.TLSHeader{
+					ContentType: tlssl.ContentTypeApplicationData},
+				Fragment: []byte(plain[i]),
+			})
+
+			if err != nil {
+				t.Fatalf("%v: %v", tt.cs.Name(), err)
+			}
+
+			packet, err := tct.Packet(writer.CipherType(), false)
+			if err != nil {
+				t.Fatalf("%v: %v", tt.cs.Name(), err)
+			}
+
+			if hex.EncodeToString(packet) != expected {
+				t.Errorf("%v: record %v mismatch\n%x\n%v", tt.cs.Name(), i,
+					packet, expected)
+			}
+
+			record, _ := hex.DecodeString(expected)
+			tpt, err := reader.DecryptRecord(&tlssl.TLSCipherText{
+				Header:   tlssl.TLSHead(record),
+				Fragment: record[tlssl.TLS_HEADER_SIZE:],
+			})
+
+			if err != nil {
+				t.Fatalf("%v: record %v: %v", tt.cs.Name(), i, err)
+			}
+
+			if string(tpt.Fragment) != plain[i] {
+				t.Errorf("%v: record %v plaintext %q", tt.cs.Name(), i,
+					tpt.Fragment)
+			}
+		}
+	}
+}
@@ -0,0 +1,394 @@
+package tester
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"tlesio/tlssl"
+	"tlesio/tlssl/client"
+)
+
+// Our client against our server. Covers what crypto/tls can't talk to
+// the server with (see TestInteropCryptoTLS)
+type clientCase struct {
+	name    string
+	env     map[string]string
+	config  func(*tlssl.ClientConfig)
+	version uint16
+	suite   uint16
+	ok      bool
+}
+
+func TestClientDial(t *testing.T) {
+
+	pki := newInteropPKI(t)
+	certs := fmt.Sprintf("%v:%v,%v:%v", pki.serverRSA[0], pki.serverRSA[1],
+		pki.serverEC[0], pki.serverEC[1])
+	pskFile := filepath.Join(t.TempDir(), "psk.txt")
+	os.WriteFile(pskFile, []byte("client1:000102030405060708090a0b0c0d0e0f\n"),
+		0600)
+
+	psk := map[string]string{"TLS_PSK_FILE": pskFile}
+	pskHint := map[string]string{"TLS_PSK_FILE": pskFile,
+		"TLS_PSK_HINT": "fleet"}
+	legacy := map[string]string{"TLS_LEGACY": "true"}
+	require := map[string]string{"TLS_CLIENT_AUTH": "require",
+		"TLS_CLIENT_CA": pki.clientCA}
+	requireLegacy := map[string]string{"TLS_CLIENT_AUTH": "require",
+		"TLS_CLIENT_CA": pki.clientCA, "TLS_LEGACY": "true"}
+	key := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+	tests := []clientCase{
+		// Suites and key exchanges
+		{"ECDHE_RSA_CHACHA20", nil, suites(0xCCA8),
+			tlssl.TLS_VERSION1_2, 0xCCA8, true},
+		{"ECDHE_ECDSA_CHACHA20", nil, suites(0xCCA9),
+			tlssl.TLS_VERSION1_2, 0xCCA9, true},
+		{"ECDHE_ECDSA_AES_128_CCM", nil, suites(0xC0AC),
+			tlssl.TLS_VERSION1_2, 0xC0AC, true},
+		{"ECDHE_ECDSA_AES_128_CCM_8", nil, suites(0xC0AE),
+			tlssl.TLS_VERSION1_2, 0xC0AE, true},
+		{"RSA_AES_256_CBC_SHA256", nil, suites(0x003D),
+			tlssl.TLS_VERSION1_2, 0x003D, true},
+		{"RSA_AES_256_CBC_SHA", nil, suites(0x0035),
+			tlssl.TLS_VERSION1_2, 0x0035, true},
+		{"ECDHE X25519 only", nil,
+			combineClient(suites(0xCCA8), groups(0x001D)),
+			tlssl.TLS_VERSION1_2, 0xCCA8, true},
+		{"ECDHE P-384 only", nil,
+			combineClient(suites(0xCCA8), groups(0x0018)),
+			tlssl.TLS_VERSION1_2, 0xCCA8, true},
+		{"default suites", nil, nil,
+			tlssl.TLS_VERSION1_2, 0xCCA9, true},
+
+		// PSK
+		{"PSK_CHACHA20", psk, pskSuites(key, 0xCCAB),
+			tlssl.TLS_VERSION1_2, 0xCCAB, true},
+		{"PSK_AES_128_CCM with hint", pskHint, pskSuites(key, 0xC0A4),
+			tlssl.TLS_VERSION1_2, 0xC0A4, true},
+		{"PSK_AES_128_CCM_8", psk, pskSuites(key, 0xC0A8),
+			tlssl.TLS_VERSION1_2, 0xC0A8, true},
+		{"DHE_PSK_CHACHA20", psk, pskSuites(key, 0xCCAD),
+			tlssl.TLS_VERSION1_2, 0xCCAD, true},
+		{"DHE_PSK_AES_128_CCM", psk, pskSuites(key, 0xC0A6),
+			tlssl.TLS_VERSION1_2, 0xC0A6, true},
+		{"ECDHE_PSK_CHACHA20", psk, pskSuites(key, 0xCCAC),
+			tlssl.TLS_VERSION1_2, 0xCCAC, true},
+		{"PSK wrong key", psk, pskSuites([]byte("wrong key"), 0xCCAB),
+			0, 0, false},
+		{"PSK unknown identity", psk, func(c *tlssl.ClientConfig) {
+			pskSuites(key, 0xCCAB)(c)
+			c.PSKIdentity = []byte("nobody")
+		}, 0, 0, false},
+
+		// Versions
+		{"TLS 1.1 legacy", legacy, version(tlssl.TLS_VERSION1_1),
+			tlssl.TLS_VERSION1_1, 0x0035, true},
+		{"TLS 1.0 legacy", legacy, version(tlssl.TLS_VERSION1_0),
+			tlssl.TLS_VERSION1_0, 0x0035, true},
+		{"TLS 1.0 legacy off", nil, version(tlssl.TLS_VERSION1_0),
+			0, 0, false},
+
+		// Server authentication
+		{"IP address, no SNI", nil, func(c *tlssl.ClientConfig) {
+			c.ServerName = "127.0.0.1"
+		}, tlssl.TLS_VERSION1_2, 0, true},
+		{"wrong server name", nil, func(c *tlssl.ClientConfig) {
+			c.ServerName = "example.com"
+		}, 0, 0, false},
+		{"unknown roots", nil, func(c *tlssl.ClientConfig) {
+			c.RootCAs = x509.NewCertPool()
+		}, 0, 0, false},
+		{"unknown roots, verification off", nil, func(c *tlssl.ClientConfig) {
+			c.RootCAs = x509.NewCertPool()
+			c.InsecureSkipVerify = true
+		}, tlssl.TLS_VERSION1_2, 0, true},
+
+		// Client authentication
+		{"require, RSA certificate", require,
+			combineClient(suites(0xCCA8), cert(t, pki.clientRSA)),
+			tlssl.TLS_VERSION1_2, 0xCCA8, true},
+		{"require, ECDSA certificate", require,
+			combineClient(suites(0xCCA9), cert(t, pki.clientEC)),
+			tlssl.TLS_VERSION1_2, 0xCCA9, true},
+		{"require, RSA certificate over RSA key exchange", require,
+			combineClient(suites(0x003D), cert(t, pki.clientRSA)),
+			tlssl.TLS_VERSION1_2, 0x003D, true},
+		{"require, TLS 1.0 RSA certificate", requireLegacy,
+			combineClient(version(tlssl.TLS_VERSION1_0),
+				cert(t, pki.clientRSA)),
+			tlssl.TLS_VERSION1_0, 0x0035, true},
+		{"require, TLS 1.1 ECDSA certificate", requireLegacy,
+			combineClient(version(tlssl.TLS_VERSION1_1),
+				cert(t, pki.clientEC)),
+			tlssl.TLS_VERSION1_1, 0x0035, true},
+		{"require, no certificate", require, nil, 0, 0, false},
+		{"require, unknown CA", require, cert(t, pki.clientMiss), 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			addr := startServer(t, certs, tt.env)
+			config := &tlssl.ClientConfig{
+				RootCAs:          pki.roots,
+				ServerName:       "localhost",
+				HandshakeTimeout: 5 * time.Second,
+			}
+
+			if tt.config != nil {
+				tt.config(config)
+			}
+
+			conn, err := clientEcho(addr, config)
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("handshake should have failed")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if conn.Version() != tt.version {
+				t.Errorf("version 0x%04X, expected 0x%04X", conn.Version(),
+					tt.version)
+			}
+
+			if tt.suite != 0 && conn.CipherSuite() != tt.suite {
+				t.Errorf("suite 0x%04X, expected 0x%04X", conn.CipherSuite(),
+					tt.suite)
+			}
+		})
+	}
+}
+
+// Our client against crypto/tls. ALPN is only checked here, the server
+// doesn't do it
+func TestClientCryptoTLS(t *testing.T) {
+
+	pki := newInteropPKI(t)
+	serverRSA, err := tls.LoadX509KeyPair(pki.serverRSA[0], pki.serverRSA[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverEC, err := tls.LoadX509KeyPair(pki.serverEC[0], pki.serverEC[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		server *tls.Config
+		config func(*tlssl.ClientConfig)
+		suite  uint16
+		alpn   string
+		ok     bool
+	}{
+		{"ECDHE_RSA_CHACHA20",
+			&tls.Config{Certificates: []tls.Certificate{serverRSA}},
+			suites(0xCCA8), 0xCCA8, "", true},
+		{"ECDHE_ECDSA_CHACHA20",
+			&tls.Config{Certificates: []tls.Certificate{serverEC}},
+			suites(0xCCA9), 0xCCA9, "", true},
+		{"RSA_AES_256_CBC_SHA",
+			&tls.Config{Certificates: []tls.Certificate{serverRSA},
+				CipherSuites: []uint16{tls.TLS_RSA_WITH_AES_256_CBC_SHA}},
+			suites(0x0035), 0x0035, "", true},
+		{"ALPN",
+			&tls.Config{Certificates: []tls.Certificate{serverRSA},
+				NextProtos: []string{"h2", "http/1.1"}},
+			func(c *tlssl.ClientConfig) {
+				c.ALPN = []string{"http/1.1", "spdy/3"}
+			}, 0, "http/1.1", true},
+		{"ALPN, no common protocol",
+			&tls.Config{Certificates: []tls.Certificate{serverRSA},
+				NextProtos: []string{"h2"}},
+			func(c *tlssl.ClientConfig) {
+				c.ALPN = []string{"spdy/3"}
+			}, 0, "", false},
+		{"client certificate",
+			&tls.Config{Certificates: []tls.Certificate{serverEC},
+				ClientAuth: tls.RequireAndVerifyClientCert,
+				ClientCAs:  pki.roots},
+			cert(t, pki.clientEC), 0, "", true},
+		{"TLS 1.3 only server",
+			&tls.Config{Certificates: []tls.Certificate{serverRSA},
+				MinVersion: tls.VersionTLS13},
+			nil, 0, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			addr := startCryptoTLSEcho(t, tt.server)
+			config := &tlssl.ClientConfig{
+				RootCAs:          pki.roots,
+				ServerName:       "localhost",
+				HandshakeTimeout: 5 * time.Second,
+			}
+
+			if tt.config != nil {
+				tt.config(config)
+			}
+
+			conn, err := clientEcho(addr, config)
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("handshake should have failed")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.suite != 0 && conn.CipherSuite() != tt.suite {
+				t.Errorf("suite 0x%04X, expected 0x%04X", conn.CipherSuite(),
+					tt.suite)
+			}
+
+			if conn.ALPN() != tt.alpn {
+				t.Errorf("ALPN '%v', expected '%v'", conn.ALPN(), tt.alpn)
+			}
+
+			if len(conn.PeerCertificates()) == 0 {
+				t.Errorf("no peer certificates")
+			}
+		})
+	}
+}
+
+// Same exchange as 'dialEcho', then close_notify both ways
+func clientEcho(addr string, config *tlssl.ClientConfig) (client.Conn,
+	error) {
+
+	conn, err := client.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	messages := [][]byte{
+		[]byte("ping"),
+		bytes.Repeat([]byte("0123456789abcdef"), 1100),
+		[]byte("pong"),
+	}
+
+	for _, msg := range messages {
+		if _, err = conn.Write(msg); err != nil {
+			return conn, err
+		}
+
+		echo := make([]byte, len(msg))
+		if _, err = io.ReadFull(conn, echo); err != nil {
+			return conn, err
+		}
+
+		if !bytes.Equal(echo, msg) {
+			return conn, errors.New("echo mismatch")
+		}
+	}
+
+	if err = conn.CloseWrite(); err != nil {
+		return conn, err
+	}
+
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		return conn, fmt.Errorf("expected close_notify, got %v", err)
+	}
+
+	return conn, nil
+}
+
+// crypto/tls echo server, one connection at a time
+func startCryptoTLSEcho(t *testing.T, config *tls.Config) string {
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			io.Copy(conn, conn)
+			conn.Close()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func suites(ids ...uint16) func(*tlssl.ClientConfig) {
+
+	return func(c *tlssl.ClientConfig) {
+		c.CipherSuites = ids
+	}
+}
+
+func groups(ids ...uint16) func(*tlssl.ClientConfig) {
+
+	return func(c *tlssl.ClientConfig) {
+		c.Groups = ids
+	}
+}
+
+func pskSuites(key []byte, ids ...uint16) func(*tlssl.ClientConfig) {
+
+	return func(c *tlssl.ClientConfig) {
+		c.CipherSuites = ids
+		c.PSKIdentity = []byte("client1")
+		c.PSK = key
+	}
+}
+
+func version(v uint16) func(*tlssl.ClientConfig) {
+
+	return func(c *tlssl.ClientConfig) {
+		c.MinVersion = v
+		c.MaxVersion = v
+	}
+}
+
+func cert(t *testing.T, cert tls.Certificate) func(*tlssl.ClientConfig) {
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return func(c *tlssl.ClientConfig) {
+		c.Certificates = []*x509.Certificate{leaf}
+		c.PrivateKey = cert.PrivateKey
+	}
+}
+
+func combineClient(configs ...func(*tlssl.ClientConfig)) func(
+	*tlssl.ClientConfig) {
+
+	return func(c *tlssl.ClientConfig) {
+		for _, config := range configs {
+			config(c)
+		}
+	}
+}
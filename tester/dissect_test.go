@@ -0,0 +1,224 @@
+package tester
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"tlesio/tlssl"
+	"tlesio/tlssl/capture"
+	"tlesio/tlssl/dissect"
+)
+
+// Golden transcripts dissect into the messages the server sent, the same
+// from raw bytes, hex or a capture
+func TestDissectGolden(t *testing.T) {
+
+	path := filepath.Join(_GOLDEN_DIR_, "rsa_aes_256_cbc_sha256")
+	client, err := os.ReadFile(path + ".client")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := os.ReadFile(path + ".server")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := dissect.Dissect(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types := dissectTypes(records)
+	expected := "ServerHello Certificate ServerHelloDone ChangeCipherSpec " +
+		"encrypted"
+	if types != expected {
+		t.Fatalf("expected %v, got %v", expected, types)
+	}
+
+	hello := records[0].Messages[0].Hello
+	if len(hello.CipherSuites) != 1 || hello.CipherSuites[0].ID != 0x003D ||
+		hello.CipherSuites[0].Name != "TLS_RSA_WITH_AES_256_CBC_SHA256" {
+		t.Errorf("ServerHello cipher suite: %+v", hello.CipherSuites)
+	}
+
+	certs := records[1].Messages[0].Certificates
+	if len(certs) != 1 || certs[0].Subject != "CN=localhost" {
+		t.Errorf("certificates: %+v", certs)
+	}
+
+	// Hex, as pasted from a log
+	var pasted []string
+
+	for _, b := range server {
+		pasted = append(pasted, hex.EncodeToString([]byte{b}))
+	}
+
+	fromHex, err := dissect.Dissect([]byte(" " + strings.Join(pasted, ":")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dissectJSON(t, fromHex) != dissectJSON(t, records) {
+		t.Errorf("hex and raw dissections differ")
+	}
+
+	// Both directions of a capture, one record per entry
+	var lines bytes.Buffer
+
+	enc := json.NewEncoder(&lines)
+	cli, srv := splitRecordsTest(client), splitRecordsTest(server)
+	enc.Encode(&capture.Entry{ConnID: 7, Dir: capture.DirIn, Data: cli[0]})
+	for _, record := range srv {
+		enc.Encode(&capture.Entry{ConnID: 7, Dir: capture.DirOut,
+			Data: record})
+	}
+
+	enc.Encode(&capture.Entry{ConnID: 7, Dir: capture.DirRand,
+		Data: []byte{1, 2, 3}})
+	for _, record := range cli[1:] {
+		enc.Encode(&capture.Entry{ConnID: 7, Dir: capture.DirIn,
+			Data: record})
+	}
+
+	records, err = dissect.Dissect(lines.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types = dissectTypes(records)
+	expected = "ClientHello " + expected + " ClientKeyExchange " +
+		"ChangeCipherSpec encrypted"
+	if types != expected {
+		t.Fatalf("expected %v, got %v", expected, types)
+	}
+
+	for _, record := range records {
+		if record.ConnID != 7 || record.Time == nil ||
+			(record.Dir != "in" && record.Dir != "out") {
+			t.Errorf("record %v: conn %v, dir %v", record.Index,
+				record.ConnID, record.Dir)
+		}
+	}
+
+	// A message split by the end of the input is reported
+	records = dissect.Records(client[:50])
+	if len(records) != 1 || records[0].Error == "" {
+		t.Errorf("truncated ClientHello: %v", records)
+	}
+
+	if _, err := dissect.Dissect([]byte("not hex")); err == nil {
+		t.Errorf("garbage dissected")
+	}
+}
+
+// Every ClientHello field of a crypto/tls client, extensions it sends that
+// this server doesn't handle named all the same
+func TestDissectClientHello(t *testing.T) {
+
+	srvConn, cliConn := net.Pipe()
+	defer srvConn.Close()
+	go tls.Client(cliConn, &tls.Config{ServerName: "example.com",
+		MaxVersion: tls.VersionTLS12}).Handshake()
+
+	header, fragment, err := tlssl.ReadRecord(srvConn)
+	cliConn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := dissect.Records(append(tlssl.TLSHeadPacket(header),
+		fragment...))
+	if len(records) != 1 || len(records[0].Messages) != 1 ||
+		records[0].Messages[0].Hello == nil {
+		t.Fatalf("no ClientHello: %v", records)
+	}
+
+	hello := records[0].Messages[0].Hello
+	if records[0].Messages[0].Error != "" || len(hello.CipherSuites) == 0 ||
+		len(hello.Random) != 64 || hello.Compression != "00" {
+		t.Fatalf("ClientHello: %v", records[0])
+	}
+
+	if out := dissectJSON(t, records); !strings.Contains(out,
+		`"compression_methods":"00"`) {
+		t.Errorf("compression methods not hex: %v", out)
+	}
+
+	names := make(map[uint16]*dissect.Extension)
+	for _, ext := range hello.Extensions {
+		if ext.Name == "" {
+			t.Errorf("extension 0x%04X has no name", ext.ID)
+		}
+
+		names[ext.ID] = ext
+	}
+
+	if sni := names[0x0000]; sni == nil ||
+		!strings.Contains(sni.Detail, "example.com") {
+		t.Errorf("server_name: %+v", sni)
+	}
+
+	// Not registered with the server
+	if ems := names[0x0017]; ems == nil ||
+		ems.Name != "extended_master_secret" || ems.Detail != "" {
+		t.Errorf("extended_master_secret: %+v", ems)
+	}
+
+	text := records[0].String()
+	for _, cs := range hello.CipherSuites {
+		if !strings.Contains(text, cs.Name) {
+			t.Errorf("cipher suite %v missing from the text output", cs.Name)
+		}
+	}
+}
+
+// Content type, handshake types or "encrypted", one per record
+func dissectTypes(records []*dissect.Record) string {
+
+	var types []string
+
+	for _, record := range records {
+		switch {
+		case record.Encrypted:
+			types = append(types, "encrypted")
+		case len(record.Messages) == 0:
+			types = append(types, record.ContentType)
+		}
+
+		for _, msg := range record.Messages {
+			types = append(types, msg.Type)
+		}
+	}
+
+	return strings.Join(types, " ")
+}
+
+func dissectJSON(t *testing.T, records []*dissect.Record) string {
+
+	out, err := json.Marshal(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(out)
+}
+
+func splitRecordsTest(buff []byte) [][]byte {
+
+	var records [][]byte
+
+	for len(buff) >= tlssl.TLS_HEADER_SIZE {
+		recLen := tlssl.TLS_HEADER_SIZE + (int(buff[3])<<8 | int(buff[4]))
+		records = append(records, buff[:recLen])
+		buff = buff[recLen:]
+	}
+
+	return records
+}
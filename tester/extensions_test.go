@@ -0,0 +1,185 @@
+package tester
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"tlesio/tlssl"
+	"tlesio/tlssl/dissect"
+	ex "tlesio/tlssl/extensions"
+)
+
+// Extension for tests. Answers with what the client sent, or fails
+type xTestExt struct {
+	id       uint16
+	messages ex.Messages
+	err      error
+	suite    uint16 // Seen while negotiating
+}
+
+func (x *xTestExt) ID() uint16                  { return x.id }
+func (x *xTestExt) Name() string                { return "test" }
+func (x *xTestExt) Messages() ex.Messages       { return x.messages }
+func (x *xTestExt) PrintRaw(data []byte) string { return "" }
+func (x *xTestExt) LoadData(data []byte, sz int) (*[]byte, error) {
+	return &data, nil
+}
+
+func (x *xTestExt) Negotiate(data *[]byte, state ex.State) ([]byte,
+	error) {
+
+	x.suite = state.CipherSuite()
+	if x.err != nil || data == nil {
+		return nil, x.err
+	}
+
+	echo := *data
+	answer := []byte{byte(x.id >> 8), byte(x.id), 0, byte(len(echo))}
+	return append(answer, echo...), nil
+}
+
+// ServerHello extensions come in registration order, each one negotiated
+// once the cipher suite is known. Bad ClientHello extensions get the
+// alert they deserve
+func TestExtensionNegotiation(t *testing.T) {
+
+	reneg := helloExt(0xFF01, 0x00)
+	points := helloExt(0x000B, 0x01, 0x00)
+	tests := []struct {
+		name    string
+		suite   uint16
+		exts    [][]byte
+		test    *xTestExt
+		answers string // ServerHello extensions, in order
+		alert   tlssl.AlertDescriptionType
+	}{
+		{"registration order", 0x003D,
+			[][]byte{helloExt(0x00FA, 1, 2), reneg, points},
+			&xTestExt{id: 0x00FA,
+				messages: ex.MsgClientHello | ex.MsgServerHello},
+			"ec_point_formats renegotiation_info unknown", 0},
+		{"not for ServerHello", 0x003D,
+			[][]byte{helloExt(0x00FA, 1, 2), points},
+			&xTestExt{id: 0x00FA, messages: ex.MsgClientHello},
+			"ec_point_formats renegotiation_info", 0},
+		{"encrypt_then_mac with CBC", 0x003D,
+			[][]byte{helloExt(0x0016), points}, nil,
+			"ec_point_formats renegotiation_info encrypt_then_mac", 0},
+		{"encrypt_then_mac with AEAD", 0xCCAB,
+			[][]byte{helloExt(0x0016)}, nil, "renegotiation_info", 0},
+		{"duplicated extension", 0x003D,
+			[][]byte{points, reneg, points}, nil, "",
+			tlssl.AlertIllegalParameter},
+		{"not for ClientHello", 0x003D,
+			[][]byte{helloExt(0x00FA)},
+			&xTestExt{id: 0x00FA, messages: ex.MsgServerHello}, "",
+			tlssl.AlertIllegalParameter},
+		{"negotiation fails", 0x003D, nil,
+			&xTestExt{id: 0x00FA, messages: ex.MsgServerHello,
+				err: fmt.Errorf("no: %w", ex.ErrIllegalParameter)}, "",
+			tlssl.AlertIllegalParameter},
+		{"renegotiation attempt", 0x003D,
+			[][]byte{helloExt(0xFF01, 0x02, 0xAA, 0xBB)}, nil, "",
+			tlssl.AlertHandshakeFailure},
+		{"no common cipher suite", 0x1301, nil, nil, "",
+			tlssl.AlertHandshakeFailure},
+		{"truncated server_name", 0x003D,
+			[][]byte{helloExt(0x0000, 0x00, 0x06, 0x00, 0x00, 0x03, 'a')},
+			nil, "", tlssl.AlertDecodeError},
+		{"truncated supported_groups", 0x003D,
+			[][]byte{helloExt(0x000A, 0x00, 0x04, 0x00, 0x17)}, nil, "",
+			tlssl.AlertDecodeError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var alertErr *tlssl.AlertError
+
+			tCtx := goldenContext(t, io.Discard)
+			ex.Register(tCtx.Exts, ex.NewExtEncryptThenMac())
+			if tt.test != nil {
+				ex.Register(tCtx.Exts, tt.test)
+			}
+
+			conn := &xReplayConn{in: clientHelloRecord(tt.suite, tt.exts...)}
+			err := replayGolden(tCtx, conn)
+			if tt.alert != 0 {
+				if !errors.As(err, &alertErr) ||
+					alertErr.Description != tt.alert {
+					t.Fatalf("expected %v alert, got %v", tt.alert, err)
+				}
+
+				return
+			}
+
+			records := dissect.Records(conn.out.Bytes())
+			if len(records) == 0 || len(records[0].Messages) == 0 ||
+				records[0].Messages[0].Hello == nil {
+				t.Fatalf("no ServerHello: %v (%v)", records, err)
+			}
+
+			var names []string
+
+			for _, ext := range records[0].Messages[0].Hello.Extensions {
+				names = append(names, ext.Name)
+			}
+
+			if strings.Join(names, " ") != tt.answers {
+				t.Errorf("expected %v, got %v", tt.answers, names)
+			}
+
+			if tt.test != nil &&
+				tt.test.messages&ex.MsgServerHello != 0 &&
+				tt.test.suite != tt.suite {
+				t.Errorf("negotiated before the suite was chosen")
+			}
+		})
+	}
+}
+
+// Versions below TLS 1.2 are refused with protocol_version unless legacy
+// mode is on
+func TestHelloVersionAlert(t *testing.T) {
+
+	for _, version := range []uint16{tlssl.TLS_VERSION1_0, 0x0300} {
+		var alertErr *tlssl.AlertError
+
+		record := clientHelloRecord(0x003D)
+		record[9], record[10] = byte(version>>8), byte(version)
+		err := replayGolden(goldenContext(t, io.Discard),
+			&xReplayConn{in: record})
+		if !errors.As(err, &alertErr) ||
+			alertErr.Description != tlssl.AlertProtocolVersion {
+			t.Errorf("version 0x%04X: expected protocol_version, got %v",
+				version, err)
+		}
+	}
+}
+
+// Client hello record offering 'suite' with 'exts' (whole extensions)
+func clientHelloRecord(suite uint16, exts ...[]byte) []byte {
+
+	var body, block []byte
+
+	body = append(body, 0x03, 0x03)
+	body = append(body, make([]byte, 32)...)
+	body = append(body, 0x00, 0x00, 0x02, byte(suite>>8), byte(suite))
+	body = append(body, 0x01, 0x00)
+	for _, ext := range exts {
+		block = append(block, ext...)
+	}
+
+	body = append(body, byte(len(block)>>8), byte(len(block)))
+	body = append(body, block...)
+	return append(tlssl.TLSHeadsHandShakePacket(tlssl.HandshakeTypeClientHello,
+		len(body), tlssl.TLS_VERSION1_2), body...)
+}
+
+func helloExt(id uint16, data ...byte) []byte {
+
+	ext := []byte{byte(id >> 8), byte(id), byte(len(data) >> 8),
+		byte(len(data))}
+	return append(ext, data...)
+}
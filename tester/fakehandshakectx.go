@@ -2,7 +2,9 @@ package tester
 
 import (
 	"net"
+	"tlesio/tlssl"
 	"tlesio/tlssl/handshake"
+	"tlesio/tlssl/suite"
 
 	clog "github.com/julinox/consolelogrus"
 	"github.com/sirupsen/logrus"
@@ -14,10 +16,10 @@ type testHandshakeCtx struct {
 }
 
 type testHandshakeCtxData struct {
-	expected int
-	stage    int
-	order    []int
-	comms    net.Conn
+	stage      int
+	order      []int
+	comms      net.Conn
+	transcript handshake.Transcript
 }
 
 func testCtxHandshake(data *testHandshakeCtxData) handshake.HandShakeContext {
@@ -26,11 +28,19 @@ func testCtxHandshake(data *testHandshakeCtxData) handshake.HandShakeContext {
 		return nil
 	}
 
+	if data.transcript == nil {
+		data.transcript, _ = handshake.NewTranscript(suite.SHA256)
+	}
+
 	return &testHandshakeCtx{
 		data: data,
 	}
 }
 
+func (x *testHandshakeCtx) Transcript() handshake.Transcript {
+	return x.data.transcript
+}
+
 func (x *testHandshakeCtx) GetTransitionStage() int {
 	return x.data.stage
 }
@@ -39,45 +49,27 @@ func (x *testHandshakeCtx) SetTransitionStage(s int) {
 	x.data.stage = s
 }
 
-func (x *testHandshakeCtx) GetComms() net.Conn {
-	return x.data.comms
+func (x *testHandshakeCtx) SetBuffer(int, []byte) {
 }
 
-func (x *testHandshakeCtx) Order() []int {
-	return x.data.order
+func (x *testHandshakeCtx) GetVersion() uint16 {
+	return tlssl.TLS_VERSION1_2
 }
 
-func (x *testHandshakeCtx) PrintOrder() string {
-	return handshake.HandshakeNameList(x.data.order)
+func (x *testHandshakeCtx) GetConnID() uint64 {
+	return 0
 }
 
-func (x *testHandshakeCtx) Expected() int {
-	return x.data.expected
+func (x *testHandshakeCtx) GetComms() net.Conn {
+	return x.data.comms
 }
 
-func (x *testHandshakeCtx) UnAppendExpected(op int) {
-	x.data.expected &= ^op
+func (x *testHandshakeCtx) Order() []int {
+	return x.data.order
 }
 
-func (x *testHandshakeCtx) PrintExpected() string {
-
-	var expected []int
-
-	allExpected := []int{
-		handshake.CERTIFICATE,
-		handshake.CLIENTKEYEXCHANGE,
-		handshake.CERTIFICATEVERIFY,
-		handshake.CHANGECIPHERSPEC,
-		handshake.FINISHED,
-	}
-
-	for _, v := range allExpected {
-		if x.data.expected&v != 0 {
-			expected = append(expected, v)
-		}
-	}
-
-	return handshake.HandshakeNameList(expected)
+func (x *testHandshakeCtx) PrintOrder() string {
+	return handshake.HandshakeNameList(x.data.order)
 }
 
 func (x *testHandshakeCtx) SendCtxBuff([]int) error {
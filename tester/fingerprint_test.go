@@ -0,0 +1,61 @@
+package tester
+
+import (
+	"testing"
+	"tlesio/tlssl/handshake"
+)
+
+// JA4 technical details example (Chrome). GREASE values sprinkled in, they
+// must not change anything
+func TestFingerprintJA4(t *testing.T) {
+
+	hello := &handshake.MsgHello{
+		Version: [2]byte{0x03, 0x03},
+		CipherSuites: []uint16{0x2A2A, 0x1301, 0x1302, 0x1303, 0xC02B,
+			0xC02F, 0xC02C, 0xC030, 0xCCA9, 0xCCA8, 0xC013, 0xC014, 0x009C,
+			0x009D, 0x002F, 0x0035},
+		ExtensionIDs: []uint16{0x3A3A, 0x0000, 0x0017, 0xFF01, 0x000A,
+			0x000B, 0x0023, 0x0010, 0x0005, 0x000D, 0x0012, 0x0033, 0x002D,
+			0x002B, 0x001B, 0x4469, 0x0015},
+		SignAlgos: []uint16{0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501,
+			0x0806, 0x0601},
+		SupportedVersions: []uint16{0x5A5A, 0x0304, 0x0303},
+		ALPN:              []string{"h2", "http/1.1"},
+	}
+
+	expected := "t13d1516h2_8daaf6152771_e5627efa2ab1"
+	if ja4 := hello.JA4(); ja4 != expected {
+		t.Errorf("JA4 mismatch: %v, expected %v", ja4, expected)
+	}
+
+	// No SNI, no ALPN, no extensions at all
+	hello = &handshake.MsgHello{
+		Version:      [2]byte{0x03, 0x03},
+		CipherSuites: []uint16{0x002F},
+	}
+
+	expected = "t12i010000_ba72b8082249_000000000000"
+	if ja4 := hello.JA4(); ja4 != expected {
+		t.Errorf("JA4 mismatch: %v, expected %v", ja4, expected)
+	}
+}
+
+func TestFingerprintJA3(t *testing.T) {
+
+	hello := &handshake.MsgHello{
+		Version:      [2]byte{0x03, 0x03},
+		CipherSuites: []uint16{0x0A0A, 0xC02B, 0xC02F, 0x009C},
+		ExtensionIDs: []uint16{0x1A1A, 0x0000, 0x000A, 0x000B, 0x000D},
+		Groups:       []uint16{0x2A2A, 0x001D, 0x0017},
+		PointFormats: []uint8{0x00},
+	}
+
+	expected := "771,49195-49199-156,0-10-11-13,29-23,0"
+	if ja3 := hello.JA3(); ja3 != expected {
+		t.Errorf("JA3 mismatch: %v, expected %v", ja3, expected)
+	}
+
+	if len(hello.JA3Hash()) != 32 {
+		t.Errorf("JA3 hash: %v", hello.JA3Hash())
+	}
+}
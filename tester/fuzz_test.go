@@ -0,0 +1,283 @@
+package tester
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"tlesio/tlssl"
+	"tlesio/tlssl/dissect"
+	ex "tlesio/tlssl/extensions"
+	"tlesio/tlssl/handshake"
+	mx "tlesio/tlssl/modulos"
+	"tlesio/tlssl/suite"
+	"tlesio/tlssl/suite/ciphersuites"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ClientHello records captured off the wire from real clients (curl,
+// Go crypto/tls, OpenSSL 1.2 and 1.3 offers, Python ssl)
+const _HELLO_SEEDS_ = "testdata/clienthello/*.bin"
+
+// Fuzzing must not panic. Errors are fine, every target ignores them
+
+func FuzzTLSRecordsDecode(f *testing.F) {
+
+	for _, seed := range helloSeeds(f) {
+		f.Add(seed)
+	}
+
+	buff := certificate()
+	buff = append(buff, changeCipherSpec()...)
+	buff = append(buff, clientKeyExchange()...)
+	buff = append(buff, finished()...)
+	f.Add(buff)
+	f.Add([]byte{0x16, 0x03, 0x03, 0x00, 0x01, 0x01})
+	f.Fuzz(func(t *testing.T, data []byte) {
+
+		records, err := tlssl.TLSRecordsDecode(data)
+		if err != nil {
+			return
+		}
+
+		for _, record := range records {
+			if len(record.Msg) != tlssl.TLS_HEADER_SIZE+record.Header.Len {
+				t.Fatalf("record len %v, header says %v", len(record.Msg),
+					record.Header.Len)
+			}
+		}
+	})
+}
+
+func FuzzClientHello(f *testing.F) {
+
+	for _, seed := range helloSeeds(f) {
+		f.Add(seed)
+	}
+
+	tCtx := &tlssl.TLSContext{Lg: fuzzLogger()}
+	tCtx.Exts = ex.NewExtensions(tCtx.Lg)
+	ex.Register(tCtx.Exts, ex.NewExtSignAlgo())
+	ex.Register(tCtx.Exts, ex.NewExtSessionTicket())
+	ex.Register(tCtx.Exts, ex.NewExtSNI())
+	ex.Register(tCtx.Exts, ex.NewExtSupportedGroups())
+	ex.Register(tCtx.Exts, ex.NewExtECPointFormats())
+	ex.Register(tCtx.Exts, ex.NewExtRenegotiation())
+	srv, cli := net.Pipe()
+	defer srv.Close()
+	defer cli.Close()
+	f.Fuzz(func(t *testing.T, data []byte) {
+
+		hCtx := handshake.NewHandShakeContext(tCtx.Lg, srv)
+		hCtx.SetBuffer(handshake.CLIENTHELLO, data)
+		err := handshake.NewClientHello(&handshake.AllContexts{
+			Hctx: hCtx, Tctx: tCtx}).Handle()
+		if err != nil {
+			return
+		}
+
+		hello := hCtx.GetMsgHello()
+		hello.JA3Hash()
+		hello.JA4()
+	})
+}
+
+// The dissector sees whatever tlsdump is given
+func FuzzDissect(f *testing.F) {
+
+	for _, seed := range helloSeeds(f) {
+		f.Add(seed)
+	}
+
+	f.Add(certificate())
+	f.Add(append(changeCipherSpec(), finished()...))
+	f.Fuzz(func(t *testing.T, data []byte) {
+
+		for _, record := range dissect.Records(data) {
+			_ = record.String()
+			if _, err := json.Marshal(record); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
+
+func FuzzExtSNI(f *testing.F) {
+
+	for _, seed := range helloSeeds(f) {
+		if data, ok := helloExtensions(seed)[0x0000]; ok {
+			f.Add(data)
+		}
+	}
+
+	f.Add([]byte{0x00, 0x03, 0x00, 0x00, 0x00})
+	sni := ex.NewExtSNI()
+	f.Fuzz(func(t *testing.T, data []byte) {
+
+		sni.LoadData(data, len(data))
+		sni.PrintRaw(data)
+	})
+}
+
+func FuzzExtSignAlgo(f *testing.F) {
+
+	for _, seed := range helloSeeds(f) {
+		if data, ok := helloExtensions(seed)[0x000D]; ok {
+			f.Add(data)
+		}
+	}
+
+	f.Add([]byte{0x00, 0x01, 0x04})
+	signAlgo := ex.NewExtSignAlgo()
+	f.Fuzz(func(t *testing.T, data []byte) {
+
+		xdata, err := signAlgo.LoadData(data, len(data))
+		signAlgo.PrintRaw(data)
+		if err != nil {
+			return
+		}
+
+		if int(xdata.Len) != len(xdata.Algos) {
+			t.Fatalf("Len %v, %v algorithms", xdata.Len, len(xdata.Algos))
+		}
+	})
+}
+
+// 'kx' picks the negotiated suite: plain PSK, DHE_PSK, ECDHE_PSK or ECDHE
+func FuzzClientKeyExchange(f *testing.F) {
+
+	suites := []uint16{0xC0A4, 0xC0A6, 0xCCAC, 0xCCA8}
+	store, _ := tlssl.NewPSKStore(nil, map[string][]byte{
+		"client1": {0x1a, 0x2b, 0x3c}})
+	tCtx := &tlssl.TLSContext{
+		Lg:   fuzzLogger(),
+		Modz: mx.NewModuloZ(),
+		PSK:  store,
+	}
+
+	tCtx.Modz.InitTLSSuite(tCtx.Lg, []suite.Suite{
+		ciphersuites.NewPSK_AES_128_CCM(),
+		ciphersuites.NewDHE_PSK_AES_128_CCM(),
+		ciphersuites.NewECDHE_PSK_CHACHA20_POLY1305_SHA256(),
+		ciphersuites.NewECDHE_RSA_CHACHA20_POLY1305_SHA256(),
+	})
+
+	ecdhKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	dhKey := new(big.Int).Lsh(big.NewInt(0x1337), 200)
+	identity := append([]byte{0x00, 0x07}, "client1"...)
+	point := ecdhKey.PublicKey().Bytes()
+	ecPoint := append([]byte{byte(len(point))}, point...)
+	f.Add(uint8(0), cke(identity))
+	f.Add(uint8(1), cke(append(identity, 0x00, 0x01, 0x02)))
+	f.Add(uint8(2), cke(append(identity, ecPoint...)))
+	f.Add(uint8(3), cke(ecPoint))
+	srv, cli := net.Pipe()
+	defer srv.Close()
+	defer cli.Close()
+	f.Fuzz(func(t *testing.T, kx uint8, data []byte) {
+
+		hCtx := handshake.NewHandShakeContext(tCtx.Lg, srv)
+		hCtx.SetCipherSuite(suites[int(kx)%len(suites)])
+		hCtx.SetECDHKey(ecdhKey)
+		hCtx.SetDHKey(dhKey)
+		hCtx.SetBuffer(handshake.CLIENTKEYEXCHANGE, data)
+		handshake.NewClientKeyExchange(&handshake.AllContexts{
+			Hctx: hCtx, Tctx: tCtx}).Handle()
+	})
+}
+
+// Whole ClientKeyExchange record around 'body'
+func cke(body []byte) []byte {
+
+	header := tlssl.TLSHeadsHandShakePacket(
+		tlssl.HandshakeTypeClientKeyExchange, len(body), tlssl.TLS_VERSION1_2)
+	return append(header, body...)
+}
+
+func helloSeeds(f *testing.F) [][]byte {
+
+	var seeds [][]byte
+
+	paths, err := filepath.Glob(_HELLO_SEEDS_)
+	if err != nil || len(paths) == 0 {
+		f.Fatalf("no ClientHello seeds(%v)", _HELLO_SEEDS_)
+	}
+
+	for _, path := range paths {
+		seed, err := os.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+
+		seeds = append(seeds, seed)
+	}
+
+	return seeds
+}
+
+// Extension ID -> data of a well formed ClientHello record
+func helloExtensions(record []byte) map[uint16][]byte {
+
+	exts := make(map[uint16][]byte)
+	// Record and handshake headers, version, random
+	offset := tlssl.TLS_HEADER_SIZE + tlssl.TLS_HANDSHAKE_SIZE + 2 + 32
+	offset += 1 + int(record[offset])
+	offset += 2 + int(binary.BigEndian.Uint16(record[offset:]))
+	offset += 1 + int(record[offset])
+	offset += 2
+	for offset+4 <= len(record) {
+		extID := binary.BigEndian.Uint16(record[offset:])
+		extLen := int(binary.BigEndian.Uint16(record[offset+2:]))
+		exts[extID] = record[offset+4 : offset+4+extLen]
+		offset += 4 + extLen
+	}
+
+	return exts
+}
+
+func fuzzLogger() *logrus.Logger {
+
+	lg := logrus.New()
+	lg.SetOutput(io.Discard)
+	return lg
+}
+
+// Every captured hello is well formed and must go through
+func TestClientHelloCaptured(t *testing.T) {
+
+	tCtx := &tlssl.TLSContext{Lg: fuzzLogger()}
+	tCtx.Exts = ex.NewExtensions(tCtx.Lg)
+	ex.Register(tCtx.Exts, ex.NewExtSignAlgo())
+	ex.Register(tCtx.Exts, ex.NewExtSNI())
+	srv, cli := net.Pipe()
+	defer srv.Close()
+	defer cli.Close()
+	paths, _ := filepath.Glob(_HELLO_SEEDS_)
+	for _, path := range paths {
+		seed, _ := os.ReadFile(path)
+		hCtx := handshake.NewHandShakeContext(tCtx.Lg, srv)
+		hCtx.SetBuffer(handshake.CLIENTHELLO, seed)
+		err := handshake.NewClientHello(&handshake.AllContexts{
+			Hctx: hCtx, Tctx: tCtx}).Handle()
+		if err != nil {
+			t.Errorf("%v: %v", filepath.Base(path), err)
+			continue
+		}
+
+		hello := hCtx.GetMsgHello()
+		if _, ok := hello.Extensions[0x000D]; !ok {
+			t.Errorf("%v: signature_algorithms not loaded", filepath.Base(path))
+		}
+	}
+}
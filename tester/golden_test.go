@@ -0,0 +1,309 @@
+package tester
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"flag"
+	"io"
+	"math/big"
+	mrand "math/rand/v2"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"tlesio/server"
+	"tlesio/tlssl"
+	"tlesio/tlssl/client"
+	ex "tlesio/tlssl/extensions"
+	"tlesio/tlssl/handshake"
+	mx "tlesio/tlssl/modulos"
+	"tlesio/tlssl/suite"
+	"tlesio/tlssl/suite/ciphersuites"
+)
+
+// Recorded client bytes (<case>.client) and what the server answered
+// (<case>.server), plus the server certificate both were made with
+const _GOLDEN_DIR_ = "testdata/golden"
+
+var updateGolden = flag.Bool("update", false,
+	"record new client transcripts and server golden files")
+
+var (
+	goldenTime = time.Date(2025, time.March, 1, 12, 0, 0, 0, time.UTC)
+	goldenSeed = [32]byte([]byte("tlesio golden handshake seed 01!"))
+)
+
+// Same seed, same clock, same client bytes: the server must answer the
+// very same bytes. Run with -update after a deliberate wire change
+func TestGoldenHandshake(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		suite uint16
+	}{
+		{"rsa_aes_256_cbc_sha256", 0x003D},
+		{"rsa_aes_256_cbc_sha", 0x0035},
+		{"psk_chacha20_poly1305", 0xCCAB},
+		{"dhe_psk_aes_128_ccm", 0xC0A6},
+	}
+
+	if *updateGolden {
+		goldenCert(t)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(_GOLDEN_DIR_, tt.name)
+			if *updateGolden {
+				recordGolden(t, path, tt.suite)
+			}
+
+			transcript, err := os.ReadFile(path + ".client")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected, err := os.ReadFile(path + ".server")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var trace bytes.Buffer
+
+			conn := &xReplayConn{in: transcript}
+			err = replayGolden(goldenContext(t, &trace), conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(conn.out.Bytes(), expected) {
+				t.Fatalf("server output differs from %v.server:\n%x",
+					path, conn.out.Bytes())
+			}
+
+			for _, line := range strings.Split(trace.String(), "\n") {
+				var ev struct {
+					Event string    `json:"event"`
+					Time  time.Time `json:"time"`
+				}
+
+				if line == "" || json.Unmarshal([]byte(line), &ev) != nil ||
+					ev.Event != "handshake_done" {
+					continue
+				}
+
+				if !ev.Time.Equal(goldenTime) {
+					t.Errorf("event not stamped with the clock: %v", line)
+				}
+			}
+		})
+	}
+}
+
+// Server state machine over a recorded transcript, ClientHello first
+func replayGolden(tCtx *tlssl.TLSContext, conn *xReplayConn) error {
+
+	header, fragment, err := tlssl.ReadRecord(conn)
+	if err != nil {
+		return err
+	}
+
+	handle, err := server.Handle(tCtx, conn, 1)
+	if err != nil {
+		return err
+	}
+
+	return handle.LetsTalk(append(tlssl.TLSHeadPacket(header), fragment...))
+}
+
+// Our client against a deterministic server. The client is free to use
+// real randomness, its bytes are what gets replayed
+func recordGolden(t *testing.T, path string, id uint16) {
+
+	srvConn, cliConn := net.Pipe()
+	defer srvConn.Close()
+	defer cliConn.Close()
+
+	srv := &xRecordConn{Conn: srvConn}
+	cli := &xRecordConn{Conn: cliConn}
+	done := make(chan error, 1)
+	go func() {
+		header, fragment, err := tlssl.ReadRecord(srv)
+		if err != nil {
+			done <- err
+			return
+		}
+
+		handle, err := server.Handle(goldenContext(t, io.Discard), srv, 1)
+		if err != nil {
+			done <- err
+			return
+		}
+
+		done <- handle.LetsTalk(append(tlssl.TLSHeadPacket(header),
+			fragment...))
+	}()
+
+	config := &tlssl.ClientConfig{
+		InsecureSkipVerify: true,
+		CipherSuites:       []uint16{id},
+		PSKIdentity:        []byte("client1"),
+		PSK:                goldenPSK(),
+	}
+
+	if _, err := client.NewConn(cli, config); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	err := os.WriteFile(path+".client", cli.out.Bytes(), 0644)
+	if err == nil {
+		err = os.WriteFile(path+".server", srv.out.Bytes(), 0644)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Server context as server/init.go builds it, randomness and clock fixed
+func goldenContext(t *testing.T, trace io.Writer) *tlssl.TLSContext {
+
+	lg := testLogger()
+	lg.SetOutput(io.Discard)
+	store, err := tlssl.NewPSKStore(nil,
+		map[string][]byte{"client1": goldenPSK()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tCtx := &tlssl.TLSContext{
+		Lg:     lg,
+		Modz:   mx.NewModuloZ(),
+		Exts:   ex.NewExtensions(lg),
+		PSK:    store,
+		Tracer: handshake.NewJSONTracer(trace),
+		Rand:   mrand.NewChaCha8(goldenSeed),
+		Time:   func() time.Time { return goldenTime },
+	}
+
+	tCtx.Modz.InitTLSSuite(lg, []suite.Suite{
+		ciphersuites.NewAES_256_CBC_SHA(),
+		ciphersuites.NewAES_256_CBC_SHA256(),
+		ciphersuites.NewPSK_CHACHA20_POLY1305_SHA256(),
+		ciphersuites.NewDHE_PSK_AES_128_CCM(),
+	})
+
+	tCtx.Modz.InitCerts(lg, []*mx.CertPaths{{
+		PathCert: filepath.Join(_GOLDEN_DIR_, "server.crt"),
+		PathKey:  filepath.Join(_GOLDEN_DIR_, "server.key"),
+	}})
+
+	if err := tCtx.Modz.CheckModInit(); err != nil {
+		t.Fatal(err)
+	}
+
+	ex.Register(tCtx.Exts, ex.NewExtSignAlgo())
+	ex.Register(tCtx.Exts, ex.NewExtSessionTicket())
+	ex.Register(tCtx.Exts, ex.NewExtSNI())
+	ex.Register(tCtx.Exts, ex.NewExtStatusRequest())
+	ex.Register(tCtx.Exts, ex.NewExtSupportedGroups())
+	ex.Register(tCtx.Exts, ex.NewExtECPointFormats())
+	ex.Register(tCtx.Exts, ex.NewExtRenegotiation())
+	return tCtx
+}
+
+func goldenPSK() []byte {
+	return []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09,
+		0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f}
+}
+
+// RSA server certificate, made once. Every golden file depends on it
+func goldenCert(t *testing.T) {
+
+	certPath := filepath.Join(_GOLDEN_DIR_, "server.crt")
+	if _, err := os.Stat(certPath); err == nil {
+		return
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    goldenTime.AddDate(-1, 0, 0),
+		NotAfter:     goldenTime.AddDate(100, 0, 0),
+		KeyUsage: x509.KeyUsageDigitalSignature |
+			x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.MkdirAll(_GOLDEN_DIR_, 0755)
+	writePEM(t, _GOLDEN_DIR_, "server.crt", "CERTIFICATE", der)
+	writePEM(t, _GOLDEN_DIR_, "server.key", "PRIVATE KEY", keyDer)
+}
+
+// Reads come from the transcript, writes are kept
+type xReplayConn struct {
+	net.Conn
+	in  []byte
+	out bytes.Buffer
+}
+
+func (x *xReplayConn) Read(b []byte) (int, error) {
+
+	if len(x.in) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(b, x.in)
+	x.in = x.in[n:]
+	return n, nil
+}
+
+func (x *xReplayConn) Write(b []byte) (int, error) {
+	return x.out.Write(b)
+}
+
+func (x *xReplayConn) Close() error                     { return nil }
+func (x *xReplayConn) LocalAddr() net.Addr              { return &net.TCPAddr{} }
+func (x *xReplayConn) RemoteAddr() net.Addr             { return &net.TCPAddr{} }
+func (x *xReplayConn) SetDeadline(time.Time) error      { return nil }
+func (x *xReplayConn) SetReadDeadline(time.Time) error  { return nil }
+func (x *xReplayConn) SetWriteDeadline(time.Time) error { return nil }
+
+// Keeps a copy of everything written
+type xRecordConn struct {
+	net.Conn
+	out bytes.Buffer
+}
+
+func (x *xRecordConn) Write(b []byte) (int, error) {
+
+	x.out.Write(b)
+	return x.Conn.Write(b)
+}
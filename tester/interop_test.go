@@ -0,0 +1,468 @@
+package tester
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"tlesio/server"
+)
+
+// Server on a loopback listener, crypto/tls on the other end. PSK, DHE_PSK
+// and ECDHE_PSK key exchanges, CCM suites and RSA_WITH_AES_256_CBC_SHA256
+// are not in crypto/tls, TestClientDial covers them with our own client
+type interopPKI struct {
+	roots       *x509.CertPool
+	clientRSA   tls.Certificate
+	clientEC    tls.Certificate
+	clientMiss  tls.Certificate // Signed by a CA the server doesn't know
+	clientChain tls.Certificate // With intermediates, see clientChain
+	ca          *x509.Certificate
+	caKey       crypto.Signer
+	serverRSA   [2]string // cert, key paths
+	serverEC    [2]string
+	clientCA    string
+}
+
+type interopCase struct {
+	name    string
+	env     map[string]string
+	config  func(*tls.Config)
+	version uint16
+	suite   uint16
+	ok      bool
+}
+
+func TestInteropCryptoTLS(t *testing.T) {
+
+	pki := newInteropPKI(t)
+	certs := fmt.Sprintf("%v:%v,%v:%v", pki.serverRSA[0], pki.serverRSA[1],
+		pki.serverEC[0], pki.serverEC[1])
+	legacy := map[string]string{"TLS_LEGACY": "true"}
+	request := map[string]string{"TLS_CLIENT_AUTH": "request"}
+	require := map[string]string{"TLS_CLIENT_AUTH": "require"}
+	verify := map[string]string{"TLS_CLIENT_AUTH": "require",
+		"TLS_CLIENT_CA": pki.clientCA}
+	verifyLegacy := map[string]string{"TLS_CLIENT_AUTH": "require",
+		"TLS_CLIENT_CA": pki.clientCA, "TLS_LEGACY": "true"}
+
+	tests := []interopCase{
+		// Versions, suites and key exchanges
+		{"ECDHE_RSA_CHACHA20 X25519", nil,
+			tls12(tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+				tls.X25519),
+			tls.VersionTLS12, 0xCCA8, true},
+		{"ECDHE_RSA_CHACHA20 P-256", nil,
+			tls12(tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+				tls.CurveP256),
+			tls.VersionTLS12, 0xCCA8, true},
+		{"ECDHE_RSA_CHACHA20 P-384", nil,
+			tls12(tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+				tls.CurveP384),
+			tls.VersionTLS12, 0xCCA8, true},
+		{"ECDHE_ECDSA_CHACHA20 X25519", nil,
+			tls12(tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+				tls.X25519, tls.CurveP256),
+			tls.VersionTLS12, 0xCCA9, true},
+		// The certificate's curve must be a supported group (RFC 8422 5.3)
+		{"ECDHE_ECDSA_CHACHA20 no P-256", nil,
+			tls12(tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+				tls.X25519),
+			0, 0, false},
+		{"ECDHE_ECDSA_CHACHA20 P-256", nil,
+			tls12(tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+				tls.CurveP256),
+			tls.VersionTLS12, 0xCCA9, true},
+		{"RSA_AES_256_CBC_SHA", nil,
+			tls12(tls.TLS_RSA_WITH_AES_256_CBC_SHA),
+			tls.VersionTLS12, 0x0035, true},
+		{"TLS 1.3 capable client", nil, nil,
+			tls.VersionTLS12, 0, true},
+		{"TLS 1.1 legacy", legacy,
+			legacyVersion(tls.VersionTLS11),
+			tls.VersionTLS11, 0x0035, true},
+		{"TLS 1.0 legacy", legacy,
+			legacyVersion(tls.VersionTLS10),
+			tls.VersionTLS10, 0x0035, true},
+		{"TLS 1.0 legacy off", nil,
+			legacyVersion(tls.VersionTLS10),
+			0, 0, false},
+
+		// Client authentication
+		{"request, no certificate", request, nil,
+			tls.VersionTLS12, 0, true},
+		{"request, RSA certificate", request,
+			clientCert(pki.clientRSA),
+			tls.VersionTLS12, 0, true},
+		{"require, ECDSA certificate", require,
+			clientCert(pki.clientEC),
+			tls.VersionTLS12, 0, true},
+		{"require, no certificate", require, nil,
+			0, 0, false},
+		{"require, RSA certificate over RSA key exchange", verify,
+			combine(clientCert(pki.clientRSA),
+				tls12(tls.TLS_RSA_WITH_AES_256_CBC_SHA)),
+			tls.VersionTLS12, 0x0035, true},
+		{"require, ECDSA certificate over ECDSA suite", verify,
+			combine(clientCert(pki.clientEC),
+				tls12(tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256)),
+			tls.VersionTLS12, 0xCCA9, true},
+		{"require, unknown CA", verify,
+			clientCert(pki.clientMiss),
+			0, 0, false},
+		// Over 2 KB of client Certificate, more than one record for some
+		{"require, RSA certificate with intermediates", verify,
+			clientCert(clientChain(t, pki)),
+			tls.VersionTLS12, 0, true},
+		{"require, RSA certificate with intermediates over RSA key exchange",
+			verify, combine(clientCert(clientChain(t, pki)),
+				tls12(tls.TLS_RSA_WITH_AES_256_CBC_SHA)),
+			tls.VersionTLS12, 0x0035, true},
+		{"require, RSA certificate without its intermediates", verify,
+			clientCert(tls.Certificate{
+				Certificate: clientChain(t, pki).Certificate[:1],
+				PrivateKey:  clientChain(t, pki).PrivateKey,
+			}),
+			0, 0, false},
+		{"require, TLS 1.0 RSA certificate", verifyLegacy,
+			combine(clientCert(pki.clientRSA),
+				legacyVersion(tls.VersionTLS10)),
+			tls.VersionTLS10, 0x0035, true},
+		{"require, TLS 1.1 ECDSA certificate", verifyLegacy,
+			combine(clientCert(pki.clientEC),
+				legacyVersion(tls.VersionTLS11)),
+			tls.VersionTLS11, 0x0035, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			addr := startServer(t, certs, tt.env)
+			config := &tls.Config{RootCAs: pki.roots, ServerName: "localhost"}
+			if tt.config != nil {
+				tt.config(config)
+			}
+
+			state, err := dialEcho(addr, config)
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("handshake should have failed")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if state.Version != tt.version {
+				t.Errorf("version 0x%04X, expected 0x%04X", state.Version,
+					tt.version)
+			}
+
+			if tt.suite != 0 && state.CipherSuite != tt.suite {
+				t.Errorf("suite 0x%04X, expected 0x%04X", state.CipherSuite,
+					tt.suite)
+			}
+		})
+	}
+}
+
+// No session cache on the server, offered tickets or sessions must end
+// in full handshakes, never in a failed one
+func TestInteropResumption(t *testing.T) {
+
+	pki := newInteropPKI(t)
+	addr := startServer(t, pki.serverRSA[0]+":"+pki.serverRSA[1], nil)
+	configs := map[string]*tls.Config{
+		"session tickets": {
+			MaxVersion:         tls.VersionTLS12,
+			ClientSessionCache: tls.NewLRUClientSessionCache(4),
+		},
+		"tickets disabled": {
+			MaxVersion:             tls.VersionTLS12,
+			SessionTicketsDisabled: true,
+		},
+	}
+
+	for name, config := range configs {
+		config.RootCAs = pki.roots
+		config.ServerName = "localhost"
+		for i := 0; i < 2; i++ {
+			state, err := dialEcho(addr, config)
+			if err != nil {
+				t.Fatalf("%v, connection %v: %v", name, i, err)
+			}
+
+			if state.DidResume {
+				t.Errorf("%v, connection %v: resumed", name, i)
+			}
+		}
+	}
+}
+
+// Handshake, a few round trips of application data (one of them bigger
+// than a record) and close_notify
+func dialEcho(addr string, config *tls.Config) (tls.ConnectionState, error) {
+
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, config)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	messages := [][]byte{
+		[]byte("ping"),
+		bytes.Repeat([]byte("0123456789abcdef"), 1100),
+		[]byte("pong"),
+	}
+
+	for _, msg := range messages {
+		if _, err = conn.Write(msg); err != nil {
+			return conn.ConnectionState(), err
+		}
+
+		echo := make([]byte, len(msg))
+		if _, err = io.ReadFull(conn, echo); err != nil {
+			return conn.ConnectionState(), err
+		}
+
+		if !bytes.Equal(echo, msg) {
+			return conn.ConnectionState(), errors.New("echo mismatch")
+		}
+	}
+
+	return conn.ConnectionState(), conn.CloseWrite()
+}
+
+func startServer(t *testing.T, certs string, env map[string]string) string {
+
+	t.Setenv("TLS_CERTS", certs)
+	t.Setenv("TLS_LOG_LEVEL", "error")
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+
+	srv, err := server.NewServer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(listener) }()
+	t.Cleanup(func() {
+		srv.Close()
+		if err := <-done; !errors.Is(err, server.ErrServerClosed) {
+			t.Errorf("Serve: %v", err)
+		}
+	})
+
+	return listener.Addr().String()
+}
+
+func tls12(suite uint16, curves ...tls.CurveID) func(*tls.Config) {
+
+	return func(c *tls.Config) {
+		c.MaxVersion = tls.VersionTLS12
+		c.CipherSuites = []uint16{suite}
+		c.CurvePreferences = curves
+	}
+}
+
+func legacyVersion(version uint16) func(*tls.Config) {
+
+	return func(c *tls.Config) {
+		c.MinVersion = version
+		c.MaxVersion = version
+		c.CipherSuites = []uint16{tls.TLS_RSA_WITH_AES_256_CBC_SHA}
+	}
+}
+
+func clientCert(cert tls.Certificate) func(*tls.Config) {
+
+	return func(c *tls.Config) {
+		c.Certificates = []tls.Certificate{cert}
+	}
+}
+
+func combine(configs ...func(*tls.Config)) func(*tls.Config) {
+
+	return func(c *tls.Config) {
+		for _, config := range configs {
+			config(c)
+		}
+	}
+}
+
+// RSA leaf under two RSA intermediates of the client CA, the chain sent
+// whole. Generated once per PKI
+func clientChain(t *testing.T, pki *interopPKI) tls.Certificate {
+
+	var size int
+
+	if pki.clientChain.PrivateKey != nil {
+		return pki.clientChain
+	}
+
+	parent, parentKey := pki.ca, pki.caKey
+	var chain [][]byte
+	for _, cn := range []string{"Interop Intermediate 1",
+		"Interop Intermediate 2"} {
+		key, _ := rsa.GenerateKey(rand.Reader, 2048)
+		parent = issue(t, cn, key.Public(), parent, parentKey, true)
+		parentKey = key
+		chain = append([][]byte{parent.Raw}, chain...)
+	}
+
+	leafKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	leaf := issue(t, "client-chain", leafKey.Public(), parent, parentKey,
+		false)
+	pki.clientChain = tls.Certificate{
+		Certificate: append([][]byte{leaf.Raw}, chain...),
+		PrivateKey:  leafKey,
+	}
+
+	for _, der := range pki.clientChain.Certificate {
+		size += len(der)
+	}
+
+	if size <= 2048 {
+		t.Fatalf("client chain is only %v bytes", size)
+	}
+
+	return pki.clientChain
+}
+
+// Throwaway CA, RSA and ECDSA server certificates (files, as the server
+// loads them) and client certificates
+func newInteropPKI(t *testing.T) *interopPKI {
+
+	var pki interopPKI
+
+	dir := t.TempDir()
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca := issue(t, "Interop CA", caKey.Public(), nil, caKey, true)
+	missKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	missCA := issue(t, "Unknown CA", missKey.Public(), nil, missKey, true)
+	pki.ca, pki.caKey = ca, caKey
+	pki.roots = x509.NewCertPool()
+	pki.roots.AddCert(ca)
+	pki.clientCA = writePEM(t, dir, "client-ca.crt", "CERTIFICATE", ca.Raw)
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	for _, srv := range []struct {
+		paths *[2]string
+		name  string
+		key   crypto.Signer
+	}{
+		{&pki.serverRSA, "server-rsa", rsaKey},
+		{&pki.serverEC, "server-ec", ecKey},
+	} {
+		cert := issue(t, "localhost", srv.key.Public(), ca, caKey, false)
+		der, err := x509.MarshalPKCS8PrivateKey(srv.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		srv.paths[0] = writePEM(t, dir, srv.name+".crt", "CERTIFICATE",
+			cert.Raw)
+		srv.paths[1] = writePEM(t, dir, srv.name+".key", "PRIVATE KEY", der)
+	}
+
+	cliRSA, _ := rsa.GenerateKey(rand.Reader, 2048)
+	cliEC, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	pki.clientRSA = tlsCert(issue(t, "client-rsa", cliRSA.Public(), ca, caKey,
+		false), cliRSA)
+	pki.clientEC = tlsCert(issue(t, "client-ec", cliEC.Public(), ca, caKey,
+		false), cliEC)
+	pki.clientMiss = tlsCert(issue(t, "client-miss", cliEC.Public(), missCA,
+		missKey, false), cliEC)
+	return &pki
+}
+
+// Self signed (by 'parentKey') when there is no parent
+func issue(t *testing.T, cn string, pub crypto.PublicKey,
+	parent *x509.Certificate, parentKey crypto.Signer,
+	isCA bool) *x509.Certificate {
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+
+	if isCA {
+		template.IsCA = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		template.ExtKeyUsage = nil
+	} else {
+		template.DNSNames = []string{cn}
+		template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+		// RSA key exchange encrypts to the certificate's key
+		if _, ok := pub.(*rsa.PublicKey); ok {
+			template.KeyUsage |= x509.KeyUsageKeyEncipherment
+		}
+	}
+
+	if parent == nil {
+		parent = template
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, pub,
+		parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+func tlsCert(cert *x509.Certificate, key crypto.Signer) tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}
+}
+
+func writePEM(t *testing.T, dir, name, kind string, der []byte) string {
+
+	path := filepath.Join(dir, name)
+	data := pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
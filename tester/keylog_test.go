@@ -0,0 +1,129 @@
+package tester
+
+import (
+	"bytes"
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"tlesio/server"
+	"tlesio/tlssl"
+)
+
+// Wireshark wants one 'CLIENT_RANDOM <client_random> <secret>' line per
+// session
+func TestKeyLog(t *testing.T) {
+
+	var out bytes.Buffer
+
+	clientRandom := bytes.Repeat([]byte{0xAB}, 32)
+	masterSecret := bytes.Repeat([]byte{0x01}, 48)
+	err := tlssl.KeyLog(&out, clientRandom, masterSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "CLIENT_RANDOM " + strings.Repeat("ab", 32) + " " +
+		strings.Repeat("01", 48) + "\n"
+	if out.String() != expected {
+		t.Errorf("key log line mismatch:\n%q\n%q", out.String(), expected)
+	}
+
+	out.Reset()
+	err = tlssl.KeyLog(&out, clientRandom[:16], masterSecret)
+	if err == nil || out.Len() != 0 {
+		t.Errorf("short client random accepted")
+	}
+
+	err = tlssl.KeyLog(nil, clientRandom, masterSecret)
+	if err != nil {
+		t.Errorf("nil writer: %v", err)
+	}
+}
+
+// The server logs the same CLIENT_RANDOM line crypto/tls does for its end
+func TestKeyLogHandshake(t *testing.T) {
+
+	pki := newInteropPKI(t)
+	path := filepath.Join(t.TempDir(), "keys.log")
+	addr := startServer(t, pki.serverRSA[0]+":"+pki.serverRSA[1],
+		map[string]string{"TLS_KEYLOG_FILE": path})
+
+	var expected bytes.Buffer
+
+	for _, suite := range []uint16{
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	} {
+		config := &tls.Config{RootCAs: pki.roots, ServerName: "localhost",
+			KeyLogWriter: &expected}
+		tls12(suite, tls.X25519)(config)
+		if _, err := dialEcho(addr, config); err != nil {
+			t.Fatalf("suite 0x%04X: %v", suite, err)
+		}
+	}
+
+	logged, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected.Len() == 0 || string(logged) != expected.String() {
+		t.Errorf("key log mismatch:\n%s\nexpected:\n%s", logged,
+			expected.String())
+	}
+}
+
+// No key log, no server, if others could read it
+func TestKeyLogPermissions(t *testing.T) {
+
+	pki := newInteropPKI(t)
+	t.Setenv("TLS_CERTS", pki.serverRSA[0]+":"+pki.serverRSA[1])
+	t.Setenv("TLS_LOG_LEVEL", "error")
+	tests := []struct {
+		name     string
+		dirMode  os.FileMode
+		fileMode os.FileMode // Zero, the server creates it
+		ok       bool
+	}{
+		{"new file", 0700, 0, true},
+		{"existing 0600 file", 0700, 0600, true},
+		{"existing 0644 file", 0700, 0644, false},
+		{"world readable directory", 0755, 0, false},
+		{"world writable directory", 0703, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// Not under t.TempDir(), others can't get into that one
+			dir, err := os.MkdirTemp("", "keylog")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			t.Cleanup(func() { os.RemoveAll(dir) })
+
+			path := filepath.Join(dir, "keys.log")
+			if tt.fileMode != 0 {
+				if err := os.WriteFile(path, nil, tt.fileMode); err != nil {
+					t.Fatal(err)
+				}
+
+				os.Chmod(path, tt.fileMode)
+			}
+
+			os.Chmod(dir, tt.dirMode)
+			t.Setenv("TLS_KEYLOG_FILE", path)
+			srv, err := server.NewServer("")
+			if err == nil {
+				srv.Close()
+			}
+
+			if (err == nil) != tt.ok {
+				t.Errorf("expected ok %v, got %v", tt.ok, err)
+			}
+		})
+	}
+}
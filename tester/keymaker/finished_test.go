@@ -2,11 +2,15 @@ package keymaker
 
 import (
 	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	"os"
 	"testing"
 	"tlesio/tlssl"
+	"tlesio/tlssl/handshake"
 	"tlesio/tlssl/suite"
 )
 
@@ -42,6 +46,79 @@ func TestSuiteFinished(t *testing.T) {
 
 }
 
+// Running transcript, fed message by message as the handshake does, vs the
+// concatenated messages hashed at Finished
+func TestTranscriptFinished(t *testing.T) {
+
+	km := theKeymaker()
+	msgs := getHandshakeMsgList()
+	tr, err := handshake.NewTranscript(suite.MD5SHA1, suite.SHA256,
+		suite.SHA384)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every hash until ServerHello picks the suite
+	tr.Write(msgs[0])
+	for _, algo := range tr.Algos() {
+		sum, _ := tr.Sum(algo)
+		if !bytes.Equal(sum, hashAlgo(algo, msgs[0])) {
+			t.Errorf("hash %v mismatch after ClientHello", algo)
+		}
+	}
+
+	if err := tr.Keep(suite.SHA256); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msg := range msgs[1:] {
+		tr.Write(msg)
+	}
+
+	sum, err := tr.Sum(suite.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	concat := getHandshakeMsgs()
+	if !bytes.Equal(sum, hashear(concat)) {
+		t.Fatalf("transcript %x, concatenated messages %x", sum,
+			hashear(concat))
+	}
+
+	clientVD := km.PRF(getMasterSecret(), "client finished", sum)[:12]
+	if !bytes.Equal(clientVD, verifyData()) {
+		t.Errorf("client verify data %x, expected %x", clientVD, verifyData())
+	}
+
+	// Server's includes the client's Finished
+	finished := append([]byte{0x14, 0x00, 0x00, 0x0C}, clientVD...)
+	tr.Write(finished)
+	sum, _ = tr.Sum(suite.SHA256)
+	serverVD := km.PRF(getMasterSecret(), "server finished", sum)[:12]
+	expected := km.PRF(getMasterSecret(), "server finished",
+		hashear(append(concat, finished...)))[:12]
+	if !bytes.Equal(serverVD, expected) {
+		t.Errorf("server verify data %x, expected %x", serverVD, expected)
+	}
+}
+
+func hashAlgo(algo int, data []byte) []byte {
+
+	switch algo {
+	case suite.MD5SHA1:
+		md5Sum := md5.Sum(data)
+		sha1Sum := sha1.Sum(data)
+		return append(md5Sum[:], sha1Sum[:]...)
+
+	case suite.SHA384:
+		sha384Sum := sha512.Sum384(data)
+		return sha384Sum[:]
+	}
+
+	return hashear(data)
+}
+
 func theKeymaker() tlssl.TheKeyMaker {
 
 	km, err := tlssl.NewKeymaker(suite.SHA256, 32)
@@ -64,6 +141,11 @@ func getMasterSecret() []byte {
 }
 
 func getHandshakeMsgs() []byte {
+	return bytes.Join(getHandshakeMsgList(), nil)
+}
+
+// In the order they were sent, handshake headers included
+func getHandshakeMsgList() [][]byte {
 
 	clientHello := "0100012003032c48e0cb34cde4bcf8255e3701520a2b3e6f40e78b3a6a83dbcdc00e27a13aa420878fd47ee6af7d1121727f0fad3bf9c74d7f7fe258cea30b443e49ed7edc02f5003e130213031301c02cc030009fcca9cca8ccaac02bc02f009ec024c028006bc023c0270067c00ac0140039c009c0130033009d009c003d003c0035002f00ff01000099000b000403000102000a00160014001d0017001e0019001801000101010201030104002300000016000000170000000d002a0028040305030603080708080809080a080b080408050806040105010601030303010302040205020602002b0009080304030303020301002d00020101003300260024001d0020c2585138b7329d1cbe36dc65c9c77b4bc319fe8596b7bdc94275ce89cd975413"
 	serverHello := "0200003103030cba459cd4ae9bcd146a425b3c22cd7ce3ed0e16aa6567441b775d0559d3261800003d00000900230000ff01000100"
@@ -71,10 +153,14 @@ func getHandshakeMsgs() []byte {
 	serverHelloDone := "0e000000"
 	clientKeyExchange := "10000102010068e788dc607e2a6e6ee9b586451b544315c8382dc8ff2614106b73e8655f06553a5100c00701cf3cbc3bc7c421713b37d40462a1b626f36c4ff237172701d9af1e5511f769f8011e1e9cb8c7758b0657b75c0fff593066315d40a6b50df02ead6c7293fa770279e3e5c5d2adf37cada99690dfbbc54c3f49c6e0230b7cdd924d819fa094ed428c5250aebb6d8c3072038382d13c3db4bfda929a33368e37ac598d3007c0b4a4be72db8e80fce45b8bb6767e36153e9bbebaa9f13d4c2a691ab2b1e554857ffcd498a1cd64bbcc871ddd7f1bc564c8886730d4f5ebc1c3738bc26daae86a0bb52b39c8087abb6eadcc3e8962d6df73605dcfb880049a51a11bca"
 
-	handshakeMsgs := clientHello + serverHello + certificate +
-		serverHelloDone + clientKeyExchange
-	hm, _ := hex.DecodeString(handshakeMsgs)
-	return hm
+	var msgs [][]byte
+	for _, msg := range []string{clientHello, serverHello, certificate,
+		serverHelloDone, clientKeyExchange} {
+		hm, _ := hex.DecodeString(msg)
+		msgs = append(msgs, hm)
+	}
+
+	return msgs
 }
 
 func hashear(data []byte) []byte {
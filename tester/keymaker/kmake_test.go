@@ -1,6 +1,8 @@
 package keymaker
 
 import (
+	"bytes"
+	"encoding/hex"
 	"fmt"
 	"testing"
 
@@ -42,3 +44,24 @@ func TestPRFSha3(t *testing.T) {
 	pp := pf.PRF(secret, "", seed)
 	fmt.Printf("%x\nMaterial Len: %v\n", pp, len(pp))
 }
+
+// TLS 1.0/1.1 PRF test vector (secret 48 * 0xAB, seed 64 * 0xCD)
+func TestPRFLegacy(t *testing.T) {
+
+	expected := "d3d4d1e349b5d515044666d51de32bab258cb521b6b053463e354832fd976754" +
+		"443bcf9a296519bc289abcbc1187e4ebd31e602353776c408aafb74cbc85eff6" +
+		"9255f9788faa184cbb957a9819d84a5d7eb006eb459d3ae8de9810454b8b2d8f" +
+		"1afbc655a8c9a013"
+
+	pf, err := tlssl.NewKeymaker(suite.MD5SHA1, 104)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := bytes.Repeat([]byte{0xAB}, 48)
+	seed := bytes.Repeat([]byte{0xCD}, 64)
+	prf := pf.PRF(secret, "PRF Testvector", seed)
+	if hex.EncodeToString(prf) != expected {
+		t.Errorf("legacy PRF mismatch: %x", prf)
+	}
+}
@@ -0,0 +1,301 @@
+package tester
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A stalled or trickling client is dropped on the handshake deadline or
+// the per read timeout, whichever comes first
+func TestHandshakeTimeouts(t *testing.T) {
+
+	pki := newInteropPKI(t)
+	tests := []struct {
+		name      string
+		handshake string
+		read      string
+		hello     bool // ClientHello sent
+		trickle   bool // A byte every 50ms afterwards
+		min, max  time.Duration
+	}{
+		{"no ClientHello", "300ms", "10s", false, false,
+			250 * time.Millisecond, 3 * time.Second},
+		{"read timeout", "10s", "300ms", true, false,
+			250 * time.Millisecond, 3 * time.Second},
+		{"handshake deadline", "600ms", "10s", true, true,
+			550 * time.Millisecond, 3 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			metrics := metricsAddr(t)
+			addr := startServer(t, pki.serverRSA[0]+":"+pki.serverRSA[1],
+				map[string]string{
+					"TLS_HANDSHAKE_TIMEOUT": tt.handshake,
+					"TLS_READ_TIMEOUT":      tt.read,
+					"TLS_METRICS_ADDR":      metrics,
+				})
+
+			start := time.Now()
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer conn.Close()
+			if tt.hello {
+				conn.Write(clientHelloRecord(0x003D))
+			}
+
+			stop := make(chan struct{})
+			defer close(stop)
+			if tt.trickle {
+				go trickle(conn, stop)
+			}
+
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			if _, err := io.Copy(io.Discard, conn); err != nil {
+				t.Fatalf("connection not closed by the server: %v", err)
+			}
+
+			took := time.Since(start)
+			if took < tt.min || took > tt.max {
+				t.Errorf("closed after %v, expected %v to %v", took, tt.min,
+					tt.max)
+			}
+
+			waitMetric(t, metrics, `tls_timeouts_total{phase="handshake"}`, 1)
+		})
+	}
+}
+
+// A zero timeout is no timeout, handshakes still finish
+func TestTimeoutsDisabled(t *testing.T) {
+
+	pki := newInteropPKI(t)
+	config := &tls.Config{RootCAs: pki.roots, ServerName: "localhost"}
+	tls12(tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		tls.X25519)(config)
+	for _, env := range []string{"TLS_HANDSHAKE_TIMEOUT", "TLS_READ_TIMEOUT",
+		"TLS_IDLE_TIMEOUT"} {
+		t.Run(env, func(t *testing.T) {
+
+			addr := startServer(t, pki.serverRSA[0]+":"+pki.serverRSA[1],
+				map[string]string{env: "0"})
+			if _, err := dialEcho(addr, config); err != nil {
+				t.Errorf("%v=0: %v", env, err)
+			}
+		})
+	}
+}
+
+// Established connections end with close_notify when idle, or when the
+// client stops reading what is echoed back
+func TestEstablishedTimeouts(t *testing.T) {
+
+	pki := newInteropPKI(t)
+	config := &tls.Config{RootCAs: pki.roots, ServerName: "localhost"}
+	tls12(tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		tls.X25519)(config)
+	certs := pki.serverRSA[0] + ":" + pki.serverRSA[1]
+
+	t.Run("idle", func(t *testing.T) {
+
+		metrics := metricsAddr(t)
+		addr := startServer(t, certs, map[string]string{
+			"TLS_IDLE_TIMEOUT": "300ms",
+			"TLS_METRICS_ADDR": metrics,
+		})
+
+		conn, err := tls.Dial("tcp", addr, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer conn.Close()
+		start := time.Now()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("expected close_notify, got %v", err)
+		}
+
+		if took := time.Since(start); took < 250*time.Millisecond {
+			t.Errorf("closed after %v", took)
+		}
+
+		waitMetric(t, metrics, `tls_timeouts_total{phase="idle"}`, 1)
+		waitMetric(t, metrics, "tls_connections_established", 0)
+	})
+
+	t.Run("write", func(t *testing.T) {
+
+		metrics := metricsAddr(t)
+		addr := startServer(t, certs, map[string]string{
+			"TLS_READ_TIMEOUT": "300ms",
+			"TLS_IDLE_TIMEOUT": "0",
+			"TLS_METRICS_ADDR": metrics,
+		})
+
+		conn, err := tls.Dial("tcp", addr, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer conn.Close()
+		waitMetric(t, metrics, "tls_connections_established", 1)
+
+		// Echoes pile up until the server can't write anymore
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		go func() {
+			data := make([]byte, 16384)
+			for {
+				if _, err := conn.Write(data); err != nil {
+					return
+				}
+			}
+		}()
+
+		waitMetric(t, metrics, `tls_timeouts_total{phase="write"}`, 1)
+		waitMetric(t, metrics, "tls_connections_established", 0)
+	})
+}
+
+// Past the in-flight handshakes limit connections are dropped right away,
+// a finished handshake frees its slot
+func TestMaxHandshakes(t *testing.T) {
+
+	pki := newInteropPKI(t)
+	metrics := metricsAddr(t)
+	addr := startServer(t, pki.serverRSA[0]+":"+pki.serverRSA[1],
+		map[string]string{
+			"TLS_MAX_HANDSHAKES": "1",
+			"TLS_METRICS_ADDR":   metrics,
+		})
+
+	stalled, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer stalled.Close()
+	waitMetric(t, metrics, "tls_handshakes_in_flight", 1)
+	dropped, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer dropped.Close()
+	dropped.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := dropped.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("connection over the limit not dropped: %v", err)
+	}
+
+	waitMetric(t, metrics, "tls_connections_rejected_total", 1)
+	stalled.Close()
+	waitMetric(t, metrics, "tls_handshakes_in_flight", 0)
+	config := &tls.Config{RootCAs: pki.roots, ServerName: "localhost"}
+	tls12(tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		tls.X25519)(config)
+	if _, err := dialEcho(addr, config); err != nil {
+		t.Errorf("handshake after the slot was freed: %v", err)
+	}
+}
+
+// ClientKeyExchange record header, one byte at a time until 'stop'
+func trickle(conn net.Conn, stop chan struct{}) {
+
+	data := []byte{0x16, 0x03, 0x03, 0x01, 0x06, 0x10, 0x00, 0x01, 0x02}
+	for i := 0; ; i++ {
+		select {
+		case <-stop:
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		b := data[i%len(data):]
+		if _, err := conn.Write(b[:1]); err != nil {
+			return
+		}
+	}
+}
+
+// Loopback address for the metrics endpoint, free a moment ago
+func metricsAddr(t *testing.T) string {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// Exposition text from the metrics endpoint
+func scrapeMetrics(t *testing.T, addr string) string {
+
+	var body strings.Builder
+
+	for i := 0; ; i++ {
+		resp, err := http.Get("http://" + addr + "/metrics")
+		if err != nil {
+			if i == 50 {
+				t.Fatal(err)
+			}
+
+			time.Sleep(20 * time.Millisecond)
+			continue
+		}
+
+		defer resp.Body.Close()
+		io.Copy(&body, resp.Body)
+		return body.String()
+	}
+}
+
+// Value of the 'series' sample, -1 if it isn't there
+func metricValue(text, series string) float64 {
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(scanner.Text(), series+" ")
+		if !ok {
+			continue
+		}
+
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return -1
+		}
+
+		return v
+	}
+
+	return -1
+}
+
+func waitMetric(t *testing.T, addr, series string, want float64) {
+
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := metricValue(scrapeMetrics(t, addr), series)
+		if got == want {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("%v is %v, expected %v", series, got, want)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,104 @@
+package tester
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"testing"
+	"tlesio/tlssl"
+	"tlesio/tlssl/suite/ciphersuites"
+)
+
+// Bad padding, bad MAC and bad lengths must all look the same
+func TestCBCBadRecordMAC(t *testing.T) {
+
+	keys := &tlssl.Keys{
+		MAC: bytes.Repeat([]byte{0x11}, 20),
+		Key: bytes.Repeat([]byte{0x22}, 32),
+		IV:  bytes.Repeat([]byte{0x33}, 16),
+	}
+
+	cs := ciphersuites.NewAES_256_CBC_SHA()
+	header := &tlssl.TLSHeader{
+		ContentType: tlssl.ContentTypeApplicationData,
+		Version:     tlssl.TLS_VERSION1_2,
+	}
+
+	content := []byte("0123456789abcdef0123456789")
+	mac, err := tlssl.NewTLSCipherSpec(cs, keys, tlssl.MODE_MTE,
+		tlssl.TLS_VERSION1_2, nil).Macintosh(header, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	badMAC := append([]byte{}, mac...)
+	badMAC[0] ^= 0x01
+
+	// content(26) + mac(20) = 46, 2 bytes of padding to get to 48
+	tests := []struct {
+		name    string
+		mac     []byte
+		padding []byte
+		ok      bool
+	}{
+		{"valid", mac, []byte{0x01, 0x01}, true},
+		{"valid long padding", mac, bytes.Repeat([]byte{0x11}, 18), true},
+		{"padding byte mismatch", mac, []byte{0x00, 0x01}, false},
+		{"padding too long", mac, bytes.Repeat([]byte{0xFF}, 2), false},
+		{"bad MAC", badMAC, []byte{0x01, 0x01}, false},
+		{"bad MAC and padding", badMAC, []byte{0x07, 0x01}, false},
+	}
+
+	for _, tt := range tests {
+		clearText := append(append(append([]byte{}, content...),
+			tt.mac...), tt.padding...)
+		record := cbcRecord(t, keys.Key, clearText)
+		tpt, err := tlssl.NewTLSCipherSpec(cs, keys, tlssl.MODE_MTE,
+			tlssl.TLS_VERSION1_2, nil).DecryptRecord(&tlssl.TLSCipherText{
+			Header:   header,
+			Fragment: record,
+		})
+
+		if tt.ok {
+			if err != nil {
+				t.Errorf("%v: %v", tt.name, err)
+			} else if !bytes.Equal(tpt.Fragment, content) {
+				t.Errorf("%v: plaintext mismatch %x", tt.name, tpt.Fragment)
+			}
+
+			continue
+		}
+
+		if !errors.Is(err, tlssl.ErrBadRecordMAC) {
+			t.Errorf("%v: expected bad_record_mac, got %v", tt.name, err)
+		}
+	}
+
+	// Shorter than a block of MAC + padding length or not block aligned
+	for _, sz := range []int{16, 32, 47, 50} {
+		_, err := tlssl.NewTLSCipherSpec(cs, keys, tlssl.MODE_MTE,
+			tlssl.TLS_VERSION1_2, nil).DecryptRecord(&tlssl.TLSCipherText{
+			Header:   header,
+			Fragment: make([]byte, sz),
+		})
+
+		if !errors.Is(err, tlssl.ErrBadRecordMAC) {
+			t.Errorf("len %v: expected bad_record_mac, got %v", sz, err)
+		}
+	}
+}
+
+// Explicit IV + AES-CBC, no padding added
+func cbcRecord(t *testing.T, key, clearText []byte) []byte {
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	iv := bytes.Repeat([]byte{0x44}, aes.BlockSize)
+	record := make([]byte, len(clearText))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(record, clearText)
+	return append(iv, record...)
+}
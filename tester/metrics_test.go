@@ -0,0 +1,150 @@
+package tester
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"tlesio/tlssl"
+)
+
+// Exposition text after real handshakes: every family has HELP and TYPE,
+// label values are escaped, histograms are cumulative and client chosen
+// labels (SNI, JA4) stop growing at their caps
+func TestMetricsExposition(t *testing.T) {
+
+	pki := newInteropPKI(t)
+	metrics := metricsAddr(t)
+	addr := startServer(t, pki.serverRSA[0]+":"+pki.serverRSA[1],
+		map[string]string{"TLS_METRICS_ADDR": metrics})
+
+	// One more name than the cap, the odd one first so it is counted
+	names := []string{`quote"back\slash`}
+	for i := 0; len(names) <= 128; i++ {
+		names = append(names, fmt.Sprintf("host%v.example", i))
+	}
+
+	for _, name := range names {
+		config := &tls.Config{ServerName: name, InsecureSkipVerify: true}
+		tls12(tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.X25519)(config)
+		conn, err := tls.Dial("tcp", addr, config)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+
+		conn.Close()
+	}
+
+	// A new fingerprint each, the handshakes go nowhere
+	for i := 0; i <= 256; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn.Write(clientHelloRecord(0x003D, helloExt(uint16(0x1000+i))))
+		conn.Close()
+	}
+
+	completed := float64(len(names))
+	waitMetric(t, metrics, "tls_handshakes_completed_total", completed)
+	waitMetric(t, metrics, "tls_handshakes_started_total", completed+257)
+	text := scrapeMetrics(t, metrics)
+
+	// HELP and TYPE right before each family's samples
+	families := make(map[string]string)
+	var family string
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case strings.HasPrefix(line, "# HELP "):
+			family = fields[2]
+			if len(fields) < 4 {
+				t.Errorf("%v: empty HELP", family)
+			}
+
+		case strings.HasPrefix(line, "# TYPE "):
+			if fields[2] != family {
+				t.Errorf("TYPE %v after HELP %v", fields[2], family)
+			}
+
+			families[family] = fields[3]
+
+		case !strings.HasPrefix(line, family):
+			t.Errorf("sample out of its family(%v): %v", family, line)
+		}
+	}
+
+	expected := map[string]string{
+		"tls_handshakes_completed_total":       "counter",
+		"tls_timeouts_total":                   "counter",
+		"tls_handshake_duration_seconds":       "histogram",
+		"tls_handshake_state_duration_seconds": "histogram",
+		"tls_handshakes_in_flight":             "gauge",
+	}
+
+	for name, kind := range expected {
+		if families[name] != kind {
+			t.Errorf("%v: type %q, expected %v", name, families[name], kind)
+		}
+	}
+
+	if _, ok := families["tls_resumptions_total"]; ok {
+		t.Errorf("resumptions counted, there are none")
+	}
+
+	series := `tls_negotiated_key_exchanges_total{kx="ECDHE"}`
+	if metricValue(text, series) != completed {
+		t.Errorf("%v is %v", series, metricValue(text, series))
+	}
+
+	// Same version names as the logs and traces
+	series = `tls_negotiated_versions_total{version="` +
+		tlssl.VersionName(tlssl.TLS_VERSION1_2) + `"}`
+	if metricValue(text, series) != completed {
+		t.Errorf("%v is %v", series, metricValue(text, series))
+	}
+
+	series = `tls_sni_hosts_total{host="quote\"back\\slash"}`
+	if metricValue(text, series) != 1 {
+		t.Errorf("escaped SNI host not found")
+	}
+
+	if n := strings.Count(text, "tls_sni_hosts_total{"); n != 129 ||
+		metricValue(text, `tls_sni_hosts_total{host="other"}`) != 1 {
+		t.Errorf("%v SNI series, expected 128 hosts and other", n)
+	}
+
+	if n := strings.Count(text, "tls_client_fingerprints_total{"); n != 257 ||
+		metricValue(text, `tls_client_fingerprints_total{ja4="other"}`) < 1 {
+		t.Errorf("%v JA4 series, expected 256 fingerprints and other", n)
+	}
+
+	// Cumulative buckets, +Inf is the count
+	var last float64
+	prefix := "tls_handshake_duration_seconds_bucket{le="
+	for _, line := range strings.Split(text, "\n") {
+		le, value, ok := strings.Cut(strings.TrimPrefix(line, prefix), "} ")
+		if !ok || !strings.HasPrefix(line, prefix) {
+			continue
+		}
+
+		v, _ := strconv.ParseFloat(value, 64)
+		if v < last {
+			t.Errorf("bucket %v: %v after %v", le, v, last)
+		}
+
+		last = v
+		if le == `"+Inf"` && v != completed {
+			t.Errorf("+Inf bucket %v, %v handshakes", v, completed)
+		}
+	}
+
+	if metricValue(text, "tls_handshake_duration_seconds_count") != completed ||
+		!strings.Contains(text, prefix+`"0.0005"}`) {
+		t.Errorf("duration histogram does not match the handshakes")
+	}
+}
@@ -0,0 +1,288 @@
+package tester
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"tlesio/tlssl"
+	"tlesio/tlssl/dissect"
+	mx "tlesio/tlssl/modulos"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+type xStaticOCSP struct {
+	response []byte
+}
+
+func (x *xStaticOCSP) OCSPResponse() ([]byte, error) {
+	return x.response, nil
+}
+
+type ocspPKI struct {
+	ca, leaf   *x509.Certificate
+	caKey      crypto.Signer
+	chain, key string // Leaf and CA, leaf's key
+}
+
+// Only good, fresh responses for the certificate, signed by its issuer,
+// are stapled
+func TestOCSPValidation(t *testing.T) {
+
+	now := time.Now().Truncate(time.Second)
+	pki := newOCSPPKI(t)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherCA := issue(t, "Other CA", otherKey.Public(), nil, otherKey, true)
+	responder := issue(t, "responder", otherKey.Public(), pki.ca, pki.caKey,
+		false)
+	good := ocsp.Response{Status: ocsp.Good, SerialNumber: pki.leaf.SerialNumber,
+		ThisUpdate: now.Add(-time.Hour), NextUpdate: now.Add(time.Hour)}
+
+	tests := []struct {
+		name   string
+		signer crypto.Signer
+		issuer *x509.Certificate // Responder's certificate
+		edit   func(*ocsp.Response)
+		now    time.Time
+		ok     bool
+	}{
+		{"good", pki.caKey, pki.ca, nil, now, true},
+		{"expired", pki.caKey, pki.ca, nil, now.Add(2 * time.Hour), false},
+		{"not yet valid", pki.caKey, pki.ca, nil, now.Add(-2 * time.Hour),
+			false},
+		{"no nextUpdate", pki.caKey, pki.ca,
+			func(r *ocsp.Response) { r.NextUpdate = time.Time{} }, now, true},
+		{"no nextUpdate, old", pki.caKey, pki.ca,
+			func(r *ocsp.Response) {
+				r.NextUpdate = time.Time{}
+				r.ThisUpdate = now.AddDate(0, 0, -8)
+			}, now, false},
+		{"revoked", pki.caKey, pki.ca,
+			func(r *ocsp.Response) {
+				r.Status = ocsp.Revoked
+				r.RevokedAt = now.Add(-time.Hour)
+			}, now, false},
+		{"another certificate", pki.caKey, pki.ca,
+			func(r *ocsp.Response) { r.SerialNumber = big.NewInt(7) }, now,
+			false},
+		{"another issuer", otherKey, otherCA, nil, now, false},
+		{"responder not delegated", otherKey, responder, nil, now, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			template := good
+			if tt.edit != nil {
+				tt.edit(&template)
+			}
+
+			// A delegated responder comes with the response
+			if tt.issuer == responder {
+				template.Certificate = responder
+			}
+
+			response, err := ocsp.CreateResponse(pki.ca, tt.issuer, template,
+				tt.signer)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			certs, err := mx.NewModCerts(testLogger(), []*mx.CertPaths{{
+				PathCert: pki.chain, PathKey: pki.key,
+				OCSP: &xStaticOCSP{response: response}}})
+			if err != nil || len(certs.CNs()) != 1 ||
+				!certs.HasOCSP(pki.leaf) {
+				t.Fatalf("certificate not loaded: %v", err)
+			}
+
+			staple := certs.GetCertOCSP(pki.leaf, tt.now)
+			if tt.ok != bytes.Equal(staple, response) {
+				t.Errorf("stapled %v bytes, expected it: %v", len(staple),
+					tt.ok)
+			}
+		})
+	}
+
+	// The issuer must be in the certificate file
+	leafOnly := writePEM(t, t.TempDir(), "leaf.crt", "CERTIFICATE",
+		pki.leaf.Raw)
+	certs, _ := mx.NewModCerts(testLogger(), []*mx.CertPaths{{
+		PathCert: leafOnly, PathKey: pki.key, OCSP: &xStaticOCSP{}}})
+	if len(certs.CNs()) != 0 {
+		t.Errorf("certificate loaded with no issuer to check responses")
+	}
+}
+
+// crypto/tls asks for the status, gets the response file's contents, and
+// the next handshake sees the file rewritten
+func TestOCSPStapling(t *testing.T) {
+
+	now := time.Now()
+	pki := newOCSPPKI(t)
+	response := func(status int) []byte {
+		der, err := ocsp.CreateResponse(pki.ca, pki.ca, ocsp.Response{
+			Status: status, SerialNumber: pki.leaf.SerialNumber,
+			ThisUpdate: now.Add(-time.Hour), NextUpdate: now.Add(time.Hour),
+			RevokedAt: now.Add(-time.Hour)}, pki.caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return der
+	}
+
+	good := response(ocsp.Good)
+	path := filepath.Join(t.TempDir(), "leaf.ocsp")
+	if err := os.WriteFile(path, good, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := startServer(t, pki.chain+":"+pki.key,
+		map[string]string{"TLS_OCSP": pki.chain + "=" + path})
+	roots := x509.NewCertPool()
+	roots.AddCert(pki.ca)
+	config := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+	tls12(tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+		tls.CurveP256)(config)
+	state, err := dialEcho(addr, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(state.OCSPResponse, good) {
+		t.Errorf("stapled %x", state.OCSPResponse)
+	}
+
+	// The issuer after the leaf in its file goes with it
+	if len(state.PeerCertificates) != 2 ||
+		!state.PeerCertificates[1].Equal(pki.ca) {
+		t.Errorf("chain of %v certificates", len(state.PeerCertificates))
+	}
+
+	// Revoked now, nothing stapled but the handshake goes on
+	revoked := response(ocsp.Revoked)
+	if err := os.WriteFile(path, revoked, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Chtimes(path, now.Add(time.Minute), now.Add(time.Minute))
+	state, err = dialEcho(addr, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(state.OCSPResponse) != 0 {
+		t.Errorf("revoked response stapled")
+	}
+}
+
+// status_request is answered for the certificate the handshake goes on
+// with, an RSA one with no response configured gets no answer
+func TestOCSPChosenCertificate(t *testing.T) {
+
+	now := time.Now()
+	pki := newOCSPPKI(t)
+	rsaPKI := newInteropPKI(t)
+	der, err := ocsp.CreateResponse(pki.ca, pki.ca, ocsp.Response{
+		Status: ocsp.Good, SerialNumber: pki.leaf.SerialNumber,
+		ThisUpdate: now.Add(-time.Hour), NextUpdate: now.Add(time.Hour)},
+		pki.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "leaf.ocsp")
+	if err := os.WriteFile(path, der, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := startServer(t, rsaPKI.serverRSA[0]+":"+rsaPKI.serverRSA[1]+","+
+		pki.chain+":"+pki.key,
+		map[string]string{"TLS_OCSP": pki.chain + "=" + path})
+	status := helloExt(0x0005, 0x01, 0x00, 0x00, 0x00, 0x00)
+	tests := []struct {
+		name    string
+		hello   []byte
+		answers bool
+	}{
+		{"RSA", clientHelloRecord(0x003D, status,
+			helloExt(0x000D, 0x00, 0x02, 0x04, 0x01)), false},
+		{"ECDSA", clientHelloRecord(0xCCA9, status,
+			helloExt(0x000D, 0x00, 0x02, 0x04, 0x03),
+			helloExt(0x000A, 0x00, 0x02, 0x00, 0x17),
+			helloExt(0x000B, 0x01, 0x00)), true},
+	}
+
+	for _, tt := range tests {
+		conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write(tt.hello)
+		header, fragment, err := tlssl.ReadRecord(conn)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+
+		records := dissect.Records(append(tlssl.TLSHeadPacket(header),
+			fragment...))
+		if len(records) == 0 || len(records[0].Messages) == 0 ||
+			records[0].Messages[0].Hello == nil {
+			t.Fatalf("%v: no ServerHello: %v", tt.name, records)
+		}
+
+		answered := false
+		for _, ext := range records[0].Messages[0].Hello.Extensions {
+			answered = answered || ext.ID == 0x0005
+		}
+
+		if answered != tt.answers {
+			t.Errorf("%v: status_request answered %v", tt.name, answered)
+		}
+	}
+}
+
+// CA and an ECDSA leaf for localhost, the chain file as a server would have
+// it
+func newOCSPPKI(t *testing.T) *ocspPKI {
+
+	var pki ocspPKI
+
+	dir := t.TempDir()
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	pki.caKey = caKey
+	pki.ca = issue(t, "OCSP CA", caKey.Public(), nil, caKey, true)
+	leafKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	pki.leaf = issue(t, "localhost", leafKey.Public(), pki.ca, caKey, false)
+	der, err := x509.MarshalPKCS8PrivateKey(leafKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pki.key = writePEM(t, dir, "leaf.key", "PRIVATE KEY", der)
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+		Bytes: pki.leaf.Raw})
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+		Bytes: pki.ca.Raw})...)
+	pki.chain = filepath.Join(dir, "leaf.crt")
+	if err := os.WriteFile(pki.chain, chain, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return &pki
+}
@@ -0,0 +1,231 @@
+package tester
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"tlesio/tlssl"
+	"tlesio/tlssl/capture"
+)
+
+// Client and server byte streams of one synthesized TCP connection
+type pcapStream struct {
+	in, out []byte
+	fin     int
+}
+
+// The pcapng file holds the very records the JSON captures hold, in valid
+// IPv4/TCP packets, and the key log lines for them
+func TestPcapngExport(t *testing.T) {
+
+	pki := newInteropPKI(t)
+	dir := t.TempDir()
+	pskFile := filepath.Join(dir, "psk.txt")
+	os.WriteFile(pskFile, []byte("client1:000102030405060708090a0b0c0d0e0f\n"),
+		0600)
+
+	pcapFile := filepath.Join(dir, "handshakes.pcapng")
+	captures := filepath.Join(dir, "captures")
+	srv, addr := startCaptureServer(t, map[string]string{
+		"TLS_CERTS":       pki.serverRSA[0] + ":" + pki.serverRSA[1],
+		"TLS_PSK_FILE":    pskFile,
+		"TLS_CAPTURE_DIR": captures,
+		"TLS_PCAP_FILE":   pcapFile,
+	})
+
+	config := &tls.Config{RootCAs: pki.roots, ServerName: "localhost"}
+	tls12(tls.TLS_RSA_WITH_AES_256_CBC_SHA)(config)
+	if _, err := dialEcho(addr, config); err != nil {
+		t.Fatal(err)
+	}
+
+	key := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	cfg := &tlssl.ClientConfig{RootCAs: pki.roots, ServerName: "localhost"}
+	pskSuites(key, 0xCCAC)(cfg)
+	if _, err := clientEcho(addr, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(pcapFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	streams, secrets := parsePcapng(t, data)
+	if len(streams) != 2 {
+		t.Fatalf("expected 2 connections, got %v", len(streams))
+	}
+
+	if strings.Count(secrets, "CLIENT_RANDOM ") != 2 {
+		t.Errorf("expected 2 CLIENT_RANDOM lines, got:\n%v", secrets)
+	}
+
+	for port, stream := range streams {
+		if stream.fin != 2 {
+			t.Errorf("connection %v: %v FINs", port, stream.fin)
+		}
+	}
+
+	paths, _ := filepath.Glob(filepath.Join(captures, "*.jsonl"))
+	if len(paths) != 2 {
+		t.Fatalf("expected 2 captures, got %v", len(paths))
+	}
+
+	for _, path := range paths {
+		var in, out []byte
+
+		entries, err := capture.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, entry := range entries {
+			switch entry.Dir {
+			case capture.DirIn:
+				in = append(in, entry.Data...)
+			case capture.DirOut:
+				out = append(out, entry.Data...)
+			}
+		}
+
+		found := false
+		for _, stream := range streams {
+			if bytes.Equal(stream.in, in) && bytes.Equal(stream.out, out) {
+				found = true
+			}
+		}
+
+		if !found {
+			t.Errorf("%v: no matching connection in the pcapng file", path)
+		}
+	}
+}
+
+// TCP payloads by client port and the Decryption Secrets Blocks' contents.
+// Every block and checksum is checked on the way
+func parsePcapng(t *testing.T, data []byte) (map[uint16]*pcapStream,
+	string) {
+
+	var secrets strings.Builder
+
+	streams := make(map[uint16]*pcapStream)
+	le := binary.LittleEndian
+	for i := 0; len(data) > 0; i++ {
+		if len(data) < 12 {
+			t.Fatalf("block %v: truncated", i)
+		}
+
+		blockType, total := le.Uint32(data), int(le.Uint32(data[4:]))
+		if total%4 != 0 || total < 12 || total > len(data) ||
+			int(le.Uint32(data[total-4:])) != total {
+			t.Fatalf("block %v: bad length %v", i, total)
+		}
+
+		body := data[8 : total-4]
+		data = data[total:]
+		switch {
+		case i == 0:
+			if blockType != 0x0A0D0D0A || le.Uint32(body) != 0x1A2B3C4D {
+				t.Fatalf("no Section Header Block first")
+			}
+		case i == 1:
+			if blockType != 0x00000001 || le.Uint16(body) != 101 {
+				t.Fatalf("no raw IP Interface Description Block second")
+			}
+		case blockType == 0x0000000A:
+			if le.Uint32(body) != 0x544C534B {
+				t.Fatalf("block %v: secrets type 0x%08X", i, le.Uint32(body))
+			}
+
+			secrets.Write(body[8 : 8+le.Uint32(body[4:])])
+		case blockType == 0x00000006:
+			captured := le.Uint32(body[12:])
+			pcapSegment(t, streams, body[20:20+captured])
+		default:
+			t.Fatalf("block %v: unexpected type 0x%08X", i, blockType)
+		}
+	}
+
+	return streams, secrets.String()
+}
+
+func pcapSegment(t *testing.T, streams map[uint16]*pcapStream, packet []byte) {
+
+	if packet[0] != 0x45 || packet[9] != 6 ||
+		int(binary.BigEndian.Uint16(packet[2:])) != len(packet) {
+		t.Fatalf("not an IPv4 TCP packet: %x", packet[:20])
+	}
+
+	if pcapChecksum(packet[:20]) != 0 {
+		t.Fatalf("bad IPv4 header checksum: %x", packet[:20])
+	}
+
+	tcp := packet[20:]
+	pseudo := append(append([]byte{}, packet[12:20]...), 0, 6)
+	pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(tcp)))
+	if pcapChecksum(append(pseudo, tcp...)) != 0 {
+		t.Fatalf("bad TCP checksum: %x", tcp[:20])
+	}
+
+	src, dst := binary.BigEndian.Uint16(tcp), binary.BigEndian.Uint16(tcp[2:])
+	flags, payload := tcp[13], tcp[20:]
+	if flags&0x02 != 0 {
+		if _, ok := streams[src]; !ok && flags&0x10 == 0 {
+			streams[src] = &pcapStream{}
+		}
+
+		return
+	}
+
+	// The client port names the connection, either way
+	stream, fromClient := streams[src], true
+	if stream == nil {
+		stream, fromClient = streams[dst], false
+	}
+
+	if stream == nil {
+		t.Fatalf("segment %v -> %v before its SYN", src, dst)
+	}
+
+	if flags&0x01 != 0 {
+		stream.fin++
+	}
+
+	if fromClient {
+		stream.in = append(stream.in, payload...)
+	} else {
+		stream.out = append(stream.out, payload...)
+	}
+}
+
+// Sums to zero over data that includes its own checksum
+func pcapChecksum(data []byte) uint16 {
+
+	var sum uint32
+
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+
+	for sum>>16 != 0 {
+		sum = sum&0xFFFF + sum>>16
+	}
+
+	return ^uint16(sum)
+}
@@ -0,0 +1,137 @@
+package tester
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"tlesio/tlssl"
+	"tlesio/tlssl/handshake"
+	mx "tlesio/tlssl/modulos"
+	"tlesio/tlssl/suite"
+	"tlesio/tlssl/suite/ciphersuites"
+)
+
+func TestPSKStoreFile(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "psk.txt")
+	content := "# fleet keys\n\nsensor:01:0a0b0c\ngateway:ffff\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := tlssl.NewPSKStoreFile(path, []byte("fleet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Identity may contain ':', the key is after the last one
+	if !bytes.Equal(store.Get([]byte("sensor:01")), []byte{0x0a, 0x0b, 0x0c}) {
+		t.Errorf("sensor:01 key mismatch")
+	}
+
+	if store.Get([]byte("nobody")) != nil {
+		t.Errorf("unknown identity found")
+	}
+
+	if string(store.Hint()) != "fleet" {
+		t.Errorf("hint mismatch: %s", store.Hint())
+	}
+
+	os.WriteFile(path, []byte("badline\n"), 0600)
+	if _, err := tlssl.NewPSKStoreFile(path, nil); err == nil {
+		t.Errorf("malformed file accepted")
+	}
+}
+
+// Plain PSK pre master secret: uint16(N) || N zeroes || uint16(N) || psk.
+// Unknown identities and malformed input end in their own alerts
+func TestStageClientKeyExchangePSK(t *testing.T) {
+
+	psk := []byte{0x01, 0x02, 0x03}
+	store, _ := tlssl.NewPSKStore(nil, map[string][]byte{"client1": psk})
+	tCtx := &tlssl.TLSContext{
+		Lg:   testLogger(),
+		Modz: mx.NewModuloZ(),
+		PSK:  store,
+	}
+
+	tCtx.Modz.InitTLSSuite(tCtx.Lg, []suite.Suite{
+		ciphersuites.NewPSK_AES_128_CCM(),
+		ciphersuites.NewDHE_PSK_AES_128_CCM(),
+		ciphersuites.NewECDHE_PSK_CHACHA20_POLY1305_SHA256(),
+	})
+	ecKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	srv, cli := net.Pipe()
+	defer srv.Close()
+	defer cli.Close()
+
+	identity := func(id string, public ...byte) []byte {
+		return append(append([]byte{0x00, byte(len(id))}, id...), public...)
+	}
+
+	tests := []struct {
+		name  string
+		suite uint16
+		body  []byte
+		alert tlssl.AlertDescriptionType // 0 when accepted
+	}{
+		{"known identity", 0xC0A4, identity("client1"), 0},
+		{"unknown identity", 0xC0A4, identity("client2"),
+			tlssl.AlertUnknownPSKIdentity},
+		{"empty identity", 0xC0A4, identity(""), tlssl.AlertDecodeError},
+		{"identity too long", 0xC0A4, []byte{0x00, 0x09, 'c'},
+			tlssl.AlertDecodeError},
+		{"trailing data", 0xC0A4, identity("client1", 0x00),
+			tlssl.AlertDecodeError},
+		{"dh_Yc too short", 0xC0A6, identity("client1", 0x00, 0x02, 0x05),
+			tlssl.AlertDecodeError},
+		{"dh_Yc out of range", 0xC0A6, identity("client1", 0x00, 0x01, 0x01),
+			tlssl.AlertIllegalParameter},
+		{"ECPoint too short", 0xCCAC, identity("client1", 0x20, 0x09),
+			tlssl.AlertDecodeError},
+		{"bad X25519 ECPoint", 0xCCAC, identity("client1", 0x02, 0x09, 0x09),
+			tlssl.AlertIllegalParameter},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var alertErr *tlssl.AlertError
+
+			hCtx := handshake.NewHandShakeContext(tCtx.Lg, srv)
+			hCtx.SetCipherSuite(tt.suite)
+			hCtx.SetDHKey(big.NewInt(7))
+			hCtx.SetECDHKey(ecKey)
+			hCtx.SetBuffer(handshake.CLIENTKEYEXCHANGE, cke(tt.body))
+			err := handshake.NewClientKeyExchange(&handshake.AllContexts{
+				Hctx: hCtx, Tctx: tCtx}).Handle()
+			if tt.alert != 0 {
+				if !errors.As(err, &alertErr) ||
+					alertErr.Description != tt.alert {
+					t.Errorf("expected %v alert, got %v", tt.alert, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := []byte{0, 3, 0, 0, 0, 0, 3, 1, 2, 3}
+			pms := hCtx.GetBuffer(handshake.PREMASTERSECRET)
+			if !bytes.Equal(pms, expected) {
+				t.Errorf("pre master secret mismatch: %x", pms)
+			}
+
+			if string(hCtx.GetPSKIdentity()) != "client1" {
+				t.Errorf("identity not recorded")
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package tester
+
+import (
+	"bytes"
+	"testing"
+	"tlesio/tlssl"
+	"tlesio/tlssl/suite/ciphersuites"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// RFC 7905: nonce is the fixed IV XOR the sequence number and there is no
+// explicit nonce in the record
+func TestAEADRecordChaCha(t *testing.T) {
+
+	keys := &tlssl.Keys{
+		Key: bytes.Repeat([]byte{0x42}, chacha20poly1305.KeySize),
+		IV:  bytes.Repeat([]byte{0x24}, chacha20poly1305.NonceSize),
+	}
+
+	cs := ciphersuites.NewECDHE_RSA_CHACHA20_POLY1305_SHA256()
+	spec := tlssl.NewTLSCipherSpec(cs, keys, tlssl.MODE_MTE,
+		tlssl.TLS_VERSION1_2, nil)
+	if spec == nil {
+		t.Fatal("nil cipher spec")
+	}
+
+	// Finished (sequence number 0)
+	fragment := append([]byte{0x14, 0x00, 0x00, 0x0C}, make([]byte, 12)...)
+	tct, err := spec.EncryptRecord(&tlssl.TLSPlaintext{
+		Header:   &tlssl.TLSHeader{ContentType: tlssl.ContentTypeHandshake},
+		Fragment: fragment,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet, err := tct.Packet(spec.CipherType(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aead, _ := chacha20poly1305.New(keys.Key)
+	aad := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0x16, 0x03, 0x03, 0x00, 0x10}
+	expected := aead.Seal(nil, keys.IV, fragment, aad)
+	if !bytes.Equal(packet[tlssl.TLS_HEADER_SIZE:], expected) {
+		t.Fatalf("record mismatch\n%x\n%x", packet, expected)
+	}
+
+	// One spec per direction, the writer's sequence number is 1 now
+	reader := tlssl.NewTLSCipherSpec(cs, keys, tlssl.MODE_MTE,
+		tlssl.TLS_VERSION1_2, nil)
+	tpt, err := reader.DecryptRecord(&tlssl.TLSCipherText{
+		Header:   tlssl.TLSHead(packet),
+		Fragment: packet[tlssl.TLS_HEADER_SIZE:],
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(tpt.Fragment, fragment) {
+		t.Errorf("plaintext mismatch: %x", tpt.Fragment)
+	}
+}
+
+// Zero length application data seals to a bare tag and opens to nothing,
+// anything shorter than the tag is a bad record MAC
+func TestAEADRecordChaChaEmpty(t *testing.T) {
+
+	keys := &tlssl.Keys{
+		Key: bytes.Repeat([]byte{0x42}, chacha20poly1305.KeySize),
+		IV:  bytes.Repeat([]byte{0x24}, chacha20poly1305.NonceSize),
+	}
+
+	cs := ciphersuites.NewECDHE_RSA_CHACHA20_POLY1305_SHA256()
+	writer := tlssl.NewTLSCipherSpec(cs, keys, tlssl.MODE_MTE,
+		tlssl.TLS_VERSION1_2, nil)
+	reader := tlssl.NewTLSCipherSpec(cs, keys, tlssl.MODE_MTE,
+		tlssl.TLS_VERSION1_2, nil)
+	tct, err := writer.EncryptRecord(&tlssl.TLSPlaintext{
+		Header: &tlssl.TLSHeader{
+			ContentType: tlssl.ContentTypeApplicationData},
+		Fragment: []byte{},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet, err := tct.Packet(writer.CipherType(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(packet) != tlssl.TLS_HEADER_SIZE+chacha20poly1305.Overhead {
+		t.Fatalf("empty record is %v bytes", len(packet))
+	}
+
+	tpt, err := reader.DecryptRecord(&tlssl.TLSCipherText{
+		Header:   tlssl.TLSHead(packet),
+		Fragment: packet[tlssl.TLS_HEADER_SIZE:],
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tpt.Fragment) != 0 {
+		t.Errorf("plaintext of an empty record: %x", tpt.Fragment)
+	}
+
+	short := packet[:len(packet)-1]
+	_, err = reader.DecryptRecord(&tlssl.TLSCipherText{
+		Header:   tlssl.TLSHead(short),
+		Fragment: short[tlssl.TLS_HEADER_SIZE:],
+	})
+
+	if err != tlssl.ErrBadRecordMAC {
+		t.Errorf("record shorter than the tag: %v", err)
+	}
+}
@@ -0,0 +1,219 @@
+package tester
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"testing"
+	"tlesio/tlssl"
+	"tlesio/tlssl/suite/ciphersuites"
+)
+
+// Same spec object for Finished, alerts and application data. Sequence
+// numbers move on with every record and the MAC covers the real type
+func TestCBCRecordSequence(t *testing.T) {
+
+	keys := &tlssl.Keys{
+		MAC: bytes.Repeat([]byte{0x11}, 32),
+		Key: bytes.Repeat([]byte{0x22}, 32),
+		IV:  bytes.Repeat([]byte{0x33}, 16),
+	}
+
+	cs := ciphersuites.NewAES_256_CBC_SHA256()
+	writer := tlssl.NewTLSCipherSpec(cs, keys, tlssl.MODE_MTE,
+		tlssl.TLS_VERSION1_2, nil)
+	reader := tlssl.NewTLSCipherSpec(cs, keys, tlssl.MODE_MTE,
+		tlssl.TLS_VERSION1_2, nil)
+	if writer == nil || reader == nil {
+		t.Fatal("nil cipher spec")
+	}
+
+	records := []*tlssl.TLSPlaintext{
+		{
+			Header:   &tlssl.TLSHeader{ContentType: tlssl.ContentTypeHandshake},
+			Fragment: append([]byte{0x14, 0, 0, 0x0C}, make([]byte, 12)...),
+		},
+		{
+			Header:   &tlssl.TLSHeader{ContentType: tlssl.ContentTypeApplicationData},
+			Fragment: []byte("GET / HTTP/1.1\r\n\r\n"),
+		},
+		{
+			Header:   &tlssl.TLSHeader{ContentType: tlssl.ContentTypeAlert},
+			Fragment: []byte{0x01, 0x00},
+		},
+	}
+
+	var packets [][]byte
+	for _, tpt := range records {
+		tct, err := writer.EncryptRecord(tpt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		packet, err := tct.Packet(writer.CipherType(), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if tlssl.TLSHead(packet).Len != len(packet)-tlssl.TLS_HEADER_SIZE {
+			t.Fatalf("record header length mismatch")
+		}
+
+		packets = append(packets, packet)
+	}
+
+	// Out of order: record 1 read with sequence number 0
+	_, err := tlssl.NewTLSCipherSpec(cs, keys, tlssl.MODE_MTE,
+		tlssl.TLS_VERSION1_2, nil).DecryptRecord(&tlssl.TLSCipherText{
+		Header:   tlssl.TLSHead(packets[1]),
+		Fragment: packets[1][tlssl.TLS_HEADER_SIZE:],
+	})
+
+	if err == nil {
+		t.Errorf("record decrypted with wrong sequence number")
+	}
+
+	// Content type is authenticated
+	forged := append([]byte{}, packets[0]...)
+	forged[0] = byte(tlssl.ContentTypeApplicationData)
+	_, err = tlssl.NewTLSCipherSpec(cs, keys, tlssl.MODE_MTE,
+		tlssl.TLS_VERSION1_2, nil).DecryptRecord(&tlssl.TLSCipherText{
+		Header:   tlssl.TLSHead(forged),
+		Fragment: forged[tlssl.TLS_HEADER_SIZE:],
+	})
+
+	if err == nil {
+		t.Errorf("record decrypted with forged content type")
+	}
+
+	for i, packet := range packets {
+		tpt, err := reader.DecryptRecord(&tlssl.TLSCipherText{
+			Header:   tlssl.TLSHead(packet),
+			Fragment: packet[tlssl.TLS_HEADER_SIZE:],
+		})
+
+		if err != nil {
+			t.Fatalf("record %v: %v", i, err)
+		}
+
+		if !bytes.Equal(tpt.Fragment, records[i].Fragment) {
+			t.Errorf("record %v: plaintext mismatch %x", i, tpt.Fragment)
+		}
+	}
+}
+
+// TLS 1.0 CBC application data goes out as 1 and n-1 byte records, each IV
+// being the last cipher block of the record before it
+func TestCBCSplitRecord(t *testing.T) {
+
+	keys := &tlssl.Keys{
+		MAC: bytes.Repeat([]byte{0x11}, 20),
+		Key: bytes.Repeat([]byte{0x22}, 32),
+		IV:  bytes.Repeat([]byte{0x33}, 16),
+	}
+
+	cs := ciphersuites.NewAES_256_CBC_SHA()
+	writer := tlssl.NewTLSCipherSpec(cs, keys, tlssl.MODE_MTE,
+		tlssl.TLS_VERSION1_0, nil)
+	reader := tlssl.NewTLSCipherSpec(cs, keys, tlssl.MODE_MTE,
+		tlssl.TLS_VERSION1_0, nil)
+	if writer == nil || reader == nil {
+		t.Fatal("nil cipher spec")
+	}
+
+	data := []byte("GET / HTTP/1.1\r\n\r\n")
+	records := writer.SplitRecord(&tlssl.TLSPlaintext{
+		Header:   &tlssl.TLSHeader{ContentType: tlssl.ContentTypeApplicationData},
+		Fragment: data,
+	})
+
+	if len(records) != 2 || !bytes.Equal(records[0].Fragment, data[:1]) ||
+		!bytes.Equal(records[1].Fragment, data[1:]) ||
+		records[0].Header.Len != 1 || records[1].Header.Len != len(data)-1 {
+		t.Fatalf("application data not split 1/n-1: %v records", len(records))
+	}
+
+	// Nothing else is split
+	for _, tpt := range []*tlssl.TLSPlaintext{
+		{
+			Header:   &tlssl.TLSHeader{ContentType: tlssl.ContentTypeApplicationData},
+			Fragment: data[:1],
+		},
+		{
+			Header:   &tlssl.TLSHeader{ContentType: tlssl.ContentTypeAlert},
+			Fragment: []byte{0x01, 0x00},
+		},
+	} {
+		if len(writer.SplitRecord(tpt)) != 1 {
+			t.Errorf("%v record of %v bytes split", tpt.Header.ContentType,
+				len(tpt.Fragment))
+		}
+	}
+
+	tls12 := tlssl.NewTLSCipherSpec(ciphersuites.NewAES_256_CBC_SHA256(),
+		&tlssl.Keys{MAC: make([]byte, 32), Key: keys.Key, IV: keys.IV},
+		tlssl.MODE_MTE, tlssl.TLS_VERSION1_2, nil)
+	if len(tls12.SplitRecord(&tlssl.TLSPlaintext{
+		Header:   &tlssl.TLSHeader{ContentType: tlssl.ContentTypeApplicationData},
+		Fragment: data,
+	})) != 1 {
+		t.Errorf("TLS 1.2 application data split")
+	}
+
+	var bodies [][]byte
+	for _, record := range records {
+		tct, err := writer.EncryptRecord(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		packet, err := tct.Packet(writer.CipherType(), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bodies = append(bodies, packet[tlssl.TLS_HEADER_SIZE:])
+	}
+
+	// No explicit IV: first record under the key block's, second one under
+	// the first record's last block
+	block, err := aes.NewCipher(keys.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ivs := [][]byte{keys.IV, bodies[0][len(bodies[0])-aes.BlockSize:]}
+	for i, body := range bodies {
+		if len(body)%aes.BlockSize != 0 {
+			t.Fatalf("record %v: %v bytes of cipher text", i, len(body))
+		}
+
+		clear := make([]byte, len(body))
+		cipher.NewCBCDecrypter(block, ivs[i]).CryptBlocks(clear, body)
+		if !bytes.HasPrefix(clear, records[i].Fragment) {
+			t.Errorf("record %v: not chained, %x", i, clear)
+		}
+	}
+
+	var got []byte
+	for i, body := range bodies {
+		tpt, err := reader.DecryptRecord(&tlssl.TLSCipherText{
+			Header: &tlssl.TLSHeader{
+				ContentType: tlssl.ContentTypeApplicationData,
+				Version:     tlssl.TLS_VERSION1_0,
+				Len:         len(body),
+			},
+			Fragment: body,
+		})
+
+		if err != nil {
+			t.Fatalf("record %v: %v", i, err)
+		}
+
+		got = append(got, tpt.Fragment...)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Errorf("plaintext mismatch %q", got)
+	}
+}
@@ -0,0 +1,189 @@
+package tester
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"testing"
+	"tlesio/tlssl"
+	"tlesio/tlssl/suite"
+	"tlesio/tlssl/suite/ciphersuites"
+)
+
+// RFC 7366: records are CBC encrypted with their padding and the MAC goes
+// last, over the IV and the cipher text. Expected records are built here
+// with crypto/aes and crypto/hmac
+func TestETMRecord(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		cs      suite.Suite
+		version uint16
+		hash    func() hash.Hash
+	}{
+		{"TLS 1.2", ciphersuites.NewAES_256_CBC_SHA256(),
+			tlssl.TLS_VERSION1_2, sha256.New},
+		{"TLS 1.0, chained IVs", ciphersuites.NewAES_256_CBC_SHA(),
+			tlssl.TLS_VERSION1_0, sha1.New},
+	}
+
+	fragments := [][]byte{{}, []byte("GET / HTTP/1.1\r\n\r\n")}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			keys := &tlssl.Keys{
+				MAC: bytes.Repeat([]byte{0x11}, tt.hash().Size()),
+				Key: bytes.Repeat([]byte{0x22}, 32),
+				IV:  bytes.Repeat([]byte{0x33}, aes.BlockSize),
+			}
+
+			random := bytes.Repeat([]byte{0x44}, 64)
+			writer := tlssl.NewTLSCipherSpec(tt.cs, keys, tlssl.MODE_ETM,
+				tt.version, bytes.NewReader(random))
+			reader := tlssl.NewTLSCipherSpec(tt.cs, keys, tlssl.MODE_ETM,
+				tt.version, nil)
+			if writer == nil || reader == nil {
+				t.Fatal("nil cipher spec")
+			}
+
+			chainIV := keys.IV
+			for seq, fragment := range fragments {
+				tct, err := writer.EncryptRecord(&tlssl.TLSPlaintext{
+					Header: &tlssl.TLSHeader{
+						ContentType: tlssl.ContentTypeApplicationData},
+					Fragment: fragment,
+				})
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				packet, err := tct.Packet(writer.CipherType(), false)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				explicitIV := random[seq*aes.BlockSize : (seq+1)*aes.BlockSize]
+				iv := explicitIV
+				if tt.version == tlssl.TLS_VERSION1_0 {
+					iv, explicitIV = chainIV, nil
+				}
+
+				expected := etmRecord(t, tt.hash, keys, tt.version,
+					uint64(seq), iv, explicitIV, etmPadding(fragment))
+				if !bytes.Equal(packet, expected) {
+					t.Fatalf("record %v mismatch\n%x\n%x", seq, packet,
+						expected)
+				}
+
+				macAt := len(packet) - tt.hash().Size()
+				chainIV = packet[macAt-aes.BlockSize : macAt]
+				tpt, err := reader.DecryptRecord(&tlssl.TLSCipherText{
+					Header:   tlssl.TLSHead(packet),
+					Fragment: packet[tlssl.TLS_HEADER_SIZE:],
+				})
+
+				if err != nil {
+					t.Fatalf("record %v: %v", seq, err)
+				}
+
+				if !bytes.Equal(tpt.Fragment, fragment) {
+					t.Errorf("record %v: plaintext %x", seq, tpt.Fragment)
+				}
+			}
+		})
+	}
+}
+
+// Cipher text or MAC changed, a padding under a good MAC: all of them are
+// bad_record_mac
+func TestETMRecordTampered(t *testing.T) {
+
+	keys := &tlssl.Keys{
+		MAC: bytes.Repeat([]byte{0x11}, sha256.Size),
+		Key: bytes.Repeat([]byte{0x22}, 32),
+		IV:  bytes.Repeat([]byte{0x33}, aes.BlockSize),
+	}
+
+	cs := ciphersuites.NewAES_256_CBC_SHA256()
+	iv := bytes.Repeat([]byte{0x44}, aes.BlockSize)
+	good := etmRecord(t, sha256.New, keys, tlssl.TLS_VERSION1_2, 0, iv, iv,
+		etmPadding([]byte("ping")))
+	cipherFlip := append([]byte{}, good...)
+	cipherFlip[tlssl.TLS_HEADER_SIZE+aes.BlockSize] ^= 0x01
+	macFlip := append([]byte{}, good...)
+	macFlip[len(macFlip)-1] ^= 0x01
+	badPadding := append([]byte("ping"), bytes.Repeat([]byte{0x0A}, 11)...)
+	badPadding = append(badPadding, 0x0B)
+	tests := []struct {
+		name   string
+		record []byte
+	}{
+		{"cipher text", cipherFlip},
+		{"MAC", macFlip},
+		{"padding", etmRecord(t, sha256.New, keys, tlssl.TLS_VERSION1_2, 0,
+			iv, iv, badPadding)},
+		{"no MAC", good[:len(good)-sha256.Size]},
+	}
+
+	for _, tt := range tests {
+		reader := tlssl.NewTLSCipherSpec(cs, keys, tlssl.MODE_ETM,
+			tlssl.TLS_VERSION1_2, nil)
+		_, err := reader.DecryptRecord(&tlssl.TLSCipherText{
+			Header:   tlssl.TLSHead(tt.record),
+			Fragment: tt.record[tlssl.TLS_HEADER_SIZE:],
+		})
+
+		if err != tlssl.ErrBadRecordMAC {
+			t.Errorf("%v: %v", tt.name, err)
+		}
+	}
+
+	reader := tlssl.NewTLSCipherSpec(cs, keys, tlssl.MODE_ETM,
+		tlssl.TLS_VERSION1_2, nil)
+	if _, err := reader.DecryptRecord(&tlssl.TLSCipherText{
+		Header:   tlssl.TLSHead(good),
+		Fragment: good[tlssl.TLS_HEADER_SIZE:],
+	}); err != nil {
+		t.Errorf("untouched record: %v", err)
+	}
+}
+
+// Application data record: IV, CBC(padded) and the MAC over both
+func etmRecord(t *testing.T, h func() hash.Hash, keys *tlssl.Keys,
+	version uint16, seq uint64, iv, explicitIV, padded []byte) []byte {
+
+	block, err := aes.NewCipher(keys.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := append([]byte{}, explicitIV...)
+	ciphered := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphered, padded)
+	body = append(body, ciphered...)
+	mac := hmac.New(h, keys.MAC)
+	binary.Write(mac, binary.BigEndian, seq)
+	mac.Write([]byte{byte(tlssl.ContentTypeApplicationData),
+		byte(version >> 8), byte(version), byte(len(body) >> 8),
+		byte(len(body))})
+	mac.Write(body)
+	body = mac.Sum(body)
+	return append(tlssl.TLSHeadPacket(&tlssl.TLSHeader{
+		ContentType: tlssl.ContentTypeApplicationData,
+		Version:     version,
+		Len:         len(body),
+	}), body...)
+}
+
+func etmPadding(fragment []byte) []byte {
+
+	n := aes.BlockSize - len(fragment)%aes.BlockSize
+	return append(append([]byte{}, fragment...),
+		bytes.Repeat([]byte{byte(n - 1)}, n)...)
+}
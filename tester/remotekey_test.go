@@ -0,0 +1,240 @@
+package tester
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"tlesio/tlssl/remotekey"
+)
+
+// Key whose first operation waits until 'release' is closed, the rest
+// go through
+type xHeldKey struct {
+	crypto.Signer
+	first   atomic.Bool
+	held    chan struct{}
+	release chan struct{}
+}
+
+func (x *xHeldKey) hold() {
+
+	if x.first.CompareAndSwap(false, true) {
+		close(x.held)
+		<-x.release
+	}
+}
+
+func (x *xHeldKey) Sign(rand io.Reader, digest []byte,
+	opts crypto.SignerOpts) ([]byte, error) {
+
+	x.hold()
+	return x.Signer.Sign(rand, digest, opts)
+}
+
+func (x *xHeldKey) Decrypt(rand io.Reader, msg []byte,
+	opts crypto.DecrypterOpts) ([]byte, error) {
+
+	x.hold()
+	return x.Signer.(crypto.Decrypter).Decrypt(rand, msg, opts)
+}
+
+// Server keys behind Unix sockets: RSA key exchange decrypts remotely,
+// ECDHE signs remotely, and a stuck key operation holds up its own
+// handshake only
+func TestRemoteKey(t *testing.T) {
+
+	pki := newInteropPKI(t)
+	rsaKey := &xHeldKey{Signer: serveKey(t, pki.serverRSA),
+		held: make(chan struct{}), release: make(chan struct{})}
+	rsaSock := listenKey(t, "rsa.sock", rsaKey)
+	ecSock := listenKey(t, "ec.sock", serveKey(t, pki.serverEC))
+	addr := startServer(t, fmt.Sprintf("%v:unix:%v,%v:unix:%v",
+		pki.serverRSA[0], rsaSock, pki.serverEC[0], ecSock), nil)
+
+	dial := func(suite uint16) error {
+		config := &tls.Config{RootCAs: pki.roots, ServerName: "localhost"}
+		tls12(suite, tls.X25519, tls.CurveP256)(config)
+		_, err := dialEcho(addr, config)
+		return err
+	}
+
+	pending := make(chan error, 1)
+	go func() { pending <- dial(tls.TLS_RSA_WITH_AES_256_CBC_SHA) }()
+	select {
+	case <-rsaKey.held:
+	case <-time.After(5 * time.Second):
+		t.Fatal("remote decryption never started")
+	}
+
+	for _, suite := range []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	} {
+		if err := dial(suite); err != nil {
+			t.Errorf("suite 0x%04X while a key operation is pending: %v",
+				suite, err)
+		}
+	}
+
+	close(rsaKey.release)
+	if err := <-pending; err != nil {
+		t.Errorf("held handshake: %v", err)
+	}
+
+	if _, err := remotekey.Dial(filepath.Join(t.TempDir(), "none.sock"),
+		time.Second); err == nil {
+		t.Errorf("dialed a key nobody serves")
+	}
+}
+
+// Key service side of the connections, for the test to drop them. Each
+// one closed, by either side, is a value on 'closed'
+type xKeyListener struct {
+	net.Listener
+	mu     sync.Mutex
+	conns  []net.Conn
+	closed chan struct{}
+}
+
+type xKeyConn struct {
+	net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (x *xKeyListener) Accept() (net.Conn, error) {
+
+	conn, err := x.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.conns = append(x.conns, conn)
+	return &xKeyConn{Conn: conn, closed: x.closed}, nil
+}
+
+// Listener closed and every connection dropped, as a key service restart
+func (x *xKeyListener) drop() {
+
+	x.Listener.Close()
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, conn := range x.conns {
+		conn.Close()
+	}
+}
+
+func (x *xKeyConn) Close() error {
+
+	x.once.Do(func() { x.closed <- struct{}{} })
+	return x.Conn.Close()
+}
+
+// An idle connection the key service dropped is replaced on the next
+// operation, once
+func TestRemoteKeyReconnect(t *testing.T) {
+
+	pki := newInteropPKI(t)
+	signer := serveKey(t, pki.serverRSA)
+	path := filepath.Join(t.TempDir(), "rsa.sock")
+	first := listenKeyOn(t, path, signer)
+	key, err := remotekey.Dial(path, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer key.Close()
+	first.drop()
+	<-first.closed
+	second := listenKeyOn(t, path, signer)
+	digest := sha256.Sum256([]byte("reconnect"))
+	signature, err := key.Sign(nil, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("sign after the key service restart: %v", err)
+	}
+
+	if err := rsa.VerifyPKCS1v15(signer.Public().(*rsa.PublicKey),
+		crypto.SHA256, digest[:], signature); err != nil {
+		t.Errorf("signature: %v", err)
+	}
+
+	second.drop()
+	if _, err := key.Sign(nil, digest[:], crypto.SHA256); err == nil {
+		t.Errorf("signed with the key service gone")
+	}
+}
+
+// The server's connections to its remote keys go with it
+func TestRemoteKeyServerClose(t *testing.T) {
+
+	pki := newInteropPKI(t)
+	path := filepath.Join(t.TempDir(), "rsa.sock")
+	ln := listenKeyOn(t, path, serveKey(t, pki.serverRSA))
+	t.Setenv("TLS_CERTS", pki.serverRSA[0]+":unix:"+path)
+	t.Setenv("TLS_LOG_LEVEL", "error")
+	srv, _, _ := serveShutdown(t)
+	select {
+	case <-ln.closed:
+		t.Fatal("remote key connection closed before the server")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	srv.Close()
+	select {
+	case <-ln.closed:
+	case <-time.After(5 * time.Second):
+		t.Error("remote key connection still open after Close")
+	}
+}
+
+func serveKey(t *testing.T, paths [2]string) crypto.Signer {
+
+	pair, err := tls.LoadX509KeyPair(paths[0], paths[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pair.PrivateKey.(crypto.Signer)
+}
+
+// Socket path serving 'key' until the test ends
+func listenKey(t *testing.T, name string, key crypto.Signer) string {
+
+	path := filepath.Join(t.TempDir(), name)
+	listenKeyOn(t, path, key)
+	return path
+}
+
+// Same as listenKey, at 'path' and with the connections at hand
+func listenKeyOn(t *testing.T, path string,
+	key crypto.Signer) *xKeyListener {
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracked := &xKeyListener{Listener: ln, closed: make(chan struct{}, 16)}
+	done := make(chan error, 1)
+	go func() { done <- remotekey.Serve(tracked, key) }()
+	t.Cleanup(func() {
+		tracked.drop()
+		if err := <-done; err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+	})
+
+	return tracked
+}
@@ -0,0 +1,180 @@
+package tester
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"tlesio/server"
+	"tlesio/tlssl"
+	"tlesio/tlssl/capture"
+)
+
+// Captured connections replay byte for byte. A changed client record or
+// missing randomness shows up as a divergence
+func TestCaptureReplay(t *testing.T) {
+
+	pki := newInteropPKI(t)
+	dir := t.TempDir()
+	pskFile := filepath.Join(dir, "psk.txt")
+	os.WriteFile(pskFile, []byte("client1:000102030405060708090a0b0c0d0e0f\n"),
+		0600)
+
+	captures := filepath.Join(dir, "captures")
+	srv, addr := startCaptureServer(t, map[string]string{
+		"TLS_CERTS":       pki.serverRSA[0] + ":" + pki.serverRSA[1],
+		"TLS_PSK_FILE":    pskFile,
+		"TLS_CAPTURE_DIR": captures,
+	})
+
+	key := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	config := &tls.Config{RootCAs: pki.roots, ServerName: "localhost"}
+	tls12(tls.TLS_RSA_WITH_AES_256_CBC_SHA)(config)
+	if _, err := dialEcho(addr, config); err != nil {
+		t.Fatal(err)
+	}
+
+	// ECDHE_PSK, DHE_PSK and ECDHE_RSA (RSA-PSS signature)
+	for _, id := range []uint16{0xCCAC, 0xC0A6, 0xCCA8} {
+		cfg := &tlssl.ClientConfig{RootCAs: pki.roots, ServerName: "localhost"}
+		pskSuites(key, id)(cfg)
+		if _, err := clientEcho(addr, cfg); err != nil {
+			t.Fatalf("0x%04X: %v", id, err)
+		}
+	}
+
+	// Capture files are complete once their connection is gone
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	paths, _ := filepath.Glob(filepath.Join(captures, "*.jsonl"))
+	if len(paths) != 4 {
+		t.Fatalf("expected 4 captures, got %v", len(paths))
+	}
+
+	// Handshakes only: no key log, no more captures
+	keyLog := filepath.Join(dir, "keys.log")
+	t.Setenv("TLS_KEYLOG_FILE", keyLog)
+	replayer, err := server.NewReplayer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer replayer.Close()
+	for _, path := range paths {
+		entries, err := capture.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		report, err := replayer.Replay(entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if report.Err != nil || report.Diverged >= 0 || report.Records < 5 {
+			t.Errorf("%v: %v", path, report)
+		}
+
+		// Without the server's randomness ServerHello is already different
+		report, err = replayer.Replay(withoutRand(entries))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if report.Diverged != 0 || report.Err == nil {
+			t.Errorf("%v without randomness: %v", path, report)
+		}
+
+		// A bad client Finished gets an alert instead of the server's
+		// ChangeCipherSpec
+		report, err = replayer.Replay(badFinished(t, entries))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		diverged := report.Got
+		if report.Err == nil || diverged == nil ||
+			tlssl.ContentTypeType(diverged[0]) != tlssl.ContentTypeAlert {
+			t.Errorf("%v with a bad Finished: %v", path, report)
+		}
+	}
+
+	if _, err := replayer.Replay(nil); err == nil {
+		t.Errorf("empty capture replayed")
+	}
+
+	if _, err := os.Stat(keyLog); !os.IsNotExist(err) {
+		t.Errorf("replay opened the key log: %v", err)
+	}
+
+	if paths, _ = filepath.Glob(filepath.Join(captures, "*")); len(paths) != 4 {
+		t.Errorf("replay captured, %v files", len(paths))
+	}
+}
+
+func startCaptureServer(t *testing.T, env map[string]string) (server.Server,
+	string) {
+
+	t.Setenv("TLS_LOG_LEVEL", "error")
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+
+	srv, err := server.NewServer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Close() })
+	return srv, listener.Addr().String()
+}
+
+func withoutRand(entries []*capture.Entry) []*capture.Entry {
+
+	var kept []*capture.Entry
+
+	for _, entry := range entries {
+		if entry.Dir != capture.DirRand {
+			kept = append(kept, entry)
+		}
+	}
+
+	return kept
+}
+
+// Last handshake record from the client is its (protected) Finished
+func badFinished(t *testing.T, entries []*capture.Entry) []*capture.Entry {
+
+	last := -1
+	changed := make([]*capture.Entry, len(entries))
+	for i, entry := range entries {
+		changed[i] = entry
+		if entry.Dir == capture.DirIn &&
+			tlssl.ContentTypeType(entry.Data[0]) == tlssl.ContentTypeHandshake {
+			last = i
+		}
+	}
+
+	if last < 0 {
+		t.Fatal("no client handshake records in capture")
+	}
+
+	finished := *entries[last]
+	finished.Data = append([]byte{}, finished.Data...)
+	finished.Data[len(finished.Data)-1] ^= 0x01
+	changed[last] = &finished
+	return changed
+}
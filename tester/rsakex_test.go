@@ -0,0 +1,83 @@
+package tester
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"tlesio/tlssl/handshake"
+)
+
+// Bad padding, a wrong length or a wrong client_version are no errors: the
+// pre master secret is just not the client's (RFC 5246 7.4.7.1)
+func TestRSAKeyExchangeOracle(t *testing.T) {
+
+	tCtx := goldenContext(t, io.Discard)
+	cert := tCtx.Modz.Certs.GetByCriteria(0, "")
+	pub := cert.PublicKey.(*rsa.PublicKey)
+	good := append([]byte{0x03, 0x03}, bytes.Repeat([]byte{0xAB}, 46)...)
+	oldVersion := append([]byte{0x03, 0x01}, good[2:]...)
+
+	// Block type 2 expected, 1 sent
+	badBlock := append([]byte{0x00, 0x01}, bytes.Repeat([]byte{0xFF},
+		pub.Size()-2-len(good)-1)...)
+	badBlock = append(append(badBlock, 0x00), good...)
+	badPadding := new(big.Int).Exp(new(big.Int).SetBytes(badBlock),
+		big.NewInt(int64(pub.E)), pub.N).FillBytes(make([]byte, pub.Size()))
+
+	tests := []struct {
+		name      string
+		encrypted []byte
+		same      int // PMS bytes equal to 'good' from this one on, -1 none
+	}{
+		{"valid", encryptPMS(t, pub, good), 0},
+		{"client_version mismatch", encryptPMS(t, pub, oldVersion), 2},
+		{"short secret", encryptPMS(t, pub, good[:47]), -1},
+		{"bad padding", badPadding, -1},
+	}
+
+	srv, cli := net.Pipe()
+	defer srv.Close()
+	defer cli.Close()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			hCtx := handshake.NewHandShakeContext(tCtx.Lg, srv)
+			hCtx.SetCipherSuite(0x003D)
+			hCtx.SetCert(cert)
+			hCtx.SetMsgHello(&handshake.MsgHello{Version: [2]byte{3, 3}})
+			body := append([]byte{byte(len(tt.encrypted) >> 8),
+				byte(len(tt.encrypted))}, tt.encrypted...)
+			hCtx.SetBuffer(handshake.CLIENTKEYEXCHANGE, cke(body))
+			err := handshake.NewClientKeyExchange(&handshake.AllContexts{
+				Hctx: hCtx, Tctx: tCtx}).Handle()
+			if err != nil {
+				t.Fatalf("ClientKeyExchange failed: %v", err)
+			}
+
+			pms := hCtx.GetBuffer(handshake.PREMASTERSECRET)
+			if len(pms) != 48 || pms[0] != 0x03 || pms[1] != 0x03 {
+				t.Fatalf("pre master secret: %x", pms)
+			}
+
+			same := bytes.Equal(pms[2:], good[2:])
+			if tt.same >= 0 && !bytes.Equal(pms[tt.same:], good[tt.same:]) ||
+				tt.same < 0 && same {
+				t.Errorf("pre master secret %x, client's %x", pms, good)
+			}
+		})
+	}
+}
+
+func encryptPMS(t *testing.T, pub *rsa.PublicKey, pms []byte) []byte {
+
+	encrypted, err := rsa.EncryptPKCS1v15(rand.Reader, pub, pms)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return encrypted
+}
@@ -0,0 +1,171 @@
+package tester
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+	"tlesio/server"
+)
+
+// Client connection whose second write (its second flight) waits until
+// 'release' is closed
+type xGatedConn struct {
+	net.Conn
+	writes  int
+	held    chan struct{}
+	release chan struct{}
+}
+
+func (x *xGatedConn) Write(b []byte) (int, error) {
+
+	x.writes++
+	if x.writes == 2 {
+		close(x.held)
+		<-x.release
+	}
+
+	return x.Conn.Write(b)
+}
+
+// Shutdown lets a handshake in progress finish, says close_notify to every
+// established connection and gives up on its context
+func TestShutdown(t *testing.T) {
+
+	pki := newInteropPKI(t)
+	config := &tls.Config{RootCAs: pki.roots, ServerName: "localhost"}
+	tls12(tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		tls.X25519)(config)
+	t.Setenv("TLS_CERTS", pki.serverRSA[0]+":"+pki.serverRSA[1])
+	t.Setenv("TLS_LOG_LEVEL", "error")
+
+	t.Run("drain", func(t *testing.T) {
+
+		srv, addr, served := serveShutdown(t)
+		established, err := tls.Dial("tcp", addr, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer established.Close()
+		if _, err := established.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := io.ReadFull(established, make([]byte, 4)); err != nil {
+			t.Fatal(err)
+		}
+
+		raw, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		gated := &xGatedConn{Conn: raw, held: make(chan struct{}),
+			release: make(chan struct{})}
+		pending := tls.Client(gated, config)
+		defer pending.Close()
+		handshake := make(chan error, 1)
+		go func() { handshake <- pending.Handshake() }()
+		select {
+		case <-gated.held:
+		case <-time.After(5 * time.Second):
+			t.Fatal("client flight never sent")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(),
+			5*time.Second)
+		defer cancel()
+		shutdown := make(chan error, 1)
+		go func() { shutdown <- srv.Shutdown(ctx) }()
+
+		// Established: close_notify
+		established.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := established.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("established connection: expected close_notify, got %v",
+				err)
+		}
+
+		if err := <-served; !errors.Is(err, server.ErrServerClosed) {
+			t.Errorf("Serve: %v", err)
+		}
+
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			t.Errorf("new connection accepted while shutting down")
+		}
+
+		select {
+		case err := <-shutdown:
+			t.Fatalf("Shutdown returned with a handshake pending: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		// In flight: finishes, then close_notify
+		close(gated.release)
+		if err := <-handshake; err != nil {
+			t.Fatalf("pending handshake: %v", err)
+		}
+
+		pending.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := pending.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("drained connection: expected close_notify, got %v", err)
+		}
+
+		if err := <-shutdown; err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+
+		srv, addr, served := serveShutdown(t)
+		stalled, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer stalled.Close()
+		ctx, cancel := context.WithTimeout(context.Background(),
+			200*time.Millisecond)
+		defer cancel()
+
+		// Let the server take it before shutting down
+		time.Sleep(50 * time.Millisecond)
+		if err := srv.Shutdown(ctx); !errors.Is(err,
+			context.DeadlineExceeded) {
+			t.Errorf("Shutdown: expected the context error, got %v", err)
+		}
+
+		stalled.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := stalled.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("stalled connection not closed: %v", err)
+		}
+
+		if err := <-served; !errors.Is(err, server.ErrServerClosed) {
+			t.Errorf("Serve: %v", err)
+		}
+	})
+}
+
+// Server on a loopback listener, Serve's result on the channel
+func serveShutdown(t *testing.T) (server.Server, string, chan error) {
+
+	srv, err := server.NewServer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(listener) }()
+	t.Cleanup(func() { srv.Close() })
+	return srv, listener.Addr().String(), served
+}
@@ -1,6 +1,9 @@
 package tester
 
 import (
+	"bytes"
+	"errors"
+	"io"
 	"math"
 	"net"
 	"os"
@@ -12,81 +15,187 @@ import (
 
 var _HANDSHAKE_TIMEOUT_ = 3
 
+// Fake messages, not handshake ids
+const (
+	_BIG_CKE_SPLIT_ = iota + 1000 // 3000 bytes in 1000 bytes records
+	_CKE_HALF_                    // First record of the above only
+	_CKE_TWICE_                   // Two ClientKeyExchange, one record
+)
+
 type xFakeConn struct {
 	net.Conn
 	deadlineSec int
 	msgsCtr     int
 	msgs        []int
-	modo        int
+	modo        int // 0 all at once, 1 a record per read, 2 a byte per read
 	sleepp      int
+	pending     []byte
 }
 
+// Client's second flight must come in order, nothing more, nothing less
 func TestStageFinishedClient(t *testing.T) {
 
-	var newCtx handshake.AllContexts
+	var alertErr *tlssl.AlertError
 
-	lg := testLogger()
-	newCtx.Hctx = testCtxHandshake(&testHandshakeCtxData{
-		comms: &xFakeConn{msgs: msgsToSend()},
-		//comms:    &xFakeConn{msgs: msgsToSend(), modo: 1, sleepp: 400},
-		stage:    handshake.STAGE_SERVERHELLODONE,
-		expected: handshake.CLIENTKEYEXCHANGE | handshake.CHANGECIPHERSPEC,
-	})
-
-	if newCtx.Hctx == nil {
-		t.Errorf("Error: %v", "nil handshake context")
-		return
+	tests := []struct {
+		name string
+		msgs []int
+		modo int
+		ok   bool
+	}{
+		{"in order", msgsToSend(), 0, true},
+		{"one record per read", msgsToSend(), 1, true},
+		{"one byte per read", msgsToSend(), 2, true},
+		{"message split across records", []int{
+			_BIG_CKE_SPLIT_,
+			handshake.CHANGECIPHERSPEC,
+			handshake.FINISHED,
+		}, 1, true},
+		// Left for whoever reads after the handshake
+		{"record after Finished", append(msgsToSend(),
+			handshake.COMPLETEHANDSHAKE), 0, true},
+		{"ChangeCipherSpec inside a message", []int{
+			_CKE_HALF_,
+			handshake.CHANGECIPHERSPEC,
+			handshake.FINISHED,
+		}, 0, false},
+		{"two messages in a record", []int{
+			_CKE_TWICE_,
+			handshake.CHANGECIPHERSPEC,
+			handshake.FINISHED,
+		}, 0, false},
+		{"out of order", []int{
+			handshake.CERTIFICATE,
+			handshake.CLIENTKEYEXCHANGE,
+			handshake.FINISHED,
+			handshake.CERTIFICATEVERIFY,
+			handshake.CHANGECIPHERSPEC,
+		}, 0, false},
+		{"duplicated", []int{
+			handshake.CLIENTKEYEXCHANGE,
+			handshake.CLIENTKEYEXCHANGE,
+			handshake.CHANGECIPHERSPEC,
+			handshake.FINISHED,
+		}, 0, false},
+		{"no ClientKeyExchange", []int{
+			handshake.CHANGECIPHERSPEC,
+			handshake.FINISHED,
+		}, 0, false},
+		{"ClientHello mid-handshake", []int{
+			handshake.CLIENTHELLO,
+			handshake.CLIENTKEYEXCHANGE,
+			handshake.CHANGECIPHERSPEC,
+			handshake.FINISHED,
+		}, 0, false},
+		{"application data", []int{
+			handshake.CLIENTKEYEXCHANGE,
+			handshake.COMPLETEHANDSHAKE,
+			handshake.CHANGECIPHERSPEC,
+			handshake.FINISHED,
+		}, 0, false},
 	}
 
-	newCtx.Tctx = &tlssl.TLSContext{
-		Lg: lg,
-	}
+	lg := testLogger()
+	for _, tt := range tests {
+		var newCtx handshake.AllContexts
+
+		conn := &xFakeConn{msgs: tt.msgs, modo: tt.modo}
+
+		newCtx.Hctx = testCtxHandshake(&testHandshakeCtxData{
+			comms: conn,
+			stage: handshake.STAGE_SERVERHELLODONE,
+		})
+
+		if newCtx.Hctx == nil {
+			t.Fatalf("Error: %v", "nil handshake context")
+		}
+
+		newCtx.Tctx = &tlssl.TLSContext{
+			Lg: lg,
+		}
+
+		transit := handshake.NewTransition(&newCtx)
+		lg.Infof("Starting test: %v", tt.name)
+		err := transit.Handle()
+		if tt.ok {
+			if err != nil {
+				t.Errorf("%v: %v", tt.name, err)
+			}
 
-	transit := handshake.NewTransition(&newCtx)
-	lg.Info("Starting test")
-	if err := transit.Handle(); err != nil {
-		t.Errorf("Error: %v", err)
+			continue
+		}
+
+		if !errors.As(err, &alertErr) ||
+			alertErr.Description != tlssl.AlertUnexpectedMessage {
+			t.Errorf("%v: expected unexpected_message, got %v", tt.name, err)
+		}
 	}
 }
 
 func (x *xFakeConn) Read(b []byte) (int, error) {
 
-	var all []byte
-
-	for _, m := range x.msgs[x.msgsCtr:] {
+	for len(x.pending) == 0 && x.msgsCtr < len(x.msgs) {
+		m := x.msgs[x.msgsCtr]
+		x.msgsCtr++
 		if x.sleepp > 0 {
 			time.Sleep(time.Duration(x.sleepp) * time.Millisecond)
 		}
 
 		switch m {
 		case handshake.CHANGECIPHERSPEC:
-			all = append(all, changeCipherSpec()...)
+			x.pending = append(x.pending, changeCipherSpec()...)
 
 		case handshake.CERTIFICATE:
-			all = append(all, certificate()...)
+			x.pending = append(x.pending, certificate()...)
 
 		case handshake.CLIENTKEYEXCHANGE:
-			all = append(all, clientKeyExchange()...)
+			x.pending = append(x.pending, clientKeyExchange()...)
 
 		case handshake.CERTIFICATEVERIFY:
-			all = append(all, certificateVerify()...)
+			x.pending = append(x.pending, certificateVerify()...)
 
 		case handshake.FINISHED:
-			all = append(all, finished()...)
+			x.pending = append(x.pending, finished()...)
+
+		case handshake.CLIENTHELLO:
+			x.pending = append(x.pending, clientHello()...)
+
+		case handshake.COMPLETEHANDSHAKE:
+			x.pending = append(x.pending, applicationData()...)
+
+		case _BIG_CKE_SPLIT_:
+			x.pending = append(x.pending, bigClientKeyExchange()...)
+
+		case _CKE_HALF_:
+			x.pending = append(x.pending, bigClientKeyExchange()[:1005]...)
+
+		case _CKE_TWICE_:
+			twice := append(clientKeyExchange(), clientKeyExchange()[5:]...)
+			twice[4] = byte(len(twice) - 5)
+			x.pending = append(x.pending, twice...)
 
 		case _HANDSHAKE_TIMEOUT_:
 			time.Sleep(time.Duration(_HANDSHAKE_TIMEOUT_) * time.Second)
 			return 0, os.ErrDeadlineExceeded
 		}
 
-		if x.modo == 1 {
-			x.msgsCtr++
+		if x.modo != 0 {
 			break
 		}
 	}
 
-	copy(b, all)
-	return len(all), nil
+	if len(x.pending) == 0 {
+		return 0, io.EOF
+	}
+
+	n := len(x.pending)
+	if x.modo == 2 {
+		n = 1
+	}
+
+	n = copy(b, x.pending[:n])
+	x.pending = x.pending[n:]
+	return n, nil
 }
 
 func (x *xFakeConn) SetDeadline(t time.Time) error {
@@ -97,11 +206,9 @@ func (x *xFakeConn) SetDeadline(t time.Time) error {
 func msgsToSend() []int {
 
 	return []int{
-		handshake.CERTIFICATE,
 		handshake.CLIENTKEYEXCHANGE,
-		handshake.FINISHED,
-		handshake.CERTIFICATEVERIFY,
 		handshake.CHANGECIPHERSPEC,
+		handshake.FINISHED,
 	}
 }
 
@@ -149,6 +256,24 @@ func clientKeyExchange() []byte {
 		0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18,
 	}
 }
+
+// ClientKeyExchange with a 3000 bytes body in three handshake records
+func bigClientKeyExchange() []byte {
+
+	var records []byte
+
+	body := bytes.Repeat([]byte{0xAB}, 3000)
+	msg := append([]byte{0x10, 0x00, 0x0B, 0xB8}, body...)
+	for len(msg) > 0 {
+		n := min(len(msg), 1000)
+		records = append(records, 0x16, 0x03, 0x03, byte(n>>8), byte(n))
+		records = append(records, msg[:n]...)
+		msg = msg[n:]
+	}
+
+	return records
+}
+
 func certificateVerify() []byte {
 
 	return []byte{
@@ -186,3 +311,25 @@ func finished() []byte {
 		0x09, 0x0A, 0x0B, 0x0C,
 	}
 }
+
+func clientHello() []byte {
+
+	return []byte{
+		// Content Type (Handshake)
+		0x16,
+		// Version (TLS 1.2)
+		0x03, 0x03,
+		// Length (1 + 3 + 4)
+		0x00, 0x08,
+		// Handshake Type (ClientHello)
+		0x01,
+		// Handshake Length (4 bytes)
+		0x00, 0x00, 0x04,
+		// Truncated body, never parsed
+		0x03, 0x03, 0x00, 0x00,
+	}
+}
+
+func applicationData() []byte {
+	return []byte{0x17, 0x03, 0x03, 0x00, 0x04, 0xDE, 0xAD, 0xBE, 0xEF}
+}
@@ -0,0 +1,101 @@
+package tester
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"tlesio/tlssl"
+	"tlesio/tlssl/handshake"
+)
+
+// One JSON object per event, nothing but the event's own fields
+func TestJSONTracer(t *testing.T) {
+
+	var out bytes.Buffer
+
+	tCtx := &tlssl.TLSContext{Tracer: handshake.NewJSONTracer(&out)}
+	tCtx.Trace(7, &tlssl.TraceEvent{
+		Kind: tlssl.TraceClientHello,
+		Hello: &tlssl.TraceHello{Version: tlssl.TLS_VERSION1_2,
+			Extensions: []uint16{0x0A0A, 0x0000}},
+	})
+
+	tlssl.TraceRecords(tCtx.Tracer, 7, tlssl.TraceRecordSent,
+		append(changeCipherSpec(), finished()...))
+	tCtx.Trace(7, &tlssl.TraceEvent{
+		Kind: tlssl.TraceHandshakeDone,
+		Err:  errors.New("boom"),
+	})
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	expected := []string{"client_hello", "record_sent", "record_sent",
+		"handshake_done"}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %v events, got %v", len(expected), len(lines))
+	}
+
+	for i, line := range lines {
+		var ev map[string]interface{}
+
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			t.Fatalf("%v: %v", line, err)
+		}
+
+		if ev["event"] != expected[i] || ev["conn_id"] != float64(7) {
+			t.Errorf("unexpected event: %v", line)
+		}
+
+		if _, ok := ev["suite"]; ok {
+			t.Errorf("field from another event kind: %v", line)
+		}
+	}
+
+	if !strings.Contains(lines[0], `"extensions":["0x0A0A","0x0000"]`) ||
+		!strings.Contains(lines[2], `"record_len":16`) ||
+		!strings.Contains(lines[3], `"error":"boom"`) {
+		t.Errorf("unexpected event fields:\n%v", out.String())
+	}
+
+	// No tracer, no events, no panic
+	(&tlssl.TLSContext{}).Trace(1, &tlssl.TraceEvent{Kind: tlssl.TraceAlert})
+}
+
+// Every extension the client sent is traced, GREASE and unknown ones too
+func TestTraceHelloExtensions(t *testing.T) {
+
+	var out bytes.Buffer
+
+	tCtx := goldenContext(t, &out)
+	conn := &xReplayConn{in: clientHelloRecord(0x003D, helloExt(0x0A0A),
+		helloExt(0x0000, 0x00, 0x06, 0x00, 0x00, 0x03, 'a', '.', 'b'),
+		helloExt(0xFE0D, 0x01))}
+	replayGolden(tCtx, conn)
+
+	var ev struct {
+		Hello struct {
+			Extensions []string `json:"extensions"`
+			SNI        string   `json:"sni"`
+		} `json:"client_hello"`
+	}
+
+	for _, line := range strings.Split(out.String(), "\n") {
+		if !strings.Contains(line, `"event":"client_hello"`) {
+			continue
+		}
+
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			t.Fatalf("%v: %v", line, err)
+		}
+
+		exts := strings.Join(ev.Hello.Extensions, " ")
+		if exts != "0x0A0A 0x0000 0xFE0D" || ev.Hello.SNI != "a.b" {
+			t.Errorf("unexpected client_hello: %v", line)
+		}
+
+		return
+	}
+
+	t.Errorf("no client_hello event:\n%v", out.String())
+}
@@ -0,0 +1,87 @@
+package tester
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"testing"
+	"tlesio/tlssl/handshake"
+	"tlesio/tlssl/suite"
+)
+
+// Running transcript vs hashing the concatenated messages
+func TestTranscriptConcat(t *testing.T) {
+
+	msgs := [][]byte{
+		bytes.Repeat([]byte{0x01}, 200), // ClientHello
+		bytes.Repeat([]byte{0x02}, 90),  // ServerHello
+		bytes.Repeat([]byte{0x0B}, 900), // Certificate
+		{0x0E, 0x00, 0x00, 0x00},        // ServerHelloDone
+		bytes.Repeat([]byte{0x10}, 262), // ClientKeyExchange
+	}
+
+	tr, err := handshake.NewTranscript(suite.MD5SHA1, suite.SHA256,
+		suite.SHA384)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var concat []byte
+	for i, msg := range msgs {
+		tr.Write(msg)
+		concat = append(concat, msg...)
+
+		// Intermediate hashes at any point
+		sha256Sum := sha256.Sum256(concat)
+		sum, _ := tr.Sum(suite.SHA256)
+		if !bytes.Equal(sum, sha256Sum[:]) {
+			t.Fatalf("SHA256 mismatch after message %v", i)
+		}
+	}
+
+	md5Sum := md5.Sum(concat)
+	sha1Sum := sha1.Sum(concat)
+	sha384Sum := sha512.Sum384(concat)
+	expected := map[int][]byte{
+		suite.MD5SHA1: append(md5Sum[:], sha1Sum[:]...),
+		suite.SHA384:  sha384Sum[:],
+	}
+
+	for algo, exp := range expected {
+		sum, err := tr.Sum(algo)
+		if err != nil || !bytes.Equal(sum, exp) {
+			t.Errorf("hash %v mismatch: %x", algo, sum)
+		}
+	}
+
+	// Fork: the copy and the original go on independently
+	fork := tr.Fork()
+	if fork == nil {
+		t.Fatal("nil fork")
+	}
+
+	finished := []byte{0x14, 0x00, 0x00, 0x0C}
+	tr.Write(finished)
+	beforeSum := sha256.Sum256(concat)
+	afterSum := sha256.Sum256(append(concat, finished...))
+	forkSum, _ := fork.Sum(suite.SHA256)
+	trSum, _ := tr.Sum(suite.SHA256)
+	if !bytes.Equal(forkSum, beforeSum[:]) || !bytes.Equal(trSum, afterSum[:]) {
+		t.Errorf("fork is not independent")
+	}
+
+	// Suite chosen
+	if err := tr.Keep(suite.SHA256); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tr.Sum(suite.SHA384); err == nil {
+		t.Errorf("dropped hash still available")
+	}
+
+	if len(tr.Algos()) != 1 || len(fork.Algos()) != 3 {
+		t.Errorf("unexpected algorithms: %v / %v", tr.Algos(), fork.Algos())
+	}
+}
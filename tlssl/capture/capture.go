@@ -0,0 +1,313 @@
+package capture
+
+// Per connection capture of raw records, for replaying a handshake through
+// the server later. The randomness the server used is captured too, so
+// a capture holds the connection's secrets: treat it as a key log
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+	"tlesio/systema"
+	"tlesio/tlssl"
+)
+
+type Direction uint8
+
+const (
+	DirIn   Direction = iota + 1 // Client to server
+	DirOut                       // Server to client
+	DirRand                      // Random bytes the server read
+)
+
+// One whole record (header included) or one read of random bytes
+type Entry struct {
+	ConnID uint64
+	Time   time.Time
+	Dir    Direction
+	Data   []byte
+}
+
+type Capture interface {
+	Conn(net.Conn) net.Conn   // Records going through it
+	Rand(io.Reader) io.Reader // Bytes read from it
+	Close() error
+}
+
+// Where entries go. Calls for one capture never overlap, an entry's data
+// is only valid during the call
+type Sink interface {
+	Entry(*Entry) error
+	Close() error
+}
+
+type xCapture struct {
+	mu     sync.Mutex
+	sinks  []Sink
+	connID uint64
+	now    func() time.Time
+	in     []byte // Partial record, client to server
+	out    []byte // Partial record, server to client
+	err    error  // First sink error. Nothing is written after it
+}
+
+type xJSONSink struct {
+	w   io.WriteCloser
+	enc *json.Encoder
+}
+
+type xConn struct {
+	net.Conn
+	capture *xCapture
+}
+
+type xRand struct {
+	io.Reader
+	capture *xCapture
+}
+
+type jsonEntry struct {
+	ConnID uint64    `json:"conn_id"`
+	Time   time.Time `json:"time"`
+	Dir    string    `json:"dir"`
+	Data   string    `json:"data"`
+}
+
+// Every entry goes to all 'sinks'. A nil 'now' means time.Now
+func NewCapture(connID uint64, now func() time.Time, sinks ...Sink) Capture {
+
+	if len(sinks) == 0 {
+		return nil
+	}
+
+	if now == nil {
+		now = time.Now
+	}
+
+	return &xCapture{sinks: sinks, connID: connID, now: now}
+}
+
+// Entries as JSON lines, the format ReadEntries reads
+func NewJSONSink(w io.WriteCloser) Sink {
+
+	if w == nil {
+		return nil
+	}
+
+	return &xJSONSink{w: w, enc: json.NewEncoder(w)}
+}
+
+func (x *xCapture) Conn(conn net.Conn) net.Conn {
+	return &xConn{Conn: conn, capture: x}
+}
+
+func (x *xCapture) Rand(r io.Reader) io.Reader {
+	return &xRand{Reader: r, capture: x}
+}
+
+// Whatever is left of a partial record is written as it is
+func (x *xCapture) Close() error {
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if len(x.in) > 0 {
+		x.write(DirIn, x.in)
+	}
+
+	if len(x.out) > 0 {
+		x.write(DirOut, x.out)
+	}
+
+	x.in, x.out = nil, nil
+	for _, sink := range x.sinks {
+		if err := sink.Close(); err != nil && x.err == nil {
+			x.err = err
+		}
+	}
+
+	return x.err
+}
+
+// Appends to the direction's buffer and writes every complete record in it
+func (x *xCapture) records(dir Direction, data []byte) {
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	buff := &x.in
+	if dir == DirOut {
+		buff = &x.out
+	}
+
+	*buff = append(*buff, data...)
+	for len(*buff) >= tlssl.TLS_HEADER_SIZE {
+		head := *buff
+		recLen := tlssl.TLS_HEADER_SIZE + (int(head[3])<<8 | int(head[4]))
+		if recLen > tlssl.TLS_HEADER_SIZE+tlssl.TLS_MAX_RECORD_LEN {
+			// Not TLS. Keep it anyway, framing is lost from here on
+			recLen = len(*buff)
+		}
+
+		if len(*buff) < recLen {
+			return
+		}
+
+		x.write(dir, (*buff)[:recLen])
+		*buff = (*buff)[recLen:]
+	}
+}
+
+func (x *xCapture) write(dir Direction, data []byte) {
+
+	if x.err != nil {
+		return
+	}
+
+	entry := &Entry{ConnID: x.connID, Time: x.now(), Dir: dir, Data: data}
+	for _, sink := range x.sinks {
+		if x.err = sink.Entry(entry); x.err != nil {
+			return
+		}
+	}
+}
+
+func (x *xJSONSink) Entry(entry *Entry) error {
+	return x.enc.Encode(entry)
+}
+
+func (x *xJSONSink) Close() error {
+	return x.w.Close()
+}
+
+func (x *xConn) Read(b []byte) (int, error) {
+
+	n, err := x.Conn.Read(b)
+	if n > 0 {
+		x.capture.records(DirIn, b[:n])
+	}
+
+	return n, err
+}
+
+func (x *xConn) Write(b []byte) (int, error) {
+
+	n, err := x.Conn.Write(b)
+	if n > 0 {
+		x.capture.records(DirOut, b[:n])
+	}
+
+	return n, err
+}
+
+func (x *xRand) Read(b []byte) (int, error) {
+
+	n, err := x.Reader.Read(b)
+	if n > 0 {
+		x.capture.mu.Lock()
+		x.capture.write(DirRand, b[:n])
+		x.capture.mu.Unlock()
+	}
+
+	return n, err
+}
+
+func (x *Entry) MarshalJSON() ([]byte, error) {
+
+	return json.Marshal(&jsonEntry{
+		ConnID: x.ConnID,
+		Time:   x.Time.UTC(),
+		Dir:    x.Dir.String(),
+		Data:   hex.EncodeToString(x.Data),
+	})
+}
+
+func (x *Entry) UnmarshalJSON(data []byte) error {
+
+	var je jsonEntry
+
+	if err := json.Unmarshal(data, &je); err != nil {
+		return err
+	}
+
+	dir, err := ParseDirection(je.Dir)
+	if err != nil {
+		return err
+	}
+
+	raw, err := hex.DecodeString(je.Data)
+	if err != nil {
+		return fmt.Errorf("entry data: %v", err)
+	}
+
+	x.ConnID, x.Time, x.Dir, x.Data = je.ConnID, je.Time, dir, raw
+	return nil
+}
+
+// Every entry in 'r', in the order they were captured
+func ReadEntries(r io.Reader) ([]*Entry, error) {
+
+	var entries []*Entry
+
+	if r == nil {
+		return nil, systema.ErrNilParams
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 4*tlssl.TLS_MAX_RECORD_LEN)
+	for line := 1; scanner.Scan(); line++ {
+		var entry Entry
+
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("capture line %v: %v", line, err)
+		}
+
+		entries = append(entries, &entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+func ReadFile(path string) ([]*Entry, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+	return ReadEntries(file)
+}
+
+func ParseDirection(s string) (Direction, error) {
+
+	for _, dir := range []Direction{DirIn, DirOut, DirRand} {
+		if dir.String() == s {
+			return dir, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown capture direction(%v)", s)
+}
+
+func (x Direction) String() string {
+
+	switch x {
+	case DirIn:
+		return "in"
+	case DirOut:
+		return "out"
+	case DirRand:
+		return "rand"
+	}
+
+	return fmt.Sprintf("Direction(%d)", uint8(x))
+}
@@ -0,0 +1,152 @@
+package client
+
+// TLS 1.2 (and 1.0/1.1 if asked for) client on top of the same handshake
+// and record layer the server uses. It lives apart from tlssl because the
+// handshake package already depends on tlssl
+
+import (
+	"crypto/x509"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"tlesio/systema"
+	"tlesio/tlssl"
+	"tlesio/tlssl/handshake"
+	mx "tlesio/tlssl/modulos"
+	"tlesio/tlssl/suite"
+	"tlesio/tlssl/suite/ciphersuites"
+
+	"github.com/sirupsen/logrus"
+)
+
+type Conn interface {
+	net.Conn
+	CloseWrite() error // close_notify, then half-close the socket if it can
+	Version() uint16
+	CipherSuite() uint16
+	ALPN() string
+	PeerCertificates() []*x509.Certificate // Leaf first. nil for PSK suites
+}
+
+// Suites are shared by every connection, they hold no state
+var (
+	suitesOnce  sync.Once
+	suitesModz  *mx.ModuloZ
+	suitesOrder []uint16 // Default preference, forward secrecy and AEAD first
+)
+
+// Connects to 'addr' and runs the handshake. An empty ServerName is taken
+// from 'addr'
+func Dial(network, addr string, cfg *tlssl.ClientConfig) (Conn, error) {
+
+	var config tlssl.ClientConfig
+
+	if cfg != nil {
+		config = *cfg
+	}
+
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		config.ServerName = host
+	}
+
+	dialer := net.Dialer{Timeout: config.HandshakeTimeout}
+	conn, err := dialer.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn, err := NewConn(conn, &config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+// Handshake over an already connected 'conn'. It's left open on error
+func NewConn(conn net.Conn, cfg *tlssl.ClientConfig) (Conn, error) {
+
+	if conn == nil || cfg == nil {
+		return nil, systema.ErrNilParams
+	}
+
+	config := *cfg
+	if config.Lg == nil {
+		config.Lg = logrus.New()
+		config.Lg.SetOutput(io.Discard)
+	}
+
+	modz := clientSuites()
+	if len(config.CipherSuites) == 0 {
+		config.CipherSuites = suitesOrder
+	}
+
+	tCtx := &tlssl.TLSContext{
+		Lg:     config.Lg,
+		Modz:   modz,
+		KeyLog: config.KeyLog,
+		Rand:   config.Rand,
+		Time:   config.Time,
+	}
+
+	hCtx := handshake.NewHandShakeContext(config.Lg, conn)
+	cli := handshake.NewClient(&handshake.AllContexts{Hctx: hCtx, Tctx: tCtx},
+		&config)
+	if cli == nil {
+		return nil, systema.ErrNilParams
+	}
+
+	if config.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(config.HandshakeTimeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if err := cli.Handshake(); err != nil {
+		return nil, err
+	}
+
+	return &xConn{
+		Conn: conn,
+		hCtx: hCtx,
+		alpn: cli.ALPN(),
+		in:   hCtx.GetCipherScpec(handshake.CIPHERSPECSERVER),
+		out:  hCtx.GetCipherScpec(handshake.CIPHERSPECCLIENT),
+	}, nil
+}
+
+func clientSuites() *mx.ModuloZ {
+
+	suitesOnce.Do(func() {
+		lg := logrus.New()
+		lg.SetOutput(io.Discard)
+		all := []suite.Suite{
+			ciphersuites.NewECDHE_ECDSA_CHACHA20_POLY1305_SHA256(),
+			ciphersuites.NewECDHE_RSA_CHACHA20_POLY1305_SHA256(),
+			ciphersuites.NewECDHE_ECDSA_AES_128_CCM(),
+			ciphersuites.NewECDHE_ECDSA_AES_128_CCM_8(),
+			ciphersuites.NewECDHE_PSK_CHACHA20_POLY1305_SHA256(),
+			ciphersuites.NewDHE_PSK_CHACHA20_POLY1305_SHA256(),
+			ciphersuites.NewDHE_PSK_AES_128_CCM(),
+			ciphersuites.NewPSK_CHACHA20_POLY1305_SHA256(),
+			ciphersuites.NewPSK_AES_128_CCM(),
+			ciphersuites.NewPSK_AES_128_CCM_8(),
+			ciphersuites.NewAES_256_CBC_SHA256(),
+			ciphersuites.NewAES_256_CBC_SHA(),
+		}
+
+		suitesModz = mx.NewModuloZ()
+		suitesModz.InitTLSSuite(lg, all)
+		for _, st := range all {
+			suitesOrder = append(suitesOrder, st.ID())
+		}
+	})
+
+	return suitesModz
+}
@@ -0,0 +1,210 @@
+package client
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"tlesio/tlssl"
+	"tlesio/tlssl/handshake"
+)
+
+// Largest TLSPlaintext fragment (RFC 5246 6.2.1)
+const _MAX_PLAINTEXT_LEN_ = 1 << 14
+
+var errWriteClosed = errors.New("write after close_notify")
+
+// Established connection. Reads and writes may run at the same time, one
+// of each
+type xConn struct {
+	net.Conn
+	hCtx    handshake.HandShakeContext
+	alpn    string
+	in      tlssl.TLSCipherSpec // Server to client
+	out     tlssl.TLSCipherSpec // Client to server
+	rMu     sync.Mutex
+	pending []byte // Decrypted, not read yet
+	rErr    error  // Sticky. io.EOF after close_notify
+	wMu     sync.Mutex
+	wClosed bool // close_notify sent
+}
+
+func (x *xConn) Version() uint16 {
+	return x.hCtx.GetVersion()
+}
+
+func (x *xConn) CipherSuite() uint16 {
+	return x.hCtx.GetCipherSuite()
+}
+
+func (x *xConn) ALPN() string {
+	return x.alpn
+}
+
+func (x *xConn) PeerCertificates() []*x509.Certificate {
+	return x.hCtx.GetPeerCerts()
+}
+
+func (x *xConn) Read(b []byte) (int, error) {
+
+	x.rMu.Lock()
+	defer x.rMu.Unlock()
+	for len(x.pending) == 0 && x.rErr == nil {
+		x.rErr = x.readRecord()
+	}
+
+	if len(x.pending) == 0 {
+		return 0, x.rErr
+	}
+
+	n := copy(b, x.pending)
+	x.pending = x.pending[n:]
+	return n, nil
+}
+
+// Application data goes to 'pending'. The server gets a fatal alert for
+// anything else but close_notify. Renegotiation is not supported
+func (x *xConn) readRecord() error {
+
+	header, fragment, err := tlssl.ReadRecord(x.Conn)
+	if err != nil {
+		x.sendAlert(err)
+		return err
+	}
+
+	tpt, err := x.in.DecryptRecord(&tlssl.TLSCipherText{
+		Header:   header,
+		Fragment: fragment,
+	})
+
+	if err != nil {
+		x.sendAlert(err)
+		return err
+	}
+
+	switch tpt.Header.ContentType {
+	case tlssl.ContentTypeApplicationData:
+		x.pending = tpt.Fragment
+		return nil
+
+	case tlssl.ContentTypeAlert:
+		if len(tpt.Fragment) != tlssl.TLS_ALERT_SIZE {
+			err = tlssl.NewAlertError(tlssl.AlertDecodeError, "alert len %v",
+				len(tpt.Fragment))
+			x.sendAlert(err)
+			return err
+		}
+
+		alert := tlssl.AlertDescriptionType(tpt.Fragment[1])
+		if alert == tlssl.AlertCloseNotify {
+			return io.EOF
+		}
+
+		return fmt.Errorf("server alert: %v", alert)
+	}
+
+	err = tlssl.NewAlertError(tlssl.AlertUnexpectedMessage,
+		"%v record on established connection", tpt.Header.ContentType)
+	x.sendAlert(err)
+	return err
+}
+
+// Split in 2^14 bytes records. Returns how much was sent
+func (x *xConn) Write(b []byte) (int, error) {
+
+	x.wMu.Lock()
+	defer x.wMu.Unlock()
+	if x.wClosed {
+		return 0, errWriteClosed
+	}
+
+	sent := 0
+	for sent < len(b) {
+		chunk := b[sent:min(len(b), sent+_MAX_PLAINTEXT_LEN_)]
+		err := x.send(tlssl.ContentTypeApplicationData, chunk)
+		if err != nil {
+			return sent, err
+		}
+
+		sent += len(chunk)
+	}
+
+	return sent, nil
+}
+
+// Caller holds 'wMu'
+func (x *xConn) send(ct tlssl.ContentTypeType, data []byte) error {
+
+	tpt := &tlssl.TLSPlaintext{
+		Header:   &tlssl.TLSHeader{ContentType: ct},
+		Fragment: data,
+	}
+
+	for _, record := range x.out.SplitRecord(tpt) {
+		tct, err := x.out.EncryptRecord(record)
+		if err != nil {
+			return err
+		}
+
+		packet, err := tct.Packet(x.out.CipherType(), false)
+		if err != nil {
+			return err
+		}
+
+		if _, err = x.Conn.Write(packet); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Fatal alert for the error, if there is one. Nothing else is sent after it
+func (x *xConn) sendAlert(err error) {
+
+	alert, ok := tlssl.AlertFromError(err)
+	if !ok {
+		return
+	}
+
+	x.wMu.Lock()
+	defer x.wMu.Unlock()
+	if !x.wClosed {
+		x.wClosed = true
+		x.send(tlssl.ContentTypeAlert, tlssl.TLSAlert(alert))
+	}
+}
+
+func (x *xConn) closeNotify() error {
+
+	x.wMu.Lock()
+	defer x.wMu.Unlock()
+	if x.wClosed {
+		return nil
+	}
+
+	x.wClosed = true
+	return x.send(tlssl.ContentTypeAlert,
+		tlssl.TLSAlert(tlssl.AlertCloseNotify))
+}
+
+func (x *xConn) CloseWrite() error {
+
+	if err := x.closeNotify(); err != nil {
+		return err
+	}
+
+	if cw, ok := x.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return nil
+}
+
+func (x *xConn) Close() error {
+
+	x.closeNotify()
+	return x.Conn.Close()
+}
@@ -0,0 +1,385 @@
+package dissect
+
+// Structured view of TLS 1.2 records, for people (tlsdump) and for
+// scripts (JSON). Nothing is decrypted: once a direction sends its
+// ChangeCipherSpec, its records are only reported as encrypted
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+	"tlesio/tlssl"
+	"tlesio/tlssl/capture"
+	ex "tlesio/tlssl/extensions"
+	"tlesio/tlssl/handshake"
+	"tlesio/tlssl/suite"
+)
+
+type Record struct {
+	Index       int        `json:"index"`
+	ConnID      uint64     `json:"conn_id,omitempty"` // Captures only
+	Dir         string     `json:"dir,omitempty"`     // Same
+	Time        *time.Time `json:"time,omitempty"`    // Same
+	ContentType string     `json:"content_type"`
+	Version     string     `json:"version"`
+	Len         int        `json:"length"`
+	Encrypted   bool       `json:"encrypted,omitempty"`
+	Messages    []*Message `json:"messages,omitempty"` // Completed here
+	Alert       *Alert     `json:"alert,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+type Message struct {
+	Type         string         `json:"type"`
+	Len          int            `json:"length"`
+	Hello        *Hello         `json:"hello,omitempty"`
+	Certificates []*Certificate `json:"certificates,omitempty"`
+	Body         string         `json:"body,omitempty"` // Hex, the rest
+	Error        string         `json:"error,omitempty"`
+}
+
+// ClientHello or ServerHello. A ServerHello has one cipher suite and one
+// compression method
+type Hello struct {
+	Version      string       `json:"version"`
+	Random       string       `json:"random"`
+	SessionID    string       `json:"session_id"`
+	CipherSuites []*Named     `json:"cipher_suites"`
+	Compression  string       `json:"compression_methods"` // Hex
+	Extensions   []*Extension `json:"extensions"`
+}
+
+type Named struct {
+	ID   uint16 `json:"id"`
+	Name string `json:"name"`
+}
+
+type Extension struct {
+	ID     uint16 `json:"id"`
+	Name   string `json:"name"`
+	Len    int    `json:"length"`
+	Data   string `json:"data"`             // Hex
+	Detail string `json:"detail,omitempty"` // Registered extensions only
+}
+
+type Certificate struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	DNSNames  []string  `json:"dns_names,omitempty"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type Alert struct {
+	Level       string `json:"level"`
+	Description string `json:"description"`
+}
+
+// One direction of a connection
+type xStream struct {
+	encrypted bool
+	pending   []byte // Handshake message bytes not complete yet
+	last      *Record
+}
+
+type xDissector struct {
+	records []*Record
+	streams map[string]*xStream
+}
+
+// Every extension this server knows how to print
+var printers = map[uint16]ex.Handler{}
+
+func init() {
+
+	for _, ext := range []ex.Handler{
+		ex.Handle(ex.NewExtSNI()),
+		ex.Handle(ex.NewExtStatusRequest()),
+		ex.Handle(ex.NewExtSupportedGroups()),
+		ex.Handle(ex.NewExtECPointFormats()),
+		ex.Handle(ex.NewExtSignAlgo()),
+		ex.Handle(ex.NewExtEncryptThenMac()),
+		ex.Handle(ex.NewExtSessionTicket()),
+		ex.Handle(ex.NewExtRenegotiation()),
+	} {
+		printers[ext.ID()] = ext
+	}
+}
+
+// Hex text, a capture (JSON lines) or raw records, whichever 'data' is
+func Dissect(data []byte) ([]*Record, error) {
+
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case len(trimmed) == 0:
+		return nil, fmt.Errorf("nothing to dissect")
+	case data[0] >= byte(tlssl.ContentTypeChangeCipherSpec) &&
+		data[0] <= byte(tlssl.ContentTypeApplicationData):
+		return Records(data), nil
+	case trimmed[0] == '{':
+		entries, err := capture.ReadEntries(bytes.NewReader(trimmed))
+		if err != nil {
+			return nil, err
+		}
+
+		return Entries(entries), nil
+	}
+
+	raw, err := Hex(string(trimmed))
+	if err != nil {
+		return nil, err
+	}
+
+	return Records(raw), nil
+}
+
+// Whitespace, colons and 0x prefixes are left out
+func Hex(s string) ([]byte, error) {
+
+	s = strings.NewReplacer("0x", "", "0X", "", ":", "").Replace(s)
+	raw, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		return nil, fmt.Errorf("not hex, raw records or a capture: %v", err)
+	}
+
+	return raw, nil
+}
+
+// Records of one direction, back to back
+func Records(data []byte) []*Record {
+
+	x := &xDissector{streams: make(map[string]*xStream)}
+	x.feed(&Record{}, data)
+	return x.finish()
+}
+
+// Client and server records of captured connections, in capture order
+func Entries(entries []*capture.Entry) []*Record {
+
+	x := &xDissector{streams: make(map[string]*xStream)}
+	for _, entry := range entries {
+		if entry.Dir == capture.DirRand {
+			continue
+		}
+
+		when := entry.Time
+		x.feed(&Record{ConnID: entry.ConnID, Dir: entry.Dir.String(),
+			Time: &when}, entry.Data)
+	}
+
+	return x.finish()
+}
+
+// Records of the connection and direction in 'from'
+func (x *xDissector) feed(from *Record, data []byte) {
+
+	key := fmt.Sprintf("%v/%v", from.ConnID, from.Dir)
+	stream := x.streams[key]
+	if stream == nil {
+		stream = &xStream{}
+		x.streams[key] = stream
+	}
+
+	for len(data) > 0 {
+		record := &Record{Index: len(x.records), ConnID: from.ConnID,
+			Dir: from.Dir, Time: from.Time}
+		x.records = append(x.records, record)
+		header := tlssl.TLSHead(data)
+		if header == nil {
+			record.ContentType = "Unknown"
+			record.Len = len(data)
+			record.Error = "truncated record header"
+			return
+		}
+
+		record.ContentType = contentName(header.ContentType)
+		record.Version = tlssl.VersionName(header.Version)
+		record.Len = header.Len
+		fragment := data[tlssl.TLS_HEADER_SIZE:]
+		if len(fragment) < header.Len {
+			record.Error = fmt.Sprintf("truncated record, %v of %v bytes",
+				len(fragment), header.Len)
+			return
+		}
+
+		data = fragment[header.Len:]
+		stream.record(record, header.ContentType, fragment[:header.Len])
+	}
+}
+
+// Handshake messages cut short by the end of the input
+func (x *xDissector) finish() []*Record {
+
+	for _, stream := range x.streams {
+		if len(stream.pending) > 0 && stream.last != nil &&
+			stream.last.Error == "" {
+			stream.last.Error = fmt.Sprintf("%v bytes of an incomplete "+
+				"handshake message", len(stream.pending))
+		}
+	}
+
+	return x.records
+}
+
+func (x *xStream) record(record *Record, ct tlssl.ContentTypeType,
+	fragment []byte) {
+
+	if x.encrypted || ct == tlssl.ContentTypeApplicationData {
+		record.Encrypted = true
+		return
+	}
+
+	switch ct {
+	case tlssl.ContentTypeChangeCipherSpec:
+		x.encrypted = true
+	case tlssl.ContentTypeAlert:
+		if len(fragment) != tlssl.TLS_ALERT_SIZE {
+			record.Error = "bad alert length"
+			return
+		}
+
+		level := "warning"
+		if tlssl.AlertLevelType(fragment[0]) == tlssl.AlertLevelFatal {
+			level = "fatal"
+		}
+
+		record.Alert = &Alert{Level: level,
+			Description: tlssl.AlertDescriptionType(fragment[1]).String()}
+	case tlssl.ContentTypeHandshake:
+		x.last = record
+		x.pending = append(x.pending, fragment...)
+		for len(x.pending) >= tlssl.TLS_HANDSHAKE_SIZE {
+			head := tlssl.TLSHeadHandShake(x.pending)
+			if len(x.pending) < tlssl.TLS_HANDSHAKE_SIZE+head.Len {
+				break
+			}
+
+			body := x.pending[tlssl.TLS_HANDSHAKE_SIZE:][:head.Len]
+			record.Messages = append(record.Messages,
+				message(head.HandshakeType, body))
+			x.pending = x.pending[tlssl.TLS_HANDSHAKE_SIZE+head.Len:]
+		}
+	default:
+		record.Error = "unknown content type"
+	}
+}
+
+func message(ht tlssl.HandshakeTypeType, body []byte) *Message {
+
+	var err error
+
+	msg := &Message{Type: handshakeName(ht), Len: len(body)}
+	switch ht {
+	case tlssl.HandshakeTypeClientHello:
+		msg.Hello, err = hello(body, true)
+	case tlssl.HandshakeTypeServerHello:
+		msg.Hello, err = hello(body, false)
+	case tlssl.HandshakeTypeCertificate:
+		msg.Certificates, err = certificates(body)
+	default:
+		msg.Body = hex.EncodeToString(body)
+	}
+
+	if err != nil {
+		msg.Error = err.Error()
+	}
+
+	return msg
+}
+
+func contentName(ct tlssl.ContentTypeType) string {
+
+	if name := ct.String(); name != "Unknown" {
+		return name
+	}
+
+	return fmt.Sprintf("Unknown(0x%02X)", uint8(ct))
+}
+
+func handshakeName(ht tlssl.HandshakeTypeType) string {
+
+	if name := ht.String(); name != "Unknown" {
+		return name
+	}
+
+	return fmt.Sprintf("Unknown(0x%02X)", uint8(ht))
+}
+
+func suiteName(id uint16) string {
+
+	if handshake.IsGREASE(id) {
+		return "GREASE"
+	}
+
+	if name, ok := suite.CipherSuiteNames[id]; ok {
+		return name
+	}
+
+	return "unknown"
+}
+
+func extensionName(id uint16) string {
+
+	if handshake.IsGREASE(id) {
+		return "GREASE"
+	}
+
+	if name, ok := ex.ExtensionName[id]; ok {
+		return name
+	}
+
+	return "unknown"
+}
+
+// Big endian reads that stop at the first one past the end
+type xReader struct {
+	buff []byte
+	err  error
+}
+
+func (x *xReader) bytes(n int) []byte {
+
+	if x.err != nil {
+		return nil
+	}
+
+	if n > len(x.buff) {
+		x.err = fmt.Errorf("%v bytes needed, %v left", n, len(x.buff))
+		return nil
+	}
+
+	b := x.buff[:n]
+	x.buff = x.buff[n:]
+	return b
+}
+
+func (x *xReader) uint8() int {
+
+	if b := x.bytes(1); b != nil {
+		return int(b[0])
+	}
+
+	return 0
+}
+
+func (x *xReader) uint16() int {
+
+	if b := x.bytes(2); b != nil {
+		return int(binary.BigEndian.Uint16(b))
+	}
+
+	return 0
+}
+
+func (x *xReader) uint24() int {
+
+	if b := x.bytes(3); b != nil {
+		return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+	}
+
+	return 0
+}
@@ -0,0 +1,123 @@
+package dissect
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"tlesio/tlssl"
+)
+
+// Fields as RFC 5246 7.4.1 lists them, extensions in wire order
+func hello(body []byte, client bool) (*Hello, error) {
+
+	var msg Hello
+
+	r := &xReader{buff: body}
+	version := r.uint16()
+	msg.Version = tlssl.VersionName(uint16(version))
+	msg.Random = hex.EncodeToString(r.bytes(32))
+	msg.SessionID = hex.EncodeToString(r.bytes(r.uint8()))
+
+	suitesLen, methodsLen := 2, 1
+	if client {
+		suitesLen = r.uint16()
+	}
+
+	suites := &xReader{buff: r.bytes(suitesLen)}
+
+	for suites.err == nil && len(suites.buff) > 0 {
+		id := uint16(suites.uint16())
+		msg.CipherSuites = append(msg.CipherSuites,
+			&Named{ID: id, Name: suiteName(id)})
+	}
+
+	if suites.err != nil {
+		return &msg, fmt.Errorf("cipher suites: %v", suites.err)
+	}
+
+	if client {
+		methodsLen = r.uint8()
+	}
+
+	msg.Compression = hex.EncodeToString(r.bytes(methodsLen))
+	if r.err != nil {
+		return &msg, r.err
+	}
+
+	// No extensions at all is fine
+	if len(r.buff) == 0 {
+		return &msg, nil
+	}
+
+	exts := &xReader{buff: r.bytes(r.uint16())}
+	if r.err == nil && len(r.buff) > 0 {
+		return &msg, fmt.Errorf("%v bytes after the extensions", len(r.buff))
+	}
+
+	for exts.err == nil && len(exts.buff) > 0 {
+		id := uint16(exts.uint16())
+		data := exts.bytes(exts.uint16())
+		if exts.err != nil {
+			break
+		}
+
+		ext := &Extension{ID: id, Name: extensionName(id), Len: len(data),
+			Data: hex.EncodeToString(data)}
+		if printer, ok := printers[id]; ok && len(data) > 0 {
+			ext.Detail = strings.TrimSpace(printer.PrintRaw(data))
+		}
+
+		msg.Extensions = append(msg.Extensions, ext)
+	}
+
+	if r.err != nil {
+		return &msg, r.err
+	}
+
+	if exts.err != nil {
+		return &msg, fmt.Errorf("extensions: %v", exts.err)
+	}
+
+	return &msg, nil
+}
+
+// The chain as sent, leaf first. An unparsable certificate is kept with
+// its error
+func certificates(body []byte) ([]*Certificate, error) {
+
+	var certs []*Certificate
+
+	r := &xReader{buff: body}
+	list := &xReader{buff: r.bytes(r.uint24())}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	if len(r.buff) > 0 {
+		return nil, fmt.Errorf("%v bytes after the certificates", len(r.buff))
+	}
+
+	for len(list.buff) > 0 {
+		der := list.bytes(list.uint24())
+		if list.err != nil {
+			return certs, fmt.Errorf("certificate list: %v", list.err)
+		}
+
+		parsed, err := x509.ParseCertificate(der)
+		if err != nil {
+			certs = append(certs, &Certificate{Error: err.Error()})
+			continue
+		}
+
+		certs = append(certs, &Certificate{
+			Subject:   parsed.Subject.String(),
+			Issuer:    parsed.Issuer.String(),
+			DNSNames:  parsed.DNSNames,
+			NotBefore: parsed.NotBefore,
+			NotAfter:  parsed.NotAfter,
+		})
+	}
+
+	return certs, nil
+}
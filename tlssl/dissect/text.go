@@ -0,0 +1,122 @@
+package dissect
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+	"tlesio/systema"
+)
+
+// Indented, one field per line. Hex dumps are 16 bytes a line
+func (x *Record) String() string {
+
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "record %v", x.Index)
+	if x.Dir != "" {
+		fmt.Fprintf(&sb, " conn %v %v", x.ConnID, x.Dir)
+	}
+
+	if x.Time != nil {
+		fmt.Fprintf(&sb, " %v", x.Time.Format(time.RFC3339Nano))
+	}
+
+	fmt.Fprintf(&sb, ": %v, %v, %v bytes", x.ContentType, x.Version, x.Len)
+	if x.Encrypted {
+		sb.WriteString(", encrypted")
+	}
+
+	sb.WriteByte('\n')
+	if x.Alert != nil {
+		fmt.Fprintf(&sb, "  alert: %v %v\n", x.Alert.Level,
+			x.Alert.Description)
+	}
+
+	for _, msg := range x.Messages {
+		msg.text(&sb)
+	}
+
+	if x.Error != "" {
+		fmt.Fprintf(&sb, "  error: %v\n", x.Error)
+	}
+
+	return sb.String()
+}
+
+func (x *Message) text(sb *strings.Builder) {
+
+	fmt.Fprintf(sb, "  %v, %v bytes\n", x.Type, x.Len)
+	if x.Hello != nil {
+		x.Hello.text(sb)
+	}
+
+	for i, cert := range x.Certificates {
+		if cert.Error != "" {
+			fmt.Fprintf(sb, "    certificate %v: %v\n", i, cert.Error)
+			continue
+		}
+
+		fmt.Fprintf(sb, "    certificate %v: %v\n", i, cert.Subject)
+		fmt.Fprintf(sb, "      issuer: %v\n", cert.Issuer)
+		if len(cert.DNSNames) > 0 {
+			fmt.Fprintf(sb, "      dns names: %v\n",
+				strings.Join(cert.DNSNames, ", "))
+		}
+
+		fmt.Fprintf(sb, "      valid: %v to %v\n",
+			cert.NotBefore.Format(time.RFC3339),
+			cert.NotAfter.Format(time.RFC3339))
+	}
+
+	if x.Body != "" {
+		hexDump(sb, "    ", x.Body)
+	}
+
+	if x.Error != "" {
+		fmt.Fprintf(sb, "    error: %v\n", x.Error)
+	}
+}
+
+func (x *Hello) text(sb *strings.Builder) {
+
+	fmt.Fprintf(sb, "    version: %v\n", x.Version)
+	fmt.Fprintf(sb, "    random: %v\n", x.Random)
+	fmt.Fprintf(sb, "    session id: %v\n", orNone(x.SessionID))
+	fmt.Fprintf(sb, "    cipher suites: %v\n", len(x.CipherSuites))
+	for _, cs := range x.CipherSuites {
+		fmt.Fprintf(sb, "      %v(0x%04X)\n", cs.Name, cs.ID)
+	}
+
+	fmt.Fprintf(sb, "    compression methods: %v\n", x.Compression)
+	fmt.Fprintf(sb, "    extensions: %v\n", len(x.Extensions))
+	for _, ext := range x.Extensions {
+		fmt.Fprintf(sb, "      %v(0x%04X), %v bytes", ext.Name, ext.ID,
+			ext.Len)
+		if ext.Detail != "" {
+			fmt.Fprintf(sb, ": %v", ext.Detail)
+		}
+
+		sb.WriteByte('\n')
+		if ext.Detail == "" && ext.Data != "" {
+			hexDump(sb, "        ", ext.Data)
+		}
+	}
+}
+
+func hexDump(sb *strings.Builder, indent, data string) {
+
+	raw, _ := hex.DecodeString(data)
+	for _, line := range strings.Split(systema.PrettyPrintBytes(raw), "\n") {
+		fmt.Fprintf(sb, "%v%v\n", indent, strings.TrimSpace(line))
+	}
+}
+
+func orNone(s string) string {
+
+	if s == "" {
+		return "(none)"
+	}
+
+	return s
+}
@@ -0,0 +1,67 @@
+package extensions
+
+import (
+	"fmt"
+	"tlesio/systema"
+)
+
+const EC_POINT_UNCOMPRESSED = 0x00
+
+type ExtECPointFormatsData struct {
+	Formats []uint8
+}
+
+type xExtECPointFormats struct {
+}
+
+func NewExtECPointFormats() Extension[ExtECPointFormatsData] {
+	return &xExtECPointFormats{}
+}
+
+func (x xExtECPointFormats) Name() string {
+	return ExtensionName[x.ID()]
+}
+
+func (x xExtECPointFormats) ID() uint16 {
+	return 0x000B
+}
+
+// 1 byte list len followed by 1 byte formats. Uncompressed is the only
+// format left (RFC 8422) and must be there
+func (x xExtECPointFormats) LoadData(data []byte,
+	sz int) (*ExtECPointFormatsData, error) {
+
+	var newData ExtECPointFormatsData
+
+	if len(data) < 1 || int(data[0]) != len(data[1:]) {
+		return nil, systema.ErrInvalidData
+	}
+
+	newData.Formats = append(newData.Formats, data[1:]...)
+	for _, f := range newData.Formats {
+		if f == EC_POINT_UNCOMPRESSED {
+			return &newData, nil
+		}
+	}
+
+	return nil, fmt.Errorf("uncompressed point format not offered")
+}
+
+func (x xExtECPointFormats) PrintRaw(data []byte) string {
+	return systema.PrettyPrintBytes(data)
+}
+
+func (x xExtECPointFormats) Messages() Messages {
+	return MsgClientHello | MsgServerHello
+}
+
+// Only the uncompressed format is understood
+func (x xExtECPointFormats) Negotiate(data *ExtECPointFormatsData,
+	state State) ([]byte, error) {
+
+	if data == nil {
+		return nil, nil
+	}
+
+	return []byte{0x00, 0x0B, 0x00, 0x02, 0x01, EC_POINT_UNCOMPRESSED}, nil
+}
@@ -1,12 +1,16 @@
 package extensions
 
+import (
+	"tlesio/systema"
+)
+
 type ExtExtEncryptMacData struct {
 }
 
 type xExtEncryptMac struct {
 }
 
-func NewExtEncryptThenMac() Extension {
+func NewExtEncryptThenMac() Extension[ExtExtEncryptMacData] {
 	return &xExtEncryptMac{}
 }
 
@@ -18,7 +22,14 @@ func (x xExtEncryptMac) ID() uint16 {
 	return 0x0016
 }
 
-func (x xExtEncryptMac) LoadData(data []byte, sz int) (interface{}, error) {
+// Always empty
+func (x xExtEncryptMac) LoadData(data []byte,
+	sz int) (*ExtExtEncryptMacData, error) {
+
+	if len(data) != 0 {
+		return nil, systema.ErrInvalidData
+	}
+
 	return &ExtExtEncryptMacData{}, nil
 }
 
@@ -26,6 +37,18 @@ func (x xExtEncryptMac) PrintRaw(data []byte) string {
 	return "0x00 0x16(ExtID) 0x00 0x00(ExtLen)"
 }
 
-func (x xExtEncryptMac) PacketServerHelo(data interface{}) ([]byte, error) {
+func (x xExtEncryptMac) Messages() Messages {
+	return MsgClientHello | MsgServerHello
+}
+
+// Block ciphers only, AEAD suites are never answered (RFC 7366 3)
+func (x xExtEncryptMac) Negotiate(data *ExtExtEncryptMacData,
+	state State) ([]byte, error) {
+
+	if data == nil || !state.BlockCipher() {
+		return nil, nil
+	}
+
+	state.SetEncryptThenMac()
 	return []byte{0x00, 0x16, 0x00, 0x00}, nil
 }
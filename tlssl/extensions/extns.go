@@ -1,30 +1,152 @@
 package extensions
 
 import (
+	"errors"
+
 	"github.com/sirupsen/logrus"
 )
 
+// Registered or not, so dissections and logs name what clients send
 var ExtensionName = map[uint16]string{
 	0x0000: "server_name",
+	0x0001: "max_fragment_length",
+	0x0005: "status_request",
+	0x000A: "supported_groups",
+	0x000B: "ec_point_formats",
 	0x000D: "signature_algorithms",
+	0x0010: "application_layer_protocol_negotiation",
+	0x0012: "signed_certificate_timestamp",
+	0x0015: "padding",
 	0x0016: "encrypt_then_mac",
+	0x0017: "extended_master_secret",
+	0x001B: "compress_certificate",
 	0x0023: "session_ticket",
+	0x0029: "pre_shared_key",
+	0x002B: "supported_versions",
+	0x002D: "psk_key_exchange_modes",
+	0x0032: "signature_algorithms_cert",
+	0x0033: "key_share",
+	0xFE0D: "encrypted_client_hello",
 	0xFF01: "renegotiation_info",
 }
 
-type ExtLoadFN func([]byte, int) (interface{}, error)
+// Handshake messages an extension may appear in, as a set
+type Messages uint8
+
+const (
+	MsgClientHello Messages = 1 << iota
+	MsgServerHello
+	MsgEncryptedExtensions // TLS 1.3
+	MsgCertificate         // TLS 1.3, per certificate entry
+)
+
+// Negotiation failures. The handshake answers ErrIllegalParameter with
+// illegal_parameter, anything else with handshake_failure
+var (
+	ErrIllegalParameter = errors.New("illegal_parameter")
+	ErrHandshakeFailure = errors.New("handshake_failure")
+)
+
+// Handshake state negotiation may look at and change. The server
+// handshake provides it once the cipher suite is chosen
+type State interface {
+	Version() uint16
+	CipherSuite() uint16
+	BlockCipher() bool // CBC suite chosen
+	SetEncryptThenMac()
+	HasOCSP() bool // The chosen certificate has an OCSP response to staple
+	SetCertificateStatus()
+}
+
+// Extension whose data, as the client sends it, is a T
+type Extension[T any] interface {
+	ID() uint16
+	Name() string
+	Messages() Messages
+	PrintRaw([]byte) string
+	LoadData([]byte, int) (*T, error)
+
+	// Whole extension (header included) for the ServerHello, nothing if
+	// it isn't answered. 'data' is what LoadData returned, nil when the
+	// client didn't send it. An error aborts the handshake
+	Negotiate(data *T, state State) ([]byte, error)
+}
+
+// Some extension's data, as its LoadData returned it. Keys get it back
+// typed
+type Data interface {
+	extensionData()
+}
+
+type xData[T any] struct {
+	data *T
+}
 
-type Extension interface {
+func (x xData[T]) extensionData() {}
+
+// Any extension, whatever its data type. What registrations hold
+type Handler interface {
 	ID() uint16
 	Name() string
+	Messages() Messages
 	PrintRaw([]byte) string
-	PacketServerHelo(interface{}) ([]byte, error)
-	LoadData([]byte, int) (interface{}, error)
+	LoadData([]byte, int) (Data, error)
+	Negotiate(data Data, state State) ([]byte, error)
+}
+
+type xHandler[T any] struct {
+	Extension[T]
+}
+
+func Handle[T any](ext Extension[T]) Handler {
+
+	if ext == nil {
+		return nil
+	}
+
+	return &xHandler[T]{ext}
+}
+
+func (x *xHandler[T]) LoadData(buff []byte, sz int) (Data, error) {
+
+	data, err := x.Extension.LoadData(buff, sz)
+	if err != nil {
+		return nil, err
+	}
+
+	return xData[T]{data}, nil
+}
+
+// Data loaded by another extension counts as not sent
+func (x *xHandler[T]) Negotiate(data Data, state State) ([]byte, error) {
+
+	loaded, _ := data.(xData[T])
+	return x.Extension.Negotiate(loaded.data, state)
+}
+
+// Ties an extension ID to the type its LoadData returns, so lookups in a
+// hello's extensions come back typed. Made from the extension itself, the
+// type can't be the wrong one
+type Key[T any] uint16
+
+func KeyOf[T any](ext Extension[T]) Key[T] {
+	return Key[T](ext.ID())
 }
 
+var (
+	KeySNI             = KeyOf(NewExtSNI())
+	KeyStatusRequest   = KeyOf(NewExtStatusRequest())
+	KeySupportedGroups = KeyOf(NewExtSupportedGroups())
+	KeyECPointFormats  = KeyOf(NewExtECPointFormats())
+	KeySignAlgo        = KeyOf(NewExtSignAlgo())
+	KeyRenegotiation   = KeyOf(NewExtRenegotiation())
+)
+
+// Registered extensions, negotiated in registration order
 type Extensions struct {
 	lg    *logrus.Logger
-	table map[uint16]Extension
+	table map[uint16]Handler
+	order []Handler
 }
 
 func NewExtensions(lg *logrus.Logger) *Extensions {
@@ -32,25 +154,38 @@ func NewExtensions(lg *logrus.Logger) *Extensions {
 	var newExtns Extensions
 
 	newExtns.lg = lg
-	newExtns.table = make(map[uint16]Extension)
+	newExtns.table = make(map[uint16]Handler)
 	return &newExtns
 }
 
-func (e *Extensions) Register(ext Extension) {
+// Function, methods can't have type parameters
+func Register[T any](e *Extensions, ext Extension[T]) {
+	e.register(Handle(ext))
+}
+
+func (e *Extensions) register(ext Handler) {
 
 	if ext == nil {
 		return
 	}
 
+	// Replaced in place, it keeps its turn
 	if _, ok := e.table[ext.ID()]; ok {
 		e.lg.Warn("Extension already registered: ", ext.Name())
+		for i := range e.order {
+			if e.order[i].ID() == ext.ID() {
+				e.order[i] = ext
+			}
+		}
+	} else {
+		e.order = append(e.order, ext)
 	}
 
 	e.table[ext.ID()] = ext
 	e.lg.Info("Extension registered: ", ext.Name())
 }
 
-func (e *Extensions) Get(id uint16) Extension {
+func (e *Extensions) Get(id uint16) Handler {
 
 	if ext, ok := e.table[id]; ok {
 		return ext
@@ -59,6 +194,15 @@ func (e *Extensions) Get(id uint16) Extension {
 	return nil
 }
 
-func (e Extensions) GetAll() map[uint16]Extension {
-	return e.table
+// Registration order
+func (e *Extensions) All() []Handler {
+	return e.order
+}
+
+// Data 'k' stands for in 'exts' (ID to LoadData result), nil if it isn't
+// there
+func (k Key[T]) From(exts map[uint16]Data) *T {
+
+	loaded, _ := exts[uint16(k)].(xData[T])
+	return loaded.data
 }
@@ -1,12 +1,18 @@
 package extensions
 
+import (
+	"fmt"
+	"tlesio/systema"
+)
+
 type ExtRenegotiationData struct {
+	Connection []byte // renegotiated_connection
 }
 
 type xExtRenegotiation struct {
 }
 
-func NewExtRenegotiation() Extension {
+func NewExtRenegotiation() Extension[ExtRenegotiationData] {
 	return &xExtRenegotiation{}
 }
 
@@ -18,14 +24,46 @@ func (x xExtRenegotiation) ID() uint16 {
 	return 0xFF01
 }
 
-func (x xExtRenegotiation) LoadData(data []byte, sz int) (interface{}, error) {
-	return &ExtRenegotiationData{}, nil
+// 1 byte len followed by renegotiated_connection
+func (x xExtRenegotiation) LoadData(data []byte,
+	sz int) (*ExtRenegotiationData, error) {
+
+	if len(data) == 0 || int(data[0]) != len(data)-1 {
+		return nil, systema.ErrInvalidData
+	}
+
+	return &ExtRenegotiationData{
+		Connection: append([]byte{}, data[1:]...)}, nil
 }
 
+// renegotiated_connection, empty on an initial handshake
 func (x xExtRenegotiation) PrintRaw(data []byte) string {
-	return "0xFF 0x01(ExtID) 0x00 0x00(ExtLen)"
+
+	if len(data) == 0 || int(data[0]) != len(data)-1 {
+		return systema.PrettyPrintBytes(data)
+	}
+
+	if data[0] == 0 {
+		return "initial handshake"
+	}
+
+	return "renegotiated_connection: " + systema.PrettyPrintBytes(data[1:])
+}
+
+func (x xExtRenegotiation) Messages() Messages {
+	return MsgClientHello | MsgServerHello
 }
 
-func (x xExtRenegotiation) PacketServerHelo(data interface{}) ([]byte, error) {
+// Always answered, clients may signal support with the SCSV instead. There
+// is no renegotiation, so a non empty renegotiated_connection is an attack
+// (RFC 5746 3.6)
+func (x xExtRenegotiation) Negotiate(data *ExtRenegotiationData,
+	state State) ([]byte, error) {
+
+	if data != nil && len(data.Connection) > 0 {
+		return nil, fmt.Errorf("renegotiated_connection not empty: %w",
+			ErrHandshakeFailure)
+	}
+
 	return []byte{0xFF, 0x01, 0x00, 0x01, 0x00}, nil
 }
@@ -1,12 +1,16 @@
 package extensions
 
+import (
+	"fmt"
+)
+
 type ExtSessionTicketData struct {
 }
 
 type xExtSessionTicket struct {
 }
 
-func NewExtSessionTicket() Extension {
+func NewExtSessionTicket() Extension[ExtSessionTicketData] {
 	return &xExtSessionTicket{}
 }
 
@@ -18,14 +22,23 @@ func (x xExtSessionTicket) ID() uint16 {
 	return 0x0023
 }
 
-func (x xExtSessionTicket) LoadData(data []byte, sz int) (interface{}, error) {
+func (x xExtSessionTicket) LoadData(data []byte,
+	sz int) (*ExtSessionTicketData, error) {
 	return &ExtSessionTicketData{}, nil
 }
 
 func (x xExtSessionTicket) PrintRaw(data []byte) string {
-	return "0x00 0x23(ExtID) 0x00 0x00(ExtLen)"
+	return fmt.Sprintf("ticket: %v bytes", len(data))
+}
+
+func (x xExtSessionTicket) Messages() Messages {
+	return MsgClientHello | MsgServerHello
 }
 
-func (x xExtSessionTicket) PacketServerHelo(data interface{}) ([]byte, error) {
-	return []byte{0x00, 0x23, 0x00, 0x00}, nil
+// Answering the extension promises a NewSessionTicket (RFC 5077 3.2).
+// No tickets are issued, so it is never answered and clients fall back to
+// a full handshake
+func (x xExtSessionTicket) Negotiate(data *ExtSessionTicketData,
+	state State) ([]byte, error) {
+	return nil, nil
 }
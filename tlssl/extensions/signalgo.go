@@ -1,10 +1,13 @@
 package extensions
 
 import (
+	"strings"
 	"tlesio/systema"
 )
 
 const (
+	RSA_PKCS1_SHA1         = 0x0201
+	ECDSA_SHA1             = 0x0203
 	ECDSA_SECP256R1_SHA256 = 0x0403
 	ECDSA_SECP384R1_SHA384 = 0x0503
 	ECDSA_SECP521R1_SHA512 = 0x0603
@@ -22,6 +25,8 @@ const (
 )
 
 var SignHashAlgorithms = map[uint16]string{
+	RSA_PKCS1_SHA1:         "rsa_pkcs1_sha1",
+	ECDSA_SHA1:             "ecdsa_sha1",
 	ECDSA_SECP256R1_SHA256: "ecdsa_secp256r1_sha256",
 	ECDSA_SECP384R1_SHA384: "ecdsa_secp384r1_sha384",
 	ECDSA_SECP521R1_SHA512: "ecdsa_secp521r1_sha512",
@@ -46,7 +51,7 @@ type ExtSignAlgoData struct {
 type xExtSignAlgo struct {
 }
 
-func NewExtSignAlgo() Extension {
+func NewExtSignAlgo() Extension[ExtSignAlgoData] {
 	return &xExtSignAlgo{}
 }
 
@@ -58,20 +63,25 @@ func (x xExtSignAlgo) ID() uint16 {
 	return 0x000D
 }
 
-func (x xExtSignAlgo) LoadData(data []byte, sz int) (interface{}, error) {
+// Len is the number of algorithms
+func (x xExtSignAlgo) LoadData(data []byte, sz int) (*ExtSignAlgoData, error) {
 
-	var offset uint16 = 2
 	var newData ExtSignAlgoData
-	newData.Len = uint16(data[0])<<8 | uint16(data[1])/2
-	if len(data) < int(newData.Len) {
+
+	if len(data) < 2 {
+		return nil, systema.ErrInvalidData
+	}
+
+	listLen := int(data[0])<<8 | int(data[1])
+	if listLen%2 != 0 || listLen != len(data)-2 {
 		return nil, systema.ErrInvalidData
 	}
 
-	newData.Algos = make([]uint16, 0)
-	for i := 0; i < int(newData.Len); i++ {
+	newData.Len = uint16(listLen / 2)
+	newData.Algos = make([]uint16, 0, newData.Len)
+	for offset := 2; offset < len(data); offset += 2 {
 		newData.Algos = append(newData.Algos,
 			uint16(data[offset])<<8|uint16(data[offset+1]))
-		offset += 2
 	}
 
 	return &newData, nil
@@ -79,35 +89,30 @@ func (x xExtSignAlgo) LoadData(data []byte, sz int) (interface{}, error) {
 
 func (x xExtSignAlgo) PrintRaw(data []byte) string {
 
-	var length int
-	var newStr string = "{"
-	var offset uint16 = 2
+	var names []string
 
-	length = int(data[0])<<8 | int(data[1])/2
-	if len(data) < length {
+	xdata, err := x.LoadData(data, len(data))
+	if err != nil {
 		return "Invalid Data"
 	}
 
-	for i := 0; i < length; i++ {
-		id := uint16(data[offset])<<8 | uint16(data[offset+1])
+	for _, id := range xdata.Algos {
 		algo := SignHashAlgorithms[id]
 		if algo == "" {
 			algo = "*"
 		}
 
-		if i == length-1 {
-			newStr += algo
-		} else {
-			newStr += algo + ","
-		}
-
-		offset += 2
+		names = append(names, algo)
 	}
 
-	newStr += "}"
-	return newStr
+	return "{" + strings.Join(names, ",") + "}"
+}
+
+func (x xExtSignAlgo) Messages() Messages {
+	return MsgClientHello
 }
 
-func (x *xExtSignAlgo) PacketServerHelo(data interface{}) ([]byte, error) {
+func (x xExtSignAlgo) Negotiate(data *ExtSignAlgoData,
+	state State) ([]byte, error) {
 	return nil, nil
 }
@@ -19,7 +19,7 @@ type ExtSNIData struct {
 type xExtSNI struct {
 }
 
-func NewExtSNI() Extension {
+func NewExtSNI() Extension[ExtSNIData] {
 	return &xExtSNI{}
 }
 
@@ -31,25 +31,32 @@ func (x xExtSNI) ID() uint16 {
 	return 0x0000
 }
 
-func (x xExtSNI) LoadData(data []byte, sz int) (interface{}, error) {
+func (x xExtSNI) LoadData(data []byte, sz int) (*ExtSNIData, error) {
 
-	var count uint16
-	var offset uint16
+	var count int
 	var newData ExtSNIData
 
+	if len(data) < 2 {
+		return nil, systema.ErrInvalidData
+	}
+
 	newData.Names = make([]ExtSNIName, 0)
-	totalSz := uint16(data[offset])<<8 | uint16(data[offset+1])
-	offset += 2
-	for offset < totalSz {
-		newName, sz := parseName(data[offset:])
-		if newName != nil {
-			newData.Names = append(newData.Names, *newName)
+	totalSz := int(data[0])<<8 | int(data[1])
+	if totalSz != len(data)-2 {
+		return nil, systema.ErrInvalidData
+	}
+
+	for offset := 2; offset < len(data); {
+		newName, sz, err := parseName(data[offset:])
+		if err != nil {
+			return nil, err
 		}
 
+		newData.Names = append(newData.Names, *newName)
 		offset += sz
 		count++
 		// Security measure
-		if count > _MAX_SNI_NAMES {
+		if count >= _MAX_SNI_NAMES {
 			break
 		}
 	}
@@ -61,16 +68,11 @@ func (x xExtSNI) PrintRaw(data []byte) string {
 
 	var str string
 
-	xdata, err := x.LoadData(data, len(data))
+	sniData, err := x.LoadData(data, len(data))
 	if err != nil {
 		return systema.PrettyPrintBytes(data)
 	}
 
-	sniData, ok := xdata.(*ExtSNIData)
-	if !ok {
-		return systema.PrettyPrintBytes(data)
-	}
-
 	str = "["
 	for i, name := range sniData.Names {
 		if i < len(sniData.Names)-1 {
@@ -83,24 +85,29 @@ func (x xExtSNI) PrintRaw(data []byte) string {
 	return str + "]"
 }
 
-func (x xExtSNI) PacketServerHelo(data interface{}) ([]byte, error) {
+func (x xExtSNI) Messages() Messages {
+	return MsgClientHello | MsgServerHello | MsgEncryptedExtensions
+}
+
+// The name only picks a certificate, it is never acknowledged
+func (x xExtSNI) Negotiate(data *ExtSNIData, state State) ([]byte, error) {
 	return nil, nil
 }
 
-func parseName(buff []byte) (*ExtSNIName, uint16) {
+func parseName(buff []byte) (*ExtSNIName, int, error) {
 
-	var offset uint16
 	var newName ExtSNIName
 
-	newName.NameType = uint8(buff[0])
-	nameLen := uint16(buff[1])<<8 | uint16(buff[2])
-	if len(buff) < int(nameLen) {
-		return nil, 0
+	if len(buff) < 3 {
+		return nil, 0, systema.ErrInvalidData
 	}
 
-	offset = 3
-	newName.Name = string(buff[offset : offset+nameLen])
-	offset += nameLen
-	return &newName, offset
+	newName.NameType = uint8(buff[0])
+	nameLen := int(buff[1])<<8 | int(buff[2])
+	if nameLen == 0 || len(buff)-3 < nameLen {
+		return nil, 0, systema.ErrInvalidData
+	}
 
+	newName.Name = string(buff[3 : 3+nameLen])
+	return &newName, 3 + nameLen, nil
 }
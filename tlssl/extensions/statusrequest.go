@@ -0,0 +1,131 @@
+package extensions
+
+import (
+	"fmt"
+	"tlesio/systema"
+)
+
+const STATUS_TYPE_OCSP = 0x01
+
+// Responder IDs and request extensions are kept as sent, a stapled
+// response is whatever the server has
+type ExtStatusRequestData struct {
+	StatusType   uint8
+	ResponderIDs [][]byte
+	Extensions   []byte
+}
+
+type xExtStatusRequest struct {
+}
+
+func NewExtStatusRequest() Extension[ExtStatusRequestData] {
+	return &xExtStatusRequest{}
+}
+
+func (x xExtStatusRequest) Name() string {
+	return ExtensionName[x.ID()]
+}
+
+func (x xExtStatusRequest) ID() uint16 {
+	return 0x0005
+}
+
+//	struct {
+//		CertificateStatusType status_type;
+//		select (status_type) {
+//			case ocsp: OCSPStatusRequest;
+//		} request;
+//	} CertificateStatusRequest;
+//
+//	struct {
+//		ResponderID responder_id_list<0..2^16-1>;
+//		Extensions  request_extensions<0..2^16-1>;
+//	} OCSPStatusRequest;
+//
+// Other status types are kept with no request (RFC 6066 8)
+func (x xExtStatusRequest) LoadData(data []byte,
+	sz int) (*ExtStatusRequestData, error) {
+
+	var newData ExtStatusRequestData
+
+	if len(data) < 1 {
+		return nil, systema.ErrInvalidData
+	}
+
+	newData.StatusType = data[0]
+	if newData.StatusType != STATUS_TYPE_OCSP {
+		return &newData, nil
+	}
+
+	ids, rest, ok := vector16(data[1:])
+	if !ok {
+		return nil, systema.ErrInvalidData
+	}
+
+	for len(ids) > 0 {
+		var id []byte
+
+		id, ids, ok = vector16(ids)
+		if !ok || len(id) == 0 {
+			return nil, systema.ErrInvalidData
+		}
+
+		newData.ResponderIDs = append(newData.ResponderIDs, id)
+	}
+
+	newData.Extensions, rest, ok = vector16(rest)
+	if !ok || len(rest) != 0 {
+		return nil, systema.ErrInvalidData
+	}
+
+	return &newData, nil
+}
+
+func (x xExtStatusRequest) PrintRaw(data []byte) string {
+
+	status, err := x.LoadData(data, len(data))
+	if err != nil {
+		return systema.PrettyPrintBytes(data)
+	}
+
+	if status.StatusType != STATUS_TYPE_OCSP {
+		return fmt.Sprintf("status type %v", status.StatusType)
+	}
+
+	return fmt.Sprintf("ocsp, %v responder ids, %v bytes of extensions",
+		len(status.ResponderIDs), len(status.Extensions))
+}
+
+func (x xExtStatusRequest) Messages() Messages {
+	return MsgClientHello | MsgServerHello
+}
+
+// Answered empty when the certificate chosen for the handshake has a
+// response to staple. The CertificateStatus may still be left out if the
+// response is not good enough (RFC 6066 8)
+func (x xExtStatusRequest) Negotiate(data *ExtStatusRequestData,
+	state State) ([]byte, error) {
+
+	if data == nil || data.StatusType != STATUS_TYPE_OCSP ||
+		!state.HasOCSP() {
+		return nil, nil
+	}
+
+	state.SetCertificateStatus()
+	return []byte{0x00, 0x05, 0x00, 0x00}, nil
+}
+
+// 2 bytes length prefixed vector and what follows it
+func vector16(data []byte) ([]byte, []byte, bool) {
+
+	if len(data) < 2 {
+		return nil, nil, false
+	}
+
+	vLen := int(data[0])<<8 | int(data[1])
+	if len(data[2:]) < vLen {
+		return nil, nil, false
+	}
+
+	return data[2 : 2+vLen], data[2+vLen:], true
+}
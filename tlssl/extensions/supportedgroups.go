@@ -0,0 +1,105 @@
+package extensions
+
+import (
+	"encoding/binary"
+	"fmt"
+	"tlesio/systema"
+)
+
+const (
+	SECP256R1 = 0x0017
+	SECP384R1 = 0x0018
+	SECP521R1 = 0x0019
+	X25519    = 0x001D
+	X448      = 0x001E
+	FFDHE2048 = 0x0100
+	FFDHE3072 = 0x0101
+)
+
+var SupportedGroups = map[uint16]string{
+	SECP256R1: "secp256r1",
+	SECP384R1: "secp384r1",
+	SECP521R1: "secp521r1",
+	X25519:    "x25519",
+	X448:      "x448",
+	FFDHE2048: "ffdhe2048",
+	FFDHE3072: "ffdhe3072",
+}
+
+type ExtSupportedGroupsData struct {
+	Groups []uint16
+}
+
+type xExtSupportedGroups struct {
+}
+
+func NewExtSupportedGroups() Extension[ExtSupportedGroupsData] {
+	return &xExtSupportedGroups{}
+}
+
+func (x xExtSupportedGroups) Name() string {
+	return ExtensionName[x.ID()]
+}
+
+func (x xExtSupportedGroups) ID() uint16 {
+	return 0x000A
+}
+
+// 2 bytes list len followed by 2 bytes group IDs
+func (x xExtSupportedGroups) LoadData(data []byte,
+	sz int) (*ExtSupportedGroupsData, error) {
+
+	var newData ExtSupportedGroupsData
+
+	if len(data) < 2 {
+		return nil, systema.ErrInvalidData
+	}
+
+	listLen := int(binary.BigEndian.Uint16(data[:2]))
+	if listLen%2 != 0 || listLen != len(data[2:]) {
+		return nil, systema.ErrInvalidData
+	}
+
+	newData.Groups = make([]uint16, 0, listLen/2)
+	for offset := 2; offset < len(data); offset += 2 {
+		newData.Groups = append(newData.Groups,
+			binary.BigEndian.Uint16(data[offset:offset+2]))
+	}
+
+	return &newData, nil
+}
+
+func (x xExtSupportedGroups) PrintRaw(data []byte) string {
+
+	var str string
+
+	xdata, err := x.LoadData(data, len(data))
+	if err != nil {
+		return systema.PrettyPrintBytes(data)
+	}
+
+	for i, group := range xdata.Groups {
+		name := SupportedGroups[group]
+		if name == "" {
+			name = fmt.Sprintf("0x%04X", group)
+		}
+
+		if i > 0 {
+			str += ","
+		}
+
+		str += name
+	}
+
+	return "{" + str + "}"
+}
+
+// Not sent in a TLS 1.2 ServerHello
+func (x xExtSupportedGroups) Messages() Messages {
+	return MsgClientHello | MsgEncryptedExtensions
+}
+
+func (x xExtSupportedGroups) Negotiate(data *ExtSupportedGroupsData,
+	state State) ([]byte, error) {
+	return nil, nil
+}
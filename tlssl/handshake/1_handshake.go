@@ -112,8 +112,8 @@ func NewHandshake(actx *AllContexts) (*Handshake, error) {
 
 	newHandshake.Contexto = actx.Hctx
 	newHandshake.Cert = NewCertificate(actx)
-	newHandshake.CertificateReq = NewCertificateRequest(actx.Hctx)
-	newHandshake.CertificateVerf = NewCertificateVerify(actx.Hctx)
+	newHandshake.CertificateReq = NewCertificateRequest(actx)
+	newHandshake.CertificateVerf = NewCertificateVerify(actx)
 	newHandshake.ChgCph = NewChangeCipherSpec(actx)
 	newHandshake.ClientHelo = NewClientHello(actx)
 	newHandshake.ClientKeyExch = NewClientKeyExchange(actx)
@@ -193,6 +193,8 @@ func HandshakeName(h int) string {
 		return "CERTIFICATE"
 	case CERTIFICATEREQUEST:
 		return "CERTIFICATEREQUEST"
+	case CERTIFICATESTATUS:
+		return "CERTIFICATESTATUS"
 	case CERTIFICATEVERIFY:
 		return "CERTIFICATEVERIFY"
 	case CHANGECIPHERSPEC:
@@ -1,11 +1,14 @@
 package handshake
 
 import (
+	"crypto/ecdh"
 	"crypto/x509"
 	"fmt"
+	"math/big"
 	"net"
 	"tlesio/systema"
 	"tlesio/tlssl"
+	"tlesio/tlssl/suite"
 
 	"github.com/sirupsen/logrus"
 )
@@ -19,6 +22,7 @@ const (
 	MASTERSECRET      = 39
 	CIPHERSPECCLIENT  = 41
 	CIPHERSPECSERVER  = 43
+	CERTIFICATESTATUS = 45
 	FINISHEDSERVER    = 47
 )
 
@@ -32,6 +36,7 @@ type prfData struct {
 type xHandhsakeContextData struct {
 	certificate        []byte
 	certificateRequest []byte
+	certificateStatus  []byte
 	certificateVerify  []byte
 	clientCertificate  []byte
 	changeCipherSpec   []byte
@@ -46,11 +51,20 @@ type xHandhsakeContextData struct {
 	serverCert         *x509.Certificate
 	msgHello           *MsgHello
 	cipherSuite        uint16
+	version            uint16
 	macMode            int
 	transitionStage    int
 	order              []int
-	expected           int
 	keys               *tlssl.SessionKeys
+	ecdhKey            *ecdh.PrivateKey
+	dhKey              *big.Int
+	pskIdentity        []byte
+	ocspStapling       bool // status_request answered
+	peerCerts          []*x509.Certificate
+	certVerifyHashes   Transcript // Up to the client's CertificateVerify
+	connID             uint64
+	tracer             tlssl.Tracer
+	transcript         Transcript
 	cipherSpecClient   tlssl.TLSCipherSpec
 	cipherSpecServer   tlssl.TLSCipherSpec
 }
@@ -70,10 +84,24 @@ type HandShakeContext interface {
 	GetMsgHello() *MsgHello
 	SetCipherSuite(uint16)
 	GetCipherSuite() uint16
+	SetVersion(uint16)
+	GetVersion() uint16
 	SetMacMode(int)
 	GetMacMode() int
 	SetKeys(*tlssl.SessionKeys)
 	GetKeys() *tlssl.SessionKeys
+	SetECDHKey(*ecdh.PrivateKey)
+	GetECDHKey() *ecdh.PrivateKey
+	SetDHKey(*big.Int)
+	GetDHKey() *big.Int
+	SetPSKIdentity([]byte)
+	GetPSKIdentity() []byte
+	SetOCSPStapling(bool)
+	GetOCSPStapling() bool
+	SetPeerCerts([]*x509.Certificate)
+	GetPeerCerts() []*x509.Certificate
+	SetCertVerifyTranscript(Transcript)
+	GetCertVerifyTranscript() Transcript
 	SetCipherScpec(int, tlssl.TLSCipherSpec)
 	GetCipherScpec(int) tlssl.TLSCipherSpec
 	SetTransitionStage(int)
@@ -82,12 +110,12 @@ type HandShakeContext interface {
 	Order() []int
 	AppendOrder(int) error
 	PrintOrder() string
-	Expected() int
-	AppendExpected(int)
-	UnAppendExpected(int)
-	PrintExpected() string
 	SendCtxBuff([]int) error
 	Send([]byte) error
+	Transcript() Transcript
+	SetConnID(uint64)
+	GetConnID() uint64
+	SetTracer(tlssl.Tracer)
 }
 
 func NewHandShakeContext(lg *logrus.Logger, coms net.Conn) HandShakeContext {
@@ -101,10 +129,10 @@ func NewHandShakeContext(lg *logrus.Logger, coms net.Conn) HandShakeContext {
 	newContext.lg = lg
 	newContext.coms = coms
 	newContext.data = &xHandhsakeContextData{}
-	newContext.data.expected |= CLIENTKEYEXCHANGE
-	newContext.data.expected |= CHANGECIPHERSPEC
-	newContext.data.expected |= FINISHED
 	newContext.data.macMode = tlssl.MODE_MTE
+	newContext.data.version = tlssl.TLS_VERSION1_2
+	newContext.data.transcript, _ = NewTranscript(
+		suite.MD5SHA1, suite.SHA256, suite.SHA384)
 	return &newContext
 }
 
@@ -121,6 +149,9 @@ func (x *xHandhsakeContext) SetBuffer(op int, buff []byte) {
 	case CERTIFICATEREQUEST:
 		x.data.certificateRequest = buff
 
+	case CERTIFICATESTATUS:
+		x.data.certificateStatus = buff
+
 	case CERTIFICATEVERIFY:
 		x.data.certificateVerify = buff
 
@@ -174,6 +205,9 @@ func (x *xHandhsakeContext) GetBuffer(op int) []byte {
 	case CERTIFICATEREQUEST:
 		return x.data.certificateRequest
 
+	case CERTIFICATESTATUS:
+		return x.data.certificateStatus
+
 	case CERTIFICATEVERIFY:
 		return x.data.certificateVerify
 
@@ -228,6 +262,20 @@ func (x *xHandhsakeContext) GetCert() *x509.Certificate {
 	return x.data.serverCert
 }
 
+// Whoever accepted the connection numbers it, for tracing
+func (x *xHandhsakeContext) SetConnID(id uint64) {
+	x.data.connID = id
+}
+
+func (x *xHandhsakeContext) GetConnID() uint64 {
+	return x.data.connID
+}
+
+// Every record sent is traced
+func (x *xHandhsakeContext) SetTracer(tracer tlssl.Tracer) {
+	x.data.tracer = tracer
+}
+
 func (x *xHandhsakeContext) SetMsgHello(msg *MsgHello) {
 	x.data.msgHello = msg
 }
@@ -244,6 +292,15 @@ func (x *xHandhsakeContext) GetCipherSuite() uint16 {
 	return x.data.cipherSuite
 }
 
+// Negotiated protocol version (TLS 1.2 unless legacy mode kicks in)
+func (x *xHandhsakeContext) SetVersion(version uint16) {
+	x.data.version = version
+}
+
+func (x *xHandhsakeContext) GetVersion() uint16 {
+	return x.data.version
+}
+
 func (x *xHandhsakeContext) SetMacMode(mode int) {
 	x.data.macMode = mode
 }
@@ -264,6 +321,60 @@ func (x *xHandhsakeContext) GetKeys() *tlssl.SessionKeys {
 	return x.data.keys
 }
 
+// Server's ephemeral ECDHE key
+func (x *xHandhsakeContext) SetECDHKey(key *ecdh.PrivateKey) {
+	x.data.ecdhKey = key
+}
+
+func (x *xHandhsakeContext) GetECDHKey() *ecdh.PrivateKey {
+	return x.data.ecdhKey
+}
+
+// Server's ephemeral DHE private exponent
+func (x *xHandhsakeContext) SetDHKey(key *big.Int) {
+	x.data.dhKey = key
+}
+
+func (x *xHandhsakeContext) GetDHKey() *big.Int {
+	return x.data.dhKey
+}
+
+// Identity the client authenticated with (PSK suites only)
+func (x *xHandhsakeContext) SetPSKIdentity(identity []byte) {
+	x.data.pskIdentity = identity
+}
+
+func (x *xHandhsakeContext) GetPSKIdentity() []byte {
+	return x.data.pskIdentity
+}
+
+// The ServerHello promised a CertificateStatus may follow the Certificate
+func (x *xHandhsakeContext) SetOCSPStapling(on bool) {
+	x.data.ocspStapling = on
+}
+
+func (x *xHandhsakeContext) GetOCSPStapling() bool {
+	return x.data.ocspStapling
+}
+
+// Peer's chain, leaf first. On the server it's empty without client
+// authentication
+func (x *xHandhsakeContext) SetPeerCerts(certs []*x509.Certificate) {
+	x.data.peerCerts = certs
+}
+
+func (x *xHandhsakeContext) GetPeerCerts() []*x509.Certificate {
+	return x.data.peerCerts
+}
+
+func (x *xHandhsakeContext) SetCertVerifyTranscript(t Transcript) {
+	x.data.certVerifyHashes = t
+}
+
+func (x *xHandhsakeContext) GetCertVerifyTranscript() Transcript {
+	return x.data.certVerifyHashes
+}
+
 func (x *xHandhsakeContext) SetCipherScpec(who int, cs tlssl.TLSCipherSpec) {
 
 	switch who {
@@ -294,6 +405,11 @@ func (x *xHandhsakeContext) GetComms() net.Conn {
 	return x.coms
 }
 
+func (x *xHandhsakeContext) Transcript() Transcript {
+	return x.data.transcript
+}
+
+// Outgoing flight, in sending order
 func (x *xHandhsakeContext) Order() []int {
 	return x.data.order
 }
@@ -305,6 +421,8 @@ func (x *xHandhsakeContext) AppendOrder(op int) error {
 		fallthrough
 	case CERTIFICATEREQUEST:
 		fallthrough
+	case CERTIFICATESTATUS:
+		fallthrough
 	case CERTIFICATEVERIFY:
 		fallthrough
 	case CHANGECIPHERSPEC:
@@ -333,79 +451,15 @@ func (x *xHandhsakeContext) PrintOrder() string {
 	return HandshakeNameList(x.data.order)
 }
 
-// All posible handshake messages from client
-// CERTIFICATE, CLIENTKEYEXCHANGE, CERTIFICATEVERIFY,
-// CHANGECIPHERSPEC, FINISHED
-func (x *xHandhsakeContext) Expected() int {
-	return x.data.expected
-}
-
-func (x *xHandhsakeContext) AppendExpected(op int) {
-
-	switch op {
-	case CERTIFICATE:
-		fallthrough
-	case CLIENTKEYEXCHANGE:
-		fallthrough
-	case CERTIFICATEVERIFY:
-		fallthrough
-	case CHANGECIPHERSPEC:
-		fallthrough
-	case FINISHED:
-		break
-	default:
-		return
-	}
-
-	x.data.expected |= op
-}
-
-func (x *xHandhsakeContext) UnAppendExpected(op int) {
-
-	switch op {
-	case CERTIFICATE:
-		fallthrough
-	case CLIENTKEYEXCHANGE:
-		fallthrough
-	case CERTIFICATEVERIFY:
-		fallthrough
-	case CHANGECIPHERSPEC:
-		fallthrough
-	case FINISHED:
-		break
-	default:
-		return
-	}
-
-	x.data.expected &= ^op
-}
-
-func (x *xHandhsakeContext) PrintExpected() string {
-
-	var expected []int
-
-	allExpected := []int{
-		CERTIFICATE,
-		CLIENTKEYEXCHANGE,
-		CERTIFICATEVERIFY,
-		CHANGECIPHERSPEC,
-		FINISHED,
-	}
-
-	for _, v := range allExpected {
-		if x.data.expected&v != 0 {
-			expected = append(expected, v)
-		}
-	}
-
-	return HandshakeNameList(expected)
-}
-
+// Handshake messages go into the transcript as they are sent.
+// ChangeCipherSpec is not a handshake message and FINISHEDSERVER is
+// already protected (fed by the Finished state)
 func (x *xHandhsakeContext) SendCtxBuff(ids []int) error {
 
 	var outBuff []byte
 
 	for _, id := range ids {
+
 		switch id {
 		case CERTIFICATE:
 			outBuff = append(outBuff, x.data.certificate...)
@@ -415,6 +469,10 @@ func (x *xHandhsakeContext) SendCtxBuff(ids []int) error {
 			outBuff = append(outBuff, x.data.certificateRequest...)
 			x.lg.Debug("Sending CERTIFICATEREQUEST")
 
+		case CERTIFICATESTATUS:
+			outBuff = append(outBuff, x.data.certificateStatus...)
+			x.lg.Debug("Sending CERTIFICATESTATUS")
+
 		case CERTIFICATEVERIFY:
 			outBuff = append(outBuff, x.data.certificateVerify...)
 			x.lg.Debug("Sending CERTIFICATEVERIFY")
@@ -450,6 +508,12 @@ func (x *xHandhsakeContext) SendCtxBuff(ids []int) error {
 			outBuff = append(outBuff, x.data.serverKeyExchange...)
 			x.lg.Debug("Sending SERVERKEYEXCHANGE")
 		}
+
+		msg := x.GetBuffer(id)
+		if id != CHANGECIPHERSPEC && id != FINISHEDSERVER &&
+			len(msg) > tlssl.TLS_HEADER_SIZE {
+			x.data.transcript.Write(msg[tlssl.TLS_HEADER_SIZE:])
+		}
 	}
 
 	return x.sendData(outBuff)
@@ -475,5 +539,8 @@ func (x *xHandhsakeContext) sendData(buffer []byte) error {
 		return err
 	}
 
+	tlssl.TraceRecords(x.data.tracer, x.data.connID, tlssl.TraceRecordSent,
+		buffer)
+
 	return nil
 }
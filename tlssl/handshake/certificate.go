@@ -1,7 +1,10 @@
 package handshake
 
 import (
+	"crypto/ecdsa"
+	"crypto/rsa"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"tlesio/systema"
 	"tlesio/tlssl"
@@ -67,41 +70,39 @@ func (x *xCertificate) certificateServer() error {
 		return fmt.Errorf("%v: invalid cipher suite", x.Name())
 	}
 
-	helloMsg := x.ctx.GetMsgHello()
-	cNames := x.tCtx.Modz.Certs.CNs()
-	cNames = append(cNames, getClientSAN(helloMsg.Extensions[0x0000])...)
-	saAlgos := getClientSuppAlgos(helloMsg.Extensions[0x000D])
-
-	// Brute force. Why ???
-	// Might return multiples choices? Dont remember why
-	for _, cn := range cNames {
-		for _, sa := range saAlgos {
-			if cert := x.tCtx.Modz.Certs.GetByCriteria(sa, cn); cert != nil {
-				certs = append(certs, cert)
-				break
-			}
-		}
+	if cs.Info().Auth == suite.PSK {
+		x.tCtx.Lg.Debugf("%v: PSK suite, no certificate", x.Name())
+		x.nextState = x.pskNextState(cs)
+		return nil
 	}
 
+	certs = selectCerts(x.tCtx, x.ctx.GetMsgHello(), cs.Info().Auth)
 	if len(certs) == 0 {
 		return fmt.Errorf("%v: no certificate found", x.Name())
 	}
 
 	// Certs
 	x.ctx.SetCert(certs[0])
+	x.tCtx.Trace(x.ctx.GetConnID(), &tlssl.TraceEvent{
+		Kind: tlssl.TraceCertSelected,
+		Cert: certs[0],
+	})
+
 	certificateBuff := packetCerts(x.tCtx.Modz.Certs.GetCertChain(certs[0]))
 
 	// Headers
 	header := tlssl.TLSHeadsHandShakePacket(tlssl.HandshakeTypeCertificate,
-		len(certificateBuff))
+		len(certificateBuff), x.ctx.GetVersion())
 
 	x.ctx.SetBuffer(CERTIFICATE, append(header, certificateBuff...))
 	x.ctx.AppendOrder(CERTIFICATE)
+	x.certificateStatus(certs[0])
 
-	if cs.Info().KeyExchange == suite.DHE {
+	if cs.Info().KeyExchange == suite.DHE ||
+		cs.Info().KeyExchange == suite.ECDHE {
 		x.nextState = SERVERKEYEXCHANGE
 
-	} else if x.tCtx.OptClientAuth {
+	} else if clientAuthOn(x.tCtx, x.ctx) {
 		x.nextState = CERTIFICATEREQUEST
 
 	} else {
@@ -111,14 +112,139 @@ func (x *xCertificate) certificateServer() error {
 	return nil
 }
 
+//	struct {
+//		CertificateStatusType status_type;
+//		select (status_type) {
+//			case ocsp: OCSPResponse;
+//		} response;
+//	} CertificateStatus;
+//
+// Only when status_request was answered and 'cert' has a good response.
+// Leaving it out is allowed (RFC 6066 8)
+func (x *xCertificate) certificateStatus(cert *x509.Certificate) {
+
+	if !x.ctx.GetOCSPStapling() {
+		return
+	}
+
+	staple := x.tCtx.Modz.Certs.GetCertOCSP(cert, x.tCtx.Now())
+	if len(staple) == 0 {
+		x.tCtx.Lg.Warnf("%v: no OCSP response to staple", x.Name())
+		return
+	}
+
+	body := []byte{ex.STATUS_TYPE_OCSP, byte(len(staple) >> 16),
+		byte(len(staple) >> 8), byte(len(staple))}
+	body = append(body, staple...)
+	header := tlssl.TLSHeadsHandShakePacket(
+		tlssl.HandshakeTypeCertificateStatus, len(body), x.ctx.GetVersion())
+	x.ctx.SetBuffer(CERTIFICATESTATUS, append(header, body...))
+	x.ctx.AppendOrder(CERTIFICATESTATUS)
+}
+
+// Client's chain. An empty one is fine unless a certificate is required
+// (RFC 5246 7.4.6). With client CAs configured the chain must lead to one
 func (x *xCertificate) certificateClient() error {
 
 	x.tCtx.Lg.Tracef("Running state: %v(CLIENT)", x.Name())
 	x.tCtx.Lg.Debugf("Running state: %v(CLIENT)", x.Name())
+	buff := x.ctx.GetBuffer(CLIENTCERTIFICATE)
+	if len(buff) < tlssl.TLS_HEADER_SIZE+tlssl.TLS_HANDSHAKE_SIZE {
+		return fmt.Errorf("nil client Certificate buffer(%v)", x.Name())
+	}
+
+	certs, err := parseCerts(buff[tlssl.TLS_HEADER_SIZE+
+		tlssl.TLS_HANDSHAKE_SIZE:])
+	if err != nil {
+		return tlssl.NewAlertError(tlssl.AlertBadCertificate, "%v(%v)", err,
+			x.Name())
+	}
+
 	x.nextState = CLIENTKEYEXCHANGE
+	if len(certs) == 0 {
+		if x.tCtx.OptClientAuthRequired {
+			return tlssl.NewAlertError(tlssl.AlertHandshakeFailure,
+				"no client certificate(%v)", x.Name())
+		}
+
+		x.tCtx.Lg.Debugf("%v: no client certificate", x.Name())
+		return nil
+	}
+
+	if err = x.verifyClientChain(certs); err != nil {
+		return err
+	}
+
+	x.ctx.SetPeerCerts(certs)
+	x.tCtx.Lg.Infof("Client certificate: %v", certs[0].Subject)
 	return nil
 }
 
+func (x *xCertificate) verifyClientChain(certs []*x509.Certificate) error {
+
+	switch certs[0].PublicKey.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return tlssl.NewAlertError(tlssl.AlertUnsupportedCertificate,
+			"client certificate key type(%v)", x.Name())
+	}
+
+	if len(x.tCtx.ClientCAs) == 0 {
+		return nil
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         x509.NewCertPool(),
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		CurrentTime:   x.tCtx.Now(),
+	}
+
+	for _, ca := range x.tCtx.ClientCAs {
+		opts.Roots.AddCert(ca)
+	}
+
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(opts)
+	if err == nil {
+		return nil
+	}
+
+	return tlssl.NewAlertError(chainAlert(err), "client certificate(%v): %v",
+		x.Name(), err)
+}
+
+// Alert for a failed x509 chain verification
+func chainAlert(err error) tlssl.AlertDescriptionType {
+
+	var invalid x509.CertificateInvalidError
+
+	switch {
+	case errors.As(err, new(x509.UnknownAuthorityError)):
+		return tlssl.AlertUnknownCA
+	case errors.As(err, &invalid) && invalid.Reason == x509.Expired:
+		return tlssl.AlertCertificateExpired
+	}
+
+	return tlssl.AlertBadCertificate
+}
+
+// ServerKeyExchange carries the identity hint and, for DHE_PSK and
+// ECDHE_PSK, the key exchange params. Plain PSK sends it only if there
+// is a hint to send
+func (x *xCertificate) pskNextState(cs suite.Suite) int {
+
+	if cs.Info().KeyExchange != suite.PSK ||
+		(x.tCtx.PSK != nil && len(x.tCtx.PSK.Hint()) > 0) {
+		return SERVERKEYEXCHANGE
+	}
+
+	return SERVERHELLODONE
+}
+
 // Pack all certificates.
 func packetCerts(certs []*x509.Certificate) []byte {
 
@@ -136,17 +262,77 @@ func packetCerts(certs []*x509.Certificate) []byte {
 	return append(finalBuff, certsBuffer...)
 }
 
+// certificate_list<0..2^24-1>, each ASN.1Cert<1..2^24-1>
+func parseCerts(buff []byte) ([]*x509.Certificate, error) {
+
+	var certs []*x509.Certificate
+
+	if len(buff) < 3 || int(buff[0])<<16|int(buff[1])<<8|int(buff[2]) !=
+		len(buff)-3 {
+		return nil, fmt.Errorf("certificate list len unmatched")
+	}
+
+	for list := buff[3:]; len(list) > 0; {
+		if len(list) < 3 {
+			return nil, fmt.Errorf("truncated certificate")
+		}
+
+		certLen := int(list[0])<<16 | int(list[1])<<8 | int(list[2])
+		if certLen == 0 || certLen > len(list)-3 {
+			return nil, fmt.Errorf("certificate len unmatched")
+		}
+
+		cert, err := x509.ParseCertificate(list[3 : 3+certLen])
+		if err != nil {
+			return nil, err
+		}
+
+		certs = append(certs, cert)
+		list = list[3+certLen:]
+	}
+
+	return certs, nil
+}
+
 // Get Subject alternative names from SNI extension
-func getClientSAN(data interface{}) []string {
+// Certificates for the client's names and signature algorithms that suit
+// 'auth', the first one goes. The ServerHello needs it before the
+// Certificate message, for status_request
+func selectCerts(tCtx *tlssl.TLSContext, helloMsg *MsgHello,
+	auth int) []*x509.Certificate {
 
-	var dnsNames []string
+	var certs []*x509.Certificate
 
-	if data == nil {
-		return nil
+	cNames := tCtx.Modz.Certs.CNs()
+	cNames = append(cNames, getClientSAN(ex.KeySNI.From(helloMsg.Extensions))...)
+	saAlgos := filterSignAlgos(
+		getClientSuppAlgos(ex.KeySignAlgo.From(helloMsg.Extensions)), auth)
+	if len(saAlgos) == 0 {
+		// No signature_algorithms (always the case before TLS 1.2), any
+		// certificate will do
+		saAlgos = []uint16{0}
 	}
 
-	extData, ok := data.(*ex.ExtSNIData)
-	if !ok {
+	// Brute force. Why ???
+	// Might return multiples choices? Dont remember why
+	for _, cn := range cNames {
+		for _, sa := range saAlgos {
+			cert := tCtx.Modz.Certs.GetByCriteria(sa, cn)
+			if cert != nil && certMatchesAuth(cert, auth, helloMsg) {
+				certs = append(certs, cert)
+				break
+			}
+		}
+	}
+
+	return certs
+}
+
+func getClientSAN(extData *ex.ExtSNIData) []string {
+
+	var dnsNames []string
+
+	if extData == nil {
 		return nil
 	}
 
@@ -158,15 +344,83 @@ func getClientSAN(data interface{}) []string {
 	return dnsNames
 }
 
-// Get supported algorithms from SignatureAlgorithms extension
-func getClientSuppAlgos(data interface{}) []uint16 {
+// Keep only the signature algorithms that fit the suite's authentication
+func filterSignAlgos(algos []uint16, auth int) []uint16 {
 
-	if data == nil {
-		return nil
+	var filtered []uint16
+
+	for _, sa := range algos {
+		switch auth {
+		case suite.RSA:
+			// PKCS1 (0x--01) or RSA-PSS with rsaEncryption keys
+			if sa&0xFF == 0x01 || (sa >= ex.RSA_PSS_RSAE_SHA256 &&
+				sa <= ex.RSA_PSS_RSAE_SHA512) {
+				filtered = append(filtered, sa)
+			}
+
+		case suite.ECDSA:
+			if sa&0xFF == 0x03 && sa>>8 < 0x08 {
+				filtered = append(filtered, sa)
+			}
+
+		default:
+			filtered = append(filtered, sa)
+		}
+	}
+
+	return filtered
+}
+
+// ECDSA certificates must also be on a curve from the client's
+// supported_groups (RFC 8422 5.1.1)
+func certMatchesAuth(cert *x509.Certificate, auth int, msg *MsgHello) bool {
+
+	switch auth {
+	case suite.RSA:
+		_, ok := cert.PublicKey.(*rsa.PublicKey)
+		return ok
+
+	case suite.ECDSA:
+		pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+		if !ok {
+			return false
+		}
+
+		groups := ex.KeySupportedGroups.From(msg.Extensions)
+		if groups == nil {
+			return true
+		}
+
+		for _, group := range groups.Groups {
+			if ecdsaCurveGroup(pub) == group {
+				return true
+			}
+		}
+
+		return false
 	}
 
-	extData, ok := data.(*ex.ExtSignAlgoData)
-	if !ok {
+	return true
+}
+
+func ecdsaCurveGroup(pub *ecdsa.PublicKey) uint16 {
+
+	switch pub.Curve.Params().BitSize {
+	case 256:
+		return ex.SECP256R1
+	case 384:
+		return ex.SECP384R1
+	case 521:
+		return ex.SECP521R1
+	}
+
+	return 0
+}
+
+// Get supported algorithms from SignatureAlgorithms extension
+func getClientSuppAlgos(extData *ex.ExtSignAlgoData) []uint16 {
+
+	if extData == nil {
 		return nil
 	}
 
@@ -1,20 +1,31 @@
 package handshake
 
-import "fmt"
+import (
+	"fmt"
+	"tlesio/tlssl"
+)
+
+// ClientCertificateType
+const (
+	_CERT_TYPE_RSA_SIGN_   = 1
+	_CERT_TYPE_ECDSA_SIGN_ = 64
+)
 
 type xCertificateRequest struct {
 	stateBasicInfo
+	tCtx *tlssl.TLSContext
 }
 
-func NewCertificateRequest(ctx HandShakeContext) CertificateRequest {
+func NewCertificateRequest(actx *AllContexts) CertificateRequest {
 
 	var newX xCertificateRequest
 
-	if ctx == nil {
+	if actx == nil || actx.Tctx == nil || actx.Hctx == nil {
 		return nil
 	}
 
-	newX.ctx = ctx
+	newX.ctx = actx.Hctx
+	newX.tCtx = actx.Tctx
 	return &newX
 }
 
@@ -26,9 +37,45 @@ func (x *xCertificateRequest) Next() (int, error) {
 	return x.nextState, x.Handle()
 }
 
+//	struct {
+//		ClientCertificateType certificate_types<1..2^8-1>;
+//		SignatureAndHashAlgorithm
+//			supported_signature_algorithms<2^16-1>; (TLS 1.2 only)
+//		DistinguishedName certificate_authorities<0..2^16-1>;
+//	} CertificateRequest;
 func (x *xCertificateRequest) Handle() error {
 
+	var buff, authorities []byte
+
+	x.tCtx.Lg.Tracef("Running state: %v", x.Name())
+	x.tCtx.Lg.Debugf("Running state: %v", x.Name())
+	buff = append(buff, 2, _CERT_TYPE_RSA_SIGN_, _CERT_TYPE_ECDSA_SIGN_)
+	if !tlssl.IsLegacyVersion(x.ctx.GetVersion()) {
+		st := x.tCtx.Modz.TLSSuite.GetSuite(x.ctx.GetCipherSuite())
+		if st == nil {
+			return fmt.Errorf("invalid cipher suite(%v)", x.Name())
+		}
+
+		algos := certVerifyAlgos(prfHash(x.ctx.GetVersion(), st))
+		buff = append(buff, byte(len(algos)*2>>8), byte(len(algos)*2))
+		for _, sa := range algos {
+			buff = append(buff, byte(sa>>8), byte(sa))
+		}
+	}
+
+	// Empty list, the client may send any certificate
+	for _, ca := range x.tCtx.ClientCAs {
+		dn := ca.RawSubject
+		authorities = append(authorities, byte(len(dn)>>8), byte(len(dn)))
+		authorities = append(authorities, dn...)
+	}
+
+	buff = append(buff, byte(len(authorities)>>8), byte(len(authorities)))
+	buff = append(buff, authorities...)
+	header := tlssl.TLSHeadsHandShakePacket(
+		tlssl.HandshakeTypeCertificateRequest, len(buff), x.ctx.GetVersion())
+	x.ctx.SetBuffer(CERTIFICATEREQUEST, append(header, buff...))
+	x.ctx.AppendOrder(CERTIFICATEREQUEST)
 	x.nextState = SERVERHELLODONE
-	fmt.Println("I AM: ", x.Name())
 	return nil
 }
@@ -1,20 +1,28 @@
 package handshake
 
-import "fmt"
+import (
+	"crypto"
+	"encoding/binary"
+	"fmt"
+	"tlesio/tlssl"
+	ex "tlesio/tlssl/extensions"
+)
 
 type xCertificateVerify struct {
 	stateBasicInfo
+	tCtx *tlssl.TLSContext
 }
 
-func NewCertificateVerify(ctx HandShakeContext) CertificateVerify {
+func NewCertificateVerify(actx *AllContexts) CertificateVerify {
 
 	var newX xCertificateVerify
 
-	if ctx == nil {
+	if actx == nil || actx.Tctx == nil || actx.Hctx == nil {
 		return nil
 	}
 
-	newX.ctx = ctx
+	newX.ctx = actx.Hctx
+	newX.tCtx = actx.Tctx
 	return &newX
 }
 
@@ -26,9 +34,103 @@ func (x *xCertificateVerify) Next() (int, error) {
 	return x.nextState, x.Handle()
 }
 
+// Client proves it holds the certificate's key by signing the transcript
+// up to (not including) this message
+//
+//	struct {
+//		SignatureAndHashAlgorithm algorithm; (TLS 1.2 only)
+//		opaque signature<0..2^16-1>;
+//	} CertificateVerify;
 func (x *xCertificateVerify) Handle() error {
 
+	var sa uint16
+
+	x.tCtx.Lg.Tracef("Running state: %v", x.Name())
+	x.tCtx.Lg.Debugf("Running state: %v", x.Name())
+	certs := x.ctx.GetPeerCerts()
+	if len(certs) == 0 {
+		return fmt.Errorf("no client certificate to verify(%v)", x.Name())
+	}
+
+	transcript := x.ctx.GetCertVerifyTranscript()
+	if transcript == nil {
+		return fmt.Errorf("nil CertificateVerify transcript(%v)", x.Name())
+	}
+
+	buff := x.ctx.GetBuffer(CERTIFICATEVERIFY)
+	if len(buff) < tlssl.TLS_HEADER_SIZE+tlssl.TLS_HANDSHAKE_SIZE {
+		return fmt.Errorf("nil CertificateVerify buffer(%v)", x.Name())
+	}
+
+	body := buff[tlssl.TLS_HEADER_SIZE+tlssl.TLS_HANDSHAKE_SIZE:]
+	legacy := tlssl.IsLegacyVersion(x.ctx.GetVersion())
+	if !legacy {
+		if len(body) < 2 {
+			return tlssl.NewAlertError(tlssl.AlertDecodeError,
+				"CertificateVerify too short(%v)", x.Name())
+		}
+
+		sa = binary.BigEndian.Uint16(body)
+		body = body[2:]
+	}
+
+	if len(body) < 2 || int(binary.BigEndian.Uint16(body)) != len(body)-2 {
+		return tlssl.NewAlertError(tlssl.AlertDecodeError,
+			"CertificateVerify signature len unmatched(%v)", x.Name())
+	}
+
+	signature := body[2:]
+	if legacy {
+		return x.verifyLegacy(certs[0].PublicKey, transcript, signature)
+	}
+
+	st := x.tCtx.Modz.TLSSuite.GetSuite(x.ctx.GetCipherSuite())
+	if st == nil {
+		return fmt.Errorf("invalid cipher suite(%v)", x.Name())
+	}
+
+	// Must be one of the CertificateRequest ones
+	prf := prfHash(x.ctx.GetVersion(), st)
+	offered := false
+	for _, algo := range certVerifyAlgos(prf) {
+		offered = offered || algo == sa
+	}
+
+	if !offered {
+		return tlssl.NewAlertError(tlssl.AlertIllegalParameter,
+			"signature algorithm 0x%04X not offered(%v)", sa, x.Name())
+	}
+
+	digest, err := transcript.Sum(prf)
+	if err != nil {
+		return fmt.Errorf("%v(%v)", err, x.Name())
+	}
+
+	err = verifySignature(certs[0].PublicKey, sa, digest, signature)
+	if err != nil {
+		return tlssl.NewAlertError(tlssl.AlertDecryptError,
+			"client signature(%v): %v", x.Name(), err)
+	}
+
+	x.tCtx.Lg.Debugf("Client signature verified: %v", ex.SignHashAlgorithms[sa])
+	x.nextState = CHANGECIPHERSPEC
+	return nil
+}
+
+func (x *xCertificateVerify) verifyLegacy(pub crypto.PublicKey,
+	transcript Transcript, signature []byte) error {
+
+	digest, err := transcript.Sum(prfHash(x.ctx.GetVersion(), nil))
+	if err != nil {
+		return fmt.Errorf("%v(%v)", err, x.Name())
+	}
+
+	if err = verifyLegacySignature(pub, digest, signature); err != nil {
+		return tlssl.NewAlertError(tlssl.AlertDecryptError,
+			"client signature(%v): %v", x.Name(), err)
+	}
+
+	x.tCtx.Lg.Debug("Client signature verified")
 	x.nextState = CHANGECIPHERSPEC
-	fmt.Println("I AM: ", x.Name())
 	return nil
 }
@@ -64,6 +64,12 @@ func (x *xChangeCipherSpec) cipeherSpecClient() error {
 		return err
 	}
 
+	x.tCtx.Trace(x.ctx.GetConnID(), &tlssl.TraceEvent{
+		Kind:    tlssl.TraceKeysDerived,
+		Version: x.ctx.GetVersion(),
+		Suite:   x.ctx.GetCipherSuite(),
+	})
+
 	// create a new cipher spec
 	st := x.tCtx.Modz.TLSSuite.GetSuite(x.ctx.GetCipherSuite())
 	if st == nil {
@@ -71,7 +77,8 @@ func (x *xChangeCipherSpec) cipeherSpecClient() error {
 	}
 
 	clientKeys := x.ctx.GetKeys().ClientKeys
-	newSpec := tlssl.NewTLSCipherSpec(st, &clientKeys, x.ctx.GetMacMode())
+	newSpec := tlssl.NewTLSCipherSpec(st, &clientKeys, x.ctx.GetMacMode(),
+		x.ctx.GetVersion(), x.tCtx.Random())
 	if newSpec == nil {
 		return fmt.Errorf("nil TLSCipherSpec object create(%v)", x.Name())
 	}
@@ -92,7 +99,8 @@ func (x *xChangeCipherSpec) cipeherSpecServer() error {
 	}
 
 	serverKeys := x.ctx.GetKeys().ServerKeys
-	newSpec := tlssl.NewTLSCipherSpec(st, &serverKeys, x.ctx.GetMacMode())
+	newSpec := tlssl.NewTLSCipherSpec(st, &serverKeys, x.ctx.GetMacMode(),
+		x.ctx.GetVersion(), x.tCtx.Random())
 	if newSpec == nil {
 		return fmt.Errorf("nil TLSCipherSpec object create(%v)", x.Name())
 	}
@@ -112,7 +120,8 @@ func (x *xChangeCipherSpec) masterSecreto() error {
 		return fmt.Errorf("nil TLSSuite object(%v)", x.Name())
 	}
 
-	keyMaker, err := tlssl.NewKeymaker(suite.SHA256, _MASTER_SECRET_SIZE_)
+	keyMaker, err := tlssl.NewKeymaker(prfHash(x.ctx.GetVersion(), stt),
+		_MASTER_SECRET_SIZE_)
 	if err != nil {
 		return fmt.Errorf("NewKeymaker error(%v): %v", x.Name(), err)
 	}
@@ -136,6 +145,12 @@ func (x *xChangeCipherSpec) masterSecreto() error {
 	x.ctx.SetBuffer(MASTERSECRET, masterSecret)
 	x.tCtx.Lg.Info("MasterSecret generated")
 	x.tCtx.Lg.Tracef("MasterSecret: %x", masterSecret)
+	err = tlssl.KeyLog(x.tCtx.KeyLog, x.ctx.GetBuffer(CLIENTRANDOM),
+		masterSecret)
+	if err != nil {
+		x.tCtx.Lg.Warn("key log: ", err)
+	}
+
 	return nil
 }
 
@@ -156,7 +171,7 @@ func (x *xChangeCipherSpec) sessionKeys() error {
 	}
 
 	blockLen := 2 * (stInfo.KeySizeHMAC + stInfo.KeySize + stInfo.IVSize)
-	kMake, err := tlssl.NewKeymaker(suite.SHA256, blockLen)
+	kMake, err := tlssl.NewKeymaker(prfHash(x.ctx.GetVersion(), st), blockLen)
 	if err != nil {
 		return fmt.Errorf("nil Keymaker object(%v)", x.Name())
 	}
@@ -202,6 +217,21 @@ func (x *xChangeCipherSpec) sessionKeys() error {
 	return nil
 }
 
+// TLS 1.0/1.1 use the MD5/SHA1 PRF. TLS 1.2 uses SHA256 unless the suite
+// calls for SHA384
+func prfHash(version uint16, st suite.Suite) int {
+
+	if tlssl.IsLegacyVersion(version) {
+		return suite.MD5SHA1
+	}
+
+	if st != nil && st.Info().Hash == suite.SHA384 {
+		return suite.SHA384
+	}
+
+	return suite.SHA256
+}
+
 func checkKeys(keys *tlssl.SessionKeys, info *suite.SuiteInfo, tag string) error {
 
 	if keys == nil {
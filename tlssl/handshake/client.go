@@ -0,0 +1,345 @@
+package handshake
+
+import (
+	"fmt"
+	"io"
+	"tlesio/tlssl"
+	"tlesio/tlssl/suite"
+)
+
+// Largest handshake message accepted from the server. Certificate chains
+// are the only big ones
+const _MAX_HANDSHAKE_LEN_ = 1 << 18
+
+// Server flight order. Each message may only follow the ones before it
+const (
+	_SERVER_CERTIFICATE_ = iota + 1
+	_SERVER_KEY_EXCHANGE_
+	_SERVER_CERTIFICATE_REQUEST_
+)
+
+// Client side of a full handshake. Same context, transcript, key schedule
+// and signature code the server uses, the messages just go the other way
+type Client interface {
+	Handshake() error
+	ALPN() string
+}
+
+type xClient struct {
+	stateBasicInfo
+	tCtx        *tlssl.TLSContext
+	cfg         *tlssl.ClientConfig
+	suites      []uint16 // Offered, in order
+	groups      []uint16 // Offered, in order
+	offeredExts map[uint16]bool
+	pending     []byte // Server handshake bytes not parsed yet
+	alpn        string
+	certReq     *clientCertRequest // nil unless the server asked for one
+	peerKX      interface{}        // Server's *ecdh.PublicKey or DHE *big.Int
+	csServer    tlssl.TLSCipherSpec
+	csClient    tlssl.TLSCipherSpec
+}
+
+type clientCertRequest struct {
+	types []uint8
+	algos []uint16 // TLS 1.2 only
+}
+
+func NewClient(actx *AllContexts, cfg *tlssl.ClientConfig) Client {
+
+	var newX xClient
+
+	if actx == nil || actx.Tctx == nil || actx.Hctx == nil || cfg == nil {
+		return nil
+	}
+
+	newX.ctx = actx.Hctx
+	newX.tCtx = actx.Tctx
+	newX.cfg = cfg
+	newX.offeredExts = make(map[uint16]bool)
+	return &newX
+}
+
+func (x *xClient) Name() string {
+	return "_Client_"
+}
+
+// Protocol the server picked out of the offered ones, if any
+func (x *xClient) ALPN() string {
+	return x.alpn
+}
+
+// Full handshake. The server is told why it failed if there is an alert
+// for the error
+func (x *xClient) Handshake() error {
+
+	err := x.handshake()
+	if err != nil {
+		x.sendAlert(err)
+		x.tCtx.Trace(x.ctx.GetConnID(), &tlssl.TraceEvent{
+			Kind: tlssl.TraceHandshakeDone,
+			Err:  err,
+		})
+
+		return err
+	}
+
+	x.tCtx.Trace(x.ctx.GetConnID(), &tlssl.TraceEvent{
+		Kind:    tlssl.TraceHandshakeDone,
+		Version: x.ctx.GetVersion(),
+		Suite:   x.ctx.GetCipherSuite(),
+	})
+
+	return nil
+}
+
+func (x *xClient) handshake() error {
+
+	if err := x.clientHello(); err != nil {
+		return err
+	}
+
+	if err := x.serverFlight(); err != nil {
+		return err
+	}
+
+	if err := x.clientFlight(); err != nil {
+		return err
+	}
+
+	if err := x.serverFinished(); err != nil {
+		return err
+	}
+
+	x.tCtx.Lg.Info("Complete Handshake")
+	return nil
+}
+
+// ServerHello, then up to ServerHelloDone. What may come in between
+// depends on the suite (RFC 5246 7.3)
+func (x *xClient) serverFlight() error {
+
+	var step int
+
+	msg, err := x.readMessage()
+	if err != nil {
+		return err
+	}
+
+	if tlssl.HandshakeTypeType(msg[0]) != tlssl.HandshakeTypeServerHello {
+		return x.unexpected(msg)
+	}
+
+	if err = x.serverHello(msg[tlssl.TLS_HANDSHAKE_SIZE:]); err != nil {
+		return err
+	}
+
+	x.ctx.Transcript().Write(msg)
+	st := x.tCtx.Modz.TLSSuite.GetSuite(x.ctx.GetCipherSuite())
+	info := st.Info()
+	for {
+		msg, err = x.readMessage()
+		if err != nil {
+			return err
+		}
+
+		body := msg[tlssl.TLS_HANDSHAKE_SIZE:]
+		switch tlssl.HandshakeTypeType(msg[0]) {
+		case tlssl.HandshakeTypeCertificate:
+			if step >= _SERVER_CERTIFICATE_ || info.Auth == suite.PSK {
+				return x.unexpected(msg)
+			}
+
+			step = _SERVER_CERTIFICATE_
+			err = x.serverCertificate(body, info.Auth)
+
+		case tlssl.HandshakeTypeServerKeyExchange:
+			if step >= _SERVER_KEY_EXCHANGE_ || info.KeyExchange == suite.RSA ||
+				(info.Auth != suite.PSK && step < _SERVER_CERTIFICATE_) {
+				return x.unexpected(msg)
+			}
+
+			step = _SERVER_KEY_EXCHANGE_
+			err = x.serverKeyExchange(body, info.KeyExchange)
+
+		case tlssl.HandshakeTypeCertificateRequest:
+			if step >= _SERVER_CERTIFICATE_REQUEST_ || info.Auth == suite.PSK {
+				return x.unexpected(msg)
+			}
+
+			step = _SERVER_CERTIFICATE_REQUEST_
+			err = x.certificateRequest(body)
+
+		case tlssl.HandshakeTypeServerHelloDone:
+			if len(body) != 0 {
+				return tlssl.NewAlertError(tlssl.AlertDecodeError,
+					"ServerHelloDone not empty(%v)", x.Name())
+			}
+
+			if info.Auth != suite.PSK && len(x.ctx.GetPeerCerts()) == 0 {
+				return tlssl.NewAlertError(tlssl.AlertUnexpectedMessage,
+					"no server Certificate(%v)", x.Name())
+			}
+
+			// Plain PSK sends it only when there is a hint
+			if x.peerKX == nil && info.KeyExchange != suite.RSA &&
+				info.KeyExchange != suite.PSK {
+				return tlssl.NewAlertError(tlssl.AlertUnexpectedMessage,
+					"no ServerKeyExchange(%v)", x.Name())
+			}
+
+			x.ctx.Transcript().Write(msg)
+			return nil
+
+		default:
+			return x.unexpected(msg)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		x.ctx.Transcript().Write(msg)
+	}
+}
+
+// Next handshake message (handshake header included, no record header).
+// Messages may share a record or span several of them
+func (x *xClient) readMessage() ([]byte, error) {
+
+	for {
+		if len(x.pending) >= tlssl.TLS_HANDSHAKE_SIZE {
+			msgLen := int(x.pending[1])<<16 | int(x.pending[2])<<8 |
+				int(x.pending[3])
+			if msgLen > _MAX_HANDSHAKE_LEN_ {
+				return nil, tlssl.NewAlertError(tlssl.AlertDecodeError,
+					"handshake message len %v(%v)", msgLen, x.Name())
+			}
+
+			if len(x.pending) >= tlssl.TLS_HANDSHAKE_SIZE+msgLen {
+				msg := x.pending[:tlssl.TLS_HANDSHAKE_SIZE+msgLen]
+				x.pending = x.pending[tlssl.TLS_HANDSHAKE_SIZE+msgLen:]
+				x.tCtx.Lg.Debugf("Received %v",
+					tlssl.HandshakeTypeType(msg[0]))
+				return msg, nil
+			}
+		}
+
+		header, fragment, err := x.readRecord()
+		if err != nil {
+			return nil, err
+		}
+
+		if header.ContentType != tlssl.ContentTypeHandshake {
+			return nil, tlssl.NewAlertError(tlssl.AlertUnexpectedMessage,
+				"%v record in handshake(%v)", header.ContentType, x.Name())
+		}
+
+		x.pending = append(x.pending, fragment...)
+	}
+}
+
+// Next record, unprotected once the server's ChangeCipherSpec is in. An
+// alert from the server ends the handshake
+func (x *xClient) readRecord() (*tlssl.TLSHeader, []byte, error) {
+
+	header, fragment, err := tlssl.ReadRecord(x.ctx.GetComms())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	x.tCtx.Trace(x.ctx.GetConnID(), &tlssl.TraceEvent{
+		Kind:   tlssl.TraceRecordReceived,
+		Record: header,
+	})
+
+	if x.csServer != nil {
+		tpt, err := x.csServer.DecryptRecord(&tlssl.TLSCipherText{
+			Header:   header,
+			Fragment: fragment,
+		})
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		header, fragment = tpt.Header, tpt.Fragment
+	}
+
+	if header.ContentType != tlssl.ContentTypeAlert {
+		return header, fragment, nil
+	}
+
+	if len(fragment) != tlssl.TLS_ALERT_SIZE {
+		return nil, nil, tlssl.NewAlertError(tlssl.AlertDecodeError,
+			"alert len %v(%v)", len(fragment), x.Name())
+	}
+
+	alert := tlssl.AlertDescriptionType(fragment[1])
+	x.tCtx.Trace(x.ctx.GetConnID(), &tlssl.TraceEvent{
+		Kind:  tlssl.TraceAlert,
+		Alert: alert,
+	})
+
+	return nil, nil, fmt.Errorf("server alert: %v(%v)", alert, x.Name())
+}
+
+func (x *xClient) unexpected(msg []byte) error {
+
+	return tlssl.NewAlertError(tlssl.AlertUnexpectedMessage,
+		"unexpected %v(%v)", tlssl.HandshakeTypeType(msg[0]), x.Name())
+}
+
+// Fatal alert for the error, protected once the client's ChangeCipherSpec
+// is out
+func (x *xClient) sendAlert(err error) {
+
+	alert, ok := tlssl.AlertFromError(err)
+	if !ok {
+		return
+	}
+
+	x.tCtx.Lg.Debugf("Sending alert: %v", alert)
+	x.tCtx.Trace(x.ctx.GetConnID(), &tlssl.TraceEvent{
+		Kind:  tlssl.TraceAlert,
+		Alert: alert,
+		Sent:  true,
+	})
+
+	if x.csClient == nil {
+		x.ctx.Send(tlssl.TLSAlertPacket(alert, x.ctx.GetVersion()))
+		return
+	}
+
+	packet, err := protect(x.csClient, tlssl.ContentTypeAlert,
+		tlssl.TLSAlert(alert))
+	if err == nil {
+		x.ctx.Send(packet)
+	}
+}
+
+// One protected record
+func protect(cs tlssl.TLSCipherSpec, ct tlssl.ContentTypeType,
+	data []byte) ([]byte, error) {
+
+	tct, err := cs.EncryptRecord(&tlssl.TLSPlaintext{
+		Header:   &tlssl.TLSHeader{ContentType: ct},
+		Fragment: data,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return tct.Packet(cs.CipherType(), false)
+}
+
+func randomBytes(random io.Reader, n int) ([]byte, error) {
+
+	buff := make([]byte, n)
+	if _, err := io.ReadFull(random, buff); err != nil {
+		return nil, err
+	}
+
+	return buff, nil
+}
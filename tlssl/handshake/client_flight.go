@@ -0,0 +1,368 @@
+package handshake
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"fmt"
+	"math/big"
+	"tlesio/tlssl"
+	ex "tlesio/tlssl/extensions"
+	"tlesio/tlssl/suite"
+)
+
+// Certificate (if asked for), ClientKeyExchange, CertificateVerify (if a
+// chain was sent), ChangeCipherSpec and Finished. All in a single write,
+// one message per record
+func (x *xClient) clientFlight() error {
+
+	var sa uint16
+	var flight []byte
+
+	sign := false
+	version := x.ctx.GetVersion()
+	st := x.tCtx.Modz.TLSSuite.GetSuite(x.ctx.GetCipherSuite())
+	prf := prfHash(version, st)
+	if x.certReq != nil {
+		var body []byte
+		body, sa, sign = x.clientCertificate(prf)
+		flight = append(flight, x.handshakeMsg(
+			tlssl.HandshakeTypeCertificate, body)...)
+	}
+
+	body, err := x.clientKeyExchange(st.Info().KeyExchange)
+	if err != nil {
+		return err
+	}
+
+	flight = append(flight, x.handshakeMsg(
+		tlssl.HandshakeTypeClientKeyExchange, body)...)
+	if sign {
+		body, err = x.certificateVerify(sa, prf)
+		if err != nil {
+			return err
+		}
+
+		flight = append(flight, x.handshakeMsg(
+			tlssl.HandshakeTypeCertificateVerify, body)...)
+	}
+
+	// Master secret, key block and both cipher specs
+	ccs := &xChangeCipherSpec{stateBasicInfo{ctx: x.ctx}, x.tCtx}
+	if err = ccs.cipeherSpecClient(); err != nil {
+		return err
+	}
+
+	if err = ccs.cipeherSpecServer(); err != nil {
+		return err
+	}
+
+	fin := &xFinished{stateBasicInfo{ctx: x.ctx}, x.tCtx}
+	verifyData, err := fin.calculateVD(_VERIFY_DATA_LABEL_CLIENT)
+	if err != nil {
+		return err
+	}
+
+	finished := tlssl.TLSHeadHandShakePacket(&tlssl.TLSHeaderHandshake{
+		HandshakeType: tlssl.HandshakeTypeFinished,
+		Len:           tlssl.VERIFYDATALEN,
+	})
+
+	finished = append(finished, verifyData...)
+	x.ctx.Transcript().Write(finished)
+	flight = append(flight, tlssl.TLSHeadPacket(&tlssl.TLSHeader{
+		ContentType: tlssl.ContentTypeChangeCipherSpec,
+		Version:     version,
+		Len:         1,
+	})...)
+
+	flight = append(flight, 0x01)
+	x.csClient = x.ctx.GetCipherScpec(CIPHERSPECCLIENT)
+	packet, err := protect(x.csClient, tlssl.ContentTypeHandshake, finished)
+	if err != nil {
+		return fmt.Errorf("protecting Finished(%v): %v", x.Name(), err)
+	}
+
+	x.tCtx.Lg.Debugf("Computed verify data(CLIENT): %x", verifyData)
+	return x.ctx.Send(append(flight, packet...))
+}
+
+// Record with one handshake message. It goes into the transcript too
+func (x *xClient) handshakeMsg(ht tlssl.HandshakeTypeType,
+	body []byte) []byte {
+
+	packet := tlssl.TLSHeadsHandShakePacket(ht, len(body),
+		x.ctx.GetVersion())
+	packet = append(packet, body...)
+	x.ctx.Transcript().Write(packet[tlssl.TLS_HEADER_SIZE:])
+	x.tCtx.Lg.Debugf("Sending %v", ht)
+	return packet
+}
+
+// Configured chain if the server takes its key type and, on TLS 1.2, there
+// is a signature algorithm both can use. An empty list otherwise, the
+// server decides if that's fatal (RFC 5246 7.4.6)
+func (x *xClient) clientCertificate(prf int) ([]byte, uint16, bool) {
+
+	var sa uint16
+	var certType uint8
+
+	certs := x.cfg.Certificates
+	if _, ok := x.cfg.PrivateKey.(crypto.Signer); len(certs) == 0 || !ok {
+		return packetCerts(nil), 0, false
+	}
+
+	pub := certs[0].PublicKey
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		certType = _CERT_TYPE_RSA_SIGN_
+	case *ecdsa.PublicKey:
+		certType = _CERT_TYPE_ECDSA_SIGN_
+	}
+
+	typeOK := false
+	for _, t := range x.certReq.types {
+		typeOK = typeOK || (certType != 0 && t == certType)
+	}
+
+	if !typeOK {
+		x.tCtx.Lg.Warn("Server does not take the client certificate type")
+		return packetCerts(nil), 0, false
+	}
+
+	// The transcript only keeps the PRF hash
+	if !tlssl.IsLegacyVersion(x.ctx.GetVersion()) {
+		for _, algo := range certVerifyAlgos(prf) {
+			for _, srvAlgo := range x.certReq.algos {
+				if sa == 0 && algo == srvAlgo && signAlgoMatchesKey(algo, pub) {
+					sa = algo
+				}
+			}
+		}
+
+		if sa == 0 {
+			x.tCtx.Lg.Warn("No signature algorithm for the client certificate")
+			return packetCerts(nil), 0, false
+		}
+	}
+
+	x.tCtx.Lg.Infof("Client certificate: %v", certs[0].Subject)
+	return packetCerts(certs), sa, true
+}
+
+//	struct {
+//		SignatureAndHashAlgorithm algorithm; (TLS 1.2 only)
+//		opaque signature<0..2^16-1>;
+//	} CertificateVerify;
+func (x *xClient) certificateVerify(sa uint16, prf int) ([]byte, error) {
+
+	var body, signature []byte
+
+	digest, err := x.ctx.Transcript().Sum(prf)
+	if err != nil {
+		return nil, fmt.Errorf("%v(%v)", err, x.Name())
+	}
+
+	key, _ := x.cfg.PrivateKey.(crypto.Signer)
+	if tlssl.IsLegacyVersion(x.ctx.GetVersion()) {
+		signature, err = signLegacySignature(x.tCtx.Random(), key, digest)
+	} else {
+		body = append(body, byte(sa>>8), byte(sa))
+		signature, err = signDigest(x.tCtx.Random(), key, sa, digest)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("CertificateVerify signature(%v): %v",
+			x.Name(), err)
+	}
+
+	if sa != 0 {
+		x.tCtx.Lg.Debugf("Client signature: %v", ex.SignHashAlgorithms[sa])
+	}
+
+	body = append(body, byte(len(signature)>>8), byte(len(signature)))
+	return append(body, signature...), nil
+}
+
+// ClientKeyExchange body. The pre master secret goes into the context
+func (x *xClient) clientKeyExchange(kx int) ([]byte, error) {
+
+	var err error
+	var body, pms []byte
+
+	x.tCtx.Lg.Debugf("Running state: %v(CLIENTKEYEXCHANGE)", x.Name())
+	switch kx {
+	case suite.RSA:
+		body, pms, err = x.rsaKeyExchange()
+
+	case suite.ECDHE:
+		body, pms, err = x.ecdheKeyExchange()
+
+	case suite.PSK, suite.DHE_PSK, suite.ECDHE_PSK:
+		body, pms, err = x.pskKeyExchange(kx)
+
+	default:
+		return nil, fmt.Errorf("key exchange not implemented yet(%v)",
+			x.Name())
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	x.ctx.SetBuffer(PREMASTERSECRET, pms)
+	return body, nil
+}
+
+//	struct {
+//		ProtocolVersion client_version;
+//		opaque random[46];
+//	} PreMasterSecret;
+//
+// client_version is the ClientHello one, not the negotiated one
+func (x *xClient) rsaKeyExchange() ([]byte, []byte, error) {
+
+	pub, ok := x.ctx.GetPeerCerts()[0].PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("server key is not RSA(%v)", x.Name())
+	}
+
+	_, maxV, _ := x.versions()
+	random, err := randomBytes(x.tCtx.Random(), _PMS_SIZE_-2)
+	if err != nil {
+		return nil, nil, fmt.Errorf("pre master secret(%v): %v", x.Name(), err)
+	}
+
+	pms := append([]byte{byte(maxV >> 8), byte(maxV)}, random...)
+	encrypted, err := rsa.EncryptPKCS1v15(x.tCtx.Random(), pub, pms)
+	if err != nil {
+		return nil, nil, fmt.Errorf("pre master secret(%v): %v", x.Name(), err)
+	}
+
+	body := []byte{byte(len(encrypted) >> 8), byte(len(encrypted))}
+	return append(body, encrypted...), pms, nil
+}
+
+// ECPoint with the client's public key, shared secret as pre master secret
+func (x *xClient) ecdheKeyExchange() ([]byte, []byte, error) {
+
+	peer, ok := x.peerKX.(*ecdh.PublicKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("no server ECDHE key(%v)", x.Name())
+	}
+
+	privKey, err := generateECDHKey(peer.Curve(), x.tCtx.Random())
+	if err != nil {
+		return nil, nil, fmt.Errorf("ECDHE key generation(%v): %v", x.Name(),
+			err)
+	}
+
+	shared, err := privKey.ECDH(peer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ECDHE shared secret(%v): %v", x.Name(),
+			err)
+	}
+
+	pubKey := privKey.PublicKey().Bytes()
+	return append([]byte{byte(len(pubKey))}, pubKey...), shared, nil
+}
+
+// dh_Yc and the shared secret, leading zeroes stripped (RFC 5246 8.1.2)
+func (x *xClient) dheKeyExchange() ([]byte, []byte, error) {
+
+	peer, ok := x.peerKX.(*big.Int)
+	if !ok {
+		return nil, nil, fmt.Errorf("no server DHE key(%v)", x.Name())
+	}
+
+	exponent, err := randomBytes(x.tCtx.Random(), _DHE_EXPONENT_SIZE_)
+	if err != nil {
+		return nil, nil, fmt.Errorf("DHE key generation(%v): %v", x.Name(), err)
+	}
+
+	privKey := new(big.Int).SetBytes(exponent)
+	pubKey := new(big.Int).Exp(ffdhe2048G, privKey, ffdhe2048P).Bytes()
+	shared := new(big.Int).Exp(peer, privKey, ffdhe2048P).Bytes()
+	body := []byte{byte(len(pubKey) >> 8), byte(len(pubKey))}
+	return append(body, pubKey...), shared, nil
+}
+
+// psk_identity followed by the (EC)DHE public value, if any
+func (x *xClient) pskKeyExchange(kx int) ([]byte, []byte, error) {
+
+	var err error
+	var public, other []byte
+
+	switch kx {
+	case suite.DHE_PSK:
+		public, other, err = x.dheKeyExchange()
+	case suite.ECDHE_PSK:
+		public, other, err = x.ecdheKeyExchange()
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	identity := x.cfg.PSKIdentity
+	body := []byte{byte(len(identity) >> 8), byte(len(identity))}
+	body = append(body, identity...)
+	x.tCtx.Lg.Tracef("PSK identity: %s", identity)
+	return append(body, public...), pskPreMasterSecret(other, x.cfg.PSK), nil
+}
+
+// Server's ChangeCipherSpec and Finished. Its verify data covers the
+// client's Finished too
+func (x *xClient) serverFinished() error {
+
+	x.tCtx.Lg.Debugf("Running state: %v(FINISHED)", x.Name())
+	header, fragment, err := x.readRecord()
+	if err != nil {
+		return err
+	}
+
+	if header.ContentType != tlssl.ContentTypeChangeCipherSpec ||
+		len(x.pending) != 0 {
+		return tlssl.NewAlertError(tlssl.AlertUnexpectedMessage,
+			"expected ChangeCipherSpec, got %v(%v)", header.ContentType,
+			x.Name())
+	}
+
+	if len(fragment) != 1 || fragment[0] != 0x01 {
+		return tlssl.NewAlertError(tlssl.AlertDecodeError,
+			"invalid ChangeCipherSpec(%v)", x.Name())
+	}
+
+	x.csServer = x.ctx.GetCipherScpec(CIPHERSPECSERVER)
+	fin := &xFinished{stateBasicInfo{ctx: x.ctx}, x.tCtx}
+	expected, err := fin.calculateVD(_VERIFY_DATA_LABEL_SERVER)
+	if err != nil {
+		return err
+	}
+
+	msg, err := x.readMessage()
+	if err != nil {
+		return err
+	}
+
+	if tlssl.HandshakeTypeType(msg[0]) != tlssl.HandshakeTypeFinished {
+		return x.unexpected(msg)
+	}
+
+	x.tCtx.Lg.Tracef("Computed/Received verify data: %x / %x", expected,
+		msg[tlssl.TLS_HANDSHAKE_SIZE:])
+	if !hmac.Equal(expected, msg[tlssl.TLS_HANDSHAKE_SIZE:]) {
+		return tlssl.NewAlertError(tlssl.AlertDecryptError,
+			"verify data mismatch(%v)", x.Name())
+	}
+
+	x.ctx.Transcript().Write(msg)
+	if len(x.pending) != 0 {
+		return tlssl.NewAlertError(tlssl.AlertUnexpectedMessage,
+			"data after Finished(%v)", x.Name())
+	}
+
+	return nil
+}
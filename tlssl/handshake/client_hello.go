@@ -0,0 +1,368 @@
+package handshake
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"tlesio/tlssl"
+	ex "tlesio/tlssl/extensions"
+	"tlesio/tlssl/suite"
+)
+
+const _EXT_RENEGOTIATION_INFO_ = 0xFF01
+
+// Offered in signature_algorithms. Every one of them can be verified
+var clientSignAlgos = []uint16{
+	ex.ECDSA_SECP256R1_SHA256, ex.ECDSA_SECP384R1_SHA384,
+	ex.ECDSA_SECP521R1_SHA512, ex.RSA_PSS_RSAE_SHA256,
+	ex.RSA_PSS_RSAE_SHA384, ex.RSA_PSS_RSAE_SHA512, ex.RSA_PKCS1_SHA256,
+	ex.RSA_PKCS1_SHA384, ex.RSA_PKCS1_SHA512, ex.ECDSA_SHA1,
+	ex.RSA_PKCS1_SHA1,
+}
+
+// Used when the config has no groups
+var clientDefaultGroups = []uint16{ex.X25519, ex.SECP256R1, ex.SECP384R1}
+
+// Zero versions mean TLS 1.2
+func (x *xClient) versions() (uint16, uint16, error) {
+
+	minV, maxV := x.cfg.MinVersion, x.cfg.MaxVersion
+	if maxV == 0 {
+		maxV = tlssl.TLS_VERSION1_2
+	}
+
+	if minV == 0 {
+		minV = tlssl.TLS_VERSION1_2
+		if maxV < minV {
+			minV = maxV
+		}
+	}
+
+	for _, v := range []uint16{minV, maxV} {
+		if v != tlssl.TLS_VERSION1_2 && !tlssl.IsLegacyVersion(v) {
+			return 0, 0, fmt.Errorf("unsupported version 0x%04X(%v)", v,
+				x.Name())
+		}
+	}
+
+	if minV > maxV {
+		return 0, 0, fmt.Errorf("MinVersion over MaxVersion(%v)", x.Name())
+	}
+
+	return minV, maxV, nil
+}
+
+//	struct {
+//		ProtocolVersion client_version;
+//		Random random;
+//		SessionID session_id;
+//		CipherSuite cipher_suites<2..2^16-2>;
+//		CompressionMethod compression_methods<1..2^8-1>;
+//		Extension extensions<0..2^16-1>;
+//	} ClientHello;
+//
+// No session resumption, so the session ID is always empty
+func (x *xClient) clientHello() error {
+
+	var buff []byte
+
+	x.tCtx.Lg.Debugf("Running state: %v(CLIENTHELLO)", x.Name())
+	minV, maxV, err := x.versions()
+	if err != nil {
+		return err
+	}
+
+	x.offerSuites(maxV)
+	if len(x.suites) == 0 {
+		return fmt.Errorf("no cipher suite to offer(%v)", x.Name())
+	}
+
+	random, err := randomBytes(x.tCtx.Random(), 32)
+	if err != nil {
+		return fmt.Errorf("client random(%v): %v", x.Name(), err)
+	}
+
+	buff = append(buff, byte(maxV>>8), byte(maxV))
+	buff = append(buff, random...)
+	buff = append(buff, 0x00)
+	buff = append(buff, byte(len(x.suites)*2>>8), byte(len(x.suites)*2))
+	for _, cs := range x.suites {
+		buff = append(buff, byte(cs>>8), byte(cs))
+	}
+
+	buff = append(buff, 0x01, 0x00)
+	exts := x.extensions(maxV)
+	buff = append(buff, byte(len(exts)>>8), byte(len(exts)))
+	buff = append(buff, exts...)
+
+	// Record version is the lowest one, some servers choke on anything else
+	packet := tlssl.TLSHeadsHandShakePacket(tlssl.HandshakeTypeClientHello,
+		len(buff), minV)
+	packet = append(packet, buff...)
+	x.ctx.SetVersion(minV)
+	x.ctx.SetBuffer(CLIENTHELLO, packet)
+	x.ctx.SetBuffer(CLIENTRANDOM, random)
+	x.ctx.Transcript().Write(packet[tlssl.TLS_HEADER_SIZE:])
+	x.tCtx.Lg.Tracef("Field[Random(client)]: %x", random)
+	return x.ctx.Send(packet)
+}
+
+// Config's suites (or every supported one) the version can use. PSK ones
+// need an identity and a key
+func (x *xClient) offerSuites(maxV uint16) {
+
+	candidates := x.cfg.CipherSuites
+	if len(candidates) == 0 {
+		candidates = x.tCtx.Modz.TLSSuite.AllSupported()
+	}
+
+	dhe := false
+	for _, id := range candidates {
+		if !x.tCtx.Modz.TLSSuite.IsSupported(id) {
+			continue
+		}
+
+		st := x.tCtx.Modz.TLSSuite.GetSuite(id)
+		if !suiteVersionOK(st, maxV) {
+			continue
+		}
+
+		if st.Info().Auth == suite.PSK &&
+			(len(x.cfg.PSK) == 0 || len(x.cfg.PSKIdentity) == 0) {
+			continue
+		}
+
+		dhe = dhe || st.Info().KeyExchange == suite.DHE_PSK
+		x.suites = append(x.suites, id)
+	}
+
+	groups := x.cfg.Groups
+	if len(groups) == 0 {
+		groups = append([]uint16{}, clientDefaultGroups...)
+		if dhe {
+			groups = append(groups, ex.FFDHE2048)
+		}
+	}
+
+	for _, group := range groups {
+		if ecdhCurve(group) != nil || group == ex.FFDHE2048 {
+			x.groups = append(x.groups, group)
+		}
+	}
+}
+
+// Extensions block content. Whatever is offered here is all the server may
+// answer with
+func (x *xClient) extensions(maxV uint16) []byte {
+
+	var buff, data []byte
+
+	// No IP literals in SNI (RFC 6066 3)
+	name := x.cfg.ServerName
+	if name != "" && net.ParseIP(name) == nil {
+		data = append(data, byte((len(name)+3)>>8), byte(len(name)+3), 0x00)
+		data = append(data, byte(len(name)>>8), byte(len(name)))
+		data = append(data, name...)
+		buff = x.appendExt(buff, _EXT_SERVER_NAME_, data)
+	}
+
+	data = []byte{byte(len(x.groups) * 2 >> 8), byte(len(x.groups) * 2)}
+	for _, group := range x.groups {
+		data = append(data, byte(group>>8), byte(group))
+	}
+
+	buff = x.appendExt(buff, _EXT_SUPPORTED_GROUPS_, data)
+	buff = x.appendExt(buff, _EXT_EC_POINT_FORMATS_,
+		[]byte{0x01, ex.EC_POINT_UNCOMPRESSED})
+
+	// TLS 1.2 only (RFC 5246 7.4.1.4.1)
+	if maxV == tlssl.TLS_VERSION1_2 {
+		data = []byte{byte(len(clientSignAlgos) * 2 >> 8),
+			byte(len(clientSignAlgos) * 2)}
+		for _, sa := range clientSignAlgos {
+			data = append(data, byte(sa>>8), byte(sa))
+		}
+
+		buff = x.appendExt(buff, _EXT_SIGNATURE_ALGOS_, data)
+	}
+
+	if len(x.cfg.ALPN) > 0 {
+		var list []byte
+		for _, proto := range x.cfg.ALPN {
+			if len(proto) == 0 || len(proto) > 255 {
+				continue
+			}
+
+			list = append(list, byte(len(proto)))
+			list = append(list, proto...)
+		}
+
+		data = append([]byte{byte(len(list) >> 8), byte(len(list))}, list...)
+		buff = x.appendExt(buff, _EXT_ALPN_, data)
+	}
+
+	// Initial handshake, empty renegotiated_connection (RFC 5746 3.4)
+	return x.appendExt(buff, _EXT_RENEGOTIATION_INFO_, []byte{0x00})
+}
+
+func (x *xClient) appendExt(buff []byte, id uint16, data []byte) []byte {
+
+	x.offeredExts[id] = true
+	buff = append(buff, byte(id>>8), byte(id))
+	buff = append(buff, byte(len(data)>>8), byte(len(data)))
+	return append(buff, data...)
+}
+
+//	struct {
+//		ProtocolVersion server_version;
+//		Random random;
+//		SessionID session_id;
+//		CipherSuite cipher_suite;
+//		CompressionMethod compression_method;
+//		Extension extensions<0..2^16-1>;
+//	} ServerHello;
+func (x *xClient) serverHello(body []byte) error {
+
+	x.tCtx.Lg.Debugf("Running state: %v(SERVERHELLO)", x.Name())
+	minV, maxV, _ := x.versions()
+	if len(body) < 2+32+1 || len(body) < 2+32+1+int(body[34])+3 {
+		return tlssl.NewAlertError(tlssl.AlertDecodeError,
+			"ServerHello too short(%v)", x.Name())
+	}
+
+	version := binary.BigEndian.Uint16(body)
+	if version < minV || version > maxV {
+		return tlssl.NewAlertError(tlssl.AlertProtocolVersion,
+			"server version 0x%04X(%v)", version, x.Name())
+	}
+
+	random := body[2:34]
+	sidLen := int(body[34])
+	if sidLen > 32 {
+		return tlssl.NewAlertError(tlssl.AlertDecodeError,
+			"session ID len %v(%v)", sidLen, x.Name())
+	}
+
+	body = body[35+sidLen:]
+	cs := binary.BigEndian.Uint16(body)
+	st := x.tCtx.Modz.TLSSuite.GetSuite(cs)
+	if !x.offered(cs) || !suiteVersionOK(st, version) {
+		return tlssl.NewAlertError(tlssl.AlertIllegalParameter,
+			"server suite 0x%04X not offered(%v)", cs, x.Name())
+	}
+
+	if body[2] != 0x00 {
+		return tlssl.NewAlertError(tlssl.AlertIllegalParameter,
+			"compression method %v(%v)", body[2], x.Name())
+	}
+
+	if err := x.serverExtensions(body[3:]); err != nil {
+		return err
+	}
+
+	x.ctx.SetVersion(version)
+	x.ctx.SetCipherSuite(cs)
+	x.ctx.SetBuffer(SERVERRANDOM, append([]byte{}, random...))
+	if err := x.ctx.Transcript().Keep(prfHash(version, st)); err != nil {
+		return err
+	}
+
+	x.tCtx.Lg.Tracef("CipherSuite: %v", suite.CipherSuiteNames[cs])
+	x.tCtx.Trace(x.ctx.GetConnID(), &tlssl.TraceEvent{
+		Kind:    tlssl.TraceSuiteSelected,
+		Version: version,
+		Suite:   cs,
+	})
+
+	return nil
+}
+
+func (x *xClient) offered(cs uint16) bool {
+
+	for _, id := range x.suites {
+		if id == cs {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Only what was offered, once each (RFC 5246 7.4.1.4)
+func (x *xClient) serverExtensions(buff []byte) error {
+
+	seen := make(map[uint16]bool)
+	if len(buff) == 0 {
+		return nil
+	}
+
+	if len(buff) < 2 || int(binary.BigEndian.Uint16(buff)) != len(buff)-2 {
+		return tlssl.NewAlertError(tlssl.AlertDecodeError,
+			"ServerHello extensions len unmatched(%v)", x.Name())
+	}
+
+	for buff = buff[2:]; len(buff) > 0; {
+		if len(buff) < 4 {
+			return tlssl.NewAlertError(tlssl.AlertDecodeError,
+				"truncated extension header(%v)", x.Name())
+		}
+
+		extID := binary.BigEndian.Uint16(buff)
+		extLen := int(binary.BigEndian.Uint16(buff[2:]))
+		if extLen > len(buff)-4 {
+			return tlssl.NewAlertError(tlssl.AlertDecodeError,
+				"extension 0x%04X is too long(%v)", extID, x.Name())
+		}
+
+		data := buff[4 : 4+extLen]
+		buff = buff[4+extLen:]
+		if !x.offeredExts[extID] {
+			return tlssl.NewAlertError(tlssl.AlertUnsupportedExtension,
+				"extension 0x%04X not offered(%v)", extID, x.Name())
+		}
+
+		if seen[extID] {
+			return tlssl.NewAlertError(tlssl.AlertIllegalParameter,
+				"duplicated extension 0x%04X(%v)", extID, x.Name())
+		}
+
+		seen[extID] = true
+		if err := x.serverExtension(extID, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (x *xClient) serverExtension(extID uint16, data []byte) error {
+
+	switch extID {
+	// protocol_name_list with exactly one offered protocol (RFC 7301 3.1)
+	case _EXT_ALPN_:
+		if len(data) < 3 || int(binary.BigEndian.Uint16(data)) != len(data)-2 ||
+			int(data[2]) != len(data)-3 {
+			return tlssl.NewAlertError(tlssl.AlertDecodeError,
+				"ALPN extension len unmatched(%v)", x.Name())
+		}
+
+		proto := string(data[3:])
+		for _, offered := range x.cfg.ALPN {
+			if offered == proto {
+				x.alpn = proto
+				return nil
+			}
+		}
+
+		return tlssl.NewAlertError(tlssl.AlertIllegalParameter,
+			"ALPN protocol '%v' not offered(%v)", proto, x.Name())
+
+	case _EXT_RENEGOTIATION_INFO_:
+		if len(data) != 1 || data[0] != 0x00 {
+			return tlssl.NewAlertError(tlssl.AlertHandshakeFailure,
+				"renegotiation_info not empty(%v)", x.Name())
+		}
+	}
+
+	return nil
+}
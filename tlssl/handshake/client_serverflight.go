@@ -0,0 +1,317 @@
+package handshake
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"tlesio/tlssl"
+	ex "tlesio/tlssl/extensions"
+	"tlesio/tlssl/suite"
+)
+
+// Server's chain. Verified against the config's roots unless told not to
+func (x *xClient) serverCertificate(body []byte, auth int) error {
+
+	x.tCtx.Lg.Debugf("Running state: %v(CERTIFICATE)", x.Name())
+	certs, err := parseCerts(body)
+	if err != nil {
+		return tlssl.NewAlertError(tlssl.AlertBadCertificate, "%v(%v)", err,
+			x.Name())
+	}
+
+	if len(certs) == 0 {
+		return tlssl.NewAlertError(tlssl.AlertBadCertificate,
+			"empty server Certificate(%v)", x.Name())
+	}
+
+	keyOK := false
+	switch certs[0].PublicKey.(type) {
+	case *rsa.PublicKey:
+		keyOK = auth == suite.RSA
+	case *ecdsa.PublicKey:
+		keyOK = auth == suite.ECDSA
+	}
+
+	if !keyOK {
+		return tlssl.NewAlertError(tlssl.AlertUnsupportedCertificate,
+			"server key does not fit the suite(%v)", x.Name())
+	}
+
+	if err = x.verifyServerChain(certs); err != nil {
+		return err
+	}
+
+	x.ctx.SetPeerCerts(certs)
+	x.tCtx.Lg.Infof("Server certificate: %v", certs[0].Subject)
+	return nil
+}
+
+func (x *xClient) verifyServerChain(certs []*x509.Certificate) error {
+
+	if x.cfg.InsecureSkipVerify {
+		x.tCtx.Lg.Warn("Server certificate not verified")
+		return nil
+	}
+
+	if x.cfg.ServerName == "" {
+		return fmt.Errorf("no ServerName to verify the server with(%v)",
+			x.Name())
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         x.cfg.RootCAs,
+		DNSName:       x.cfg.ServerName,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		CurrentTime:   x.tCtx.Now(),
+	}
+
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	if _, err := certs[0].Verify(opts); err != nil {
+		return tlssl.NewAlertError(chainAlert(err),
+			"server certificate(%v): %v", x.Name(), err)
+	}
+
+	return nil
+}
+
+// PSK suites start with the identity hint. Only ECDHE params are signed,
+// DHE_PSK and ECDHE_PSK rely on the PSK instead (RFC 4279 3, RFC 5489 2)
+func (x *xClient) serverKeyExchange(body []byte, kx int) error {
+
+	var err error
+
+	x.tCtx.Lg.Debugf("Running state: %v(SERVERKEYEXCHANGE)", x.Name())
+	if kx == suite.PSK || kx == suite.DHE_PSK || kx == suite.ECDHE_PSK {
+		if len(body) < 2 || int(binary.BigEndian.Uint16(body)) > len(body)-2 {
+			return tlssl.NewAlertError(tlssl.AlertDecodeError,
+				"PSK identity hint len unmatched(%v)", x.Name())
+		}
+
+		hintLen := int(binary.BigEndian.Uint16(body))
+		x.tCtx.Lg.Tracef("PSK identity hint: %s", body[2:2+hintLen])
+		body = body[2+hintLen:]
+	}
+
+	switch kx {
+	case suite.PSK:
+		if len(body) != 0 {
+			err = fmt.Errorf("trailing ServerKeyExchange data")
+		}
+
+	case suite.DHE_PSK:
+		err = x.dheServerParams(body)
+
+	case suite.ECDHE, suite.ECDHE_PSK:
+		var n int
+		n, err = x.ecdheServerParams(body)
+		if err == nil && kx == suite.ECDHE {
+			return x.verifyServerParams(body[:n], body[n:])
+		}
+
+		if err == nil && n != len(body) {
+			err = fmt.Errorf("trailing ServerKeyExchange data")
+		}
+
+	default:
+		return fmt.Errorf("key exchange not implemented yet(%v)", x.Name())
+	}
+
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := tlssl.AlertFromError(err); ok {
+		return err
+	}
+
+	return tlssl.NewAlertError(tlssl.AlertDecodeError, "%v(%v)", err,
+		x.Name())
+}
+
+// ServerECDHParams. Returns how many bytes they took. The group must be
+// one of the offered ones
+func (x *xClient) ecdheServerParams(buff []byte) (int, error) {
+
+	if len(buff) < 4 || int(buff[3]) > len(buff)-4 {
+		return 0, fmt.Errorf("ServerECDHParams len unmatched")
+	}
+
+	if buff[0] != _NAMED_CURVE_ {
+		return 0, tlssl.NewAlertError(tlssl.AlertIllegalParameter,
+			"curve type %v(%v)", buff[0], x.Name())
+	}
+
+	group := binary.BigEndian.Uint16(buff[1:])
+	curve := ecdhCurve(group)
+	offered := false
+	for _, g := range x.groups {
+		offered = offered || g == group
+	}
+
+	if curve == nil || !offered {
+		return 0, tlssl.NewAlertError(tlssl.AlertIllegalParameter,
+			"group 0x%04X not offered(%v)", group, x.Name())
+	}
+
+	pub, err := curve.NewPublicKey(buff[4 : 4+int(buff[3])])
+	if err != nil {
+		return 0, tlssl.NewAlertError(tlssl.AlertIllegalParameter,
+			"invalid server ECDHE key(%v): %v", x.Name(), err)
+	}
+
+	x.peerKX = pub
+	x.tCtx.Lg.Tracef("ECDHE group: %v", ex.SupportedGroups[group])
+	return 4 + int(buff[3]), nil
+}
+
+// ServerDHParams. Only ffdhe2048 is accepted, it's what was offered
+func (x *xClient) dheServerParams(buff []byte) error {
+
+	var values []*big.Int
+
+	for i := 0; i < 3; i++ {
+		if len(buff) < 2 || int(binary.BigEndian.Uint16(buff)) > len(buff)-2 {
+			return fmt.Errorf("ServerDHParams len unmatched")
+		}
+
+		vLen := int(binary.BigEndian.Uint16(buff))
+		values = append(values, new(big.Int).SetBytes(buff[2:2+vLen]))
+		buff = buff[2+vLen:]
+	}
+
+	if len(buff) != 0 {
+		return fmt.Errorf("trailing ServerKeyExchange data")
+	}
+
+	if values[0].Cmp(ffdhe2048P) != 0 || values[1].Cmp(ffdhe2048G) != 0 {
+		return tlssl.NewAlertError(tlssl.AlertInsufficientSecurity,
+			"DHE group is not ffdhe2048(%v)", x.Name())
+	}
+
+	// 1 < Ys < p - 1
+	pMinus1 := new(big.Int).Sub(ffdhe2048P, big.NewInt(1))
+	if values[2].Cmp(big.NewInt(1)) <= 0 || values[2].Cmp(pMinus1) >= 0 {
+		return tlssl.NewAlertError(tlssl.AlertIllegalParameter,
+			"invalid server DHE key(%v)", x.Name())
+	}
+
+	x.peerKX = values[2]
+	return nil
+}
+
+//	digitally-signed struct {
+//		opaque client_random[32];
+//		opaque server_random[32];
+//		ServerECDHParams params;
+//	} signed_params;
+func (x *xClient) verifyServerParams(params, buff []byte) error {
+
+	var sa uint16
+	var signed []byte
+
+	legacy := tlssl.IsLegacyVersion(x.ctx.GetVersion())
+	if !legacy {
+		if len(buff) < 2 {
+			return tlssl.NewAlertError(tlssl.AlertDecodeError,
+				"no signature algorithm(%v)", x.Name())
+		}
+
+		sa = binary.BigEndian.Uint16(buff)
+		buff = buff[2:]
+	}
+
+	if len(buff) < 2 || int(binary.BigEndian.Uint16(buff)) != len(buff)-2 {
+		return tlssl.NewAlertError(tlssl.AlertDecodeError,
+			"ServerKeyExchange signature len unmatched(%v)", x.Name())
+	}
+
+	signed = append(signed, x.ctx.GetBuffer(CLIENTRANDOM)...)
+	signed = append(signed, x.ctx.GetBuffer(SERVERRANDOM)...)
+	signed = append(signed, params...)
+	pub := x.ctx.GetPeerCerts()[0].PublicKey
+	err := x.checkSignature(pub, sa, signed, buff[2:], legacy)
+	if err != nil {
+		return tlssl.NewAlertError(tlssl.AlertDecryptError,
+			"server signature(%v): %v", x.Name(), err)
+	}
+
+	x.tCtx.Lg.Debug("Server params signature verified")
+	return nil
+}
+
+func (x *xClient) checkSignature(pub crypto.PublicKey, sa uint16, signed,
+	sig []byte, legacy bool) error {
+
+	if legacy {
+		md5sha1 := append(hashWith(crypto.MD5, signed),
+			hashWith(crypto.SHA1, signed)...)
+		return verifyLegacySignature(pub, md5sha1, sig)
+	}
+
+	offered := false
+	for _, algo := range clientSignAlgos {
+		offered = offered || algo == sa
+	}
+
+	if !offered || !signAlgoMatchesKey(sa, pub) {
+		return fmt.Errorf("signature algorithm 0x%04X not acceptable", sa)
+	}
+
+	return verifySignature(pub, sa, hashWith(signAlgosHash[sa], signed), sig)
+}
+
+//	struct {
+//		ClientCertificateType certificate_types<1..2^8-1>;
+//		SignatureAndHashAlgorithm
+//			supported_signature_algorithms<2^16-1>; (TLS 1.2 only)
+//		DistinguishedName certificate_authorities<0..2^16-1>;
+//	} CertificateRequest;
+//
+// Authorities are not looked at, the configured chain is sent anyway
+func (x *xClient) certificateRequest(body []byte) error {
+
+	var req clientCertRequest
+
+	x.tCtx.Lg.Debugf("Running state: %v(CERTIFICATEREQUEST)", x.Name())
+	if len(body) < 1 || int(body[0]) == 0 || int(body[0]) > len(body)-1 {
+		return tlssl.NewAlertError(tlssl.AlertDecodeError,
+			"certificate types len unmatched(%v)", x.Name())
+	}
+
+	req.types = append(req.types, body[1:1+int(body[0])]...)
+	body = body[1+int(body[0]):]
+	if !tlssl.IsLegacyVersion(x.ctx.GetVersion()) {
+		if len(body) < 2 || int(binary.BigEndian.Uint16(body)) > len(body)-2 ||
+			binary.BigEndian.Uint16(body)%2 != 0 {
+			return tlssl.NewAlertError(tlssl.AlertDecodeError,
+				"signature algorithms len unmatched(%v)", x.Name())
+		}
+
+		algosLen := int(binary.BigEndian.Uint16(body))
+		req.algos = uint16List(body[:2+algosLen], 2)
+		body = body[2+algosLen:]
+	}
+
+	if len(body) < 2 || int(binary.BigEndian.Uint16(body)) != len(body)-2 {
+		return tlssl.NewAlertError(tlssl.AlertDecodeError,
+			"certificate authorities len unmatched(%v)", x.Name())
+	}
+
+	x.certReq = &req
+	return nil
+}
+
+func hashWith(h crypto.Hash, data []byte) []byte {
+
+	hasher := h.New()
+	hasher.Write(data)
+	return hasher.Sum(nil)
+}
@@ -34,7 +34,16 @@ type MsgHello struct {
 	Random       [32]byte
 	SessionId    []byte
 	CipherSuites []uint16
-	Extensions   map[uint16]interface{} //ExtensionType -> ExtensionData
+	Extensions   map[uint16]ex.Data //ExtensionType -> ExtensionData
+
+	// As sent (wire order, GREASE included), registered extension or not.
+	// Fingerprints are computed from these
+	ExtensionIDs      []uint16
+	Groups            []uint16
+	PointFormats      []uint8
+	SignAlgos         []uint16
+	ALPN              []string
+	SupportedVersions []uint16
 }
 
 type xClientHello struct {
@@ -77,11 +86,12 @@ func (x *xClientHello) Handle() error {
 		return fmt.Errorf("nil ClientHello buffer")
 	}
 
-	cliHelloBuf := buff[tlssl.TLS_HEADER_SIZE+tlssl.TLS_HANDSHAKE_SIZE:]
-	if len(cliHelloBuf) < 38 {
+	if len(buff) < tlssl.TLS_HEADER_SIZE+tlssl.TLS_HANDSHAKE_SIZE+38 {
 		return fmt.Errorf("ClientHello buffer is too small")
 	}
 
+	cliHelloBuf := buff[tlssl.TLS_HEADER_SIZE+tlssl.TLS_HANDSHAKE_SIZE:]
+
 	offset += x.version(cliHelloBuf[offset:], &newMsg)
 	offset += x.random(cliHelloBuf[offset:], &newMsg)
 	aux, err = x.sessionId(cliHelloBuf[offset:], &newMsg)
@@ -103,16 +113,32 @@ func (x *xClientHello) Handle() error {
 
 	compressionMethodsLen := uint32(cliHelloBuf[offset])
 	offset += 1 + compressionMethodsLen
-	newMsg.Extensions = make(map[uint16]interface{})
-	offset += x.extensions(cliHelloBuf[offset:], &newMsg)
+	if len(cliHelloBuf) < int(offset) {
+		return fmt.Errorf("buffer too small in Compression Methods")
+	}
+
+	newMsg.Extensions = make(map[uint16]ex.Data)
+	aux, err = x.extensions(cliHelloBuf[offset:], &newMsg)
+	if err != nil {
+		return err
+	}
+
+	offset += aux
 
 	if int(offset) != len(cliHelloBuf) {
 		return fmt.Errorf("ClientHello message parse doesnt match offset")
 	}
 
-	x.ctx.AppendOrder(CLIENTHELLO)
+	x.ctx.Transcript().Write(buff[tlssl.TLS_HEADER_SIZE:])
 	x.ctx.SetMsgHello(&newMsg)
 	x.ctx.SetBuffer(CLIENTRANDOM, newMsg.Random[:])
+	x.tCtx.Lg.Infof("Client fingerprint: JA3 %v, JA4 %v", newMsg.JA3Hash(),
+		newMsg.JA4())
+	x.tCtx.Trace(x.ctx.GetConnID(), &tlssl.TraceEvent{
+		Kind:  tlssl.TraceClientHello,
+		Hello: traceHello(&newMsg),
+	})
+
 	x.nextState = SERVERHELLO
 	return nil
 }
@@ -139,7 +165,7 @@ func (x *xClientHello) sessionId(buff []byte, msg *MsgHello) (uint32, error) {
 		return offsetSessionIdLen, nil
 	}
 
-	if sessionIdLen > 32 {
+	if sessionIdLen > 32 || len(buff) < int(1+sessionIdLen) {
 		return 0, fmt.Errorf("invalid session ID length")
 	}
 
@@ -153,8 +179,12 @@ func (x *xClientHello) sessionId(buff []byte, msg *MsgHello) (uint32, error) {
 func (x *xClientHello) cSuites(buffer []byte, msg *MsgHello) (uint32, error) {
 
 	offset := uint32(offsetCipherSuitesLen)
+	if len(buffer) < int(offset) {
+		return 0, fmt.Errorf("CipherSuites field is too small")
+	}
+
 	fieldLen := binary.BigEndian.Uint16(buffer[:2])
-	if len(buffer) < int(fieldLen) {
+	if len(buffer) < int(offset)+int(fieldLen) {
 		return 0, fmt.Errorf("CipherSuites field is too small")
 	}
 
@@ -175,43 +205,72 @@ func (x *xClientHello) cSuites(buffer []byte, msg *MsgHello) (uint32, error) {
 	return offset, nil
 }
 
-// Parse and store only supported extensions data
-func (x *xClientHello) extensions(buffer []byte, msg *MsgHello) uint32 {
+// Parse and store only supported extensions data. Every extension ID is
+// kept, plus the raw lists used for fingerprinting. No extensions at all
+// is fine, a malformed block, a repeated extension or one that doesn't
+// belong in a ClientHello is not
+func (x *xClientHello) extensions(buffer []byte,
+	msg *MsgHello) (uint32, error) {
+
+	seen := make(map[uint16]bool)
+	if len(buffer) == 0 {
+		return 0, nil
+	}
 
 	if len(buffer) < 2 {
-		return 0
+		return 0, fmt.Errorf("Extensions field is too small")
 	}
 
-	offset := 0
-	extLen := binary.BigEndian.Uint16(buffer[:2])
-	if len(buffer) < int(extLen) {
-		return 0
+	offset := 2
+	end := offset + int(binary.BigEndian.Uint16(buffer[:2]))
+	if len(buffer) < end {
+		return 0, fmt.Errorf("Extensions field is too small")
 	}
 
-	offset += 2
-	for offset < int(extLen) {
+	for offset < end {
+		if end-offset < 4 {
+			return 0, fmt.Errorf("truncated extension header")
+		}
+
 		extID := binary.BigEndian.Uint16(buffer[offset : offset+2])
 		extLen := binary.BigEndian.Uint16(buffer[offset+2 : offset+4])
 		offset += 2 + 2
+		if offset+int(extLen) > end {
+			return 0, fmt.Errorf("extension 0x%04X is too long", extID)
+		}
+
+		// RFC 5246 7.4.1.4
+		if seen[extID] {
+			return 0, tlssl.NewAlertError(tlssl.AlertIllegalParameter,
+				"duplicated extension 0x%04X", extID)
+		}
+
+		seen[extID] = true
+		msg.ExtensionIDs = append(msg.ExtensionIDs, extID)
+		fingerprintExt(extID, buffer[offset:offset+int(extLen)], msg)
 		ext := x.tCtx.Exts.Get(extID)
+		if ext != nil && ext.Messages()&ex.MsgClientHello == 0 {
+			return 0, tlssl.NewAlertError(tlssl.AlertIllegalParameter,
+				"extension %v not allowed in ClientHello", ext.Name())
+		}
+
 		if ext != nil {
 			data, err := ext.LoadData(
 				buffer[offset:offset+int(extLen)], int(extLen))
 			if err != nil {
-				x.tCtx.Lg.Errorf("data load(%v): %v",
-					ex.ExtensionName[extID], err)
-			} else {
-				msg.Extensions[extID] = data
-				x.tCtx.Lg.Trace(fmt.Sprintf("Field[Extension %v]: %v",
-					ex.ExtensionName[extID],
-					ext.PrintRaw(buffer[offset:offset+int(extLen)])))
+				return 0, tlssl.NewAlertError(tlssl.AlertDecodeError,
+					"extension %v: %v", ext.Name(), err)
 			}
+
+			msg.Extensions[extID] = data
+			x.tCtx.Lg.Trace(fmt.Sprintf("Field[Extension %v]: %v",
+				ext.Name(), ext.PrintRaw(buffer[offset:offset+int(extLen)])))
 		}
 
 		offset += int(extLen)
 	}
 
-	return uint32(offset)
+	return uint32(offset), nil
 }
 
 func algoToName(varr, algo uint16) string {
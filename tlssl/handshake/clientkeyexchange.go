@@ -1,10 +1,12 @@
 package handshake
 
 import (
+	"bytes"
 	"crypto"
-	"crypto/rand"
 	"crypto/rsa"
+	"crypto/subtle"
 	"fmt"
+	"math/big"
 	"tlesio/tlssl"
 	"tlesio/tlssl/suite"
 )
@@ -48,6 +50,10 @@ func (x *xClientKeyExchange) Handle() error {
 		return fmt.Errorf("nil ClientKeyExchange buffer(%v)", x.Name())
 	}
 
+	if len(kBuff) < tlssl.TLS_HEADER_SIZE+tlssl.TLS_HANDSHAKE_SIZE {
+		return fmt.Errorf("ClientKeyExchange buffer too small(%v)", x.Name())
+	}
+
 	// Remove TLS Header
 	hh := tlssl.TLSHeadHandShake(kBuff[tlssl.TLS_HEADER_SIZE:])
 	if hh == nil {
@@ -64,27 +70,15 @@ func (x *xClientKeyExchange) Handle() error {
 
 	// Parse the coded pre master secret from the client key exchange message
 	aux := tlssl.TLS_HEADER_SIZE + tlssl.TLS_HANDSHAKE_SIZE
-	if len(kBuff[aux:]) < 2 {
-		return fmt.Errorf("PreMasterSecreto no content(%v)", x.Name())
-	}
-
-	kBuff = kBuff[aux:]
-	pmsLen := uint16(kBuff[0])<<8 | uint16(kBuff[1])
-	if int(pmsLen) != len(kBuff[2:]) {
-		return fmt.Errorf("PreMasterSecreto len unmatched(%v)", x.Name())
-	}
-
-	// Decode the pre master secret
-	pmsCoded := kBuff[2:]
-	pms, err := x.preMasterSecret(pmsCoded)
+	pms, err := x.preMasterSecret(kBuff[aux:])
 	if err != nil {
 		return err
 	}
 
 	// Calculate the session keys
 	x.ctx.SetBuffer(PREMASTERSECRET, pms)
-	x.ctx.AppendOrder(CLIENTKEYEXCHANGE)
-	if x.tCtx.OptClientAuth {
+	// No CertificateVerify after an empty client Certificate
+	if clientAuthOn(x.tCtx, x.ctx) && len(x.ctx.GetPeerCerts()) > 0 {
 		x.nextState = CERTIFICATEVERIFY
 	} else {
 		x.nextState = CHANGECIPHERSPEC
@@ -107,13 +101,37 @@ func (x *xClientKeyExchange) preMasterSecret(cPms []byte) ([]byte, error) {
 
 	case suite.DHE:
 		return x.preMasterSecretDHE(cPms)
+
+	case suite.ECDHE:
+		return x.preMasterSecretECDHE(cPms)
+
+	case suite.PSK, suite.DHE_PSK, suite.ECDHE_PSK:
+		return x.preMasterSecretPSK(cPms, cs.Info().KeyExchange)
 	}
 
 	return nil, fmt.Errorf("key exchange not implemented yet(%v)", x.Name())
 }
 
-func (x *xClientKeyExchange) preMasterSecretRSA(cPms []byte) ([]byte, error) {
+//	struct {
+//		public-key-encrypted PreMasterSecret pre_master_secret;
+//	} EncryptedPreMasterSecret;
+//
+// Bad padding, a wrong length or a wrong client_version must look like
+// success (RFC 5246 7.4.7.1). A random pre master secret is used instead
+// and the handshake fails at Finished, as with any wrong key
+func (x *xClientKeyExchange) preMasterSecretRSA(buff []byte) ([]byte, error) {
+
+	// Framing says nothing about the plaintext, it can fail here
+	if len(buff) < 2 {
+		return nil, fmt.Errorf("PreMasterSecreto no content(%v)", x.Name())
+	}
+
+	pmsLen := uint16(buff[0])<<8 | uint16(buff[1])
+	if int(pmsLen) != len(buff[2:]) {
+		return nil, fmt.Errorf("PreMasterSecreto len unmatched(%v)", x.Name())
+	}
 
+	cPms := buff[2:]
 	ctxCert := x.ctx.GetCert()
 	if ctxCert == nil {
 		return nil, fmt.Errorf("handshakectx nil certificate(%v)", x.Name())
@@ -124,15 +142,26 @@ func (x *xClientKeyExchange) preMasterSecretRSA(cPms []byte) ([]byte, error) {
 		return nil, fmt.Errorf("cert's private key not found(%v)", x.Name())
 	}
 
-	pms, err := decodeRSA(cPms, privateKey)
+	hello := x.ctx.GetMsgHello()
+	if hello == nil {
+		return nil, fmt.Errorf("nil client hello(%v)", x.Name())
+	}
+
+	// Before decrypting, so every path costs the same
+	pms, err := randomBytes(x.tCtx.Random(), _PMS_SIZE_)
 	if err != nil {
-		return nil, fmt.Errorf("%v(%v)", err.Error(), x.Name())
+		return nil, fmt.Errorf("random pre master secret(%v): %v", x.Name(),
+			err)
 	}
 
-	if len(pms) != _PMS_SIZE_ {
-		return nil, fmt.Errorf("invalid pre master secret len(%v)", x.Name())
+	err = decodeRSA(cPms, privateKey, pms)
+	if err != nil {
+		x.tCtx.Lg.Debugf("RSA pre master secret(%v): %v", x.Name(), err)
 	}
 
+	// The ClientHello version, whatever the client encrypted. A mismatch
+	// ends up as a different secret, not as an error
+	pms[0], pms[1] = hello.Version[0], hello.Version[1]
 	return pms, nil
 }
 
@@ -140,18 +169,144 @@ func (x *xClientKeyExchange) preMasterSecretDHE(buff []byte) ([]byte, error) {
 	return nil, fmt.Errorf("key exchange DHE not implemented yet")
 }
 
-func decodeRSA(data []byte, key crypto.PrivateKey) ([]byte, error) {
+//	struct {
+//		opaque point <1..2^8-1>;
+//	} ECPoint;
+//
+// The pre master secret is the shared secret (x coordinate for NIST curves)
+func (x *xClientKeyExchange) preMasterSecretECDHE(buff []byte) ([]byte, error) {
+
+	if len(buff) < 1 || int(buff[0]) != len(buff[1:]) {
+		return nil, tlssl.NewAlertError(tlssl.AlertDecodeError,
+			"ECPoint len unmatched(%v)", x.Name())
+	}
+
+	privKey := x.ctx.GetECDHKey()
+	if privKey == nil {
+		return nil, fmt.Errorf("nil ECDHE server key(%v)", x.Name())
+	}
+
+	cliPubKey, err := privKey.Curve().NewPublicKey(buff[1:])
+	if err != nil {
+		return nil, tlssl.NewAlertError(tlssl.AlertIllegalParameter,
+			"invalid client ECDHE key(%v): %v", x.Name(), err)
+	}
+
+	pms, err := privKey.ECDH(cliPubKey)
+	if err != nil {
+		return nil, tlssl.NewAlertError(tlssl.AlertIllegalParameter,
+			"ECDHE shared secret(%v): %v", x.Name(), err)
+	}
+
+	return pms, nil
+}
+
+//	struct {
+//		opaque psk_identity<0..2^16-1>;
+//		select (KeyExchangeAlgorithm) {
+//			case psk: ;
+//			case diffie_hellman_psk: ClientDiffieHellmanPublic public;
+//			case ecdhe_psk: ClientECDiffieHellmanPublic public;
+//		};
+//	} ClientKeyExchange;
+func (x *xClientKeyExchange) preMasterSecretPSK(buff []byte,
+	kx int) ([]byte, error) {
+
+	var other []byte
+
+	if x.tCtx.PSK == nil {
+		return nil, fmt.Errorf("no PSK store(%v)", x.Name())
+	}
+
+	identity, public, err := pskIdentity(buff)
+	if err != nil {
+		return nil, tlssl.NewAlertError(tlssl.AlertDecodeError, "%v(%v)", err,
+			x.Name())
+	}
+
+	psk := x.tCtx.PSK.Get(identity)
+	if psk == nil {
+		return nil, tlssl.NewAlertError(tlssl.AlertUnknownPSKIdentity,
+			"unknown PSK identity '%s'(%v)", identity, x.Name())
+	}
+
+	x.ctx.SetPSKIdentity(identity)
+	x.tCtx.Lg.Tracef("PSK identity: %s", identity)
+	switch kx {
+	case suite.PSK:
+		if len(public) != 0 {
+			return nil, tlssl.NewAlertError(tlssl.AlertDecodeError,
+				"trailing PSK data(%v)", x.Name())
+		}
+
+	case suite.DHE_PSK:
+		other, err = x.dheSharedSecret(public)
+
+	case suite.ECDHE_PSK:
+		other, err = x.preMasterSecretECDHE(public)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return pskPreMasterSecret(other, psk), nil
+}
+
+//	struct {
+//		opaque dh_Yc<1..2^16-1>;
+//	} ClientDiffieHellmanPublic;
+//
+// Leading zero bytes of the shared secret are stripped (RFC 5246 8.1.2)
+func (x *xClientKeyExchange) dheSharedSecret(buff []byte) ([]byte, error) {
+
+	if len(buff) < 2 || int(buff[0])<<8|int(buff[1]) != len(buff[2:]) {
+		return nil, tlssl.NewAlertError(tlssl.AlertDecodeError,
+			"dh_Yc len unmatched(%v)", x.Name())
+	}
+
+	privKey := x.ctx.GetDHKey()
+	if privKey == nil {
+		return nil, fmt.Errorf("nil DHE server key(%v)", x.Name())
+	}
+
+	// 1 < Yc < p - 1
+	cliPubKey := new(big.Int).SetBytes(buff[2:])
+	pMinus1 := new(big.Int).Sub(ffdhe2048P, big.NewInt(1))
+	if cliPubKey.Cmp(big.NewInt(1)) <= 0 || cliPubKey.Cmp(pMinus1) >= 0 {
+		return nil, tlssl.NewAlertError(tlssl.AlertIllegalParameter,
+			"invalid client DHE key(%v)", x.Name())
+	}
+
+	return new(big.Int).Exp(cliPubKey, privKey, ffdhe2048P).Bytes(), nil
+}
+
+// Decrypts into 'pms' in constant time, leaving it as it is when the
+// padding or the length are wrong. 'key' may be remote (HSM, KMS), this
+// blocks until it answers. Errors are for logging only
+func decodeRSA(data []byte, key crypto.Signer, pms []byte) error {
 
-	// Decode the data
-	rsaPkey, ok := key.(*rsa.PrivateKey)
+	decrypter, ok := key.(crypto.Decrypter)
 	if !ok {
-		return nil, fmt.Errorf("invalid private key")
+		return fmt.Errorf("invalid private key")
 	}
 
-	decrypted, err := rsa.DecryptPKCS1v15(rand.Reader, rsaPkey, data)
+	if _, ok := decrypter.Public().(*rsa.PublicKey); !ok {
+		return fmt.Errorf("invalid private key")
+	}
+
+	// Local keys fall back to what they read from 'rand': 'pms' itself.
+	// Remote ones may answer bad padding with an error instead
+	decrypted, err := decrypter.Decrypt(bytes.NewReader(pms), data,
+		&rsa.PKCS1v15DecryptOptions{SessionKeyLen: len(pms)})
 	if err != nil {
-		return nil, fmt.Errorf("decryption error: %v", err)
+		return fmt.Errorf("decryption error: %v", err)
 	}
 
-	return decrypted, nil
+	// A remote key's answer may have any length
+	sized := make([]byte, len(pms))
+	copy(sized, decrypted)
+	subtle.ConstantTimeCopy(subtle.ConstantTimeEq(int32(len(decrypted)),
+		int32(len(pms))), pms, sized)
+	return nil
 }
@@ -0,0 +1,244 @@
+package handshake
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"tlesio/tlssl"
+)
+
+// Extensions whose content goes into a fingerprint
+const (
+	_EXT_SERVER_NAME_        = 0x0000
+	_EXT_SUPPORTED_GROUPS_   = 0x000A
+	_EXT_EC_POINT_FORMATS_   = 0x000B
+	_EXT_SIGNATURE_ALGOS_    = 0x000D
+	_EXT_ALPN_               = 0x0010
+	_EXT_SUPPORTED_VERSIONS_ = 0x002B
+)
+
+// Keep the raw lists of the extensions fingerprints look into. Malformed
+// ones are left empty, the handshake decides if they are fatal
+func fingerprintExt(extID uint16, data []byte, msg *MsgHello) {
+
+	switch extID {
+	case _EXT_SUPPORTED_GROUPS_:
+		msg.Groups = uint16List(data, 2)
+
+	case _EXT_SIGNATURE_ALGOS_:
+		msg.SignAlgos = uint16List(data, 2)
+
+	case _EXT_SUPPORTED_VERSIONS_:
+		msg.SupportedVersions = uint16List(data, 1)
+
+	case _EXT_EC_POINT_FORMATS_:
+		if len(data) < 1 || int(data[0]) != len(data)-1 {
+			return
+		}
+
+		msg.PointFormats = append([]uint8{}, data[1:]...)
+
+	case _EXT_ALPN_:
+		if len(data) < 2 ||
+			int(binary.BigEndian.Uint16(data)) != len(data)-2 {
+			return
+		}
+
+		for list := data[2:]; len(list) > 0; {
+			n := int(list[0])
+			if n == 0 || n > len(list)-1 {
+				msg.ALPN = nil
+				return
+			}
+
+			msg.ALPN = append(msg.ALPN, string(list[1:1+n]))
+			list = list[1+n:]
+		}
+	}
+}
+
+// List of uint16 behind a 'lenSize' bytes length
+func uint16List(data []byte, lenSize int) []uint16 {
+
+	var list []uint16
+
+	if len(data) < lenSize {
+		return nil
+	}
+
+	n := int(data[0])
+	if lenSize == 2 {
+		n = int(binary.BigEndian.Uint16(data))
+	}
+
+	data = data[lenSize:]
+	if n != len(data) || n%2 != 0 {
+		return nil
+	}
+
+	for i := 0; i < n; i += 2 {
+		list = append(list, binary.BigEndian.Uint16(data[i:]))
+	}
+
+	return list
+}
+
+// RFC 8701. 0x0A0A, 0x1A1A ... 0xFAFA
+func IsGREASE(v uint16) bool {
+	return v&0x0F0F == 0x0A0A && v>>8 == v&0xFF
+}
+
+// SSLVersion,Ciphers,Extensions,EllipticCurves,EllipticCurvePointFormats
+// Decimal values, GREASE left out
+func (x *MsgHello) JA3() string {
+
+	var fields []string
+
+	version := binary.BigEndian.Uint16(x.Version[:])
+	fields = append(fields, strconv.Itoa(int(version)))
+	fields = append(fields, ja3List(x.CipherSuites))
+	fields = append(fields, ja3List(x.ExtensionIDs))
+	fields = append(fields, ja3List(x.Groups))
+	formats := make([]string, 0, len(x.PointFormats))
+	for _, f := range x.PointFormats {
+		formats = append(formats, strconv.Itoa(int(f)))
+	}
+
+	fields = append(fields, strings.Join(formats, "-"))
+	return strings.Join(fields, ",")
+}
+
+func (x *MsgHello) JA3Hash() string {
+
+	sum := md5.Sum([]byte(x.JA3()))
+	return hex.EncodeToString(sum[:])
+}
+
+// JA4 (TCP): <t><version><d|i><ciphers><extensions><alpn>_<ciphers hash>_
+// <extensions + signature algorithms hash>
+func (x *MsgHello) JA4() string {
+
+	var ciphers, exts []string
+
+	sni := "i"
+	for _, c := range x.CipherSuites {
+		if !IsGREASE(c) {
+			ciphers = append(ciphers, fmt.Sprintf("%04x", c))
+		}
+	}
+
+	// SNI and ALPN count as extensions but are not hashed
+	extCount := 0
+	for _, e := range x.ExtensionIDs {
+		if IsGREASE(e) {
+			continue
+		}
+
+		extCount++
+		switch e {
+		case _EXT_SERVER_NAME_:
+			sni = "d"
+		case _EXT_ALPN_:
+		default:
+			exts = append(exts, fmt.Sprintf("%04x", e))
+		}
+	}
+
+	ja4a := fmt.Sprintf("t%v%v%02d%02d%v", x.ja4Version(), sni,
+		min(len(ciphers), 99), min(extCount, 99), x.ja4ALPN())
+	sort.Strings(ciphers)
+	sort.Strings(exts)
+	extsSigs := strings.Join(exts, ",")
+	if len(x.SignAlgos) > 0 {
+		var sigs []string
+
+		for _, s := range x.SignAlgos {
+			if !IsGREASE(s) {
+				sigs = append(sigs, fmt.Sprintf("%04x", s))
+			}
+		}
+
+		extsSigs += "_" + strings.Join(sigs, ",")
+	}
+
+	return fmt.Sprintf("%v_%v_%v", ja4a, ja4Hash(ciphers, strings.Join(
+		ciphers, ",")), ja4Hash(exts, extsSigs))
+}
+
+// Highest version offered, supported_versions extension first
+func (x *MsgHello) ja4Version() string {
+
+	version := binary.BigEndian.Uint16(x.Version[:])
+	if len(x.SupportedVersions) > 0 {
+		version = 0
+		for _, v := range x.SupportedVersions {
+			if !IsGREASE(v) && v > version {
+				version = v
+			}
+		}
+	}
+
+	switch version {
+	case 0x0304:
+		return "13"
+	case tlssl.TLS_VERSION1_2:
+		return "12"
+	case tlssl.TLS_VERSION1_1:
+		return "11"
+	case tlssl.TLS_VERSION1_0:
+		return "10"
+	case 0x0300:
+		return "s3"
+	}
+
+	return "00"
+}
+
+// First and last characters of the first ALPN value. Hex when they are
+// not alphanumeric
+func (x *MsgHello) ja4ALPN() string {
+
+	if len(x.ALPN) == 0 || len(x.ALPN[0]) == 0 {
+		return "00"
+	}
+
+	alpn := x.ALPN[0]
+	first, last := alpn[0], alpn[len(alpn)-1]
+	if !isAlphaNum(first) || !isAlphaNum(last) {
+		return hex.EncodeToString([]byte{first})[:1] +
+			hex.EncodeToString([]byte{last})[1:]
+	}
+
+	return string([]byte{first, last})
+}
+
+func ja4Hash(list []string, s string) string {
+
+	if len(list) == 0 {
+		return "000000000000"
+	}
+
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func ja3List(values []uint16) string {
+
+	list := make([]string, 0, len(values))
+	for _, v := range values {
+		if !IsGREASE(v) {
+			list = append(list, strconv.Itoa(int(v)))
+		}
+	}
+
+	return strings.Join(list, "-")
+}
+
+func isAlphaNum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
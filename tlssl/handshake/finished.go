@@ -2,10 +2,8 @@ package handshake
 
 import (
 	"crypto/hmac"
-	"crypto/sha256"
 	"fmt"
 	"tlesio/tlssl"
-	"tlesio/tlssl/suite"
 )
 
 const _VERIFY_DATA_LABEL_CLIENT = "client finished"
@@ -58,14 +56,8 @@ func (x *xFinished) finishedClient() error {
 	x.tCtx.Lg.Tracef("Running state: %v(CLIENT)", x.Name())
 	x.tCtx.Lg.Debugf("Running state: %v(CLIENT)", x.Name())
 
-	// Get the handshake messages (in order) to hash them
-	hskMsgs := x.handshakeMessagesOrder()
-	if hskMsgs == nil {
-		return fmt.Errorf("nil handshake messages buffer(%v)", x.Name())
-	}
-
-	// computed verify data
-	calcVerify, err := x.calculateVD(hskMsgs, _VERIFY_DATA_LABEL_CLIENT)
+	// computed verify data (transcript up to, not including, this message)
+	calcVerify, err := x.calculateVD(_VERIFY_DATA_LABEL_CLIENT)
 	if err != nil {
 		return err
 	}
@@ -101,7 +93,7 @@ func (x *xFinished) finishedClient() error {
 
 	finishedMsg := append(tlssl.TLSHeadPacket(tpt.Header), content...)
 	x.ctx.SetBuffer(FINISHED, finishedMsg)
-	x.ctx.AppendOrder(FINISHED)
+	x.ctx.Transcript().Write(content)
 	x.nextState = TRANSITION
 	return nil
 }
@@ -118,14 +110,8 @@ func (x *xFinished) finishedServer() error {
 		return fmt.Errorf("nil cipher spec client(%v)", x.Name())
 	}
 
-	// Get the handshake messages (in order) to hash them
-	hskMsgs := x.handshakeMessagesOrder()
-	if hskMsgs == nil {
-		return fmt.Errorf("nil handshake messages buffer(%v)", x.Name())
-	}
-
-	// computed verify data
-	calcVerify, err := x.calculateVD(hskMsgs, _VERIFY_DATA_LABEL_SERVER)
+	// computed verify data (client's Finished included)
+	calcVerify, err := x.calculateVD(_VERIFY_DATA_LABEL_SERVER)
 	if err != nil {
 		return err
 	}
@@ -146,60 +132,23 @@ func (x *xFinished) finishedServer() error {
 	}
 
 	cipherType := x.ctx.GetCipherScpec(CIPHERSPECSERVER).CipherType()
-	packet, err := tct.Packet(cipherType, true)
+	packet, err := tct.Packet(cipherType, false)
 	if err != nil {
 		return fmt.Errorf("TLSCipherText packet creation(%v)", x.Name())
 	}
 
 	x.ctx.SetBuffer(FINISHEDSERVER, packet)
+	x.ctx.Transcript().Write(tpt.Fragment)
 	x.nextState = TRANSITION
 	return nil
 }
 
-// Get the handshake messages in order (TLS Header is not included)
-func (x *xFinished) handshakeMessagesOrder() []byte {
-
-	var hashMe []byte
-
-	for _, m := range x.ctx.Order() {
-		var aux []byte
-
-		switch m {
-		case CERTIFICATE:
-			aux = x.ctx.GetBuffer(CERTIFICATE)
-		case CERTIFICATEREQUEST:
-			aux = x.ctx.GetBuffer(CERTIFICATEREQUEST)
-		case CERTIFICATEVERIFY:
-			aux = x.ctx.GetBuffer(CERTIFICATEVERIFY)
-		case CLIENTHELLO:
-			aux = x.ctx.GetBuffer(CLIENTHELLO)
-		case CLIENTCERTIFICATE:
-			aux = x.ctx.GetBuffer(CLIENTCERTIFICATE)
-		case CLIENTKEYEXCHANGE:
-			aux = x.ctx.GetBuffer(CLIENTKEYEXCHANGE)
-		case FINISHED:
-			aux = x.ctx.GetBuffer(FINISHED)
-		case SERVERHELLO:
-			aux = x.ctx.GetBuffer(SERVERHELLO)
-		case SERVERHELLODONE:
-			aux = x.ctx.GetBuffer(SERVERHELLODONE)
-		case SERVERKEYEXCHANGE:
-			aux = x.ctx.GetBuffer(SERVERKEYEXCHANGE)
-		default:
-			continue
-		}
-
-		hashMe = append(hashMe, aux[tlssl.TLS_HEADER_SIZE:]...)
-	}
-
-	return hashMe
-}
-
 // Calculate the verify data.
 // The label is "client finished" or "server finished"
 // The verify data is the first 12 bytes of the PRF output
-// Hash function is SHA256 (as defined in the RFC)
-func (x *xFinished) calculateVD(hskMsgs []byte, label string) ([]byte, error) {
+// Hash function is the PRF one (SHA256 for TLS 1.2 as defined in the RFC).
+// TLS 1.0/1.1 hash the messages with both MD5 and SHA1
+func (x *xFinished) calculateVD(label string) ([]byte, error) {
 
 	var err error
 
@@ -208,7 +157,8 @@ func (x *xFinished) calculateVD(hskMsgs []byte, label string) ([]byte, error) {
 		return nil, fmt.Errorf("error getting TLS Suite(%v)", x.Name())
 	}
 
-	keyMake, err := tlssl.NewKeymaker(suite.SHA256, 32)
+	prfAlgo := prfHash(x.ctx.GetVersion(), st)
+	keyMake, err := tlssl.NewKeymaker(prfAlgo, 48)
 	if err != nil {
 		return nil, fmt.Errorf("error creating Keymaker(%v)", x.Name())
 	}
@@ -218,10 +168,12 @@ func (x *xFinished) calculateVD(hskMsgs []byte, label string) ([]byte, error) {
 		return nil, fmt.Errorf("invalid master secret buffer(%v)", x.Name())
 	}
 
-	// Hash the handshake messages
-	hasher := sha256.New()
-	hasher.Write(hskMsgs)
-	expectedVerify := keyMake.PRF(masterSecret, label, hasher.Sum(nil))
+	hashed, err := x.ctx.Transcript().Sum(prfAlgo)
+	if err != nil {
+		return nil, fmt.Errorf("%v(%v)", err, x.Name())
+	}
+
+	expectedVerify := keyMake.PRF(masterSecret, label, hashed)
 	if len(expectedVerify) <= tlssl.VERIFYDATALEN {
 		return nil, fmt.Errorf("expected verify data calc(%v)", x.Name())
 	}
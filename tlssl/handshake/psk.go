@@ -0,0 +1,67 @@
+package handshake
+
+import (
+	"fmt"
+	"tlesio/tlssl"
+	"tlesio/tlssl/suite"
+)
+
+// PSK suites carry no certificate, so no CertificateRequest either
+// (RFC 4279 2)
+func clientAuthOn(tCtx *tlssl.TLSContext, hCtx HandShakeContext) bool {
+
+	if !tCtx.OptClientAuth {
+		return false
+	}
+
+	cs := tCtx.Modz.TLSSuite.GetSuite(hCtx.GetCipherSuite())
+	return cs == nil || cs.Info().Auth != suite.PSK
+}
+
+// opaque psk_identity_hint<0..2^16-1>;
+func pskHint(store tlssl.PSKStore) []byte {
+
+	var hint []byte
+
+	if store != nil {
+		hint = store.Hint()
+	}
+
+	return append([]byte{byte(len(hint) >> 8), byte(len(hint))}, hint...)
+}
+
+// opaque psk_identity<0..2^16-1>;
+// Returns the identity and what follows it
+func pskIdentity(buff []byte) ([]byte, []byte, error) {
+
+	if len(buff) < 2 {
+		return nil, nil, fmt.Errorf("PSK identity no content")
+	}
+
+	idLen := int(buff[0])<<8 | int(buff[1])
+	if idLen == 0 || idLen > len(buff[2:]) {
+		return nil, nil, fmt.Errorf("PSK identity len unmatched")
+	}
+
+	return buff[2 : 2+idLen], buff[2+idLen:], nil
+}
+
+//	struct {
+//		opaque other_secret<0..2^16-1>;
+//		opaque psk<0..2^16-1>;
+//	};
+//
+// 'other' is N zeroes for plain PSK, N being the PSK len (RFC 4279 2)
+func pskPreMasterSecret(other, psk []byte) []byte {
+
+	var pms []byte
+
+	if other == nil {
+		other = make([]byte, len(psk))
+	}
+
+	pms = append(pms, byte(len(other)>>8), byte(len(other)))
+	pms = append(pms, other...)
+	pms = append(pms, byte(len(psk)>>8), byte(len(psk)))
+	return append(pms, psk...)
+}
@@ -1,11 +1,13 @@
 package handshake
 
 import (
-	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"tlesio/tlssl"
 	ex "tlesio/tlssl/extensions"
+	mx "tlesio/tlssl/modulos"
 	"tlesio/tlssl/suite"
 )
 
@@ -14,6 +16,12 @@ type xServerHello struct {
 	tCtx *tlssl.TLSContext
 }
 
+// What extensions see of the handshake while negotiating
+type xExtState struct {
+	ctx  HandShakeContext
+	tCtx *tlssl.TLSContext
+}
+
 func NewServerHello(actx *AllContexts) ServerHello {
 
 	var newX xServerHello
@@ -48,7 +56,13 @@ func (x *xServerHello) Handle() error {
 
 	serverHelloBuf = make([]byte, 0)
 	// Version
-	serverHelloBuf = append(serverHelloBuf, x.setVersion()...)
+	version, err := x.setVersion(msgHello)
+	if err != nil {
+		return err
+	}
+
+	x.ctx.SetVersion(version)
+	serverHelloBuf = append(serverHelloBuf, byte(version>>8), byte(version))
 
 	// Random
 	random, err := x.random()
@@ -66,19 +80,31 @@ func (x *xServerHello) Handle() error {
 
 	cs := x.cipherSuites(msgHello)
 	if len(cs) <= 0 {
-		return fmt.Errorf("no supported cipher suites")
+		return tlssl.NewAlertError(tlssl.AlertHandshakeFailure,
+			"no supported cipher suites")
 	}
 
 	serverHelloBuf = append(serverHelloBuf, cs...)
+	err = x.ctx.Transcript().Keep(prfHash(version,
+		x.tCtx.Modz.TLSSuite.GetSuite(x.ctx.GetCipherSuite())))
+	if err != nil {
+		return err
+	}
+
 	// "Compression methods"
 	serverHelloBuf = append(serverHelloBuf, 0x00)
 
 	// Extensions
-	serverHelloBuf = append(serverHelloBuf, x.extensions(msgHello)...)
+	extsBuf, err := x.extensions(msgHello)
+	if err != nil {
+		return err
+	}
+
+	serverHelloBuf = append(serverHelloBuf, extsBuf...)
 
 	// Headers
 	header := tlssl.TLSHeadsHandShakePacket(tlssl.HandshakeTypeServerHello,
-		len(serverHelloBuf))
+		len(serverHelloBuf), version)
 
 	// Set server hello buffer and client and server random (which are
 	// needed for the session keys generation)
@@ -89,16 +115,33 @@ func (x *xServerHello) Handle() error {
 	return nil
 }
 
-func (x *xServerHello) setVersion() []byte {
+// TLS 1.2 unless the client can't do it and legacy mode is enabled, in
+// which case the client's version (TLS 1.0 or 1.1) is used
+func (x *xServerHello) setVersion(cliMsg *MsgHello) (uint16, error) {
+
+	cliVersion := uint16(cliMsg.Version[0])<<8 | uint16(cliMsg.Version[1])
+	if cliVersion >= tlssl.TLS_VERSION1_2 {
+		return tlssl.TLS_VERSION1_2, nil
+	}
+
+	if !tlssl.IsLegacyVersion(cliVersion) {
+		return 0, tlssl.NewAlertError(tlssl.AlertProtocolVersion,
+			"unsupported client version(0x%04X)", cliVersion)
+	}
+
+	if !x.tCtx.OptLegacy {
+		return 0, tlssl.NewAlertError(tlssl.AlertProtocolVersion,
+			"legacy version(0x%04X) but legacy mode is off", cliVersion)
+	}
 
-	// Force TLS 1.2
-	return []byte{0x03, 0x03}
+	x.tCtx.Lg.Warnf("Negotiating legacy version(0x%04X)", cliVersion)
+	return cliVersion, nil
 }
 
 func (x *xServerHello) random() ([]byte, error) {
 
 	newBuff := make([]byte, 32)
-	_, err := rand.Read(newBuff)
+	_, err := io.ReadFull(x.tCtx.Random(), newBuff)
 	if err != nil {
 		return nil, err
 	}
@@ -112,7 +155,12 @@ func (x *xServerHello) cipherSuites(cliMsg *MsgHello) []byte {
 	var newBuff []byte
 
 	for _, algo := range cliMsg.CipherSuites {
-		if x.tCtx.Modz.TLSSuite.IsSupported(algo) {
+		if !x.tCtx.Modz.TLSSuite.IsSupported(algo) {
+			continue
+		}
+
+		st := x.tCtx.Modz.TLSSuite.GetSuite(algo)
+		if suiteVersionOK(st, x.ctx.GetVersion()) && x.suiteUsable(st, cliMsg) {
 			newBuff = append(newBuff, byte(algo>>8), byte(algo))
 			cs = algo
 			break
@@ -121,49 +169,128 @@ func (x *xServerHello) cipherSuites(cliMsg *MsgHello) []byte {
 
 	x.ctx.SetCipherSuite(cs)
 	x.tCtx.Lg.Tracef("CipherSuite: %v", suite.CipherSuiteNames[cs])
+	if cs != 0 {
+		x.tCtx.Trace(x.ctx.GetConnID(), &tlssl.TraceEvent{
+			Kind:    tlssl.TraceSuiteSelected,
+			Version: x.ctx.GetVersion(),
+			Suite:   cs,
+		})
+	}
+
 	return newBuff
 }
 
-func (x *xServerHello) extensions(cliMsg *MsgHello) []byte {
+// Is there a certificate (or PSK store) for the suite's authentication
+// and, for (EC)DHE, a group both sides can use
+func (x *xServerHello) suiteUsable(cs suite.Suite, cliMsg *MsgHello) bool {
 
-	var extsBuffer []byte
+	switch cs.Info().Auth {
+	case suite.RSA:
+		if !x.tCtx.Modz.Certs.HasKeyType(mx.PKI_TYPE_RSA) {
+			return false
+		}
 
-	extsBuffer = make([]byte, 2)
-	for extID, extData := range cliMsg.Extensions {
-		ext := x.tCtx.Exts.Get(extID)
-		// Renegiation info skip
-		if ext.ID() == 0xFF01 {
-			continue
+	case suite.ECDSA:
+		if !x.tCtx.Modz.Certs.HasKeyType(mx.PKI_TYPE_EC) {
+			return false
 		}
 
-		// This should never happen
-		if ext == nil || extData == nil {
-			x.tCtx.Lg.Warnf("Packet Extension(%v) not found",
-				ex.ExtensionName[extID])
-			continue
+	case suite.PSK:
+		if x.tCtx.PSK == nil {
+			return false
 		}
+	}
 
-		auxBuffer, err := ext.PacketServerHelo(extData)
-		if err != nil {
-			x.tCtx.Lg.Errorf("Packet Extension(%v) : %v",
-				ex.ExtensionName[extID], err)
-			continue
+	switch cs.Info().KeyExchange {
+	case suite.ECDHE, suite.ECDHE_PSK:
+		if ecdheGroup(cliMsg) == 0 {
+			return false
 		}
 
-		if len(auxBuffer) == 0 {
-			continue
+	case suite.DHE_PSK:
+		if !dheGroupOK(cliMsg) {
+			return false
 		}
+	}
 
-		extsBuffer = append(extsBuffer, auxBuffer...)
+	return true
+}
+
+// SHA256/SHA384 HMAC and AEAD suites were introduced with TLS 1.2.
+// TLS 1.3 suites are never negotiated here
+func suiteVersionOK(cs suite.Suite, version uint16) bool {
+
+	if cs == nil || cs.Info().TLS13 {
+		return false
 	}
 
-	// Force renegotiation info
-	rInfoBuff, err := x.tCtx.Exts.Get(0xFF01).PacketServerHelo(nil)
-	if err != nil {
-		x.tCtx.Lg.Errorf("Force Renegiation Info: %v", err)
+	if !tlssl.IsLegacyVersion(version) {
+		return true
+	}
+
+	info := cs.Info()
+	return info.CipherType == suite.CIPHER_CBC && info.Hash == suite.SHA1
+}
+
+// Every registered extension that may go in a ServerHello negotiates, in
+// registration order, with what the client sent for it (if anything)
+func (x *xServerHello) extensions(cliMsg *MsgHello) ([]byte, error) {
+
+	extsBuffer := make([]byte, 2)
+	state := &xExtState{ctx: x.ctx, tCtx: x.tCtx}
+	for _, ext := range x.tCtx.Exts.All() {
+		if ext.Messages()&ex.MsgServerHello == 0 {
+			continue
+		}
+
+		answer, err := ext.Negotiate(cliMsg.Extensions[ext.ID()], state)
+		if err != nil {
+			alert := tlssl.AlertHandshakeFailure
+			if errors.Is(err, ex.ErrIllegalParameter) {
+				alert = tlssl.AlertIllegalParameter
+			}
+
+			return nil, tlssl.NewAlertError(alert, "extension %v: %v",
+				ext.Name(), err)
+		}
+
+		extsBuffer = append(extsBuffer, answer...)
 	}
 
-	extsBuffer = append(extsBuffer, rInfoBuff...)
 	binary.BigEndian.PutUint16(extsBuffer, uint16(len(extsBuffer)-2))
-	return extsBuffer
+	return extsBuffer, nil
+}
+
+func (x *xExtState) Version() uint16 {
+	return x.ctx.GetVersion()
+}
+
+func (x *xExtState) CipherSuite() uint16 {
+	return x.ctx.GetCipherSuite()
+}
+
+func (x *xExtState) BlockCipher() bool {
+
+	st := x.tCtx.Modz.TLSSuite.GetSuite(x.ctx.GetCipherSuite())
+	return st != nil && st.Info().CipherType == suite.CIPHER_CBC
+}
+
+func (x *xExtState) SetEncryptThenMac() {
+	x.ctx.SetMacMode(tlssl.MODE_ETM)
+}
+
+// The certificate the Certificate message will carry, not just any
+func (x *xExtState) HasOCSP() bool {
+
+	st := x.tCtx.Modz.TLSSuite.GetSuite(x.ctx.GetCipherSuite())
+	if x.tCtx.Modz.Certs == nil || st == nil || st.Info().Auth == suite.PSK {
+		return false
+	}
+
+	certs := selectCerts(x.tCtx, x.ctx.GetMsgHello(), st.Info().Auth)
+	return len(certs) > 0 && x.tCtx.Modz.Certs.HasOCSP(certs[0])
+}
+
+func (x *xExtState) SetCertificateStatus() {
+	x.ctx.SetOCSPStapling(true)
 }
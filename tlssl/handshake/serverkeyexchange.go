@@ -1,10 +1,38 @@
 package handshake
 
 import (
+	"crypto/ecdh"
 	"fmt"
+	"io"
+	"math/big"
 	"tlesio/tlssl"
+	ex "tlesio/tlssl/extensions"
+	"tlesio/tlssl/suite"
 )
 
+// ECCurveType named_curve (RFC 8422 5.4)
+const _NAMED_CURVE_ = 0x03
+
+// Used when the client does not send supported_groups (RFC 8422 4)
+const _DEFAULT_ECDHE_GROUP_ = ex.SECP256R1
+
+// DHE private exponent size. Well over the 225 bits RFC 7919 5.2 asks
+// for ffdhe2048
+const _DHE_EXPONENT_SIZE_ = 32
+
+// ffdhe2048 (RFC 7919 A.1), generator 2
+var ffdhe2048P, _ = new(big.Int).SetString(
+	"FFFFFFFFFFFFFFFFADF85458A2BB4A9AAFDC5620273D3CF1D8B9C583CE2D3695"+
+		"A9E13641146433FBCC939DCE249B3EF97D2FE363630C75D8F681B202AEC4617A"+
+		"D3DF1ED5D5FD65612433F51F5F066ED0856365553DED1AF3B557135E7F57C935"+
+		"984F0C70E0E68B77E2A689DAF3EFE8721DF158A136ADE73530ACCA4F483A797A"+
+		"BC0AB182B324FB61D108A94BB2C8E3FBB96ADAB760D7F4681D4F42A3DE394DF4"+
+		"AE56EDE76372BB190B07A7C8EE0A6D709E02FCE1CDF7E2ECC03404CD28342F61"+
+		"9172FE9CE98583FF8E4F1232EEF28183C3FE3B1B4C6FAD733BB5FCBC2EC22005"+
+		"C58EF1837D1683B2C6F34A26C1B2EFFA886B423861285C97FFFFFFFFFFFFFFFF",
+	16)
+var ffdhe2048G = big.NewInt(2)
+
 type xServerKeyExchange struct {
 	stateBasicInfo
 	tCtx *tlssl.TLSContext
@@ -33,12 +61,234 @@ func (x *xServerKeyExchange) Next() (int, error) {
 
 func (x *xServerKeyExchange) Handle() error {
 
-	if x.tCtx.OptClientAuth {
+	var err error
+	var params []byte
+
+	x.tCtx.Lg.Tracef("Running state: %v", x.Name())
+	x.tCtx.Lg.Debugf("Running state: %v", x.Name())
+	cs := x.tCtx.Modz.TLSSuite.GetSuite(x.ctx.GetCipherSuite())
+	if cs == nil {
+		return fmt.Errorf("%v: invalid cipher suite", x.Name())
+	}
+
+	switch cs.Info().KeyExchange {
+	case suite.ECDHE:
+		params, err = x.ecdheParams()
+		if err == nil {
+			params, err = x.signParams(params)
+		}
+
+	// RFC 4279 2. Only sent when there is a hint
+	case suite.PSK:
+		params = pskHint(x.tCtx.PSK)
+
+	// RFC 4279 3 and RFC 5489 2. Params are not signed
+	case suite.DHE_PSK:
+		params, err = x.dheParams()
+		params = append(pskHint(x.tCtx.PSK), params...)
+
+	case suite.ECDHE_PSK:
+		params, err = x.ecdheParams()
+		params = append(pskHint(x.tCtx.PSK), params...)
+
+	default:
+		return fmt.Errorf("key exchange not implemented yet(%v)", x.Name())
+	}
+
+	if err != nil {
+		return err
+	}
+
+	header := tlssl.TLSHeadsHandShakePacket(
+		tlssl.HandshakeTypeServerKeyExchange, len(params), x.ctx.GetVersion())
+	x.ctx.SetBuffer(SERVERKEYEXCHANGE, append(header, params...))
+	x.ctx.AppendOrder(SERVERKEYEXCHANGE)
+	if clientAuthOn(x.tCtx, x.ctx) {
 		x.nextState = CERTIFICATEREQUEST
 	} else {
 		x.nextState = SERVERHELLODONE
 	}
 
-	fmt.Println("I AM: ", x.Name())
 	return nil
 }
+
+//	struct {
+//		ECParameters curve_params;
+//		ECPoint public;
+//	} ServerECDHParams;
+func (x *xServerKeyExchange) ecdheParams() ([]byte, error) {
+
+	var params []byte
+
+	group := ecdheGroup(x.ctx.GetMsgHello())
+	curve := ecdhCurve(group)
+	if curve == nil {
+		return nil, fmt.Errorf("no common ECDHE group(%v)", x.Name())
+	}
+
+	privKey, err := generateECDHKey(curve, x.tCtx.Random())
+	if err != nil {
+		return nil, fmt.Errorf("ECDHE key generation(%v): %v", x.Name(), err)
+	}
+
+	x.ctx.SetECDHKey(privKey)
+	x.tCtx.Lg.Tracef("ECDHE group: %v", ex.SupportedGroups[group])
+	pubKey := privKey.PublicKey().Bytes()
+	params = append(params, _NAMED_CURVE_, byte(group>>8), byte(group))
+	params = append(params, byte(len(pubKey)))
+	return append(params, pubKey...), nil
+}
+
+//	struct {
+//		opaque dh_p<1..2^16-1>;
+//		opaque dh_g<1..2^16-1>;
+//		opaque dh_Ys<1..2^16-1>;
+//	} ServerDHParams;
+func (x *xServerKeyExchange) dheParams() ([]byte, error) {
+
+	var params []byte
+
+	exponent := make([]byte, _DHE_EXPONENT_SIZE_)
+	_, err := io.ReadFull(x.tCtx.Random(), exponent)
+	if err != nil {
+		return nil, fmt.Errorf("DHE key generation(%v): %v", x.Name(), err)
+	}
+
+	privKey := new(big.Int).SetBytes(exponent)
+	x.ctx.SetDHKey(privKey)
+	x.tCtx.Lg.Tracef("DHE group: %v", ex.SupportedGroups[ex.FFDHE2048])
+	pubKey := new(big.Int).Exp(ffdhe2048G, privKey, ffdhe2048P)
+	for _, v := range [][]byte{ffdhe2048P.Bytes(), ffdhe2048G.Bytes(),
+		pubKey.Bytes()} {
+		params = append(params, byte(len(v)>>8), byte(len(v)))
+		params = append(params, v...)
+	}
+
+	return params, nil
+}
+
+//	digitally-signed struct {
+//		opaque client_random[32];
+//		opaque server_random[32];
+//		ServerECDHParams params;
+//	} signed_params;
+func (x *xServerKeyExchange) signParams(params []byte) ([]byte, error) {
+
+	var signed []byte
+
+	cert := x.ctx.GetCert()
+	hello := x.ctx.GetMsgHello()
+	sa, err := chooseSignAlgo(cert,
+		getClientSuppAlgos(ex.KeySignAlgo.From(hello.Extensions)))
+	if err != nil {
+		return nil, fmt.Errorf("%v(%v)", err, x.Name())
+	}
+
+	privateKey := x.tCtx.Modz.Certs.GetCertKey(cert)
+	if privateKey == nil {
+		return nil, fmt.Errorf("cert's private key not found(%v)", x.Name())
+	}
+
+	signed = append(signed, x.ctx.GetBuffer(CLIENTRANDOM)...)
+	signed = append(signed, x.ctx.GetBuffer(SERVERRANDOM)...)
+	signed = append(signed, params...)
+	signature, err := signData(x.tCtx.Random(), privateKey, sa, signed)
+	if err != nil {
+		return nil, fmt.Errorf("signing params(%v): %v", x.Name(), err)
+	}
+
+	x.tCtx.Lg.Tracef("Params signed with: %v", ex.SignHashAlgorithms[sa])
+	params = append(params, byte(sa>>8), byte(sa))
+	params = append(params, byte(len(signature)>>8), byte(len(signature)))
+	return append(params, signature...), nil
+}
+
+// First client's supported group the server can do ECDHE with. Zero if none
+func ecdheGroup(msg *MsgHello) uint16 {
+
+	if msg == nil {
+		return 0
+	}
+
+	data := ex.KeySupportedGroups.From(msg.Extensions)
+	if data == nil {
+		return _DEFAULT_ECDHE_GROUP_
+	}
+
+	for _, group := range data.Groups {
+		if ecdhCurve(group) != nil {
+			return group
+		}
+	}
+
+	return 0
+}
+
+// ffdhe2048 is the only DHE group. If the client lists FFDHE groups it
+// must be among them (RFC 7919 4)
+func dheGroupOK(msg *MsgHello) bool {
+
+	if msg == nil {
+		return false
+	}
+
+	data := ex.KeySupportedGroups.From(msg.Extensions)
+	if data == nil {
+		return true
+	}
+
+	ffdhe := false
+	for _, group := range data.Groups {
+		if group == ex.FFDHE2048 {
+			return true
+		}
+
+		if group>>8 == 0x01 {
+			ffdhe = true
+		}
+	}
+
+	return !ffdhe
+}
+
+func ecdhCurve(group uint16) ecdh.Curve {
+
+	switch group {
+	case ex.X25519:
+		return ecdh.X25519()
+	case ex.SECP256R1:
+		return ecdh.P256()
+	case ex.SECP384R1:
+		return ecdh.P384()
+	}
+
+	return nil
+}
+
+// Scalar read straight from 'random', so the same bytes give the same key.
+// ecdh's own GenerateKey may read an extra byte (or none) at random
+func generateECDHKey(curve ecdh.Curve, random io.Reader) (*ecdh.PrivateKey,
+	error) {
+
+	size := 32
+	switch curve {
+	case ecdh.P384():
+		size = 48
+	case ecdh.P256(), ecdh.X25519():
+	default:
+		return nil, fmt.Errorf("unsupported curve(%v)", curve)
+	}
+
+	scalar := make([]byte, size)
+	for {
+		if _, err := io.ReadFull(random, scalar); err != nil {
+			return nil, err
+		}
+
+		// NIST scalars must be in [1, n-1], about one in 2^32 are not
+		key, err := curve.NewPrivateKey(scalar)
+		if err == nil {
+			return key, nil
+		}
+	}
+}
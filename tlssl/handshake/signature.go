@@ -0,0 +1,234 @@
+package handshake
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/md5"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"fmt"
+	"io"
+	ex "tlesio/tlssl/extensions"
+	"tlesio/tlssl/suite"
+)
+
+// Signature algorithms the server can sign with, in no particular order
+var signAlgosHash = map[uint16]crypto.Hash{
+	ex.RSA_PKCS1_SHA1:         crypto.SHA1,
+	ex.RSA_PKCS1_SHA256:       crypto.SHA256,
+	ex.RSA_PKCS1_SHA384:       crypto.SHA384,
+	ex.RSA_PKCS1_SHA512:       crypto.SHA512,
+	ex.RSA_PSS_RSAE_SHA256:    crypto.SHA256,
+	ex.RSA_PSS_RSAE_SHA384:    crypto.SHA384,
+	ex.RSA_PSS_RSAE_SHA512:    crypto.SHA512,
+	ex.ECDSA_SHA1:             crypto.SHA1,
+	ex.ECDSA_SECP256R1_SHA256: crypto.SHA256,
+	ex.ECDSA_SECP384R1_SHA384: crypto.SHA384,
+	ex.ECDSA_SECP521R1_SHA512: crypto.SHA512,
+}
+
+// First client's signature algorithm usable with the certificate's key.
+// With no signature_algorithms from the client {sha1, <key>} is assumed
+// (RFC 5246 7.4.1.4.1)
+func chooseSignAlgo(cert *x509.Certificate, algos []uint16) (uint16, error) {
+
+	if cert == nil {
+		return 0, fmt.Errorf("nil certificate")
+	}
+
+	if len(algos) == 0 {
+		switch cert.PublicKey.(type) {
+		case *rsa.PublicKey:
+			return ex.RSA_PKCS1_SHA1, nil
+		case *ecdsa.PublicKey:
+			return ex.ECDSA_SHA1, nil
+		}
+	}
+
+	for _, sa := range algos {
+		if _, ok := signAlgosHash[sa]; !ok {
+			continue
+		}
+
+		if signAlgoMatchesKey(sa, cert.PublicKey) {
+			return sa, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no signature algorithm for certificate key")
+}
+
+func signAlgoMatchesKey(sa uint16, pub crypto.PublicKey) bool {
+
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		switch sa {
+		case ex.RSA_PKCS1_SHA1, ex.RSA_PKCS1_SHA256, ex.RSA_PKCS1_SHA384,
+			ex.RSA_PKCS1_SHA512:
+			return true
+
+		// PSS with SHA512 needs a 2048 bits modulus at least
+		case ex.RSA_PSS_RSAE_SHA256, ex.RSA_PSS_RSAE_SHA384,
+			ex.RSA_PSS_RSAE_SHA512:
+			return pub.Size() >= 256
+		}
+
+	case *ecdsa.PublicKey:
+		switch sa {
+		case ex.ECDSA_SHA1:
+			return true
+		case ex.ECDSA_SECP256R1_SHA256:
+			return pub.Curve.Params().BitSize == 256
+		case ex.ECDSA_SECP384R1_SHA384:
+			return pub.Curve.Params().BitSize == 384
+		case ex.ECDSA_SECP521R1_SHA512:
+			return pub.Curve.Params().BitSize == 521
+		}
+	}
+
+	return false
+}
+
+// Sign 'data' (not hashed yet) with the given signature algorithm
+func signData(random io.Reader, key crypto.Signer, sa uint16,
+	data []byte) ([]byte, error) {
+
+	hashAlgo, ok := signAlgosHash[sa]
+	if !ok {
+		return nil, fmt.Errorf("unsupported signature algorithm(0x%04X)", sa)
+	}
+
+	hasher := hashAlgo.New()
+	hasher.Write(data)
+	return signDigest(random, key, sa, hasher.Sum(nil))
+}
+
+// Same as 'signData' but 'digest' is already hashed with the algorithm's
+// hash (CertificateVerify signs the transcript hash). 'key' may be remote,
+// this blocks until it answers
+func signDigest(random io.Reader, key crypto.Signer, sa uint16,
+	digest []byte) ([]byte, error) {
+
+	hashAlgo, ok := signAlgosHash[sa]
+	if !ok {
+		return nil, fmt.Errorf("unsupported signature algorithm(0x%04X)", sa)
+	}
+
+	if key == nil {
+		return nil, fmt.Errorf("nil private key")
+	}
+
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		switch sa {
+		case ex.RSA_PSS_RSAE_SHA256, ex.RSA_PSS_RSAE_SHA384,
+			ex.RSA_PSS_RSAE_SHA512:
+			return key.Sign(random, digest, &rsa.PSSOptions{
+				SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: hashAlgo})
+		}
+
+		return key.Sign(random, digest, hashAlgo)
+
+	case *ecdsa.PublicKey:
+		return key.Sign(random, digest, hashAlgo)
+	}
+
+	return nil, fmt.Errorf("unsupported private key type")
+}
+
+// What a client may sign its CertificateVerify with. The transcript only
+// keeps the PRF hash, so only algorithms using it are offered
+func certVerifyAlgos(prf int) []uint16 {
+
+	if prf == suite.SHA384 {
+		return []uint16{ex.ECDSA_SECP384R1_SHA384, ex.RSA_PSS_RSAE_SHA384,
+			ex.RSA_PKCS1_SHA384}
+	}
+
+	return []uint16{ex.ECDSA_SECP256R1_SHA256, ex.RSA_PSS_RSAE_SHA256,
+		ex.RSA_PKCS1_SHA256}
+}
+
+// Check 'sig' over 'digest' (already hashed with the algorithm's hash).
+// TLS 1.2 ECDSA algorithms don't bind the curve
+func verifySignature(pub crypto.PublicKey, sa uint16, digest,
+	sig []byte) error {
+
+	hashAlgo, ok := signAlgosHash[sa]
+	if !ok {
+		return fmt.Errorf("unsupported signature algorithm(0x%04X)", sa)
+	}
+
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		switch sa {
+		case ex.RSA_PSS_RSAE_SHA256, ex.RSA_PSS_RSAE_SHA384,
+			ex.RSA_PSS_RSAE_SHA512:
+			return rsa.VerifyPSS(pub, hashAlgo, digest, sig,
+				&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+
+		case ex.RSA_PKCS1_SHA1, ex.RSA_PKCS1_SHA256, ex.RSA_PKCS1_SHA384,
+			ex.RSA_PKCS1_SHA512:
+			return rsa.VerifyPKCS1v15(pub, hashAlgo, digest, sig)
+		}
+
+	case *ecdsa.PublicKey:
+		switch sa {
+		case ex.ECDSA_SHA1, ex.ECDSA_SECP256R1_SHA256,
+			ex.ECDSA_SECP384R1_SHA384, ex.ECDSA_SECP521R1_SHA512:
+			if !ecdsa.VerifyASN1(pub, digest, sig) {
+				return fmt.Errorf("ECDSA verification failure")
+			}
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf("signature algorithm(0x%04X) does not match key", sa)
+}
+
+// TLS 1.0/1.1: RSA signs MD5 || SHA1 with no DigestInfo, ECDSA the SHA1
+// part only (RFC 4346 7.4.8, RFC 4492 5.10)
+func verifyLegacySignature(pub crypto.PublicKey, md5sha1, sig []byte) error {
+
+	if len(md5sha1) != md5.Size+sha1.Size {
+		return fmt.Errorf("invalid MD5/SHA1 digest")
+	}
+
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.MD5SHA1, md5sha1, sig)
+
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, md5sha1[md5.Size:], sig) {
+			return fmt.Errorf("ECDSA verification failure")
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("unsupported public key type")
+}
+
+func signLegacySignature(random io.Reader, key crypto.Signer,
+	md5sha1 []byte) ([]byte, error) {
+
+	if len(md5sha1) != md5.Size+sha1.Size {
+		return nil, fmt.Errorf("invalid MD5/SHA1 digest")
+	}
+
+	if key == nil {
+		return nil, fmt.Errorf("nil private key")
+	}
+
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		return key.Sign(random, md5sha1, crypto.MD5SHA1)
+
+	case *ecdsa.PublicKey:
+		return key.Sign(random, md5sha1[md5.Size:], crypto.SHA1)
+	}
+
+	return nil, fmt.Errorf("unsupported private key type")
+}
@@ -0,0 +1,160 @@
+package handshake
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"tlesio/tlssl"
+	ex "tlesio/tlssl/extensions"
+	"tlesio/tlssl/suite"
+
+	"github.com/sirupsen/logrus"
+)
+
+// One JSON object per line
+type xJSONTracer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Events as logrus fields, one Info entry each. Meant for structured
+// formatters (logrus.JSONFormatter and the like)
+type xLogrusTracer struct {
+	lg *logrus.Logger
+}
+
+func NewJSONTracer(w io.Writer) tlssl.Tracer {
+
+	if w == nil {
+		return nil
+	}
+
+	return &xJSONTracer{w: w}
+}
+
+func NewLogrusTracer(lg *logrus.Logger) tlssl.Tracer {
+
+	if lg == nil {
+		return nil
+	}
+
+	return &xLogrusTracer{lg: lg}
+}
+
+func (x *xJSONTracer) Trace(ev *tlssl.TraceEvent) {
+
+	line, err := json.Marshal(TraceFields(ev))
+	if err != nil {
+		return
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.w.Write(append(line, '\n'))
+}
+
+// Console formatters drop the fields, the message keeps the gist
+func (x *xLogrusTracer) Trace(ev *tlssl.TraceEvent) {
+
+	x.lg.WithFields(logrus.Fields(TraceFields(ev))).Infof("TLS trace: "+
+		"conn %v %v", ev.ConnID, ev.Kind)
+}
+
+// Flat, indexable view of an event. Only the fields of its kind
+func TraceFields(ev *tlssl.TraceEvent) map[string]interface{} {
+
+	fields := map[string]interface{}{
+		"conn_id": ev.ConnID,
+		"event":   ev.Kind.String(),
+		"time":    ev.Time.UTC().Format("2006-01-02T15:04:05.000000Z"),
+	}
+
+	switch ev.Kind {
+	case tlssl.TraceClientHello:
+		if ev.Hello != nil {
+			fields["client_hello"] = traceHelloFields(ev.Hello)
+		}
+
+	case tlssl.TraceSuiteSelected, tlssl.TraceKeysDerived:
+		fields["version"] = tlssl.VersionName(ev.Version)
+		fields["suite"] = suite.CipherSuiteNames[ev.Suite]
+
+	case tlssl.TraceCertSelected:
+		if ev.Cert != nil {
+			fields["cert_subject"] = ev.Cert.Subject.String()
+			fields["cert_serial"] = ev.Cert.SerialNumber.String()
+			fields["cert_dns_names"] = ev.Cert.DNSNames
+		}
+
+	case tlssl.TraceRecordSent, tlssl.TraceRecordReceived:
+		if ev.Record != nil {
+			fields["record_type"] = ev.Record.ContentType.String()
+			fields["record_version"] = tlssl.VersionName(ev.Record.Version)
+			fields["record_len"] = ev.Record.Len
+		}
+
+	case tlssl.TraceAlert:
+		fields["alert"] = ev.Alert.String()
+		fields["sent"] = ev.Sent
+
+	case tlssl.TraceHandshakeDone:
+		fields["ok"] = ev.Err == nil
+		if ev.Err != nil {
+			fields["error"] = ev.Err.Error()
+		} else {
+			fields["version"] = tlssl.VersionName(ev.Version)
+			fields["suite"] = suite.CipherSuiteNames[ev.Suite]
+		}
+	}
+
+	return fields
+}
+
+// What the tracer gets from a parsed ClientHello
+func traceHello(hello *MsgHello) *tlssl.TraceHello {
+
+	traced := &tlssl.TraceHello{
+		Version:      uint16(hello.Version[0])<<8 | uint16(hello.Version[1]),
+		CipherSuites: hello.CipherSuites,
+		Extensions:   hello.ExtensionIDs,
+		JA3:          hello.JA3(),
+		JA3Hash:      hello.JA3Hash(),
+		JA4:          hello.JA4(),
+	}
+
+	if names := getClientSAN(ex.KeySNI.From(hello.Extensions)); len(names) > 0 {
+		traced.SNI = names[0]
+	}
+
+	return traced
+}
+
+func traceHelloFields(hello *tlssl.TraceHello) map[string]interface{} {
+
+	var suites []string
+	var exts []string
+
+	for _, cs := range hello.CipherSuites {
+		suites = append(suites, fmt.Sprintf("0x%04X", cs))
+	}
+
+	for _, ext := range hello.Extensions {
+		exts = append(exts, fmt.Sprintf("0x%04X", ext))
+	}
+
+	helloFields := map[string]interface{}{
+		"version":       tlssl.VersionName(hello.Version),
+		"cipher_suites": suites,
+		"extensions":    exts,
+		"ja3":           hello.JA3,
+		"ja3_hash":      hello.JA3Hash,
+		"ja4":           hello.JA4,
+	}
+
+	if hello.SNI != "" {
+		helloFields["sni"] = hello.SNI
+	}
+
+	return helloFields
+}
@@ -0,0 +1,139 @@
+package handshake
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding"
+	"fmt"
+	"hash"
+	"tlesio/tlssl/suite"
+)
+
+// Running hash of the handshake messages (record header not included).
+// Until the suite is chosen every algorithm that might be needed is fed;
+// 'Keep' drops the rest. 'Fork' gives an independent copy, i.e. the
+// transcript up to a message (CertificateVerify, EMS session hash)
+type Transcript interface {
+	Write([]byte)
+	Sum(int) ([]byte, error)
+	Keep(int) error
+	Fork() Transcript
+	Algos() []int
+}
+
+type xTranscript struct {
+	algos  []int
+	hashes map[int][]hash.Hash // MD5SHA1 runs two hashes
+}
+
+// Algorithms are suite.MD5SHA1, suite.SHA256 and suite.SHA384
+func NewTranscript(algos ...int) (Transcript, error) {
+
+	var newX xTranscript
+
+	newX.hashes = make(map[int][]hash.Hash)
+	for _, algo := range algos {
+		hashes := transcriptHashes(algo)
+		if hashes == nil {
+			return nil, fmt.Errorf("unsupported transcript hash(%v)", algo)
+		}
+
+		if _, ok := newX.hashes[algo]; ok {
+			continue
+		}
+
+		newX.algos = append(newX.algos, algo)
+		newX.hashes[algo] = hashes
+	}
+
+	if len(newX.algos) == 0 {
+		return nil, fmt.Errorf("no transcript hash")
+	}
+
+	return &newX, nil
+}
+
+func (x *xTranscript) Write(msg []byte) {
+
+	for _, hashes := range x.hashes {
+		for _, h := range hashes {
+			h.Write(msg)
+		}
+	}
+}
+
+// Hash of every message written so far. Writing can go on afterwards
+func (x *xTranscript) Sum(algo int) ([]byte, error) {
+
+	var sum []byte
+
+	hashes, ok := x.hashes[algo]
+	if !ok {
+		return nil, fmt.Errorf("transcript hash not kept(%v)", algo)
+	}
+
+	for _, h := range hashes {
+		sum = h.Sum(sum)
+	}
+
+	return sum, nil
+}
+
+func (x *xTranscript) Keep(algo int) error {
+
+	hashes, ok := x.hashes[algo]
+	if !ok {
+		return fmt.Errorf("transcript hash not kept(%v)", algo)
+	}
+
+	x.algos = []int{algo}
+	x.hashes = map[int][]hash.Hash{algo: hashes}
+	return nil
+}
+
+func (x *xTranscript) Fork() Transcript {
+
+	var newX xTranscript
+
+	newX.algos = append(newX.algos, x.algos...)
+	newX.hashes = make(map[int][]hash.Hash)
+	for algo, hashes := range x.hashes {
+		fresh := transcriptHashes(algo)
+		for i, h := range hashes {
+			// Every crypto/* hash can save and restore its state
+			state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+			if err != nil {
+				return nil
+			}
+
+			err = fresh[i].(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+			if err != nil {
+				return nil
+			}
+		}
+
+		newX.hashes[algo] = fresh
+	}
+
+	return &newX
+}
+
+func (x *xTranscript) Algos() []int {
+	return append([]int{}, x.algos...)
+}
+
+func transcriptHashes(algo int) []hash.Hash {
+
+	switch algo {
+	case suite.MD5SHA1:
+		return []hash.Hash{md5.New(), sha1.New()}
+	case suite.SHA256:
+		return []hash.Hash{sha256.New()}
+	case suite.SHA384:
+		return []hash.Hash{sha512.New384()}
+	}
+
+	return nil
+}
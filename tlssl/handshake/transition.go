@@ -5,8 +5,6 @@ import (
 	"tlesio/tlssl"
 )
 
-const _BUFFER_SIZE_ = 2048
-const _READ_TIMEOUT_ = 1
 const (
 	STAGE_SERVERHELLODONE = iota + 1
 	STAGE_FINISHED_CLIENT
@@ -15,7 +13,8 @@ const (
 
 type xTransition struct {
 	stateBasicInfo
-	tCtx *tlssl.TLSContext
+	tCtx    *tlssl.TLSContext
+	pending []byte // Client handshake bytes not yet a whole message
 }
 
 func NewTransition(actx *AllContexts) Transition {
@@ -67,7 +66,8 @@ func (x *xTransition) transitFinishedClient() error {
 func (x *xTransition) transitFinishedServer() error {
 
 	x.tCtx.Lg.Debug("Transitioning from FINISHED_SERVER")
-	css := []byte{0x14, 0x03, 0x03, 0x00, 0x01, 0x01} // ChangeCipherSpec message
+	version := x.ctx.GetVersion()
+	css := []byte{0x14, byte(version >> 8), byte(version), 0x00, 0x01, 0x01}
 	fsh := x.ctx.GetBuffer(FINISHEDSERVER)
 	x.ctx.Send(append(css, fsh...))
 	x.nextState = COMPLETEHANDSHAKE
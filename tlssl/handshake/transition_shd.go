@@ -2,67 +2,52 @@ package handshake
 
 import (
 	"fmt"
-	"time"
+	"io"
 	"tlesio/tlssl"
 )
 
+// Client's second flight (RFC 5246 7.3). Same for every key exchange, only
+// the ClientKeyExchange content changes
+func clientFlight(clientAuth bool) []int {
+
+	if clientAuth {
+		return []int{CERTIFICATE, CLIENTKEYEXCHANGE, CERTIFICATEVERIFY,
+			CHANGECIPHERSPEC, FINISHED}
+	}
+
+	return []int{CLIENTKEYEXCHANGE, CHANGECIPHERSPEC, FINISHED}
+}
+
 func (x *xTransition) transitServerHelloDone() error {
 
 	x.tCtx.Lg.Info("Transitioning from SERVERHELLODONE")
 	// Send all packets
 	x.ctx.SendCtxBuff(x.ctx.Order())
 
-	// Read 'Expected()' client response packets
-	// Wait for '_READ_TIMEOUT_' seconds then return error
-	for {
-
-		x.tCtx.Lg.Info("Waiting for client response...")
-		x.tCtx.Lg.Debug("Expect TLS Records: ", x.ctx.PrintExpected())
-		coms := x.ctx.GetComms()
-		if coms == nil {
-			return fmt.Errorf("nil net.Conn object")
-		}
+	coms := x.ctx.GetComms()
+	if coms == nil {
+		return fmt.Errorf("nil net.Conn object")
+	}
 
-		coms.SetDeadline(time.Now().Add(_READ_TIMEOUT_ * time.Second))
-		buff := make([]byte, _BUFFER_SIZE_)
-		n, err := coms.Read(buff)
+	// Read the client flight, in order. Anything else is fatal.
+	// Deadlines belong to whoever owns the connection
+	x.tCtx.Lg.Info("Waiting for client response...")
+	clientAuth := clientAuthOn(x.tCtx, x.ctx)
+	flight := clientFlight(clientAuth)
+	for len(flight) > 0 {
+		x.tCtx.Lg.Debug("Expect TLS Records: ", HandshakeNameList(flight))
+		record, err := x.clientFlightRecord(coms, flight[0])
 		if err != nil {
-			return fmt.Errorf("expected packets readerror: %v", err.Error())
-		} else if n == 0 {
-			return fmt.Errorf("expected packets readerror: nodata")
+			return err
 		}
 
-		whoIsIt, err := tlssl.TLSRecordsDecode(buff[:n])
+		flight, err = x.clientRecord(record, flight)
 		if err != nil {
-			return fmt.Errorf("decoding client records: %v", err.Error())
-		}
-
-		for i, who := range whoIsIt {
-			switch who.Header.ContentType {
-			case tlssl.ContentTypeChangeCipherSpec:
-				x.tCtx.Lg.Debugf("Received %v",
-					HandshakeName(CHANGECIPHERSPEC))
-				x.ctx.UnAppendExpected(CHANGECIPHERSPEC)
-				if i >= len(whoIsIt)-1 {
-					x.tCtx.Lg.Warn("No more packets after change cipher spec")
-					break
-				}
-
-				x.tCtx.Lg.Debugf("Received %v(?)", HandshakeName(FINISHED))
-				x.ctx.SetBuffer(FINISHED, whoIsIt[i+1].Msg)
-				x.ctx.UnAppendExpected(FINISHED)
-
-			case tlssl.ContentTypeHandshake:
-				x.isExpected(who)
-			}
-		}
-
-		if x.ctx.Expected() == 0 {
-			break
+			return err
 		}
 	}
 
-	if x.tCtx.OptClientAuth {
+	if clientAuth {
 		x.nextState = CERTIFICATE
 	} else {
 		x.nextState = CLIENTKEYEXCHANGE
@@ -72,34 +57,176 @@ func (x *xTransition) transitServerHelloDone() error {
 	return nil
 }
 
-func (x *xTransition) isExpected(record *tlssl.TLSRecord) {
+// Next record of the client's flight, read one at a time. Handshake
+// messages may be split across records or share one, they are handed out
+// one per record as if each had its own. The protected Finished is taken
+// as it comes
+func (x *xTransition) clientFlightRecord(coms io.Reader,
+	next int) (*tlssl.TLSRecord, error) {
+
+	for {
+		if next != FINISHED && len(x.pending) >= tlssl.TLS_HANDSHAKE_SIZE {
+			msgLen := int(x.pending[1])<<16 | int(x.pending[2])<<8 |
+				int(x.pending[3])
+			if msgLen > _MAX_HANDSHAKE_LEN_ {
+				return nil, tlssl.NewAlertError(tlssl.AlertDecodeError,
+					"handshake message len %v(%v)", msgLen, x.Name())
+			}
+
+			if len(x.pending) >= tlssl.TLS_HANDSHAKE_SIZE+msgLen {
+				msg := x.pending[:tlssl.TLS_HANDSHAKE_SIZE+msgLen]
+				x.pending = x.pending[tlssl.TLS_HANDSHAKE_SIZE+msgLen:]
+				header := &tlssl.TLSHeader{
+					ContentType: tlssl.ContentTypeHandshake,
+					Version:     x.ctx.GetVersion(),
+					Len:         len(msg),
+				}
 
-	switch record.HandShake.HandshakeType {
-	case tlssl.HandshakeTypeCertificate:
-		if x.ctx.Expected()&CERTIFICATE != 0 {
-			x.tCtx.Lg.Debugf("Received %v(CLIENT)", HandshakeName(CERTIFICATE))
-			x.ctx.SetBuffer(CLIENTCERTIFICATE, record.Msg)
-			x.ctx.UnAppendExpected(CERTIFICATE)
+				return &tlssl.TLSRecord{
+					Header:    header,
+					HandShake: tlssl.TLSHeadHandShake(msg),
+					Msg:       append(tlssl.TLSHeadPacket(header), msg...),
+				}, nil
+			}
 		}
 
-	case tlssl.HandshakeTypeClientKeyExchange:
-		if x.ctx.Expected()&CLIENTKEYEXCHANGE != 0 {
-			x.tCtx.Lg.Debugf("Received %v", HandshakeName(CLIENTKEYEXCHANGE))
-			x.ctx.SetBuffer(CLIENTKEYEXCHANGE, record.Msg)
-			x.ctx.UnAppendExpected(CLIENTKEYEXCHANGE)
+		header, fragment, err := tlssl.ReadRecord(coms)
+		if err != nil {
+			return nil, fmt.Errorf("expected packets readerror: %w", err)
 		}
 
-	case tlssl.HandshakeTypeCertificateVerify:
-		if x.ctx.Expected()&CERTIFICATEVERIFY != 0 {
-			x.tCtx.Lg.Debugf("Received %v", HandshakeName(CERTIFICATEVERIFY))
-			x.ctx.SetBuffer(CERTIFICATEVERIFY, record.Msg)
-			x.ctx.UnAppendExpected(CERTIFICATEVERIFY)
+		x.tCtx.Trace(x.ctx.GetConnID(), &tlssl.TraceEvent{
+			Kind:   tlssl.TraceRecordReceived,
+			Record: header,
+		})
+
+		if header.ContentType == tlssl.ContentTypeHandshake && next != FINISHED {
+			x.pending = append(x.pending, fragment...)
+			continue
+		}
+
+		// Nothing may come in between the pieces of a handshake message
+		if len(x.pending) > 0 {
+			return nil, tlssl.NewAlertError(tlssl.AlertUnexpectedMessage,
+				"%v record inside a handshake message(%v)",
+				header.ContentType, x.Name())
 		}
 
+		return &tlssl.TLSRecord{
+			Header: header,
+			Msg:    append(tlssl.TLSHeadPacket(header), fragment...),
+		}, nil
+	}
+}
+
+// 'record' must be flight[0]. Returns what is left of the flight.
+// Accepted handshake messages go into the transcript in the order they
+// arrived
+func (x *xTransition) clientRecord(record *tlssl.TLSRecord,
+	flight []int) ([]int, error) {
+
+	// Client gave up. Plaintext alerts only, protected ones can't be read
+	if record.Header.ContentType == tlssl.ContentTypeAlert &&
+		len(record.Msg) == tlssl.TLS_HEADER_SIZE+tlssl.TLS_ALERT_SIZE &&
+		flight[0] != FINISHED {
+		alert := tlssl.AlertDescriptionType(record.Msg[tlssl.TLS_HEADER_SIZE+1])
+		x.tCtx.Trace(x.ctx.GetConnID(), &tlssl.TraceEvent{
+			Kind:  tlssl.TraceAlert,
+			Alert: alert,
+		})
+
+		return nil, fmt.Errorf("client alert: %v(%v)", alert, x.Name())
+	}
+
+	msg := x.recordMessage(record, flight[0])
+	if msg != flight[0] {
+		return nil, tlssl.NewAlertError(tlssl.AlertUnexpectedMessage,
+			"expected %v, got %v(%v)", HandshakeName(flight[0]),
+			recordName(record), x.Name())
+	}
+
+	switch msg {
+	case CHANGECIPHERSPEC:
+		x.tCtx.Lg.Debugf("Received %v", HandshakeName(CHANGECIPHERSPEC))
+		if len(record.Msg) != tlssl.TLS_HEADER_SIZE+1 ||
+			record.Msg[tlssl.TLS_HEADER_SIZE] != 0x01 {
+			return nil, tlssl.NewAlertError(tlssl.AlertDecodeError,
+				"invalid ChangeCipherSpec(%v)", x.Name())
+		}
+
+	// Protected, checked by the Finished state
+	case FINISHED:
+		x.tCtx.Lg.Debugf("Received %v", HandshakeName(FINISHED))
+		x.ctx.SetBuffer(FINISHED, record.Msg)
+
 	default:
-		if x.ctx.Expected()&CHANGECIPHERSPEC != 0 {
-			x.tCtx.Lg.Warnf("Unexpected '%v' client message",
-				record.HandShake.HandshakeType)
+		if record.HandShake.Len+tlssl.TLS_HANDSHAKE_SIZE != record.Header.Len {
+			return nil, tlssl.NewAlertError(tlssl.AlertDecodeError,
+				"%v len unmatched(%v)", HandshakeName(msg), x.Name())
+		}
+
+		x.tCtx.Lg.Debugf("Received %v", HandshakeName(msg))
+		id := msg
+		if msg == CERTIFICATE {
+			id = CLIENTCERTIFICATE
+		}
+
+		// CertificateVerify signs every message before itself
+		if msg == CERTIFICATEVERIFY {
+			x.ctx.SetCertVerifyTranscript(x.ctx.Transcript().Fork())
+		}
+
+		x.ctx.SetBuffer(id, record.Msg)
+		x.ctx.Transcript().Write(record.Msg[tlssl.TLS_HEADER_SIZE:])
+
+		// Empty certificate list, nothing to verify (RFC 5246 7.4.8)
+		if msg == CERTIFICATE && record.HandShake.Len <= 3 &&
+			len(flight) > 2 && flight[2] == CERTIFICATEVERIFY {
+			flight = append([]int{flight[0], flight[1]}, flight[3:]...)
+		}
+	}
+
+	return flight[1:], nil
+}
+
+// Handshake message id for the record. After ChangeCipherSpec the record
+// is protected so its handshake type can't be looked at yet. Zero if the
+// record is not part of the client's second flight at all (application
+// data, alerts, a new ClientHello, etc)
+func (x *xTransition) recordMessage(record *tlssl.TLSRecord, next int) int {
+
+	switch record.Header.ContentType {
+	case tlssl.ContentTypeChangeCipherSpec:
+		return CHANGECIPHERSPEC
+
+	case tlssl.ContentTypeHandshake:
+		if next == FINISHED {
+			return FINISHED
+		}
+
+		if record.HandShake == nil {
+			return 0
+		}
+
+		switch record.HandShake.HandshakeType {
+		case tlssl.HandshakeTypeCertificate:
+			return CERTIFICATE
+		case tlssl.HandshakeTypeClientKeyExchange:
+			return CLIENTKEYEXCHANGE
+		case tlssl.HandshakeTypeCertificateVerify:
+			return CERTIFICATEVERIFY
 		}
 	}
+
+	return 0
+}
+
+func recordName(record *tlssl.TLSRecord) string {
+
+	if record.Header.ContentType == tlssl.ContentTypeHandshake &&
+		record.HandShake != nil {
+		return record.HandShake.HandshakeType.String()
+	}
+
+	return record.Header.ContentType.String()
 }
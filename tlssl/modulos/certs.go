@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 	"tlesio/systema"
 	ex "tlesio/tlssl/extensions"
 
@@ -29,13 +30,23 @@ type ModCerts interface {
 	CNs() []string
 	Get(string) *x509.Certificate
 	GetByCriteria(uint16, string) *x509.Certificate
-	GetCertKey(*x509.Certificate) crypto.PrivateKey
+	GetCertKey(*x509.Certificate) crypto.Signer
 	GetCertChain(*x509.Certificate) []*x509.Certificate
+	GetCertOCSP(*x509.Certificate, time.Time) []byte
+	HasKeyType(int) bool
+	HasOCSP(*x509.Certificate) bool
 }
 
+// With a Signer (HSM, KMS, remote key service) PathKey is not used. RSA
+// key exchange needs it to be a crypto.Decrypter too. Certificates after
+// the leaf in PathCert are sent with it, OCSP stapling needs the issuer
+// among them
 type CertPaths struct {
 	PathCert string
 	PathKey  string
+	PathOCSP string // DER OCSP response, read again when it changes
+	Signer   crypto.Signer
+	OCSP     OCSPRefresher // Instead of PathOCSP
 }
 
 type MsgCertificate struct {
@@ -44,11 +55,16 @@ type MsgCertificate struct {
 }
 
 type pki struct {
+	keyType   int
 	cn        string
 	saSupport map[uint16]bool
 	san       map[string]bool // Subject Alternative Names
-	key       crypto.PrivateKey
+	key       crypto.Signer
 	cert      *x509.Certificate
+	chain     []*x509.Certificate // After the leaf, as in PathCert
+	issuer    *x509.Certificate   // OCSP stapling only
+	ocsp      OCSPRefresher
+	stapled   xStaple
 }
 
 type _xModCerts struct {
@@ -74,7 +90,7 @@ func NewModCerts(lg *logrus.Logger, paths []*CertPaths) (ModCerts, error) {
 	for _, p := range paths {
 		newPki, err := newMod.Load(p)
 		if err != nil {
-			newMod.lg.Error("error loading PKI: ", p.PathCert)
+			newMod.lg.Errorf("error loading PKI(%v): %v", p.PathCert, err)
 			continue
 		}
 
@@ -95,14 +111,19 @@ func (m *_xModCerts) Load(ptr *CertPaths) (*pki, error) {
 
 	var newPki pki
 
-	cc, err := loadCertificate(ptr.PathCert)
+	certs, err := loadCertificates(ptr.PathCert)
 	if err != nil {
 		return nil, err
 	}
 
-	key, err := loadPrivateKey(ptr.PathKey)
-	if err != nil {
-		return nil, err
+	cc := certs[0]
+
+	key := ptr.Signer
+	if key == nil {
+		key, err = loadPrivateKey(ptr.PathKey)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if !validateKeyPair(cc, key) {
@@ -114,11 +135,29 @@ func (m *_xModCerts) Load(ptr *CertPaths) (*pki, error) {
 	newPki.san[newPki.cn] = true
 	newPki.key = key
 	newPki.cert = cc
+	newPki.chain = certs[1:]
 	newPki.setSignAlgoSupport()
 	for _, san := range cc.DNSNames {
 		newPki.san[san] = true
 	}
 
+	newPki.ocsp = ptr.OCSP
+	if newPki.ocsp == nil {
+		newPki.ocsp = NewOCSPFile(ptr.PathOCSP)
+	}
+
+	if newPki.ocsp != nil {
+		newPki.issuer, err = findIssuer(newPki.chain, cc)
+		if err != nil {
+			return nil, fmt.Errorf("OCSP stapling: %v", err)
+		}
+
+		// Not fatal, whoever refreshes it may fix it before long
+		if _, err := newPki.staple(time.Now()); err != nil {
+			m.lg.Warnf("Certificate %v: %v", newPki.cn, err)
+		}
+	}
+
 	return &newPki, nil
 }
 
@@ -170,7 +209,7 @@ func (m *_xModCerts) GetByCriteria(sa uint16, cn string) *x509.Certificate {
 	return nil
 }
 
-func (m *_xModCerts) GetCertKey(cert *x509.Certificate) crypto.PrivateKey {
+func (m *_xModCerts) GetCertKey(cert *x509.Certificate) crypto.Signer {
 
 	for _, pki := range m.pkInfo {
 		if pki.cert.Equal(cert) {
@@ -181,10 +220,62 @@ func (m *_xModCerts) GetCertKey(cert *x509.Certificate) crypto.PrivateKey {
 	return nil
 }
 
+// 'cert' and the certificates after it in its file
 func (m *_xModCerts) GetCertChain(cert *x509.Certificate) []*x509.Certificate {
+
+	for _, pki := range m.pkInfo {
+		if pki.cert.Equal(cert) {
+			return append([]*x509.Certificate{cert}, pki.chain...)
+		}
+	}
+
 	return []*x509.Certificate{cert}
 }
 
+// OCSP response to staple with 'cert', nil without a valid and fresh one
+func (m *_xModCerts) GetCertOCSP(cert *x509.Certificate, now time.Time) []byte {
+
+	for _, pki := range m.pkInfo {
+		if pki.ocsp == nil || !pki.cert.Equal(cert) {
+			continue
+		}
+
+		staple, err := pki.staple(now)
+		if err != nil {
+			m.lg.Warnf("Certificate %v: %v", pki.cn, err)
+			return nil
+		}
+
+		return staple
+	}
+
+	return nil
+}
+
+// Has 'cert' an OCSP response configured
+func (m *_xModCerts) HasOCSP(cert *x509.Certificate) bool {
+
+	for _, pki := range m.pkInfo {
+		if pki.ocsp != nil && pki.cert.Equal(cert) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Is there any certificate with the given key type (PKI_TYPE_*)
+func (m *_xModCerts) HasKeyType(keyType int) bool {
+
+	for _, pki := range m.pkInfo {
+		if pki.keyType == keyType {
+			return true
+		}
+	}
+
+	return false
+}
+
 // Print certs info
 func (m *_xModCerts) Print() string {
 
@@ -208,6 +299,7 @@ func (p *pki) setSignAlgoSupport() {
 	p.saSupport = make(map[uint16]bool)
 	switch pub := p.cert.PublicKey.(type) {
 	case *rsa.PublicKey:
+		p.keyType = PKI_TYPE_RSA
 		// RSA PKCS1
 		p.saSupport[ex.RSA_PKCS1_SHA256] = true
 		p.saSupport[ex.RSA_PKCS1_SHA384] = true
@@ -219,10 +311,24 @@ func (p *pki) setSignAlgoSupport() {
 			p.saSupport[ex.RSA_PSS_RSAE_SHA384] = true
 			p.saSupport[ex.RSA_PSS_RSAE_SHA512] = true
 		}
+
+	case *ecdsa.PublicKey:
+		p.keyType = PKI_TYPE_EC
+		switch pub.Curve.Params().BitSize {
+		case 256:
+			p.saSupport[ex.ECDSA_SECP256R1_SHA256] = true
+		case 384:
+			p.saSupport[ex.ECDSA_SECP384R1_SHA384] = true
+		case 521:
+			p.saSupport[ex.ECDSA_SECP521R1_SHA512] = true
+		}
 	}
 }
 
-func loadCertificate(path string) (*x509.Certificate, error) {
+// Leaf first, then whatever certificates follow it
+func loadCertificates(path string) ([]*x509.Certificate, error) {
+
+	var certs []*x509.Certificate
 
 	if path == "" {
 		return nil, fmt.Errorf("empty path")
@@ -233,15 +339,28 @@ func loadCertificate(path string) (*x509.Certificate, error) {
 		return nil, err
 	}
 
-	block, _ := pem.Decode(data)
+	block, rest := pem.Decode(data)
 	if block == nil || block.Type != "CERTIFICATE" {
 		return nil, fmt.Errorf("failed to parse certificate PEM")
 	}
 
-	return x509.ParseCertificate(block.Bytes)
+	for block != nil {
+		if block.Type == "CERTIFICATE" {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+
+			certs = append(certs, cert)
+		}
+
+		block, rest = pem.Decode(rest)
+	}
+
+	return certs, nil
 }
 
-func loadPrivateKey(path string) (crypto.PrivateKey, error) {
+func loadPrivateKey(path string) (crypto.Signer, error) {
 
 	if path == "" {
 		return nil, fmt.Errorf("empty path")
@@ -271,7 +390,13 @@ func loadPrivateKey(path string) (crypto.PrivateKey, error) {
 		}
 
 		switch key := key.(type) {
-		case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
+		case *rsa.PrivateKey:
+			return key, nil
+
+		case *ecdsa.PrivateKey:
+			return key, nil
+
+		case ed25519.PrivateKey:
 			return key, nil
 
 		default:
@@ -282,18 +407,18 @@ func loadPrivateKey(path string) (crypto.PrivateKey, error) {
 	return nil, fmt.Errorf("unsupported private key type: %s", block.Type)
 }
 
-func validateKeyPair(cert *x509.Certificate, key crypto.PrivateKey) bool {
+func validateKeyPair(cert *x509.Certificate, key crypto.Signer) bool {
 
 	if cert == nil || key == nil {
 		return false
 	}
 
-	switch keyT := key.(type) {
-	case *rsa.PrivateKey:
-		return keyT.PublicKey.Equal(cert.PublicKey)
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		return pub.Equal(cert.PublicKey)
 
-	case *ecdsa.PrivateKey:
-		return keyT.PublicKey.Equal(cert.PublicKey)
+	case *ecdsa.PublicKey:
+		return pub.Equal(cert.PublicKey)
 	}
 
 	return false
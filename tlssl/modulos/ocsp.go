@@ -0,0 +1,158 @@
+package modulos
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+	"tlesio/systema"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// Responses without nextUpdate are taken for this long after thisUpdate
+const _OCSP_MAX_AGE_ = 7 * 24 * time.Hour
+
+// Where a certificate's DER OCSP response comes from. Asked on every
+// handshake stapling it, so answers should come from memory. A sidecar
+// keeps it current, either rewriting the file behind NewOCSPFile or
+// implementing this
+type OCSPRefresher interface {
+	OCSPResponse() ([]byte, error)
+}
+
+type xOCSPFile struct {
+	path    string
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	data    []byte
+}
+
+// Last parsed response, parsed again only when the refresher's bytes change
+type xStaple struct {
+	mu   sync.Mutex
+	raw  []byte
+	resp *ocsp.Response
+	err  error
+}
+
+// Response file read again whenever its size or modification time change
+func NewOCSPFile(path string) OCSPRefresher {
+
+	if path == "" {
+		return nil
+	}
+
+	return &xOCSPFile{path: path}
+}
+
+func (x *xOCSPFile) OCSPResponse() ([]byte, error) {
+
+	info, err := os.Stat(x.path)
+	if err != nil {
+		return nil, err
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.data != nil && info.ModTime().Equal(x.modTime) &&
+		info.Size() == x.size {
+		return x.data, nil
+	}
+
+	data, err := os.ReadFile(x.path)
+	if err != nil {
+		return nil, err
+	}
+
+	x.data, x.modTime, x.size = data, info.ModTime(), info.Size()
+	return x.data, nil
+}
+
+// DER response to staple, checked against the certificate and its issuer
+// and fresh at 'now'
+func (p *pki) staple(now time.Time) ([]byte, error) {
+
+	if p.ocsp == nil {
+		return nil, systema.ErrNilParams
+	}
+
+	raw, err := p.ocsp.OCSPResponse()
+	if err != nil {
+		return nil, fmt.Errorf("OCSP response: %v", err)
+	}
+
+	p.stapled.mu.Lock()
+	if p.stapled.resp == nil && p.stapled.err == nil ||
+		!bytes.Equal(raw, p.stapled.raw) {
+		p.stapled.raw = raw
+		p.stapled.resp, p.stapled.err = parseOCSP(raw, p.cert, p.issuer)
+	}
+
+	resp, err := p.stapled.resp, p.stapled.err
+	p.stapled.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	expiry := resp.NextUpdate
+	if expiry.IsZero() {
+		expiry = resp.ThisUpdate.Add(_OCSP_MAX_AGE_)
+	}
+
+	if now.Before(resp.ThisUpdate) || !now.Before(expiry) {
+		return nil, fmt.Errorf("OCSP response not fresh: %v to %v",
+			resp.ThisUpdate.Format(time.RFC3339), expiry.Format(time.RFC3339))
+	}
+
+	return raw, nil
+}
+
+// For 'cert', signed by 'issuer' or by a responder it delegated to, and
+// saying the certificate is good
+func parseOCSP(raw []byte, cert, issuer *x509.Certificate) (*ocsp.Response,
+	error) {
+
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("empty OCSP response")
+	}
+
+	resp, err := ocsp.ParseResponseForCert(raw, cert, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("OCSP response: %v", err)
+	}
+
+	if resp.Certificate != nil {
+		delegated := false
+		for _, usage := range resp.Certificate.ExtKeyUsage {
+			delegated = delegated || usage == x509.ExtKeyUsageOCSPSigning
+		}
+
+		if !delegated {
+			return nil, fmt.Errorf("OCSP responder not delegated by issuer")
+		}
+	}
+
+	if resp.Status != ocsp.Good {
+		return nil, fmt.Errorf("OCSP status is not good(%v)", resp.Status)
+	}
+
+	return resp, nil
+}
+
+// The certificate after the leaf in its file that signed it. Responses
+// are checked against it
+func findIssuer(chain []*x509.Certificate,
+	cert *x509.Certificate) (*x509.Certificate, error) {
+
+	for _, issuer := range chain {
+		if cert.CheckSignatureFrom(issuer) == nil {
+			return issuer, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no issuer certificate after the leaf")
+}
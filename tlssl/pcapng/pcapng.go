@@ -0,0 +1,291 @@
+package pcapng
+
+// pcapng (draft-ietf-opsawg-pcapng) export of captured connections. Each
+// record is one synthesized TCP segment on a raw IP interface, key log
+// lines go in Decryption Secrets Blocks so Wireshark decrypts on open
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"tlesio/systema"
+	"tlesio/tlssl/capture"
+)
+
+const (
+	_BLOCK_SHB_ = 0x0A0D0D0A
+	_BLOCK_IDB_ = 0x00000001
+	_BLOCK_EPB_ = 0x00000006
+	_BLOCK_DSB_ = 0x0000000A
+
+	_BYTE_ORDER_MAGIC_ = 0x1A2B3C4D
+	_LINKTYPE_RAW_     = 101        // IPv4 or IPv6, no link layer
+	_SECRETS_TLS_KEY_  = 0x544C534B // 'TLSK', NSS key log lines
+)
+
+// TCP flags
+const (
+	_TCP_FIN_ = 0x01
+	_TCP_SYN_ = 0x02
+	_TCP_PSH_ = 0x08
+	_TCP_ACK_ = 0x10
+)
+
+// Server port when the connection has no TCP addresses (replays)
+const _FALLBACK_PORT_ = 443
+
+// One section, one interface. Safe for concurrent use, connections share it
+type Writer interface {
+	Conn(connID uint64, client, server net.Addr, start time.Time) Conn
+	Close() error
+}
+
+// One synthesized TCP connection. Entries become segments (randomness is
+// left out), closing it sends FIN both ways. Nothing is closed underneath
+type Conn interface {
+	capture.Sink
+	KeyLog() io.Writer // Each write is one Decryption Secrets Block
+}
+
+type xWriter struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+type endpoint struct {
+	ip   net.IP
+	port uint16
+}
+
+type xConn struct {
+	writer *xWriter
+	peers  [2]endpoint // Client, server
+	seq    [2]uint32   // Next sequence number, same order
+	ipID   uint16
+	last   time.Time
+}
+
+type xKeyLog struct {
+	writer *xWriter
+}
+
+// Section and interface headers go out right away
+func NewWriter(w io.WriteCloser) (Writer, error) {
+
+	var shb, idb []byte
+
+	if w == nil {
+		return nil, systema.ErrNilParams
+	}
+
+	newX := &xWriter{w: w}
+	shb = binary.LittleEndian.AppendUint32(shb, _BYTE_ORDER_MAGIC_)
+	shb = binary.LittleEndian.AppendUint16(shb, 1)
+	shb = binary.LittleEndian.AppendUint16(shb, 0)
+	shb = binary.LittleEndian.AppendUint64(shb, ^uint64(0)) // Unknown length
+	if err := newX.block(_BLOCK_SHB_, shb); err != nil {
+		return nil, err
+	}
+
+	idb = binary.LittleEndian.AppendUint16(idb, _LINKTYPE_RAW_)
+	idb = binary.LittleEndian.AppendUint16(idb, 0)
+	idb = binary.LittleEndian.AppendUint32(idb, 0) // No snap length
+	if err := newX.block(_BLOCK_IDB_, idb); err != nil {
+		return nil, err
+	}
+
+	return newX, nil
+}
+
+// Three way handshake at 'start'. IPv4 unless both ends are IPv6, made up
+// loopback addresses when they aren't TCP
+func (x *xWriter) Conn(connID uint64, client, server net.Addr,
+	start time.Time) Conn {
+
+	newConn := &xConn{writer: x, last: start}
+	cli, cliOK := client.(*net.TCPAddr)
+	srv, srvOK := server.(*net.TCPAddr)
+	switch {
+	case cliOK && srvOK && cli.IP.To4() != nil && srv.IP.To4() != nil:
+		newConn.peers[0] = endpoint{cli.IP.To4(), uint16(cli.Port)}
+		newConn.peers[1] = endpoint{srv.IP.To4(), uint16(srv.Port)}
+	case cliOK && srvOK && cli.IP.To4() == nil && srv.IP.To4() == nil &&
+		len(cli.IP) == net.IPv6len && len(srv.IP) == net.IPv6len:
+		newConn.peers[0] = endpoint{cli.IP, uint16(cli.Port)}
+		newConn.peers[1] = endpoint{srv.IP, uint16(srv.Port)}
+	default:
+		newConn.peers[0] = endpoint{net.IPv4(127, 0, 0, 1).To4(),
+			uint16(49152 + connID%16384)}
+		newConn.peers[1] = endpoint{net.IPv4(127, 0, 0, 1).To4(),
+			_FALLBACK_PORT_}
+	}
+
+	// Any ISN does, Wireshark shows relative numbers
+	newConn.seq[0] = uint32(connID) << 16
+	newConn.seq[1] = uint32(connID)<<16 | 0x8000
+	newConn.segment(0, _TCP_SYN_, nil)
+	newConn.segment(1, _TCP_SYN_|_TCP_ACK_, nil)
+	newConn.segment(0, _TCP_ACK_, nil)
+	return newConn
+}
+
+func (x *xWriter) Close() error {
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.w.Close()
+}
+
+// Type, length, body (padded to 32 bits), length again
+func (x *xWriter) block(blockType uint32, body []byte) error {
+
+	pad := (4 - len(body)%4) % 4
+	total := uint32(12 + len(body) + pad)
+	buff := make([]byte, 0, total)
+	buff = binary.LittleEndian.AppendUint32(buff, blockType)
+	buff = binary.LittleEndian.AppendUint32(buff, total)
+	buff = append(buff, body...)
+	buff = append(buff, make([]byte, pad)...)
+	buff = binary.LittleEndian.AppendUint32(buff, total)
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	_, err := x.w.Write(buff)
+	return err
+}
+
+func (x *xConn) Entry(entry *capture.Entry) error {
+
+	x.last = entry.Time
+	switch entry.Dir {
+	case capture.DirIn:
+		return x.segment(0, _TCP_PSH_|_TCP_ACK_, entry.Data)
+	case capture.DirOut:
+		return x.segment(1, _TCP_PSH_|_TCP_ACK_, entry.Data)
+	}
+
+	return nil
+}
+
+func (x *xConn) KeyLog() io.Writer {
+	return &xKeyLog{writer: x.writer}
+}
+
+// Client first. Both FINs are acknowledged
+func (x *xConn) Close() error {
+
+	if err := x.segment(0, _TCP_FIN_|_TCP_ACK_, nil); err != nil {
+		return err
+	}
+
+	if err := x.segment(1, _TCP_FIN_|_TCP_ACK_, nil); err != nil {
+		return err
+	}
+
+	return x.segment(0, _TCP_ACK_, nil)
+}
+
+// One Enhanced Packet Block from peer 'from' (0 client, 1 server)
+func (x *xConn) segment(from int, flags uint8, payload []byte) error {
+
+	var epb []byte
+
+	packet := x.packet(from, flags, payload)
+	usec := uint64(x.last.UnixMicro())
+	epb = binary.LittleEndian.AppendUint32(epb, 0)
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(usec>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(usec))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(packet)))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(packet)))
+	epb = append(epb, packet...)
+	return x.writer.block(_BLOCK_EPB_, epb)
+}
+
+// IP header, TCP header, payload. Moves the sender's sequence number
+func (x *xConn) packet(from int, flags uint8, payload []byte) []byte {
+
+	var tcp, packet []byte
+
+	src, dst := x.peers[from], x.peers[1-from]
+	var ack uint32
+	if flags&_TCP_ACK_ != 0 {
+		ack = x.seq[1-from]
+	}
+
+	tcp = binary.BigEndian.AppendUint16(tcp, src.port)
+	tcp = binary.BigEndian.AppendUint16(tcp, dst.port)
+	tcp = binary.BigEndian.AppendUint32(tcp, x.seq[from])
+	tcp = binary.BigEndian.AppendUint32(tcp, ack)
+	tcp = append(tcp, 5<<4, flags, 0xFF, 0xFF, 0, 0, 0, 0)
+	tcp = append(tcp, payload...)
+
+	// Pseudo header for the TCP checksum
+	pseudo := append(append([]byte{}, src.ip...), dst.ip...)
+	if len(src.ip) == net.IPv4len {
+		pseudo = append(pseudo, 0, 6)
+		pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(tcp)))
+	} else {
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(tcp)))
+		pseudo = append(pseudo, 0, 0, 0, 6)
+	}
+
+	binary.BigEndian.PutUint16(tcp[16:], checksum(append(pseudo, tcp...)))
+	x.seq[from] += uint32(len(payload))
+	if flags&(_TCP_SYN_|_TCP_FIN_) != 0 {
+		x.seq[from]++
+	}
+
+	if len(src.ip) == net.IPv4len {
+		x.ipID++
+		packet = append(packet, 0x45, 0)
+		packet = binary.BigEndian.AppendUint16(packet, uint16(20+len(tcp)))
+		packet = binary.BigEndian.AppendUint16(packet, x.ipID)
+		packet = append(packet, 0x40, 0, 64, 6, 0, 0) // DF, TTL, TCP
+		packet = append(packet, src.ip...)
+		packet = append(packet, dst.ip...)
+		binary.BigEndian.PutUint16(packet[10:], checksum(packet))
+		return append(packet, tcp...)
+	}
+
+	packet = append(packet, 0x60, 0, 0, 0)
+	packet = binary.BigEndian.AppendUint16(packet, uint16(len(tcp)))
+	packet = append(packet, 6, 64) // TCP, hop limit
+	packet = append(packet, src.ip...)
+	packet = append(packet, dst.ip...)
+	return append(packet, tcp...)
+}
+
+func (x *xKeyLog) Write(b []byte) (int, error) {
+
+	var dsb []byte
+
+	dsb = binary.LittleEndian.AppendUint32(dsb, _SECRETS_TLS_KEY_)
+	dsb = binary.LittleEndian.AppendUint32(dsb, uint32(len(b)))
+	dsb = append(dsb, b...)
+	if err := x.writer.block(_BLOCK_DSB_, dsb); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// Internet checksum (RFC 1071)
+func checksum(data []byte) uint16 {
+
+	var sum uint32
+
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+
+	for sum>>16 != 0 {
+		sum = sum&0xFFFF + sum>>16
+	}
+
+	return ^uint16(sum)
+}
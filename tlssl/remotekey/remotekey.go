@@ -0,0 +1,324 @@
+package remotekey
+
+// Private keys held by another process (a signing daemon, an HSM or KMS
+// front end) reached through a Unix socket. The key never enters this
+// process: Sign and Decrypt travel as requests, one at a time per socket
+// connection. Concurrent handshakes get a connection each, so a slow
+// operation only holds up the handshake waiting for it
+//
+//	request:  op(1) hash(1) flags(1) session_key_len(2) len(4) data
+//	response: status(1) len(4) data (result, or the error text)
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+	"tlesio/systema"
+)
+
+const (
+	_OP_PUBLIC_  = 0x01
+	_OP_SIGN_    = 0x02
+	_OP_DECRYPT_ = 0x03
+
+	_FLAG_PSS_ = 0x01
+
+	_STATUS_OK_    = 0x00
+	_STATUS_ERROR_ = 0x01
+
+	_REQUEST_HEAD_  = 9
+	_RESPONSE_HEAD_ = 5
+	_MAX_DATA_      = 1 << 16 // Digests, signatures and RSA blocks fit
+	_MAX_IDLE_      = 8       // Connections kept for later operations
+)
+
+// crypto.Decrypter only works with RSA keys
+type Key interface {
+	crypto.Signer
+	crypto.Decrypter
+	Close() error
+}
+
+type xKey struct {
+	path    string
+	timeout time.Duration
+	public  crypto.PublicKey
+	idle    chan net.Conn
+}
+
+type xRequest struct {
+	op            uint8
+	hash          crypto.Hash
+	flags         uint8
+	sessionKeyLen uint16
+	data          []byte
+}
+
+// Key served at the Unix socket 'path'. Every operation, connecting
+// included, fails after 'timeout' (zero waits forever)
+func Dial(path string, timeout time.Duration) (Key, error) {
+
+	if path == "" {
+		return nil, systema.ErrNilParams
+	}
+
+	x := &xKey{path: path, timeout: timeout,
+		idle: make(chan net.Conn, _MAX_IDLE_)}
+	der, err := x.do(&xRequest{op: _OP_PUBLIC_})
+	if err != nil {
+		return nil, err
+	}
+
+	x.public, err = x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("remote key public key: %v", err)
+	}
+
+	return x, nil
+}
+
+func (x *xKey) Public() crypto.PublicKey {
+	return x.public
+}
+
+// 'rand' is not used, randomness is the key holder's business
+func (x *xKey) Sign(rand io.Reader, digest []byte,
+	opts crypto.SignerOpts) ([]byte, error) {
+
+	req := &xRequest{op: _OP_SIGN_, hash: opts.HashFunc(), data: digest}
+	if pss, ok := opts.(*rsa.PSSOptions); ok {
+		if pss.SaltLength != rsa.PSSSaltLengthEqualsHash {
+			return nil, fmt.Errorf("remote key: unsupported PSS salt length")
+		}
+
+		req.flags |= _FLAG_PSS_
+	}
+
+	return x.do(req)
+}
+
+// Only PKCS #1 v1.5, the one TLS 1.2 RSA key exchange uses
+func (x *xKey) Decrypt(rand io.Reader, msg []byte,
+	opts crypto.DecrypterOpts) ([]byte, error) {
+
+	req := &xRequest{op: _OP_DECRYPT_, data: msg}
+	switch opts := opts.(type) {
+	case nil:
+	case *rsa.PKCS1v15DecryptOptions:
+		req.sessionKeyLen = uint16(opts.SessionKeyLen)
+	default:
+		return nil, fmt.Errorf("remote key: unsupported decrypt options")
+	}
+
+	return x.do(req)
+}
+
+func (x *xKey) Close() error {
+
+	for {
+		select {
+		case conn := <-x.idle:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// A connection nobody else is using for the length of 'req'. It goes back
+// to the idle ones only after a clean exchange. An idle connection the key
+// holder dropped meanwhile fails before any response, 'req' is then sent
+// once more on a new connection
+func (x *xKey) do(req *xRequest) ([]byte, error) {
+
+	var conn net.Conn
+	var status uint8
+	var data []byte
+	var answered bool
+	var err error
+
+	if len(req.data) > _MAX_DATA_ {
+		return nil, fmt.Errorf("remote key: request too long")
+	}
+
+	for pooled := true; ; pooled = false {
+		conn = nil
+		if pooled {
+			select {
+			case conn = <-x.idle:
+			default:
+			}
+		}
+
+		if conn == nil {
+			pooled = false
+			conn, err = net.DialTimeout("unix", x.path, x.timeout)
+			if err != nil {
+				return nil, fmt.Errorf("remote key: %v", err)
+			}
+		}
+
+		if x.timeout > 0 {
+			conn.SetDeadline(time.Now().Add(x.timeout))
+		}
+
+		status, data, answered, err = exchange(conn, req)
+		if err == nil {
+			break
+		}
+
+		conn.Close()
+		if !pooled || answered {
+			return nil, fmt.Errorf("remote key: %v", err)
+		}
+	}
+
+	conn.SetDeadline(time.Time{})
+	select {
+	case x.idle <- conn:
+	default:
+		conn.Close()
+	}
+
+	if status != _STATUS_OK_ {
+		return nil, fmt.Errorf("remote key: %s", data)
+	}
+
+	return data, nil
+}
+
+// 'answered' once the response header is in
+func exchange(conn net.Conn, req *xRequest) (uint8, []byte, bool, error) {
+
+	msg := make([]byte, _REQUEST_HEAD_, _REQUEST_HEAD_+len(req.data))
+	msg[0] = req.op
+	msg[1] = uint8(req.hash)
+	msg[2] = req.flags
+	binary.BigEndian.PutUint16(msg[3:], req.sessionKeyLen)
+	binary.BigEndian.PutUint32(msg[5:], uint32(len(req.data)))
+	if _, err := conn.Write(append(msg, req.data...)); err != nil {
+		return 0, nil, false, err
+	}
+
+	head := make([]byte, _RESPONSE_HEAD_)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return 0, nil, false, err
+	}
+
+	data, err := readData(conn, head[1:])
+	return head[0], data, true, err
+}
+
+// Requests from every connection accepted on 'ln' go to 'key', until 'ln'
+// is closed. Meant for tests and as a stand-in for a real key service
+func Serve(ln net.Listener, key crypto.Signer) error {
+
+	if ln == nil || key == nil {
+		return systema.ErrNilParams
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			return err
+		}
+
+		go serveConn(conn, key)
+	}
+}
+
+func serveConn(conn net.Conn, key crypto.Signer) {
+
+	defer conn.Close()
+	for {
+		head := make([]byte, _REQUEST_HEAD_)
+		if _, err := io.ReadFull(conn, head); err != nil {
+			return
+		}
+
+		data, err := readData(conn, head[5:])
+		if err != nil {
+			return
+		}
+
+		result, err := answer(key, &xRequest{
+			op:            head[0],
+			hash:          crypto.Hash(head[1]),
+			flags:         head[2],
+			sessionKeyLen: binary.BigEndian.Uint16(head[3:]),
+			data:          data,
+		})
+
+		status := uint8(_STATUS_OK_)
+		if err != nil {
+			status = _STATUS_ERROR_
+			result = []byte(err.Error())
+		}
+
+		msg := make([]byte, _RESPONSE_HEAD_, _RESPONSE_HEAD_+len(result))
+		msg[0] = status
+		binary.BigEndian.PutUint32(msg[1:], uint32(len(result)))
+		if _, err := conn.Write(append(msg, result...)); err != nil {
+			return
+		}
+	}
+}
+
+func answer(key crypto.Signer, req *xRequest) ([]byte, error) {
+
+	switch req.op {
+	case _OP_PUBLIC_:
+		return x509.MarshalPKIXPublicKey(key.Public())
+
+	case _OP_SIGN_:
+		var opts crypto.SignerOpts = req.hash
+		if req.flags&_FLAG_PSS_ != 0 {
+			opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash,
+				Hash: req.hash}
+		}
+
+		return key.Sign(rand.Reader, req.data, opts)
+
+	case _OP_DECRYPT_:
+		decrypter, ok := key.(crypto.Decrypter)
+		if !ok {
+			return nil, fmt.Errorf("key can't decrypt")
+		}
+
+		var opts crypto.DecrypterOpts
+		if req.sessionKeyLen > 0 {
+			opts = &rsa.PKCS1v15DecryptOptions{
+				SessionKeyLen: int(req.sessionKeyLen)}
+		}
+
+		return decrypter.Decrypt(rand.Reader, req.data, opts)
+	}
+
+	return nil, fmt.Errorf("unknown operation(0x%02X)", req.op)
+}
+
+func readData(r io.Reader, length []byte) ([]byte, error) {
+
+	n := binary.BigEndian.Uint32(length)
+	if n > _MAX_DATA_ {
+		return nil, fmt.Errorf("message too long(%v)", n)
+	}
+
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
@@ -21,8 +21,14 @@ func aesCBCEncrypt(data, key, iv []byte) ([]byte, error) {
 	return cipherText, nil
 }
 
+// Padding is left in place. The record layer checks it, in constant time,
+// along with the MAC (Lucky13)
 func aesCBCDecrypt(data, key, iv []byte) ([]byte, error) {
 
+	if len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("data is not a multiple of the block size")
+	}
+
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
@@ -31,7 +37,7 @@ func aesCBCDecrypt(data, key, iv []byte) ([]byte, error) {
 	clearText := make([]byte, len(data))
 	syphonFilter := cipher.NewCBCDecrypter(block, iv)
 	syphonFilter.CryptBlocks(clearText, data)
-	return unpaddPKCS7(clearText)
+	return clearText, nil
 }
 
 func paddPKCS7(data []byte, blockSize int) []byte {
@@ -46,17 +52,3 @@ func paddPKCS7(data []byte, blockSize int) []byte {
 	padding = append(padding, byte(padLen))
 	return append(data, padding...)
 }
-
-func unpaddPKCS7(data []byte) ([]byte, error) {
-
-	if len(data) == 0 {
-		return nil, fmt.Errorf("data is empty")
-	}
-
-	paddingLen := int(data[len(data)-1])
-	if paddingLen > len(data) {
-		return nil, fmt.Errorf("invalid padding length")
-	}
-
-	return data[:len(data)-(paddingLen)-1], nil
-}
@@ -0,0 +1,170 @@
+package ciphersuites
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+)
+
+// AES-CCM (RFC 3610, NIST SP 800-38C) as a cipher.AEAD. TLS nonces are
+// 12 bytes long (salt + explicit nonce, RFC 6655 3), so 3 bytes are left for
+// the message length
+type xAESCCM struct {
+	block     cipher.Block
+	tagSize   int
+	nonceSize int
+}
+
+func newAESCCM(key []byte, tagSize, nonceSize int) (cipher.AEAD, error) {
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if tagSize < 4 || tagSize > 16 || tagSize%2 != 0 {
+		return nil, fmt.Errorf("invalid CCM tag size")
+	}
+
+	if nonceSize < 7 || nonceSize > 13 {
+		return nil, fmt.Errorf("invalid CCM nonce size")
+	}
+
+	return &xAESCCM{
+		block:     block,
+		tagSize:   tagSize,
+		nonceSize: nonceSize,
+	}, nil
+}
+
+func (x *xAESCCM) NonceSize() int {
+	return x.nonceSize
+}
+
+func (x *xAESCCM) Overhead() int {
+	return x.tagSize
+}
+
+func (x *xAESCCM) Seal(dst, nonce, plaintext, aad []byte) []byte {
+
+	if len(nonce) != x.nonceSize || !x.lenFits(len(plaintext)) {
+		panic("ccm: invalid nonce size or plaintext too long")
+	}
+
+	out := make([]byte, len(plaintext)+x.tagSize)
+	tag := x.cbcMac(nonce, plaintext, aad)
+	x.ctr(out[:len(plaintext)], plaintext, nonce, tag)
+	copy(out[len(plaintext):], tag)
+	return append(dst, out...)
+}
+
+func (x *xAESCCM) Open(dst, nonce, ciphertext, aad []byte) ([]byte, error) {
+
+	if len(nonce) != x.nonceSize || len(ciphertext) < x.tagSize ||
+		!x.lenFits(len(ciphertext)-x.tagSize) {
+		return nil, fmt.Errorf("ccm: invalid nonce or ciphertext")
+	}
+
+	tag := make([]byte, x.tagSize)
+	plaintext := make([]byte, len(ciphertext)-x.tagSize)
+	copy(tag, ciphertext[len(plaintext):])
+	x.ctr(plaintext, ciphertext[:len(plaintext)], nonce, tag)
+	expectedTag := x.cbcMac(nonce, plaintext, aad)
+	if subtle.ConstantTimeCompare(tag, expectedTag) != 1 {
+		clear(plaintext)
+		return nil, fmt.Errorf("ccm: message authentication failed")
+	}
+
+	return append(dst, plaintext...), nil
+}
+
+// Counter blocks: flags(L - 1) || nonce || counter. A_0 encrypts the tag,
+// A_1.. the message. 'tag' is turned in place from plain to encrypted and
+// the other way around
+func (x *xAESCCM) ctr(dst, src, nonce, tag []byte) {
+
+	var s0 [aes.BlockSize]byte
+
+	counter := make([]byte, aes.BlockSize)
+	counter[0] = byte(x.lenSize() - 1)
+	copy(counter[1:], nonce)
+	x.block.Encrypt(s0[:], counter)
+	subtle.XORBytes(tag, tag, s0[:x.tagSize])
+	counter[aes.BlockSize-1] = 1
+	cipher.NewCTR(x.block, counter).XORKeyStream(dst, src)
+}
+
+// B_0: flags || nonce || message len, then the encoded AAD and the
+// message, both zero padded to the block size
+func (x *xAESCCM) cbcMac(nonce, plaintext, aad []byte) []byte {
+
+	var aadLen []byte
+
+	b0 := make([]byte, aes.BlockSize)
+	b0[0] = byte((x.tagSize-2)/2)<<3 | byte(x.lenSize()-1)
+	if len(aad) > 0 {
+		b0[0] |= 0x40
+	}
+
+	copy(b0[1:], nonce)
+	msgLen := len(plaintext)
+	for i := aes.BlockSize - 1; i > x.nonceSize; i-- {
+		b0[i] = byte(msgLen)
+		msgLen >>= 8
+	}
+
+	mac := make([]byte, aes.BlockSize)
+	x.block.Encrypt(mac, b0)
+	if len(aad) > 0 {
+		if len(aad) < 0xFF00 {
+			aadLen = binary.BigEndian.AppendUint16(nil, uint16(len(aad)))
+		} else {
+			aadLen = binary.BigEndian.AppendUint32([]byte{0xFF, 0xFE},
+				uint32(len(aad)))
+		}
+
+		x.cbcMacBlocks(mac, append(aadLen, aad...))
+	}
+
+	x.cbcMacBlocks(mac, plaintext)
+	return mac[:x.tagSize]
+}
+
+func (x *xAESCCM) cbcMacBlocks(mac, data []byte) {
+
+	for len(data) > 0 {
+		n := subtle.XORBytes(mac, mac, data)
+		x.block.Encrypt(mac, mac)
+		data = data[n:]
+	}
+}
+
+func (x *xAESCCM) lenSize() int {
+	return 15 - x.nonceSize
+}
+
+func (x *xAESCCM) lenFits(n int) bool {
+	return uint64(n) < uint64(1)<<(8*x.lenSize())
+}
+
+func aesCCMSeal(data, key, nonce, aad []byte, tagSize int) ([]byte, error) {
+
+	aead, err := newAESCCM(key, tagSize, len(nonce))
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nil, nonce, data, aad), nil
+}
+
+func aesCCMOpen(data, key, nonce, aad []byte, tagSize int) ([]byte, error) {
+
+	aead, err := newAESCCM(key, tagSize, len(nonce))
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Open(nil, nonce, data, aad)
+}
@@ -0,0 +1,25 @@
+package ciphersuites
+
+import (
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func chachaPolySeal(data, key, nonce, aad []byte) ([]byte, error) {
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nil, nonce, data, aad), nil
+}
+
+func chachaPolyOpen(data, key, nonce, aad []byte) ([]byte, error) {
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Open(nil, nonce, data, aad)
+}
@@ -0,0 +1,91 @@
+package ciphersuites
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"tlesio/tlssl/suite"
+)
+
+type x0xC0A6 struct {
+}
+
+func NewDHE_PSK_AES_128_CCM() suite.Suite {
+	return &x0xC0A6{}
+}
+
+func (x *x0xC0A6) ID() uint16 {
+	return 0xC0A6
+}
+
+func (x *x0xC0A6) Name() string {
+	return "TLS_DHE_PSK_WITH_AES_128_CCM"
+}
+
+// Salt (IV) 4 bytes + explicit nonce 8 bytes (RFC 6655 3)
+func (x *x0xC0A6) Info() *suite.SuiteInfo {
+	return &suite.SuiteInfo{
+		Mac:         suite.CBCMAC,
+		CipherType:  suite.CIPHER_AEAD,
+		Hash:        suite.SHA256,
+		HashSize:    sha256.Size,
+		Cipher:      suite.AES,
+		KeySize:     16,
+		KeySizeHMAC: 0,
+		IVSize:      4,
+		Auth:        suite.PSK,
+		KeyExchange: suite.DHE_PSK,
+		NonceSize:   8,
+		TagSize:     16,
+	}
+}
+
+func (x *x0xC0A6) Cipher(ctx *suite.SuiteContext) ([]byte, error) {
+
+	if err := x.basicCheck(ctx); err != nil {
+		return nil, err
+	}
+
+	return aesCCMSeal(ctx.Data, ctx.Key, ctx.IV, ctx.AAD, x.Info().TagSize)
+}
+
+func (x *x0xC0A6) CipherNot(ctx *suite.SuiteContext) ([]byte, error) {
+
+	if err := x.basicCheck(ctx); err != nil {
+		return nil, err
+	}
+
+	return aesCCMOpen(ctx.Data, ctx.Key, ctx.IV, ctx.AAD, x.Info().TagSize)
+}
+
+// CBC-MAC is part of the AEAD, there is no record MAC
+func (x *x0xC0A6) MacMe(data, hashKey []byte) ([]byte, error) {
+	return nil, fmt.Errorf("AEAD suite has no MAC(%v)", x.Name())
+}
+
+func (x *x0xC0A6) HashMe(data []byte) ([]byte, error) {
+
+	if len(data) == 0 {
+		return nil, fmt.Errorf("nil/empty data(%v)", x.Name())
+	}
+
+	hasher := sha256.New()
+	hasher.Write(data)
+	return hasher.Sum(nil), nil
+}
+
+func (x *x0xC0A6) basicCheck(cc *suite.SuiteContext) error {
+
+	if cc == nil {
+		return fmt.Errorf("nil SuiteContext(%v)", x.Name())
+	}
+
+	if len(cc.Key) != x.Info().KeySize {
+		return fmt.Errorf("invalid key size(%v)", x.Name())
+	}
+
+	if len(cc.IV) != x.Info().IVSize+x.Info().NonceSize {
+		return fmt.Errorf("invalid nonce size(%v)", x.Name())
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package ciphersuites
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"tlesio/tlssl/suite"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+type x0xCCA9 struct {
+}
+
+func NewECDHE_ECDSA_CHACHA20_POLY1305_SHA256() suite.Suite {
+	return &x0xCCA9{}
+}
+
+func (x *x0xCCA9) ID() uint16 {
+	return 0xCCA9
+}
+
+func (x *x0xCCA9) Name() string {
+	return "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"
+}
+
+func (x *x0xCCA9) Info() *suite.SuiteInfo {
+	return &suite.SuiteInfo{
+		Mac:         suite.POLY1305,
+		CipherType:  suite.CIPHER_AEAD,
+		Hash:        suite.SHA256,
+		HashSize:    sha256.Size,
+		Cipher:      suite.CHACHA20,
+		KeySize:     chacha20poly1305.KeySize,
+		KeySizeHMAC: 0,
+		IVSize:      chacha20poly1305.NonceSize,
+		Auth:        suite.ECDSA,
+		KeyExchange: suite.ECDHE,
+		NonceSize:   0,
+		TagSize:     chacha20poly1305.Overhead,
+	}
+}
+
+// Seal. Nonce (IV) is built by the record layer
+func (x *x0xCCA9) Cipher(ctx *suite.SuiteContext) ([]byte, error) {
+
+	if err := x.basicCheck(ctx); err != nil {
+		return nil, err
+	}
+
+	return chachaPolySeal(ctx.Data, ctx.Key, ctx.IV, ctx.AAD)
+}
+
+func (x *x0xCCA9) CipherNot(ctx *suite.SuiteContext) ([]byte, error) {
+
+	if err := x.basicCheck(ctx); err != nil {
+		return nil, err
+	}
+
+	return chachaPolyOpen(ctx.Data, ctx.Key, ctx.IV, ctx.AAD)
+}
+
+// Poly1305 is part of the AEAD, there is no record MAC
+func (x *x0xCCA9) MacMe(data, hashKey []byte) ([]byte, error) {
+	return nil, fmt.Errorf("AEAD suite has no MAC(%v)", x.Name())
+}
+
+func (x *x0xCCA9) HashMe(data []byte) ([]byte, error) {
+
+	if len(data) == 0 {
+		return nil, fmt.Errorf("nil/empty data(%v)", x.Name())
+	}
+
+	hasher := sha256.New()
+	hasher.Write(data)
+	return hasher.Sum(nil), nil
+}
+
+func (x *x0xCCA9) basicCheck(cc *suite.SuiteContext) error {
+
+	if cc == nil {
+		return fmt.Errorf("nil SuiteContext(%v)", x.Name())
+	}
+
+	if len(cc.Key) != x.Info().KeySize {
+		return fmt.Errorf("invalid key size(%v)", x.Name())
+	}
+
+	if len(cc.IV) != chacha20poly1305.NonceSize {
+		return fmt.Errorf("invalid nonce size(%v)", x.Name())
+	}
+
+	return nil
+}
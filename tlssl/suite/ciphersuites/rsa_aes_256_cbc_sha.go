@@ -83,8 +83,8 @@ func (x *x0x0035) HashMe(data []byte) ([]byte, error) {
 
 func (x *x0x0035) basicCheck(cc *suite.SuiteContext) error {
 
-	if cc == nil || len(cc.Data) == 0 {
-		return fmt.Errorf("nil/empty SuiteContext(%v)", x.Name())
+	if cc == nil {
+		return fmt.Errorf("nil SuiteContext(%v)", x.Name())
 	}
 
 	if len(cc.Key) != x.Info().KeySize {
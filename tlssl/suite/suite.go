@@ -11,13 +11,21 @@ const (
 
 	HMAC
 	POLY1305
+	CBCMAC // AES-CCM
 
+	MD5
 	SHA1
 	SHA256
 	SHA384
+	MD5SHA1 // TLS 1.0/1.1 PRF (P_MD5 XOR P_SHA1)
 
 	RSA
 	DHE
+	ECDHE
+	ECDSA
+	PSK
+	DHE_PSK
+	ECDHE_PSK
 )
 
 // Cipher Types
@@ -30,8 +38,9 @@ const (
 type SuiteContext struct {
 	Key  []byte
 	HKey []byte
-	IV   []byte
+	IV   []byte // Whole nonce for AEAD ciphers
 	Data []byte
+	AAD  []byte // AEAD only
 }
 
 type SuiteInfo struct {
@@ -45,6 +54,9 @@ type SuiteInfo struct {
 	IVSize      int
 	KeyExchange int
 	Auth        int
+	NonceSize   int  // AEAD only. Explicit nonce carried in each record
+	TagSize     int  // AEAD only
+	TLS13       bool // Key exchange and auth are negotiated apart
 }
 
 type Suite interface {
@@ -80,7 +92,7 @@ func (info *SuiteInfo) Print() string {
 	str += fmt.Sprintf("KeySizeHMAC: %d\n", info.KeySizeHMAC)
 	str += fmt.Sprintf("IVSize: %d\n", info.IVSize)
 	str += fmt.Sprintf("KeyExchange: %s",
-		keyExchangeToString(info.KeyExchange))
+		KeyExchangeToString(info.KeyExchange))
 	return str
 }
 
@@ -101,12 +113,16 @@ func modeToString(cipherType int) string {
 func hashToString(hash int) string {
 
 	switch hash {
+	case MD5:
+		return "MD5"
 	case SHA1:
 		return "SHA1"
 	case SHA256:
 		return "SHA256"
 	case SHA384:
 		return "SHA384"
+	case MD5SHA1:
+		return "MD5SHA1"
 	}
 
 	return "Unknown"
@@ -124,13 +140,24 @@ func cipherToString(cipher int) string {
 	return "Unknown"
 }
 
-func keyExchangeToString(keyExchange int) string {
+// As in the suite names: "RSA", "ECDHE", "DHE_PSK"...
+func KeyExchangeToString(keyExchange int) string {
 
 	switch keyExchange {
 	case RSA:
 		return "RSA"
 	case DHE:
 		return "DHE"
+	case ECDHE:
+		return "ECDHE"
+	case ECDSA:
+		return "ECDSA"
+	case PSK:
+		return "PSK"
+	case DHE_PSK:
+		return "DHE_PSK"
+	case ECDHE_PSK:
+		return "ECDHE_PSK"
 	}
 
 	return "Unknown"
@@ -0,0 +1,158 @@
+package tlssl
+
+import (
+	"errors"
+	"fmt"
+)
+
+//	struct {
+//		AlertLevel level;
+//		AlertDescription description;
+//	} Alert;
+
+type AlertLevelType uint8
+type AlertDescriptionType uint8
+
+const (
+	AlertLevelWarning AlertLevelType = 0x01
+	AlertLevelFatal   AlertLevelType = 0x02
+)
+
+const (
+	AlertCloseNotify             AlertDescriptionType = 0
+	AlertUnexpectedMessage       AlertDescriptionType = 10
+	AlertBadRecordMAC            AlertDescriptionType = 20
+	AlertRecordOverflow          AlertDescriptionType = 22
+	AlertHandshakeFailure        AlertDescriptionType = 40
+	AlertBadCertificate          AlertDescriptionType = 42
+	AlertUnsupportedCertificate  AlertDescriptionType = 43
+	AlertCertificateExpired      AlertDescriptionType = 45
+	AlertCertificateUnknown      AlertDescriptionType = 46
+	AlertIllegalParameter        AlertDescriptionType = 47
+	AlertUnknownCA               AlertDescriptionType = 48
+	AlertDecodeError             AlertDescriptionType = 50
+	AlertDecryptError            AlertDescriptionType = 51
+	AlertProtocolVersion         AlertDescriptionType = 70
+	AlertInsufficientSecurity    AlertDescriptionType = 71
+	AlertInternalError           AlertDescriptionType = 80
+	AlertNoRenegotiation         AlertDescriptionType = 100
+	AlertUnsupportedExtension    AlertDescriptionType = 110
+	AlertCertificateUnobtainable AlertDescriptionType = 111
+	AlertUnknownPSKIdentity      AlertDescriptionType = 115
+	AlertNoApplicationProtocol   AlertDescriptionType = 120
+)
+
+const TLS_ALERT_SIZE = 2
+
+// Handshake error that must be told to the peer with a fatal alert
+type AlertError struct {
+	Description AlertDescriptionType
+	Err         error
+}
+
+func NewAlertError(desc AlertDescriptionType, format string,
+	args ...interface{}) error {
+
+	return &AlertError{
+		Description: desc,
+		Err:         fmt.Errorf(format, args...),
+	}
+}
+
+func (x *AlertError) Error() string {
+	return fmt.Sprintf("%v(alert %v)", x.Err, x.Description)
+}
+
+func (x *AlertError) Unwrap() error {
+	return x.Err
+}
+
+// Alert to send for 'err', if any
+func AlertFromError(err error) (AlertDescriptionType, bool) {
+
+	var alertErr *AlertError
+
+	if errors.As(err, &alertErr) {
+		return alertErr.Description, true
+	}
+
+	if errors.Is(err, ErrBadRecordMAC) {
+		return AlertBadRecordMAC, true
+	}
+
+	return 0, false
+}
+
+// Alert message (level + description). Close notify is the only warning
+// level alert sent, everything else is fatal
+func TLSAlert(desc AlertDescriptionType) []byte {
+
+	level := AlertLevelFatal
+	if desc == AlertCloseNotify {
+		level = AlertLevelWarning
+	}
+
+	return []byte{byte(level), byte(desc)}
+}
+
+// Plaintext alert record
+func TLSAlertPacket(desc AlertDescriptionType, version uint16) []byte {
+
+	packet := TLSHeadPacket(&TLSHeader{
+		ContentType: ContentTypeAlert,
+		Version:     version,
+		Len:         TLS_ALERT_SIZE,
+	})
+
+	return append(packet, TLSAlert(desc)...)
+}
+
+func (x AlertDescriptionType) String() string {
+
+	switch x {
+	case AlertCloseNotify:
+		return "close_notify"
+	case AlertUnexpectedMessage:
+		return "unexpected_message"
+	case AlertBadRecordMAC:
+		return "bad_record_mac"
+	case AlertRecordOverflow:
+		return "record_overflow"
+	case AlertHandshakeFailure:
+		return "handshake_failure"
+	case AlertBadCertificate:
+		return "bad_certificate"
+	case AlertUnsupportedCertificate:
+		return "unsupported_certificate"
+	case AlertCertificateExpired:
+		return "certificate_expired"
+	case AlertCertificateUnknown:
+		return "certificate_unknown"
+	case AlertIllegalParameter:
+		return "illegal_parameter"
+	case AlertUnknownCA:
+		return "unknown_ca"
+	case AlertDecodeError:
+		return "decode_error"
+	case AlertDecryptError:
+		return "decrypt_error"
+	case AlertProtocolVersion:
+		return "protocol_version"
+	case AlertInsufficientSecurity:
+		return "insufficient_security"
+	case AlertInternalError:
+		return "internal_error"
+	case AlertNoRenegotiation:
+		return "no_renegotiation"
+	case AlertUnsupportedExtension:
+		return "unsupported_extension"
+	case AlertCertificateUnobtainable:
+		return "certificate_unobtainable"
+	case AlertUnknownPSKIdentity:
+		return "unknown_psk_identity"
+	case AlertNoApplicationProtocol:
+		return "no_application_protocol"
+	}
+
+	return fmt.Sprintf("alert(%d)", uint8(x))
+}
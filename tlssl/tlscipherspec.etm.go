@@ -1,16 +1,156 @@
 package tlssl
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"tlesio/systema"
+	"tlesio/tlssl/suite"
 )
 
+/*
+Encrypt-then-MAC (RFC 7366 3). Block ciphers only
+
+struct {
+	struct {
+		opaque IV[SecurityParameters.record_iv_length];
+		block-ciphered struct {
+			opaque content[TLSCompressed.length];
+			uint8 padding[GenericBlockCipher.padding_length];
+			uint8 padding_length;
+		};
+	} GenericBlockCipher;
+	opaque MAC[SecurityParameters.mac_length];
+} TLSCiphertext
+
+MAC(MAC_write_key, seq_num +
+	TLSCipherText.type +
+	TLSCipherText.version +
+	TLSCipherText.length +
+	IV +
+	ENC(content + padding + padding_length));
+
+TLSCipherText.length leaves the MAC out. TLS 1.0 has no IV in the record
+*/
+
 func (x *xTLSCSpec) encryptETM(tpt *TLSPlaintext) (*TLSCipherText, error) {
-	return nil, fmt.Errorf("not implemented encryptRecordETM")
+
+	var tct TLSCipherText
+	var sCtx suite.SuiteContext
+
+	myself := systema.MyName()
+	info := x.cipherSuite.Info()
+	if info.CipherType != suite.CIPHER_CBC {
+		return nil, fmt.Errorf("block ciphers only(%v)", myself)
+	}
+
+	iv, err := generateIVNonce(x.random, info.IVSize)
+	if err != nil {
+		return nil, fmt.Errorf("IV generation(%v): %v", myself, err)
+	}
+
+	sCtx.Key = x.keys.Key
+	sCtx.IV = iv
+	if x.version == TLS_VERSION1_0 {
+		sCtx.IV = x.chainIV
+		iv = nil
+	}
+
+	sCtx.Data = append(sCtx.Data, tpt.Fragment...)
+	ciphered, err := x.cipherSuite.Cipher(&sCtx)
+	if err != nil {
+		return nil, fmt.Errorf("Ciphering(%v): %v", myself, err)
+	}
+
+	var macData []byte
+	macData = append(macData, iv...)
+	macData = append(macData, ciphered...)
+	mac, err := x.Macintosh(tpt.Header, macData)
+	if err != nil {
+		return nil, fmt.Errorf("MAC calculation(%v): %v", myself, err)
+	}
+
+	if x.version == TLS_VERSION1_0 {
+		x.chainIV = lastBlock(ciphered, info.IVSize)
+	}
+
+	tct.Header = &TLSHeader{
+		ContentType: tpt.Header.ContentType,
+		Version:     x.version,
+		Len:         len(iv) + len(ciphered) + len(mac),
+	}
+
+	tct.Fragment = &GenericBlockCipher{
+		IV:            iv,
+		BlockCiphered: ciphered,
+		Mac:           mac,
+	}
+
+	return &tct, nil
 }
 
+// The MAC is checked before anything gets decrypted, padding oracles are
+// out of the picture. Every failure past the framing is ErrBadRecordMAC
 func (x *xTLSCSpec) decryptETM(tct *TLSCipherText) (*TLSPlaintext, error) {
 
+	var tpt TLSPlaintext
+
 	myself := systema.MyName()
-	return nil, fmt.Errorf("not implemented yet(%v)", myself)
+	info := x.cipherSuite.Info()
+	cipherRecord, ok := tct.Fragment.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("invalid fragment buffer type(%v)", myself)
+	}
+
+	if info.CipherType != suite.CIPHER_CBC {
+		return nil, fmt.Errorf("block ciphers only(%v)", myself)
+	}
+
+	explicitIV := info.IVSize
+	if x.version == TLS_VERSION1_0 {
+		explicitIV = 0
+	}
+
+	// IV, whole blocks (one at least) and the MAC
+	macAt := len(cipherRecord) - info.HashSize
+	if macAt < explicitIV+info.IVSize ||
+		(macAt-explicitIV)%info.IVSize != 0 {
+		return nil, ErrBadRecordMAC
+	}
+
+	computedMAC, err := x.Macintosh(tct.Header, cipherRecord[:macAt])
+	if err != nil || subtle.ConstantTimeCompare(cipherRecord[macAt:],
+		computedMAC) != 1 {
+		return nil, ErrBadRecordMAC
+	}
+
+	cipherText := cipherRecord[explicitIV:macAt]
+	iv := cipherRecord[:explicitIV]
+	if x.version == TLS_VERSION1_0 {
+		iv = x.chainIV
+		x.chainIV = lastBlock(cipherText, info.IVSize)
+	}
+
+	clearText, err := x.cipherSuite.CipherNot(&suite.SuiteContext{
+		IV:   iv,
+		Key:  x.keys.Key,
+		Data: cipherText,
+	})
+
+	if err != nil || len(clearText) != len(cipherText) {
+		return nil, ErrBadRecordMAC
+	}
+
+	toRemove, paddingGood := extractPadding(clearText)
+	if paddingGood != 0xFF {
+		return nil, ErrBadRecordMAC
+	}
+
+	tpt.Fragment = clearText[:len(clearText)-toRemove]
+	tpt.Header = &TLSHeader{
+		ContentType: tct.Header.ContentType,
+		Version:     x.version,
+		Len:         len(tpt.Fragment),
+	}
+
+	return &tpt, nil
 }
@@ -3,7 +3,10 @@ package tlssl
 import (
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"tlesio/systema"
 	"tlesio/tlssl/suite"
 )
@@ -40,6 +43,10 @@ MAC(MAC_write_key,
 
 const VERIFYDATALEN = 12
 
+// Only error a protected record gets once its framing is fine. Padding and
+// MAC failures must not be told apart (RFC 5246 7.2.2)
+var ErrBadRecordMAC = errors.New("bad_record_mac")
+
 // Mac mode
 const (
 	MODE_MTE = iota + 1
@@ -50,6 +57,8 @@ type GenericStreamCipher struct {
 }
 
 type GeneriAEADCipher struct {
+	Nonce        []byte // Explicit part only
+	AEADCiphered []byte
 }
 
 type GenericBlockCipher struct {
@@ -72,17 +81,25 @@ type TLSCipherSpec interface {
 	CipherType() int
 	EncryptRecord(*TLSPlaintext) (*TLSCipherText, error)
 	DecryptRecord(*TLSCipherText) (*TLSPlaintext, error)
-	Macintosh([]byte) ([]byte, error)
+	Macintosh(*TLSHeader, []byte) ([]byte, error)
+	SplitRecord(*TLSPlaintext) []*TLSPlaintext
 }
 
+// One per direction. 'seqNum' is the number of records already protected
+// (or unprotected) with this spec
 type xTLSCSpec struct {
 	macMode     int
 	keys        *Keys
 	seqNum      uint64
+	version     uint16
+	chainIV     []byte // TLS 1.0 only. Last cipher block of previous record
 	cipherSuite suite.Suite
+	random      io.Reader // Explicit CBC IVs
 }
 
-func NewTLSCipherSpec(cs suite.Suite, keys *Keys, mode int) TLSCipherSpec {
+// A nil 'random' means crypto/rand
+func NewTLSCipherSpec(cs suite.Suite, keys *Keys, mode int,
+	version uint16, random io.Reader) TLSCipherSpec {
 
 	var newTLSCT xTLSCSpec
 
@@ -90,6 +107,21 @@ func NewTLSCipherSpec(cs suite.Suite, keys *Keys, mode int) TLSCipherSpec {
 		return nil
 	}
 
+	switch version {
+	case TLS_VERSION1_0:
+		// First record IV comes from the key block, next ones are chained
+		newTLSCT.chainIV = keys.IV
+	case TLS_VERSION1_1, TLS_VERSION1_2:
+	default:
+		return nil
+	}
+
+	// AEAD suites are TLS 1.2 only and must know their tag size
+	if cs.Info().CipherType == suite.CIPHER_AEAD &&
+		(version != TLS_VERSION1_2 || cs.Info().TagSize <= 0) {
+		return nil
+	}
+
 	switch mode {
 	case MODE_ETM:
 		newTLSCT.macMode = MODE_ETM
@@ -101,68 +133,101 @@ func NewTLSCipherSpec(cs suite.Suite, keys *Keys, mode int) TLSCipherSpec {
 
 	newTLSCT.cipherSuite = cs
 	newTLSCT.keys = keys
+	newTLSCT.version = version
+	newTLSCT.random = random
+	if random == nil {
+		newTLSCT.random = rand.Reader
+	}
+
 	return &newTLSCT
 }
 
+// Any record type. The sequence number moves forward only when the
+// record was protected
 func (x *xTLSCSpec) EncryptRecord(tpt *TLSPlaintext) (*TLSCipherText, error) {
 
+	var err error
+	var tct *TLSCipherText
+
 	myself := systema.MyName()
 	if tpt == nil || tpt.Header == nil {
 		return nil, fmt.Errorf("nil TLSPlaintext(%v)", myself)
 	}
 
-	if x.seqNum == 0 {
-		if tpt.Header.ContentType != ContentTypeHandshake {
-			return nil, fmt.Errorf("invalid ContentType(%v)", myself)
-		}
+	if x.seqNum == math.MaxUint64 {
+		return nil, fmt.Errorf("sequence number overflow(%v)", myself)
+	}
 
-		if len(tpt.Fragment) != TLS_HANDSHAKE_SIZE+VERIFYDATALEN {
-			return nil, fmt.Errorf("(%v)", myself)
-		}
+	// MAC mode does not apply to AEAD suites
+	switch {
+	case x.CipherType() == suite.CIPHER_AEAD:
+		tct, err = x.encryptAEAD(tpt)
+	case x.macMode == MODE_ETM:
+		tct, err = x.encryptETM(tpt)
+	case x.macMode == MODE_MTE:
+		tct, err = x.encryptMTE(tpt)
+	default:
+		return nil, fmt.Errorf("no MAC-Mode match(%v)", myself)
 	}
 
-	switch x.macMode {
-	case MODE_ETM:
-		return x.encryptETM(tpt)
-	case MODE_MTE:
-		return x.encryptMTE(tpt)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, fmt.Errorf("no MAC-Mode match(%v)", myself)
+	x.seqNum++
+	return tct, nil
 }
 
 func (x *xTLSCSpec) DecryptRecord(tct *TLSCipherText) (*TLSPlaintext, error) {
 
+	var err error
+	var tpt *TLSPlaintext
+
 	myself := systema.MyName()
 	if tct == nil || tct.Header == nil || tct.Fragment == nil {
 		return nil, fmt.Errorf("nil TLSCipherText(%v)", myself)
 	}
 
-	switch x.macMode {
-	case MODE_MTE:
-		return x.decryptMTE(tct)
-	case MODE_ETM:
-		return x.decryptETM(tct)
+	if x.seqNum == math.MaxUint64 {
+		return nil, fmt.Errorf("sequence number overflow(%v)", myself)
 	}
 
-	return nil, fmt.Errorf("no cipher mode(%v)", myself)
+	switch {
+	case x.CipherType() == suite.CIPHER_AEAD:
+		tpt, err = x.decryptAEAD(tct)
+	case x.macMode == MODE_MTE:
+		tpt, err = x.decryptMTE(tct)
+	case x.macMode == MODE_ETM:
+		tpt, err = x.decryptETM(tct)
+	default:
+		return nil, fmt.Errorf("no cipher mode(%v)", myself)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	x.seqNum++
+	return tpt, nil
 }
 
-// calculate MAC
-func (x *xTLSCSpec) Macintosh(data []byte) ([]byte, error) {
+// MAC over the current sequence number and the record's real content
+// type. Length is the plaintext one
+func (x *xTLSCSpec) Macintosh(header *TLSHeader, data []byte) ([]byte, error) {
 
 	var macData []byte
-	var header TLSHeader
 
-	header.ContentType = ContentTypeApplicationData
-	header.Version = TLS_VERSION1_2
-	header.Len = len(data)
-	if x.seqNum == 0 {
-		header.ContentType = ContentTypeHandshake
+	if header == nil {
+		return nil, fmt.Errorf("nil TLSHeader(%v)", systema.MyName())
 	}
 
 	macData = append(macData, seqNumToBytes(x.seqNum)...)
-	macData = append(macData, TLSHeadPacket(&header)...)
+	macData = append(macData, TLSHeadPacket(&TLSHeader{
+		ContentType: header.ContentType,
+		Version:     x.version,
+		Len:         len(data),
+	})...)
+
 	macData = append(macData, data...)
 	return x.cipherSuite.MacMe(macData, x.keys.MAC)
 }
@@ -171,6 +236,43 @@ func (x *xTLSCSpec) CipherType() int {
 	return x.cipherSuite.Info().CipherType
 }
 
+// TLS 1.0 CBC records use the last cipher block of the previous record as
+// IV, so the first block of the next record is predictable (BEAST).
+// Application data is sent as a 1 byte record followed by the n-1 remaining
+// bytes, making the IV of the real content depend on an unpredictable MAC.
+// Any other record is returned as is
+func (x *xTLSCSpec) SplitRecord(tpt *TLSPlaintext) []*TLSPlaintext {
+
+	if tpt == nil || tpt.Header == nil {
+		return nil
+	}
+
+	if x.version != TLS_VERSION1_0 || x.CipherType() != suite.CIPHER_CBC ||
+		tpt.Header.ContentType != ContentTypeApplicationData ||
+		len(tpt.Fragment) <= 1 {
+		return []*TLSPlaintext{tpt}
+	}
+
+	return []*TLSPlaintext{
+		{
+			Header: &TLSHeader{
+				ContentType: tpt.Header.ContentType,
+				Version:     x.version,
+				Len:         1,
+			},
+			Fragment: tpt.Fragment[:1],
+		},
+		{
+			Header: &TLSHeader{
+				ContentType: tpt.Header.ContentType,
+				Version:     x.version,
+				Len:         len(tpt.Fragment) - 1,
+			},
+			Fragment: tpt.Fragment[1:],
+		},
+	}
+}
+
 // TLSCipherText
 func (xt *TLSCipherText) Packet(fragType int, skipIv bool) ([]byte, error) {
 
@@ -188,10 +290,17 @@ func (xt *TLSCipherText) Packet(fragType int, skipIv bool) ([]byte, error) {
 		}
 
 		iv = aux.IV
-		content = aux.BlockCiphered
+		content = append(content, aux.BlockCiphered...)
+		content = append(content, aux.Mac...) // Encrypt-then-MAC only
 
 	case suite.CIPHER_AEAD:
-		return nil, fmt.Errorf("AEAD cipher not implemented")
+		aux, ok := xt.Fragment.(*GeneriAEADCipher)
+		if !ok {
+			return nil, fmt.Errorf("invalid fragment type")
+		}
+
+		content = append(content, aux.Nonce...)
+		content = append(content, aux.AEADCiphered...)
 	}
 
 	packet := TLSHeadPacket(xt.Header)
@@ -208,10 +317,10 @@ func seqNumToBytes(sn uint64) []byte {
 	return seqNumBytes
 }
 
-func generateIVNonce(sz int) ([]byte, error) {
+func generateIVNonce(random io.Reader, sz int) ([]byte, error) {
 
 	iv := make([]byte, sz)
-	_, err := rand.Read(iv)
+	_, err := io.ReadFull(random, iv)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,138 @@
+package tlssl
+
+import (
+	"fmt"
+	"tlesio/systema"
+	"tlesio/tlssl/suite"
+)
+
+/*
+struct {
+	opaque nonce_explicit[SecurityParameters.record_iv_length];
+	aead-ciphered struct {
+		opaque content[TLSCompressed.length];
+	};
+} GenericAEADCipher;
+
+additional_data = seq_num + TLSCompressed.type +
+	TLSCompressed.version + TLSCompressed.length;
+
+Nonce (RFC 5288 3): fixed_iv || nonce_explicit. The explicit part is the
+sequence number.
+Nonce (RFC 7905 2): no explicit part. The 12 bytes fixed_iv XOR the left
+padded sequence number.
+*/
+
+func (x *xTLSCSpec) encryptAEAD(tpt *TLSPlaintext) (*TLSCipherText, error) {
+
+	var tct TLSCipherText
+
+	myself := systema.MyName()
+	info := x.cipherSuite.Info()
+	explicit := x.aeadExplicitNonce()
+	sCtx := suite.SuiteContext{
+		Key:  x.keys.Key,
+		IV:   x.aeadNonce(explicit),
+		Data: tpt.Fragment,
+		AAD:  x.aeadAAD(tpt.Header.ContentType, len(tpt.Fragment)),
+	}
+
+	ciphered, err := x.cipherSuite.Cipher(&sCtx)
+	if err != nil {
+		return nil, fmt.Errorf("Ciphering(%v): %v", myself, err)
+	}
+
+	tct.Header = &TLSHeader{
+		ContentType: tpt.Header.ContentType,
+		Version:     x.version,
+		Len:         info.NonceSize + len(ciphered),
+	}
+
+	tct.Fragment = &GeneriAEADCipher{
+		Nonce:        explicit,
+		AEADCiphered: ciphered,
+	}
+
+	return &tct, nil
+}
+
+func (x *xTLSCSpec) decryptAEAD(tct *TLSCipherText) (*TLSPlaintext, error) {
+
+	var tpt TLSPlaintext
+
+	myself := systema.MyName()
+	info := x.cipherSuite.Info()
+	cipherRecord, ok := tct.Fragment.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("invalid fragment buffer type(%v)", myself)
+	}
+
+	if len(cipherRecord) < info.NonceSize+info.TagSize {
+		return nil, ErrBadRecordMAC
+	}
+
+	explicit := cipherRecord[:info.NonceSize]
+	ciphered := cipherRecord[info.NonceSize:]
+	sCtx := suite.SuiteContext{
+		Key:  x.keys.Key,
+		IV:   x.aeadNonce(explicit),
+		Data: ciphered,
+		AAD: x.aeadAAD(tct.Header.ContentType,
+			len(ciphered)-info.TagSize),
+	}
+
+	plainText, err := x.cipherSuite.CipherNot(&sCtx)
+	if err != nil {
+		return nil, ErrBadRecordMAC
+	}
+
+	tpt.Fragment = plainText
+	tpt.Header = &TLSHeader{
+		ContentType: tct.Header.ContentType,
+		Version:     x.version,
+		Len:         len(plainText),
+	}
+
+	return &tpt, nil
+}
+
+// Explicit nonce is the sequence number (none for ChaCha20-Poly1305)
+func (x *xTLSCSpec) aeadExplicitNonce() []byte {
+
+	nonceSz := x.cipherSuite.Info().NonceSize
+	if nonceSz <= 0 {
+		return nil
+	}
+
+	explicit := make([]byte, nonceSz)
+	copy(explicit[nonceSz-8:], seqNumToBytes(x.seqNum))
+	return explicit
+}
+
+func (x *xTLSCSpec) aeadNonce(explicit []byte) []byte {
+
+	var nonce []byte
+
+	if len(explicit) > 0 {
+		nonce = append(nonce, x.keys.IV...)
+		return append(nonce, explicit...)
+	}
+
+	nonce = append(nonce, x.keys.IV...)
+	seqNum := seqNumToBytes(x.seqNum)
+	for i := range seqNum {
+		nonce[len(nonce)-len(seqNum)+i] ^= seqNum[i]
+	}
+
+	return nonce
+}
+
+func (x *xTLSCSpec) aeadAAD(ct ContentTypeType, length int) []byte {
+
+	aad := seqNumToBytes(x.seqNum)
+	return append(aad, TLSHeadPacket(&TLSHeader{
+		ContentType: ct,
+		Version:     x.version,
+		Len:         length,
+	})...)
+}
@@ -1,8 +1,9 @@
 package tlssl
 
 import (
-	"crypto/hmac"
+	"crypto/subtle"
 	"fmt"
+	"math/bits"
 	"tlesio/systema"
 	"tlesio/tlssl/suite"
 )
@@ -14,21 +15,22 @@ func (x *xTLSCSpec) encryptMTE(tpt *TLSPlaintext) (*TLSCipherText, error) {
 	var sCtx suite.SuiteContext
 
 	myself := systema.MyName()
-	mac, err := x.Macintosh(tpt.Fragment)
+	mac, err := x.Macintosh(tpt.Header, tpt.Fragment)
 	if err != nil {
 		return nil, fmt.Errorf("MAC calculation(%v): %v", myself, err)
 	}
 
-	iv, err := generateIVNonce(x.cipherSuite.Info().IVSize)
+	iv, err := generateIVNonce(x.random, x.cipherSuite.Info().IVSize)
 	if err != nil {
 		return nil, fmt.Errorf("IV generation(%v): %v", myself, err)
 	}
 
+	// TLS 1.0 has no explicit IV, it is chained from the previous record
 	sCtx.Key = x.keys.Key
 	sCtx.IV = iv
-	if x.seqNum == 0 {
-		sCtx.IV = x.keys.IV
-		sCtx.Data = append(sCtx.Data, iv...)
+	if x.version == TLS_VERSION1_0 {
+		sCtx.IV = x.chainIV
+		iv = nil
 	}
 
 	sCtx.Data = append(sCtx.Data, tpt.Fragment...)
@@ -38,10 +40,14 @@ func (x *xTLSCSpec) encryptMTE(tpt *TLSPlaintext) (*TLSCipherText, error) {
 		return nil, fmt.Errorf("Ciphering(%v): %v", myself, err)
 	}
 
+	if x.version == TLS_VERSION1_0 {
+		x.chainIV = lastBlock(ciphered, x.cipherSuite.Info().IVSize)
+	}
+
 	tct.Header = &TLSHeader{
 		ContentType: tpt.Header.ContentType,
-		Version:     TLS_VERSION1_2,
-		Len:         len(ciphered),
+		Version:     x.version,
+		Len:         len(iv) + len(ciphered),
 	}
 
 	switch x.cipherSuite.Info().CipherType {
@@ -61,27 +67,43 @@ func (x *xTLSCSpec) encryptMTE(tpt *TLSPlaintext) (*TLSCipherText, error) {
 	return &tct, nil
 }
 
+// Every failure past the record framing is reported as ErrBadRecordMAC.
+// Padding is checked in constant time and the MAC is always computed,
+// over as many bytes as with a valid padding (RFC 5246 6.2.3.2, Lucky13)
 func (x *xTLSCSpec) decryptMTE(tct *TLSCipherText) (*TLSPlaintext, error) {
 
-	var err error
 	var tpt TLSPlaintext
 	var iv, cipherText []byte
 
 	myself := systema.MyName()
+	info := x.cipherSuite.Info()
 	cipherRecord, ok := tct.Fragment.([]byte)
 	if !ok {
 		return nil, fmt.Errorf("invalid fragment buffer type(%v)", myself)
 	}
 
-	if len(cipherRecord) <= x.cipherSuite.Info().IVSize {
-		return nil, fmt.Errorf("decrypt short data(%v)", myself)
+	if info.CipherType != suite.CIPHER_CBC {
+		return nil, fmt.Errorf("stream cipher not implemented(%v)", myself)
+	}
+
+	// At least one block of MAC + padding length and whole blocks only.
+	// Lengths are public, nothing to hide here
+	explicitIV := info.IVSize
+	if x.version == TLS_VERSION1_0 {
+		explicitIV = 0
 	}
 
-	cipherText = cipherRecord[x.cipherSuite.Info().IVSize:]
-	iv = cipherRecord[:x.cipherSuite.Info().IVSize]
-	if x.seqNum == 0 {
-		iv = x.keys.IV
-		cipherText = cipherRecord
+	minLen := explicitIV + (info.HashSize/info.IVSize+1)*info.IVSize
+	if len(cipherRecord) < minLen ||
+		(len(cipherRecord)-explicitIV)%info.IVSize != 0 {
+		return nil, ErrBadRecordMAC
+	}
+
+	cipherText = cipherRecord[explicitIV:]
+	iv = cipherRecord[:explicitIV]
+	if x.version == TLS_VERSION1_0 {
+		iv = x.chainIV
+		x.chainIV = lastBlock(cipherRecord, info.IVSize)
 	}
 
 	sCtx := suite.SuiteContext{
@@ -91,36 +113,80 @@ func (x *xTLSCSpec) decryptMTE(tct *TLSCipherText) (*TLSPlaintext, error) {
 	}
 
 	clearText, err := x.cipherSuite.CipherNot(&sCtx)
-	if err != nil {
-		return nil, fmt.Errorf("decipher(%v): %v", myself, err)
-	}
-
-	hashSz := x.cipherSuite.Info().HashSize
-	if len(clearText) < hashSz {
-		return nil, fmt.Errorf("decipher short data(%v)", myself)
+	if err != nil || len(clearText) != len(cipherText) {
+		return nil, ErrBadRecordMAC
 	}
 
-	plainText := clearText[:len(clearText)-hashSz]
-	givenMAC := clearText[len(clearText)-hashSz:]
-	if x.seqNum == 0 {
-		plainText = plainText[x.cipherSuite.Info().IVSize:]
+	// With a bad padding 'toRemove' is 1 and the MAC is checked anyway
+	toRemove, paddingGood := extractPadding(clearText)
+	n := len(clearText) - toRemove - info.HashSize
+	n = subtle.ConstantTimeSelect(int(uint(n)>>(bits.UintSize-1)), 0, n)
+	plainText := clearText[:n]
+	givenMAC := clearText[n : n+info.HashSize]
+	computedMAC, err := x.Macintosh(tct.Header, plainText)
+	if err != nil {
+		return nil, ErrBadRecordMAC
 	}
 
-	computedMAC, err := x.Macintosh(plainText)
-	if err != nil {
-		return nil, fmt.Errorf("MAC calculation(%v): %v", myself, err)
+	// Hash what the padding took so the work done does not depend on it
+	if extra := clearText[n+info.HashSize:]; len(extra) > 0 {
+		x.cipherSuite.HashMe(extra)
 	}
 
-	if !hmac.Equal(givenMAC, computedMAC) {
-		return nil, fmt.Errorf("MAC mismatch(%v)", myself)
+	macGood := subtle.ConstantTimeCompare(givenMAC, computedMAC)
+	if macGood&int(paddingGood&1) != 1 {
+		return nil, ErrBadRecordMAC
 	}
 
 	tpt.Fragment = plainText
 	tpt.Header = &TLSHeader{
 		ContentType: tct.Header.ContentType,
-		Version:     TLS_VERSION1_2,
+		Version:     x.version,
 		Len:         len(plainText),
 	}
 
 	return &tpt, nil
 }
+
+//	uint8 padding[GenericBlockCipher.padding_length];
+//	uint8 padding_length;
+//
+// Returns how many bytes to remove and 0xFF if all padding bytes are right
+// (0x00 otherwise). Runs in constant time: the last 256 bytes are always
+// looked at, no matter the padding length
+func extractPadding(payload []byte) (int, byte) {
+
+	if len(payload) < 1 {
+		return 0, 0
+	}
+
+	paddingLen := payload[len(payload)-1]
+	t := uint(len(payload)-1) - uint(paddingLen)
+	good := byte(int32(^t) >> 31)
+	toCheck := min(256, len(payload))
+	for i := 0; i < toCheck; i++ {
+		t := uint(paddingLen) - uint(i)
+		mask := byte(int32(^t) >> 31)
+		b := payload[len(payload)-1-i]
+		good &^= mask&paddingLen ^ mask&b
+	}
+
+	// All bits set (0xFF) or none
+	good &= good << 4
+	good &= good << 2
+	good &= good << 1
+	good = uint8(int8(good) >> 7)
+	paddingLen &= good
+	return int(paddingLen) + 1, good
+}
+
+func lastBlock(buff []byte, blockSize int) []byte {
+
+	if len(buff) < blockSize {
+		return nil
+	}
+
+	block := make([]byte, blockSize)
+	copy(block, buff[len(buff)-blockSize:])
+	return block
+}
@@ -0,0 +1,32 @@
+package tlssl
+
+import (
+	"crypto"
+	"crypto/x509"
+	"io"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Client role settings. Suites and groups are offered in the given order,
+// zero versions mean TLS 1.2 only
+type ClientConfig struct {
+	Lg                 *logrus.Logger
+	ServerName         string              // SNI and the name the server certificate must match
+	RootCAs            *x509.CertPool      // nil uses the system roots
+	InsecureSkipVerify bool                // Any server chain is accepted. Tests only
+	CipherSuites       []uint16            // Unsupported ones are skipped
+	Groups             []uint16            // ECDHE and DHE groups
+	ALPN               []string            // Protocols offered, most preferred first
+	MinVersion         uint16              // TLS 1.0/1.1 only if set here
+	MaxVersion         uint16              // Sent as ClientHello.client_version
+	Certificates       []*x509.Certificate // Sent when the server asks, leaf first
+	PrivateKey         crypto.PrivateKey   // Leaf's key, a crypto.Signer (RSA or ECDSA)
+	PSKIdentity        []byte              // PSK suites are only offered with both
+	PSK                []byte
+	KeyLog             io.Writer        // NSS key log, nil disables
+	HandshakeTimeout   time.Duration    // Dial and handshake. Zero waits forever
+	Rand               io.Reader        // crypto/rand if nil
+	Time               func() time.Time // Server chain checks. time.Now if nil
+}
@@ -1,6 +1,10 @@
 package tlssl
 
 import (
+	"crypto/rand"
+	"crypto/x509"
+	"io"
+	"time"
 	ex "tlesio/tlssl/extensions"
 	mx "tlesio/tlssl/modulos"
 
@@ -8,8 +12,36 @@ import (
 )
 
 type TLSContext struct {
-	Lg            *logrus.Logger
-	Modz          *mx.ModuloZ
-	Exts          *ex.Extensions
-	OptClientAuth bool // Enable Client Authentication
+	Lg                    *logrus.Logger
+	Modz                  *mx.ModuloZ
+	Exts                  *ex.Extensions
+	OptClientAuth         bool                // Request a client certificate
+	OptClientAuthRequired bool                // No certificate, no handshake
+	ClientCAs             []*x509.Certificate // Client chains verified against these, if any
+	OptLegacy             bool                // Enable TLS 1.0/1.1 (MD5/SHA1 PRF, chained CBC IVs)
+	PSK                   PSKStore            // nil disables PSK suites
+	KeyLog                io.Writer           // NSS key log (SSLKEYLOGFILE format), nil disables
+	Tracer                Tracer              // Handshake events, nil disables
+	Rand                  io.Reader           // Randoms, keys, IVs. crypto/rand if nil
+	Time                  func() time.Time    // Certificate checks, traces. time.Now if nil
+}
+
+// Randomness source for everything the handshake and the record layer
+// generate. Only set for reproducible (test) handshakes
+func (x *TLSContext) Random() io.Reader {
+
+	if x == nil || x.Rand == nil {
+		return rand.Reader
+	}
+
+	return x.Rand
+}
+
+func (x *TLSContext) Now() time.Time {
+
+	if x == nil || x.Time == nil {
+		return time.Now()
+	}
+
+	return x.Time()
 }
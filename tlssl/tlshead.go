@@ -2,6 +2,7 @@ package tlssl
 
 import (
 	"fmt"
+	"io"
 )
 
 // -------------------------------------------
@@ -58,6 +59,9 @@ const (
 	TLS_VERSION1_0     = 0x0301
 	TLS_VERSION1_1     = 0x0302
 	TLS_VERSION1_2     = 0x0303
+
+	// Largest TLSCiphertext fragment (RFC 5246 6.2.3)
+	TLS_MAX_RECORD_LEN = 1<<14 + 2048
 )
 
 const (
@@ -77,6 +81,7 @@ const (
 	HandshakeTypeCertificateVerify  HandshakeTypeType = 0x0F
 	HandshakeTypeClientKeyExchange  HandshakeTypeType = 0x10
 	HandshakeTypeFinished           HandshakeTypeType = 0x14
+	HandshakeTypeCertificateStatus  HandshakeTypeType = 0x16
 )
 
 type TLSHeader struct {
@@ -156,11 +161,12 @@ func TLSHeadHandShakePacket(hs *TLSHeaderHandshake) []byte {
 	return newBuffer
 }
 
-func TLSHeadsHandShakePacket(ht HandshakeTypeType, buffLen int) []byte {
+func TLSHeadsHandShakePacket(ht HandshakeTypeType, buffLen int,
+	version uint16) []byte {
 
 	newBuffer := TLSHeadPacket(&TLSHeader{
 		ContentType: ContentTypeHandshake,
-		Version:     TLS_VERSION1_2,
+		Version:     version,
 		Len:         buffLen + TLS_HANDSHAKE_SIZE})
 
 	newBuffer = append(newBuffer, TLSHeadHandShakePacket(&TLSHeaderHandshake{
@@ -209,20 +215,21 @@ func TLSRecordsDecode(buff []byte) ([]*TLSRecord, error) {
 	// offset always points to the start of the next record
 	for offset < len(buff) {
 		record := TLSRecord{}
-		head := TLSHead(buff[offset : offset+TLS_HEADER_SIZE])
+		head := TLSHead(buff[offset:])
 		if head == nil {
 			return nil, fmt.Errorf("nil TLSHeader object")
 		}
 
 		record.Header = head
-		if head.Len > len(buff[offset:]) {
+		if head.Len > len(buff[offset+TLS_HEADER_SIZE:]) {
 			return nil, fmt.Errorf("invalid record len. Is this an attack?")
 		}
 
 		// TLSRecord.Msg is the whole message
 		record.Msg = buff[offset : offset+head.Len+TLS_HEADER_SIZE]
 		if head.ContentType == ContentTypeHandshake {
-			handshake := TLSHeadHandShake(buff[offset+TLS_HEADER_SIZE:])
+			// Handshake header must fit in this record
+			handshake := TLSHeadHandShake(record.Msg[TLS_HEADER_SIZE:])
 			if handshake == nil {
 				return nil, fmt.Errorf("nil TLSHeaderHandshake object")
 			}
@@ -237,10 +244,44 @@ func TLSRecordsDecode(buff []byte) ([]*TLSRecord, error) {
 	return records, nil
 }
 
+// One whole record. The header is read apart so the fragment length can
+// be checked before reading it
+func ReadRecord(r io.Reader) (*TLSHeader, []byte, error) {
+
+	head := make([]byte, TLS_HEADER_SIZE)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, nil, err
+	}
+
+	header := TLSHead(head)
+	if header == nil {
+		return nil, nil, NewAlertError(AlertDecodeError,
+			"invalid record header")
+	}
+
+	if header.Len <= 0 || header.Len > TLS_MAX_RECORD_LEN {
+		return nil, nil, NewAlertError(AlertRecordOverflow,
+			"record len %v", header.Len)
+	}
+
+	fragment := make([]byte, header.Len)
+	if _, err := io.ReadFull(r, fragment); err != nil {
+		return nil, nil, err
+	}
+
+	return header, fragment, nil
+}
+
+// TLS 1.0 and TLS 1.1 use the MD5/SHA1 PRF and are only negotiated when
+// legacy mode is enabled
+func IsLegacyVersion(v uint16) bool {
+	return v == TLS_VERSION1_0 || v == TLS_VERSION1_1
+}
+
 func (x *TLSHeader) String() string {
 
 	return fmt.Sprintf("ContentType: %v, Version: %v, Len: %d",
-		x.ContentType, version(x.Version), x.Len)
+		x.ContentType, VersionName(x.Version), x.Len)
 }
 
 func (x *TLSHeaderHandshake) String() string {
@@ -286,12 +327,14 @@ func (x HandshakeTypeType) String() string {
 		return "ClientKeyExchange"
 	case HandshakeTypeFinished:
 		return "Finished"
+	case HandshakeTypeCertificateStatus:
+		return "CertificateStatus"
 	}
 
 	return "Unknown"
 }
 
-func version(v uint16) string {
+func VersionName(v uint16) string {
 
 	switch v {
 	case TLS_VERSION1_0:
@@ -302,5 +345,5 @@ func version(v uint16) string {
 		return "TLS 1.2(0x0303)"
 	}
 
-	return "Unknown"
+	return fmt.Sprintf("Unknown(0x%04X)", v)
 }
@@ -0,0 +1,39 @@
+package tlssl
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Only the 'CLIENT_RANDOM' line of the NSS key log format (as read by
+// Wireshark), the master secret by client random. There are no TLS 1.3
+// secrets to log
+const (
+	_KEYLOG_CLIENT_RANDOM_      = "CLIENT_RANDOM"
+	_KEYLOG_CLIENT_RANDOM_SIZE_ = 32
+)
+
+// Every connection shares the same writer, lines must not interleave
+var keyLogMu sync.Mutex
+
+// Writes 'CLIENT_RANDOM <client_random> <master_secret>' (hex). Anything
+// holding this file can decrypt the logged connections, debugging only
+func KeyLog(w io.Writer, clientRandom, masterSecret []byte) error {
+
+	if w == nil {
+		return nil
+	}
+
+	if len(clientRandom) != _KEYLOG_CLIENT_RANDOM_SIZE_ ||
+		len(masterSecret) == 0 {
+		return fmt.Errorf("invalid key log entry")
+	}
+
+	line := fmt.Sprintf("%s %x %x\n", _KEYLOG_CLIENT_RANDOM_, clientRandom,
+		masterSecret)
+	keyLogMu.Lock()
+	defer keyLogMu.Unlock()
+	_, err := io.WriteString(w, line)
+	return err
+}
@@ -2,7 +2,10 @@ package tlssl
 
 import (
 	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
 	"fmt"
 	"hash"
 	"tlesio/tlssl/suite"
@@ -51,6 +54,20 @@ func NewKeymaker(hashingAlgorithm, blockLen int) (TheKeyMaker, error) {
 			return nil, fmt.Errorf("block len too short for SHA256")
 		}
 
+	case suite.SHA384:
+		km.hashAlgo = suite.SHA384
+		if blockLen < _SHA384_LEN_BYTES {
+			return nil, fmt.Errorf("block len too short for SHA384")
+		}
+
+	// TLS 1.0/1.1 only. Finished verify data is 12 bytes long so there is
+	// no minimum block len here
+	case suite.MD5SHA1:
+		km.hashAlgo = suite.MD5SHA1
+		if blockLen <= 0 {
+			return nil, fmt.Errorf("invalid block len for MD5SHA1")
+		}
+
 	default:
 		return nil, fmt.Errorf("unsupported hash algorithm (maybe in TLS 1.4)")
 	}
@@ -79,11 +96,34 @@ func (x *xKeyMake) pHash(secret, seed []byte) []byte {
 	switch x.hashAlgo {
 	case suite.SHA256:
 		return x.shamir(secret, seed, sha256.New)
+
+	case suite.SHA384:
+		return x.shamir(secret, seed, sha512.New384)
+
+	case suite.MD5SHA1:
+		return x.legacy(secret, seed)
 	}
 
 	return nil
 }
 
+// TLS 1.0/1.1 (RFC 2246 5):
+// S1 and S2 are the two halves of the secret, sharing a byte when the
+// secret len is odd
+// PRF(secret, label, seed) = P_MD5(S1, label + seed) XOR
+// P_SHA-1(S2, label + seed)
+func (x *xKeyMake) legacy(secret, seed []byte) []byte {
+
+	half := (len(secret) + 1) / 2
+	pMD5 := x.shamir(secret[:half], seed, md5.New)
+	pSHA1 := x.shamir(secret[len(secret)-half:], seed, sha1.New)
+	for i := range pMD5 {
+		pMD5[i] ^= pSHA1[i]
+	}
+
+	return pMD5
+}
+
 func (x *xKeyMake) shamir(secret, seed []byte, fn func() hash.Hash) []byte {
 
 	var blockKey []byte
@@ -0,0 +1,97 @@
+package tlssl
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// RFC 4279 5.3. Identities and keys up to 2^16-1 bytes
+const _PSK_MAX_LEN_ = 0xFFFF
+
+// Pre-shared keys lookup. 'Hint' is the psk_identity_hint sent in the
+// ServerKeyExchange (nil if none)
+type PSKStore interface {
+	Hint() []byte
+	Get(identity []byte) []byte
+}
+
+type xPSKStore struct {
+	hint []byte
+	keys map[string][]byte
+}
+
+// In-memory store. Keys are indexed by identity
+func NewPSKStore(hint []byte, keys map[string][]byte) (PSKStore, error) {
+
+	var newX xPSKStore
+
+	if len(hint) > _PSK_MAX_LEN_ {
+		return nil, fmt.Errorf("PSK identity hint too long")
+	}
+
+	newX.hint = hint
+	newX.keys = make(map[string][]byte)
+	for identity, key := range keys {
+		if len(identity) == 0 || len(identity) > _PSK_MAX_LEN_ {
+			return nil, fmt.Errorf("invalid PSK identity(%v)", identity)
+		}
+
+		if len(key) == 0 || len(key) > _PSK_MAX_LEN_ {
+			return nil, fmt.Errorf("invalid PSK key(%v)", identity)
+		}
+
+		newX.keys[identity] = key
+	}
+
+	return &newX, nil
+}
+
+// One 'identity:hexkey' per line. Empty lines and lines starting
+// with '#' are skipped
+func NewPSKStoreFile(path string, hint []byte) (PSKStore, error) {
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer fd.Close()
+	keys := make(map[string][]byte)
+	scanner := bufio.NewScanner(fd)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		idx := strings.LastIndex(line, ":")
+		if idx <= 0 {
+			return nil, fmt.Errorf("%v:%v: expected 'identity:hexkey'",
+				path, lineNo)
+		}
+
+		key, err := hex.DecodeString(line[idx+1:])
+		if err != nil {
+			return nil, fmt.Errorf("%v:%v: %v", path, lineNo, err)
+		}
+
+		keys[line[:idx]] = key
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return NewPSKStore(hint, keys)
+}
+
+func (x *xPSKStore) Hint() []byte {
+	return x.hint
+}
+
+func (x *xPSKStore) Get(identity []byte) []byte {
+	return x.keys[string(identity)]
+}
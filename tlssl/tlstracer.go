@@ -0,0 +1,126 @@
+package tlssl
+
+import (
+	"crypto/x509"
+	"time"
+)
+
+type TraceKind uint8
+
+const (
+	TraceClientHello TraceKind = iota + 1
+	TraceSuiteSelected
+	TraceCertSelected
+	TraceKeysDerived
+	TraceRecordSent
+	TraceRecordReceived
+	TraceAlert
+	TraceHandshakeDone
+)
+
+// What happened on a connection. Only the fields of the event's kind are
+// set. Never carries key material
+type TraceEvent struct {
+	ConnID  uint64
+	Kind    TraceKind
+	Time    time.Time
+	Hello   *TraceHello          // ClientHello
+	Version uint16               // SuiteSelected, KeysDerived, HandshakeDone
+	Suite   uint16               // SuiteSelected, KeysDerived, HandshakeDone
+	Cert    *x509.Certificate    // CertSelected
+	Record  *TLSHeader           // RecordSent, RecordReceived
+	Alert   AlertDescriptionType // Alert
+	Sent    bool                 // Alert. false if it came from the peer
+	Err     error                // HandshakeDone. nil on success
+}
+
+// ClientHello as the client sent it, registered extensions or not
+type TraceHello struct {
+	Version      uint16
+	CipherSuites []uint16
+	Extensions   []uint16 // Wire order, GREASE and unknown ones included
+	SNI          string   // First host name, if any
+	JA3          string
+	JA3Hash      string
+	JA4          string
+}
+
+// Called from the connection's goroutine, implementations shared between
+// connections must be safe for concurrent use
+type Tracer interface {
+	Trace(*TraceEvent)
+}
+
+func (x *TLSContext) Trace(connID uint64, ev *TraceEvent) {
+
+	if x == nil || x.Tracer == nil || ev == nil {
+		return
+	}
+
+	if ev.Time.IsZero() {
+		ev.Time = x.Now()
+	}
+
+	TraceTo(x.Tracer, connID, ev)
+}
+
+func TraceTo(tracer Tracer, connID uint64, ev *TraceEvent) {
+
+	if tracer == nil || ev == nil {
+		return
+	}
+
+	ev.ConnID = connID
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	tracer.Trace(ev)
+}
+
+// One event per record in 'buff' (header only)
+func TraceRecords(tracer Tracer, connID uint64, kind TraceKind,
+	buff []byte) {
+
+	if tracer == nil {
+		return
+	}
+
+	for len(buff) >= TLS_HEADER_SIZE {
+		header := TLSHead(buff[:TLS_HEADER_SIZE])
+		if header == nil {
+			return
+		}
+
+		TraceTo(tracer, connID, &TraceEvent{Kind: kind, Record: header})
+		if header.Len > len(buff[TLS_HEADER_SIZE:]) {
+			return
+		}
+
+		buff = buff[TLS_HEADER_SIZE+header.Len:]
+	}
+}
+
+func (x TraceKind) String() string {
+
+	switch x {
+	case TraceClientHello:
+		return "client_hello"
+	case TraceSuiteSelected:
+		return "suite_selected"
+	case TraceCertSelected:
+		return "cert_selected"
+	case TraceKeysDerived:
+		return "keys_derived"
+	case TraceRecordSent:
+		return "record_sent"
+	case TraceRecordReceived:
+		return "record_received"
+	case TraceAlert:
+		return "alert"
+	case TraceHandshakeDone:
+		return "handshake_done"
+	}
+
+	return "unknown"
+}